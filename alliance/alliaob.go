@@ -44,8 +44,8 @@ func NewObserver(allia *sdk.MultiChainSdk, voting chan *btc.BtcProof, txchan cha
 func (ob *Observer) Listen() {
 	log.Info("starting observing")
 	top := ob.db.GetHeight()
-	if top < alliaCheckPoints[ob.netType].Height {
-		top = alliaCheckPoints[ob.netType].Height
+	if cp, ok := alliaCheckPoints[ob.netType]; ok && top < cp.Height {
+		top = cp.Height
 	}
 	log.Infof("[AllianceObserver] get start height %d from checkpoint or db, check once %d seconds", top, ob.loopWaitTime)
 	tick := time.NewTicker(time.Second * time.Duration(ob.loopWaitTime))
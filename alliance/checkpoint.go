@@ -1,7 +1,13 @@
 package alliance
 
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
 type Checkpoint struct {
-	Height uint32
+	Height uint32 `json:"height"`
 }
 
 var alliaCheckPoints map[string]*Checkpoint
@@ -16,3 +22,25 @@ func init() {
 		Height: 1,
 	}
 }
+
+// LoadCheckpoints reads checkpoints from a JSON file mapping alliance network names
+// to checkpoints, e.g. {"testnet": {"height": 100}}. They replace the built in
+// checkpoint of the same network.
+func LoadCheckpoints(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read alliance checkpoint file %s: %v", file, err)
+	}
+	cps := make(map[string]*Checkpoint)
+	err = json.Unmarshal(data, &cps)
+	if err != nil {
+		return fmt.Errorf("failed to parse alliance checkpoint file %s: %v", file, err)
+	}
+	for net, cp := range cps {
+		if cp == nil {
+			return fmt.Errorf("empty alliance checkpoint for %s", net)
+		}
+		alliaCheckPoints[net] = cp
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package alliance
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLoadCheckpoints(t *testing.T) {
+	err := ioutil.WriteFile("./allia_checkpoints.json", []byte(`{"testnet": {"height": 100}, "mainnet": {"height": 5}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("./allia_checkpoints.json")
+
+	err = LoadCheckpoints("./allia_checkpoints.json")
+	if err != nil {
+		t.Fatalf("Failed to load checkpoints: %v", err)
+	}
+	if alliaCheckPoints["testnet"].Height != 100 || alliaCheckPoints["mainnet"].Height != 5 {
+		t.Fatal("Wrong checkpoints loaded")
+	}
+	if alliaCheckPoints["regtest"].Height != 1 {
+		t.Fatal("Built in checkpoint was overwritten")
+	}
+	if err = LoadCheckpoints("./not_exist.json"); err == nil {
+		t.Fatal("Loaded a file that doesn't exist")
+	}
+}
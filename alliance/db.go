@@ -7,7 +7,10 @@ import (
 	"github.com/boltdb/bolt"
 	"github.com/ontio/multi-chain/common"
 	"github.com/ontio/multi-chain/native/service/cross_chain_manager/btc"
+	"github.com/ontio/spvclient/backup"
 	"github.com/ontio/spvclient/log"
+	"github.com/ontio/spvclient/migration"
+	"io"
 	"path"
 	"strings"
 	"sync"
@@ -20,6 +23,18 @@ var (
 	KEYHeight  = []byte("last")
 )
 
+// waitingMigrations upgrade waiting dbs written by older builds. Values in BKTWaiting
+// are btc.BtcProof serializations, a change to that format needs a migration here.
+var waitingMigrations = []migration.Migration{
+	{
+		Version:     1,
+		Description: "record the schema version",
+		Apply: func(btx *bolt.Tx) error {
+			return nil
+		},
+	},
+}
+
 type WaitingDB struct {
 	lock     *sync.RWMutex
 	db       *bolt.DB
@@ -27,10 +42,15 @@ type WaitingDB struct {
 	maxReadSize int64
 }
 
-func NewWaitingDB(filePath string, maxReadSize int64) (*WaitingDB, error) {
+func waitingDBFile(filePath string) string {
 	if !strings.Contains(filePath, ".bin") {
 		filePath = path.Join(filePath, "waiting.bin")
 	}
+	return filePath
+}
+
+func NewWaitingDB(filePath string, maxReadSize int64) (*WaitingDB, error) {
+	filePath = waitingDBFile(filePath)
 	w := new(WaitingDB)
 	db, err := bolt.Open(filePath, 0644, &bolt.Options{InitialMmapSize: 500000})
 	if err != nil {
@@ -42,7 +62,12 @@ func NewWaitingDB(filePath string, maxReadSize int64) (*WaitingDB, error) {
 	w.maxReadSize = maxReadSize
 
 	if err = db.Update(func(btx *bolt.Tx) error {
-		_, err := btx.CreateBucketIfNotExists(BKTWaiting)
+		err := migration.Upgrade(btx, "waiting db", waitingMigrations)
+		if err != nil {
+			return err
+		}
+
+		_, err = btx.CreateBucketIfNotExists(BKTWaiting)
 		if err != nil {
 			return err
 		}
@@ -59,6 +84,7 @@ func NewWaitingDB(filePath string, maxReadSize int64) (*WaitingDB, error) {
 
 		return nil
 	}); err != nil {
+		db.Close()
 		return nil, err
 	}
 
@@ -194,6 +220,38 @@ func (w *WaitingDB) GetUnderHeightAndDelete(height uint32) ([]*btc.BtcProof, [][
 	return arr, keys, nil
 }
 
+// GetAboveHeight returns the txids and heights of the waiting proofs above height
+// without deleting them.
+func (w *WaitingDB) GetAboveHeight(height uint32) ([][]byte, []uint32, error) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	keys := make([][]byte, 0)
+	heights := make([]uint32, 0)
+	err := w.db.View(func(tx *bolt.Tx) error {
+		bw := tx.Bucket(BKTWaiting)
+		return bw.ForEach(func(k, v []byte) error {
+			p := &btc.BtcProof{}
+			err := p.Deserialization(common.NewZeroCopySource(v))
+			if err != nil {
+				return err
+			}
+			if p.Height > height {
+				key := make([]byte, len(k))
+				copy(key, k)
+				keys = append(keys, key)
+				heights = append(heights, p.Height)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return keys, heights, nil
+}
+
 func (w *WaitingDB) MarkVotedTx(txid []byte) error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
@@ -265,6 +323,47 @@ func (w *WaitingDB) Close() {
 	w.lock.Unlock()
 }
 
+// Backup writes a consistent snapshot of the db to w. Writes go on while it runs.
+func (w *WaitingDB) Backup(wr io.Writer) (int64, error) {
+	return backup.Snapshot(w.db, wr)
+}
+
+// RestoreWaitingDB replaces the waiting db at filePath with a snapshot taken by Backup.
+// Every waiting proof in the snapshot has to decode first. The waiting db must not be open.
+func RestoreWaitingDB(snapshot, filePath string) error {
+	return backup.Restore(snapshot, waitingDBFile(filePath), func(file string) error {
+		// NewWaitingDB would happily add the buckets to any bolt db
+		db, err := bolt.Open(file, 0644, &bolt.Options{ReadOnly: true})
+		if err != nil {
+			return err
+		}
+		err = db.View(func(btx *bolt.Tx) error {
+			if btx.Bucket(BKTWaiting) == nil {
+				return errors.New("snapshot is not a waiting db")
+			}
+			return nil
+		})
+		db.Close()
+		if err != nil {
+			return err
+		}
+		w, err := NewWaitingDB(file, 0)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		return w.db.View(func(btx *bolt.Tx) error {
+			return btx.Bucket(BKTWaiting).ForEach(func(k, v []byte) error {
+				p := &btc.BtcProof{}
+				if err := p.Deserialization(common.NewZeroCopySource(v)); err != nil {
+					return fmt.Errorf("failed to decode waiting tx %x: %v", k, err)
+				}
+				return nil
+			})
+		})
+	})
+}
+
 type OverSizeErr struct {
 	Err error
 }
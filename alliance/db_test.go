@@ -2,9 +2,13 @@ package alliance
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"github.com/boltdb/bolt"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/ontio/multi-chain/native/service/cross_chain_manager/btc"
+	"github.com/ontio/spvclient/migration"
+	"io/ioutil"
 	"os"
 	"testing"
 )
@@ -41,6 +45,32 @@ func TestNewWaitingDB(t *testing.T) {
 	}
 }
 
+func TestNewWaitingDB_SchemaVersion(t *testing.T) {
+	db, err := NewWaitingDB("", 100)
+	if err != nil {
+		t.Fatalf("Failed to new a db: %v", err)
+	}
+	defer os.RemoveAll("./waiting.bin")
+	err = db.db.Update(func(btx *bolt.Tx) error {
+		if v := migration.GetVersion(btx); v != migration.Latest(waitingMigrations) {
+			t.Errorf("Expected the latest schema version, got %d", v)
+		}
+		// Pretend a newer build wrote the db
+		v := make([]byte, 4)
+		binary.BigEndian.PutUint32(v, migration.Latest(waitingMigrations)+1)
+		return btx.Bucket(migration.BKTMeta).Put(migration.KEYVersion, v)
+	})
+	if err != nil {
+		t.Fatalf("Failed to set the version: %v", err)
+	}
+	db.Close()
+
+	_, err = NewWaitingDB("", 100)
+	if err == nil {
+		t.Fatal("Opened a db from a newer version")
+	}
+}
+
 func TestWaitingDB_Put(t *testing.T) {
 	db, err := NewWaitingDB("", 100)
 	if err != nil {
@@ -118,3 +148,100 @@ func TestWaitingDB_MarkVotedTx(t *testing.T) {
 		t.Fatal("not marked!")
 	}
 }
+
+func TestWaitingDB_GetAboveHeight(t *testing.T) {
+	db, err := NewWaitingDB("", 100)
+	if err != nil {
+		t.Fatalf("Failed to new a db: %v", err)
+	}
+	defer os.RemoveAll("./waiting.bin")
+
+	mtx := wire.NewMsgTx(wire.TxVersion)
+	err = mtx.BtcDecode(bytes.NewBuffer(Bp1.Tx), wire.ProtocolVersion, wire.LatestEncoding)
+	if err != nil {
+		t.Fatalf("Failed to decode tx: %v", err)
+	}
+
+	txid := mtx.TxHash()
+	err = db.Put(txid[:], Bp1)
+	if err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	keys, heights, err := db.GetAboveHeight(Height - 1)
+	if err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	if len(keys) != 1 || !bytes.Equal(keys[0], txid[:]) || heights[0] != Height {
+		t.Fatal("Wrong result above height")
+	}
+	keys, _, err = db.GetAboveHeight(Height)
+	if err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("Wrong length: %d", len(keys))
+	}
+	if !db.CheckIfWaiting(txid[:]) {
+		t.Fatal("GetAboveHeight deleted the proof")
+	}
+}
+
+func TestWaitingDB_BackupRestore(t *testing.T) {
+	db, err := NewWaitingDB("", 100)
+	if err != nil {
+		t.Fatalf("Failed to new a db: %v", err)
+	}
+	defer os.RemoveAll("./waiting.bin")
+	defer db.Close()
+	if err = db.Put([]byte("123"), Bp1); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	f, err := os.Create("snapshot.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("snapshot.bin")
+	_, err = db.Backup(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Failed to back up: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = RestoreWaitingDB("snapshot.bin", dir); err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+	restored, err := NewWaitingDB(dir, 100)
+	if err != nil {
+		t.Fatalf("Failed to open restored db: %v", err)
+	}
+	if !restored.CheckIfWaiting([]byte("123")) {
+		t.Fatal("Waiting proof is missing from the restored db")
+	}
+	restored.Close()
+
+	// A proof which doesn't decode makes the snapshot invalid
+	err = db.db.Update(func(btx *bolt.Tx) error {
+		return btx.Bucket(BKTWaiting).Put([]byte("456"), []byte{1})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err = os.Create("snapshot.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Backup(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Failed to back up: %v", err)
+	}
+	if err = RestoreWaitingDB("snapshot.bin", dir); err == nil {
+		t.Fatal("Restored a snapshot with a broken proof")
+	}
+}
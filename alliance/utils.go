@@ -1,13 +1,16 @@
 package alliance
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 	sdk "github.com/ontio/multi-chain-go-sdk"
 	"github.com/ontio/multi-chain/common"
 	"github.com/ontio/multi-chain/common/password"
 	"github.com/ontio/multi-chain/native/service/cross_chain_manager/btc"
+	"github.com/ontio/spvclient"
 	"time"
 )
 
@@ -69,6 +72,26 @@ func GetAccountByPassword(sdk *sdk.MultiChainSdk, path, pwd string) (*sdk.Accoun
 	return user, nil
 }
 
+// NewBtcProof builds the proof of transaction txid in the block at height from what peers
+// send, rather than taking the one submitted to the alliance chain.
+func NewBtcProof(wallet *spvclient.SPVWallet, txid chainhash.Hash, height uint32, blocksToWait uint64) (*btc.BtcProof, error) {
+	tx, proof, err := wallet.FetchMerkleProof(txid, height)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = tx.BtcEncode(&buf, wire.ProtocolVersion, wire.LatestEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode transaction: %v", err)
+	}
+	return &btc.BtcProof{
+		Tx:           buf.Bytes(),
+		Proof:        proof,
+		Height:       height,
+		BlocksToWait: blocksToWait,
+	}, nil
+}
+
 type LessConfirmationError struct {
 	Err error
 }
@@ -8,14 +8,14 @@ import (
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
-	wire_bch "github.com/gcash/bchd/wire"
-	"github.com/gcash/bchutil/merkleblock"
 	sdk "github.com/ontio/multi-chain-go-sdk"
 	"github.com/ontio/multi-chain-go-sdk/client"
 	"github.com/ontio/multi-chain/native/service/cross_chain_manager/btc"
 	"github.com/ontio/spvclient"
+	"github.com/ontio/spvclient/chain"
 	"github.com/ontio/spvclient/config"
 	"github.com/ontio/spvclient/log"
+	"sync"
 	"time"
 )
 
@@ -28,6 +28,19 @@ type Voter struct {
 	WaitingDB     *WaitingDB
 	blksToWait    uint64
 	quit          chan struct{}
+	// Fetch the proof of every transaction from peers too and check it shows the
+	// transaction in the same block as the submitted one
+	CrossCheck bool
+	// Proofs being fetched from peers for the cross check, by txid
+	fetchLock sync.Mutex
+	fetches   map[chainhash.Hash]*proofFetch
+}
+
+// proofFetch is a proof fetched from peers in the background
+type proofFetch struct {
+	done  bool
+	proof *btc.BtcProof
+	err   error
 }
 
 func NewVoter(allia *sdk.MultiChainSdk, voting chan *btc.BtcProof, wallet *spvclient.SPVWallet, redeem []byte,
@@ -41,6 +54,7 @@ func NewVoter(allia *sdk.MultiChainSdk, voting chan *btc.BtcProof, wallet *spvcl
 		WaitingDB:     wdb,
 		blksToWait:    blksToWait,
 		quit:          make(chan struct{}),
+		fetches:       make(map[chainhash.Hash]*proofFetch),
 	}, nil
 }
 
@@ -111,9 +125,21 @@ func (v *Voter) Vote() {
 func (v *Voter) WaitingRetry() {
 	log.Infof("[Voter] start retrying")
 
+	// only the latest height matters here so old events can be dropped
+	sub := v.wallet.Blockchain.Subscribe(100, chain.DropOldest)
+	defer sub.Unsubscribe()
 	for {
 		select {
-		case newh := <-v.wallet.Blockchain.HeaderUpdate:
+		case e, ok := <-sub.C:
+			if !ok {
+				log.Info("header subscription closed, stopping retrying")
+				return
+			}
+			tip, ok := e.(chain.NewTipEvent)
+			if !ok {
+				continue
+			}
+			newh := tip.Height
 			log.Debugf("retry loop once")
 			arr, keys, err := v.WaitingDB.GetUnderHeightAndDelete(newh - uint32(v.blksToWait) + 1)
 			if err != nil {
@@ -158,27 +184,25 @@ func (v *Voter) verify(item *btc.BtcProof) (*wire.MsgTx, error) {
 		}
 	}
 
-	mb := wire_bch.MsgMerkleBlock{}
-	err = mb.BchDecode(bytes.NewReader(item.Proof), wire_bch.ProtocolVersion, wire_bch.LatestEncoding)
+	res, err := v.wallet.Blockchain.VerifyTxInclusion(mtx, item.Proof, item.Height)
 	if err != nil {
-		return mtx, fmt.Errorf("verify, failed to decode proof: %v", err)
+		return mtx, fmt.Errorf("verify, %v", err)
 	}
-	mBlock := merkleblock.NewMerkleBlockFromMsg(mb)
-	merkleRootCalc := mBlock.ExtractMatches()
-	if merkleRootCalc == nil || mBlock.BadTree() || len(mBlock.GetMatches()) == 0 {
-		return mtx, fmt.Errorf("verify, bad merkle tree")
+	if !res.MainChain {
+		return mtx, fmt.Errorf("verify, block %s at height %d is not on the best chain", res.BlockHash.String(),
+			item.Height)
 	}
 
-	isExist := false
-	for _, hash := range mBlock.GetMatches() {
-		if bytes.Equal(hash[:], txid[:]) {
-			isExist = true
-			break
+	if v.CrossCheck {
+		err = v.crossCheck(txid, item, res)
+		if lerr, ok := err.(LessConfirmationError); ok {
+			return mtx, LessConfirmationError{
+				Err: fmt.Errorf("verify, cross check failed, retrying later: %v", lerr.Err),
+			}
+		} else if err != nil {
+			return mtx, fmt.Errorf("verify, cross check failed: %v", err)
 		}
 	}
-	if !isExist {
-		return mtx, fmt.Errorf("verify, transaction %s not found in proof", txid.String())
-	}
 
 	err = v.checkTxOuts(mtx)
 	if err != nil {
@@ -190,16 +214,75 @@ func (v *Voter) verify(item *btc.BtcProof) (*wire.MsgTx, error) {
 		return mtx, fmt.Errorf("verify, fariled to resolve parameter: %v", err)
 	}
 
-	sh, err := v.wallet.Blockchain.GetHeaderByHeight(item.Height)
+	return mtx, nil
+}
+
+// crossCheck checks a proof of txid we didn't take from the submitter shows txid in the
+// block the submitted proof does. That is the one our filter matched, or else one fetched
+// from peers. Not having it yet, say while it's fetched, without peers or while the chain
+// moves, is a LessConfirmationError so the proof is checked again later, only peers
+// proving another block fail it for good.
+func (v *Voter) crossCheck(txid chainhash.Hash, item *btc.BtcProof, submitted *chain.InclusionResult) error {
+	var tx *wire.MsgTx
+	var proof []byte
+	if m, ok := v.wallet.GetMatchedTx(txid); ok && m.Height == item.Height {
+		tx, proof = m.Tx, m.Proof
+	} else {
+		own, err := v.fetchedProof(txid, item)
+		if err != nil {
+			return err
+		}
+		tx = wire.NewMsgTx(wire.TxVersion)
+		err = tx.BtcDecode(bytes.NewBuffer(own.Tx), wire.ProtocolVersion, wire.LatestEncoding)
+		if err != nil {
+			return LessConfirmationError{Err: fmt.Errorf("failed to decode transaction from peers: %v", err)}
+		}
+		proof = own.Proof
+	}
+	res, err := v.wallet.Blockchain.VerifyTxInclusion(tx, proof, item.Height)
 	if err != nil {
-		return mtx, fmt.Errorf("verify, failed to get header from spv client: %v", err)
+		return LessConfirmationError{Err: fmt.Errorf("proof from peers: %v", err)}
+	}
+	if res.BlockHash != submitted.BlockHash {
+		return fmt.Errorf("peers prove %s in block %s, not in block %s", txid.String(), res.BlockHash.String(),
+			submitted.BlockHash.String())
 	}
-	if !bytes.Equal(merkleRootCalc[:], sh.Header.MerkleRoot[:]) {
-		return mtx, fmt.Errorf("verify, merkle root not equal, merkle root should be %s not %s, block hash in proof is %s",
-			sh.Header.MerkleRoot.String(), merkleRootCalc.String(), mb.Header.BlockHash().String())
+	if !res.MainChain {
+		return LessConfirmationError{Err: fmt.Errorf("block %s left the best chain", res.BlockHash.String())}
 	}
+	return nil
+}
 
-	return mtx, nil
+// fetchedProof returns the proof of txid fetched from peers. Voting doesn't wait on peers,
+// the first call starts fetching it in the background and until it's in the proof is
+// checked again at the next block.
+func (v *Voter) fetchedProof(txid chainhash.Hash, item *btc.BtcProof) (*btc.BtcProof, error) {
+	v.fetchLock.Lock()
+	defer v.fetchLock.Unlock()
+	f, ok := v.fetches[txid]
+	if !ok {
+		f = &proofFetch{}
+		v.fetches[txid] = f
+		wallet := v.wallet
+		go func() {
+			proof, err := NewBtcProof(wallet, txid, item.Height, item.BlocksToWait)
+			v.fetchLock.Lock()
+			f.done, f.proof, f.err = true, proof, err
+			v.fetchLock.Unlock()
+		}()
+	}
+	if !f.done {
+		return nil, LessConfirmationError{Err: fmt.Errorf("fetching proof of %s from peers", txid.String())}
+	}
+	delete(v.fetches, txid)
+	if f.err != nil {
+		return nil, LessConfirmationError{Err: fmt.Errorf("failed to fetch proof from peers: %v", f.err)}
+	}
+	if f.proof.Height != item.Height {
+		return nil, LessConfirmationError{Err: fmt.Errorf("fetched proof of %s at height %d, not %d",
+			txid.String(), f.proof.Height, item.Height)}
+	}
+	return f.proof, nil
 }
 
 func (v *Voter) checkTxOuts(tx *wire.MsgTx) error {
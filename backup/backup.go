@@ -0,0 +1,101 @@
+// Package backup takes consistent snapshots of bolt dbs while they are in use and
+// swaps a validated snapshot back in place of a db.
+package backup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Trailers sent after a snapshot streamed over http, so the client can tell a
+// complete snapshot from one cut short
+const (
+	TrailerSize  = "X-Backup-Size"
+	TrailerError = "X-Backup-Error"
+)
+
+// Snapshot writes a copy of db as it is at the start of a read transaction to w.
+// Writers aren't blocked while it runs.
+func Snapshot(db *bolt.DB, w io.Writer) (int64, error) {
+	var n int64
+	err := db.View(func(btx *bolt.Tx) error {
+		var err error
+		n, err = btx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// WriteFile writes to a temporary file next to file and only renames it to file once
+// write succeeded, so a failed backup never leaves a partial file behind.
+func WriteFile(file string, write func(w io.Writer) error) error {
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Restore replaces the db at target with the snapshot. The snapshot is copied next to
+// target and validate is called on the copy first, it should open it the way the owner
+// of the db does so migrations run and a snapshot from a newer version is refused.
+// The db being replaced is kept at target.old. Its owner must not have it open.
+func Restore(snapshot, target string, validate func(file string) error) error {
+	src, err := os.Open(snapshot)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err = os.MkdirAll(path.Dir(target), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := target + ".restore"
+	err = WriteFile(tmp, func(w io.Writer) error {
+		_, err := io.Copy(w, src)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy snapshot: %v", err)
+	}
+	if err = validate(tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("invalid snapshot: %v", err)
+	}
+
+	if _, err = os.Stat(target); err == nil {
+		// bolt holds a lock on the file for as long as it's open. Any other error means
+		// the db is broken, which is a good reason to restore it.
+		db, err := bolt.Open(target, 0644, &bolt.Options{Timeout: time.Second})
+		if err == bolt.ErrTimeout {
+			os.Remove(tmp)
+			return fmt.Errorf("%s is in use, stop the spv client first", target)
+		}
+		if err == nil {
+			db.Close()
+		}
+		if err = os.Rename(target, target+".old"); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	return os.Rename(tmp, target)
+}
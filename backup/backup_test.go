@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "out.bin")
+
+	err = WriteFile(file, func(w io.Writer) error {
+		w.Write([]byte("partial"))
+		return errors.New("cut short")
+	})
+	if err == nil {
+		t.Fatal("Expected the write error")
+	}
+	if names, _ := ioutil.ReadDir(dir); len(names) != 0 {
+		t.Fatalf("Failed write left %d files behind", len(names))
+	}
+
+	err = WriteFile(file, func(w io.Writer) error {
+		_, err := w.Write([]byte("snapshot"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(file); string(b) != "snapshot" {
+		t.Errorf("Wrong content %q", b)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshot := path.Join(dir, "snapshot.bin")
+	target := path.Join(dir, "db.bin")
+	if err = ioutil.WriteFile(snapshot, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(target, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = Restore(snapshot, target, func(file string) error {
+		return errors.New("invalid")
+	})
+	if err == nil {
+		t.Fatal("Restored a snapshot which failed validation")
+	}
+	if b, _ := ioutil.ReadFile(target); string(b) != "old" {
+		t.Error("Target changed after a failed restore")
+	}
+	if _, err := os.Stat(target + ".restore"); !os.IsNotExist(err) {
+		t.Error("Refused snapshot was left behind")
+	}
+
+	var validated string
+	err = Restore(snapshot, target, func(file string) error {
+		b, err := ioutil.ReadFile(file)
+		validated = string(b)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validated != "new" {
+		t.Errorf("Validated %q instead of the snapshot", validated)
+	}
+	if b, _ := ioutil.ReadFile(target); string(b) != "new" {
+		t.Error("Target was not replaced")
+	}
+	if b, _ := ioutil.ReadFile(target + ".old"); string(b) != "old" {
+		t.Error("Replaced db was not kept")
+	}
+}
@@ -5,51 +5,127 @@ package chain
 
 import (
 	"errors"
+	"fmt"
 	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/ontio/spvclient/log"
+	"io"
 	"math/big"
+	"sort"
 	"sync"
 	"time"
 )
 
-// Blockchain settings.  These are kindof Bitcoin specific, but not contained in
-// chaincfg.Params so they'll go here.  If you're into the [ANN]altcoin scene,
-// you may want to paramaterize these constants.
+// Blockchain settings. Those which differ between bitcoin and altcoins are in
+// ConsensusRules.
 const (
-	targetTimespan      = time.Hour * 24 * 14
-	targetSpacing       = time.Minute * 10
-	epochLength         = int32(targetTimespan / targetSpacing) // 2016
-	maxDiffAdjust       = 4
-	minRetargetTimespan = int64(targetTimespan / maxDiffAdjust)
-	maxRetargetTimespan = int64(targetTimespan * maxDiffAdjust)
-	medianTimeBlocks    = 11
+	medianTimeBlocks = 11
+	// Headers can't be timestamped further than this in the future
+	maxTimeOffset = 2 * time.Hour
 )
 
-var OrphanHeaderError = errors.New("header does not extend any known headers")
+var (
+	OrphanHeaderError       = errors.New("header does not extend any known headers")
+	InvalidAncestorError    = errors.New("header descends from an invalid header")
+	NonContiguousBatchError = errors.New("headers in batch do not link together")
+)
+
+// RuleErrorCode identifies the consensus rule a header broke
+type RuleErrorCode int
+
+const (
+	ErrHeadersDontLink RuleErrorCode = iota
+	ErrUnexpectedDifficulty
+	ErrBadProofOfWork
+	ErrTimeTooOld
+	ErrTimeTooNew
+	ErrBadVersion
+	ErrCheckpointMismatch
+)
+
+// HeaderRuleError is returned when a header fails consensus validation
+type HeaderRuleError struct {
+	Code RuleErrorCode
+	Err  error
+}
+
+func (err HeaderRuleError) Error() string {
+	return err.Err.Error()
+}
+
+func ruleError(code RuleErrorCode, format string, args ...interface{}) HeaderRuleError {
+	return HeaderRuleError{
+		Code: code,
+		Err:  fmt.Errorf(format, args...),
+	}
+}
+
+// HeaderResult is the outcome of committing one header of a batch
+type HeaderResult struct {
+	Hash   chainhash.Hash
+	Height uint32
+	// The header extended the best chain when it was committed
+	NewTip bool
+	// The header was already in the database
+	Known bool
+	Err   error
+}
+
+// headerSource looks up parents while validating. During a batch commit the
+// parent may still be part of the batch rather than in the database.
+type headerSource interface {
+	GetPreviousHeader(header wire.BlockHeader) (StoredHeader, error)
+}
+
+// batchView overlays the headers accepted so far in a batch on top of the db.
+type batchView struct {
+	db      Headers
+	pending map[chainhash.Hash]StoredHeader
+}
+
+func (v *batchView) GetPreviousHeader(header wire.BlockHeader) (StoredHeader, error) {
+	if sh, ok := v.pending[header.PrevBlock]; ok {
+		return sh, nil
+	}
+	return v.db.GetPreviousHeader(header)
+}
 
 // Wrapper around Headers implementation that handles all blockchain operations
 type Blockchain struct {
-	lock         *sync.Mutex
-	params       *chaincfg.Params
-	db           Headers
-	HeaderUpdate chan uint32
-	IsOpen       bool
+	lock     *sync.Mutex
+	params   *chaincfg.Params
+	db       Headers
+	notifier *notifier
+	rules    ConsensusRules
+	// Every header must agree with these, sorted by height
+	checkpoints []Checkpoint
 }
 
-func NewBlockchain(filePath string, params *chaincfg.Params, isOpen bool) (*Blockchain, error) {
+func NewBlockchain(filePath string, params *chaincfg.Params) (*Blockchain, error) {
 	hdb, err := NewHeaderDB(filePath)
 	if err != nil {
 		return nil, err
 	}
+	b, err := NewBlockchainWithHeaders(hdb, params)
+	if err != nil {
+		hdb.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// NewBlockchainWithHeaders builds the chain on top of the given storage, an empty one is
+// initialized with the checkpoint. The Blockchain owns db and closes it on Close.
+func NewBlockchainWithHeaders(db Headers, params *chaincfg.Params) (*Blockchain, error) {
 	b := &Blockchain{
-		lock:         new(sync.Mutex),
-		params:       params,
-		db:           hdb,
-		HeaderUpdate: make(chan uint32, 100),
-		IsOpen:       isOpen,
+		lock:        new(sync.Mutex),
+		params:      params,
+		db:          db,
+		notifier:    newNotifier(),
+		rules:       RulesFor(params),
+		checkpoints: builtinCheckpoints(params),
 	}
 
 	h, err := b.db.Height()
@@ -93,9 +169,9 @@ func (b *Blockchain) CommitHeader(header wire.BlockHeader) (bool, *StoredHeader,
 			return false, nil, 0, OrphanHeaderError
 		}
 	}
-	valid := b.CheckHeader(header, parentHeader)
-	if !valid {
-		return false, nil, 0, nil
+	err = b.checkHeader(header, parentHeader, b.db)
+	if err != nil {
+		return false, nil, 0, err
 	}
 	// If this block is already the tip, return
 	headerHash := header.BlockHash()
@@ -123,71 +199,352 @@ func (b *Blockchain) CommitHeader(header wire.BlockHeader) (bool, *StoredHeader,
 
 	newHeight := parentHeader.Height + 1
 	// Put the header to the database
-	err = b.db.Put(StoredHeader{
+	sh := StoredHeader{
 		Header:    header,
 		Height:    newHeight,
 		totalWork: cumulativeWork,
-	}, newTip)
+	}
+	err = b.db.Put(sh, newTip)
 	if err != nil {
 		return newTip, commonAncestor, 0, err
 	}
 
-	if b.IsOpen && newTip {
-		b.HeaderUpdate <- newHeight
+	if newTip {
+		b.notifyNewTip(bestHeader, sh, commonAncestor)
 	}
 	return newTip, commonAncestor, newHeight, nil
 }
 
-func (b *Blockchain) CheckHeader(header wire.BlockHeader, prevHeader StoredHeader) bool {
+// Subscribe returns a subscription which receives a NewTipEvent every time the best
+// header changes and a ReorgEvent before it when the change is a reorg. Events are
+// buffered up to bufferSize and the policy decides what happens past that.
+func (b *Blockchain) Subscribe(bufferSize int, policy OverflowPolicy) *Subscription {
+	return b.notifier.subscribe(bufferSize, policy)
+}
+
+// notifyNewTip must be called with the new tip already in the db.
+func (b *Blockchain) notifyNewTip(oldTip, newTip StoredHeader, commonAncestor *StoredHeader) {
+	if commonAncestor != nil {
+		disconnected, err := b.headersDownTo(oldTip, commonAncestor.Height)
+		if err != nil {
+			log.Errorf("Failed to collect disconnected headers: %v", err)
+		}
+		connected, err := b.headersDownTo(newTip, commonAncestor.Height)
+		if err != nil {
+			log.Errorf("Failed to collect connected headers: %v", err)
+		}
+		for i, j := 0, len(connected)-1; i < j; i, j = i+1, j-1 {
+			connected[i], connected[j] = connected[j], connected[i]
+		}
+		b.notifier.send(ReorgEvent{
+			CommonAncestor: *commonAncestor,
+			Disconnected:   disconnected,
+			Connected:      connected,
+		})
+	}
+	b.notifier.send(NewTipEvent{
+		Height: newTip.Height,
+		Hash:   newTip.Header.BlockHash(),
+	})
+}
+
+// headersDownTo returns sh and its ancestors above the given height, starting from sh.
+func (b *Blockchain) headersDownTo(sh StoredHeader, height uint32) ([]StoredHeader, error) {
+	var ret []StoredHeader
+	var err error
+	for sh.Height > height {
+		ret = append(ret, sh)
+		sh, err = b.db.GetPreviousHeader(sh.Header)
+		if err != nil {
+			return ret, err
+		}
+	}
+	return ret, nil
+}
+
+// CommitHeaders validates a batch of headers, ordered from parent to child, against
+// the parent of the first one and persists every accepted header in one write.
+// Headers we already know are skipped. Once a header fails validation all of its
+// descendants in the batch fail too. It returns a result per header and the common
+// ancestor if the batch caused a reorg.
+func (b *Blockchain) CommitHeaders(headers []wire.BlockHeader) ([]HeaderResult, *StoredHeader, error) {
+	if len(headers) == 0 {
+		return nil, nil, nil
+	}
+	for i := 1; i < len(headers); i++ {
+		prevHash := headers[i-1].BlockHash()
+		if !headers[i].PrevBlock.IsEqual(&prevHash) {
+			return nil, nil, NonContiguousBatchError
+		}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	bestHeader, err := b.db.GetBestHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	tipHash := bestHeader.Header.BlockHash()
+
+	parentHeader, err := b.db.GetPreviousHeader(headers[0])
+	if err != nil {
+		return nil, nil, OrphanHeaderError
+	}
+
+	view := &batchView{
+		db:      b.db,
+		pending: make(map[chainhash.Hash]StoredHeader),
+	}
+	results := make([]HeaderResult, len(headers))
+	var toPut []StoredHeader
+	var failed error
+	for i, header := range headers {
+		hash := header.BlockHash()
+		results[i].Hash = hash
+		results[i].Height = parentHeader.Height + 1
+		if failed != nil {
+			results[i].Err = InvalidAncestorError
+			continue
+		}
+		// Peers usually resend the headers around our tip, there's nothing to do for those
+		if len(toPut) == 0 {
+			if known, err := b.db.GetHeader(hash); err == nil {
+				results[i].Known = true
+				parentHeader = known
+				continue
+			}
+		}
+		if err := b.checkHeader(header, parentHeader, view); err != nil {
+			failed = err
+			results[i].Err = failed
+			continue
+		}
+		sh := StoredHeader{
+			Header:    header,
+			Height:    parentHeader.Height + 1,
+			totalWork: new(big.Int).Add(parentHeader.totalWork, blockchain.CalcWork(header.Bits)),
+		}
+		results[i].NewTip = sh.totalWork.Cmp(bestHeader.totalWork) > 0
+		view.pending[hash] = sh
+		toPut = append(toPut, sh)
+		parentHeader = sh
+	}
+	if len(toPut) == 0 {
+		return results, nil, nil
+	}
+
+	// Cumulative work only grows along the batch so if any header beat our best
+	// header the last one did too.
+	last := toPut[len(toPut)-1]
+	newTip := last.totalWork.Cmp(bestHeader.totalWork) > 0
+	var commonAncestor *StoredHeader
+	if newTip {
+		forkParent, err := view.GetPreviousHeader(toPut[0].Header)
+		if err != nil {
+			return results, nil, err
+		}
+		forkParentHash := forkParent.Header.BlockHash()
+		if !tipHash.IsEqual(&forkParentHash) {
+			commonAncestor, err = b.GetCommonAncestor(forkParent, bestHeader)
+			if err != nil {
+				log.Errorf("Error calculating common ancestor: %s", err.Error())
+				return results, nil, err
+			}
+			log.Warnf("REORG!!! REORG!!! REORG!!! At block %d, Wiped out %d blocks", int(bestHeader.Height), int(bestHeader.Height-commonAncestor.Height))
+		}
+	}
+
+	err = b.db.PutHeaders(toPut, newTip)
+	if err != nil {
+		return results, commonAncestor, err
+	}
+
+	if newTip {
+		b.notifyNewTip(bestHeader, last, commonAncestor)
+	}
+	return results, commonAncestor, nil
+}
+
+// CheckHeader validates header against its parent. A header which breaks a consensus
+// rule returns a HeaderRuleError.
+func (b *Blockchain) CheckHeader(header wire.BlockHeader, prevHeader StoredHeader) error {
+	return b.checkHeader(header, prevHeader, b.db)
+}
+
+func (b *Blockchain) checkHeader(header wire.BlockHeader, prevHeader StoredHeader, src headerSource) error {
 	// Get hash of n-1 header
 	prevHash := prevHeader.Header.BlockHash()
 	height := prevHeader.Height
 
 	// Check if headers link together.  That whole 'blockchain' thing.
 	if prevHash.IsEqual(&header.PrevBlock) == false {
-		log.Errorf("Headers %d and %d don't link.\n", height, height+1)
-		return false
+		return ruleError(ErrHeadersDontLink, "headers %d and %d don't link", height, height+1)
 	}
 
 	// Check the header meets the difficulty requirement
 	if !b.params.ReduceMinDifficulty { //TODO: 查一下原理
-		diffTarget, err := b.calcRequiredWork(header, int32(height+1), prevHeader)
+		diffTarget, err := b.calcRequiredWork(header, int32(height+1), prevHeader, src)
 		if err != nil {
-			log.Errorf("Error calclating difficulty", err)
-			return false
+			return fmt.Errorf("failed to calculate difficulty of block %d: %v", height+1, err)
 		}
 		if header.Bits != diffTarget {
-			log.Warnf("Block %d %s incorrect difficulty.  Read %d, expect %d\n",
+			return ruleError(ErrUnexpectedDifficulty, "block %d %s incorrect difficulty, read %d, expect %d",
 				height+1, header.BlockHash().String(), header.Bits, diffTarget)
-			return false
 		}
 	}
 
 	// Check if there's a valid proof of work.  That whole "Bitcoin" thing.
-	if !checkProofOfWork(header, b.params) {
-		log.Debugf("Block %d bad proof of work.\n", height+1)
-		return false
+	if !checkProofOfWork(header, b.params, b.rules) {
+		return ruleError(ErrBadProofOfWork, "block %d %s bad proof of work", height+1, header.BlockHash().String())
+	}
+
+	err := b.checkCheckpoints(header, prevHeader, src)
+	if err != nil {
+		return err
+	}
+
+	// The timestamp must be after the median time of the last few blocks. Right above the
+	// checkpoint we don't have enough of them, and a median of fewer would reject timestamps
+	// consensus allows.
+	mtp, ok := calcMedianTimePast(prevHeader, src)
+	if ok && !header.Timestamp.After(mtp) {
+		return ruleError(ErrTimeTooOld, "block %d timestamp %v is not after median time past %v",
+			height+1, header.Timestamp, mtp)
+	}
+	// And not too far in the future
+	maxTime := time.Now().Add(maxTimeOffset)
+	if header.Timestamp.After(maxTime) {
+		return ruleError(ErrTimeTooNew, "block %d timestamp %v is too far in the future, max %v",
+			height+1, header.Timestamp, maxTime)
+	}
+
+	// Reject outdated block versions once BIP34, BIP66 and BIP65 are active
+	if err := checkBlockVersion(header.Version, int32(height+1), b.params); err != nil {
+		return err
+	}
+	return nil
+}
+
+// checkCheckpoints rejects a header which conflicts with the checkpoint at its height or
+// whose chain doesn't pass through the last checkpoint below it.
+func (b *Blockchain) checkCheckpoints(header wire.BlockHeader, prevHeader StoredHeader, src headerSource) error {
+	height := prevHeader.Height + 1
+	var below *Checkpoint
+	for i := range b.checkpoints {
+		cp := &b.checkpoints[i]
+		if cp.Height == height && header.BlockHash() != cp.Header.BlockHash() {
+			return ruleError(ErrCheckpointMismatch, "block %d %s conflicts with checkpoint %s",
+				height, header.BlockHash().String(), cp.Header.BlockHash().String())
+		}
+		if cp.Height < height {
+			below = cp
+		}
+	}
+	if below == nil {
+		return nil
+	}
+	anc, err := b.ancestor(prevHeader, below.Height, src)
+	if err != nil {
+		// We don't store that far back, so there is nothing to compare against
+		return nil
 	}
+	if anc.Header.BlockHash() != below.Header.BlockHash() {
+		return ruleError(ErrCheckpointMismatch, "block %d forks off before checkpoint %d %s",
+			height, below.Height, below.Header.BlockHash().String())
+	}
+	return nil
+}
+
+// AddCheckpoints pins extra checkpoints on top of the built in ones. Headers contradicting
+// any checkpoint are rejected from then on. If the best chain already contradicts one an
+// error is returned after the checkpoints are added, the chain has to be rolled back.
+func (b *Blockchain) AddCheckpoints(checkpoints []Checkpoint) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	byHeight := make(map[uint32]Checkpoint)
+	for _, cp := range b.checkpoints {
+		byHeight[cp.Height] = cp
+	}
+	for _, cp := range checkpoints {
+		if known, ok := byHeight[cp.Height]; ok && known.Header.BlockHash() != cp.Header.BlockHash() {
+			return fmt.Errorf("checkpoint %s at height %d conflicts with %s", cp.Header.BlockHash().String(),
+				cp.Height, known.Header.BlockHash().String())
+		}
+		byHeight[cp.Height] = cp
+	}
+	b.checkpoints = b.checkpoints[:0]
+	for _, cp := range byHeight {
+		b.checkpoints = append(b.checkpoints, cp)
+	}
+	sort.Slice(b.checkpoints, func(i, j int) bool {
+		return b.checkpoints[i].Height < b.checkpoints[j].Height
+	})
 
-	return true // it must have worked if there's no errors and got to the end.
+	for _, cp := range checkpoints {
+		sh, err := b.db.GetHeaderByHeight(cp.Height)
+		if err == nil && sh.Header.BlockHash() != cp.Header.BlockHash() {
+			return fmt.Errorf("best chain has %s at height %d, contradicting checkpoint %s", sh.Header.BlockHash().String(),
+				cp.Height, cp.Header.BlockHash().String())
+		}
+	}
+	return nil
+}
+
+// calcMedianTimePast returns the median timestamp of prevHeader and the medianTimeBlocks-1
+// headers before it. It returns false if fewer are stored, as near the checkpoint.
+func calcMedianTimePast(prevHeader StoredHeader, src headerSource) (time.Time, bool) {
+	timestamps := []int64{prevHeader.Header.Timestamp.Unix()}
+	sh := prevHeader
+	for len(timestamps) < medianTimeBlocks {
+		var err error
+		sh, err = src.GetPreviousHeader(sh.Header)
+		if err != nil {
+			return time.Time{}, false
+		}
+		timestamps = append(timestamps, sh.Header.Timestamp.Unix())
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+	return time.Unix(timestamps[len(timestamps)/2], 0), true
+}
+
+func checkBlockVersion(version int32, height int32, p *chaincfg.Params) error {
+	minVersion := int32(1)
+	bip := ""
+	if height >= p.BIP0034Height {
+		minVersion, bip = 2, "BIP34"
+	}
+	if height >= p.BIP0066Height {
+		minVersion, bip = 3, "BIP66"
+	}
+	if height >= p.BIP0065Height {
+		minVersion, bip = 4, "BIP65"
+	}
+	if version < minVersion {
+		return ruleError(ErrBadVersion, "block %d version %d is below %d required by %s",
+			height, version, minVersion, bip)
+	}
+	return nil
 }
 
 // Get the PoW target this block should meet. We may need to handle a difficulty adjustment
 // or testnet difficulty rules.
-func (b *Blockchain) calcRequiredWork(header wire.BlockHeader, height int32, prevHeader StoredHeader) (uint32, error) {
+func (b *Blockchain) calcRequiredWork(header wire.BlockHeader, height int32, prevHeader StoredHeader, src headerSource) (uint32, error) {
+	interval := b.rules.RetargetInterval()
 	// If this is not a difficulty adjustment period
-	if height%epochLength != 0 {
+	if height%interval != 0 {
 		// If we are on testnet
 		if b.params.ReduceMinDifficulty {
-			// If it's been more than 20 minutes since the last header return the minimum difficulty
-			if header.Timestamp.After(prevHeader.Header.Timestamp.Add(targetSpacing * 2)) {
+			// If the last header is old enough return the minimum difficulty
+			if b.rules.MinDifficultyAllowed(header, prevHeader.Header) {
 				return b.params.PowLimitBits, nil
 			} else { // Otherwise return the difficulty of the last block not using special difficulty rules
 				for {
 					var err error = nil
-					for err == nil && int32(prevHeader.Height)%epochLength != 0 && prevHeader.Header.Bits == b.params.PowLimitBits {
+					for err == nil && int32(prevHeader.Height)%interval != 0 && prevHeader.Header.Bits == b.params.PowLimitBits {
 						var sh StoredHeader
-						sh, err = b.db.GetPreviousHeader(prevHeader.Header)
+						sh, err = src.GetPreviousHeader(prevHeader.Header)
 						// Error should only be non-nil if prevHeader is the checkpoint.
 						// In that case we should just return checkpoint bits
 						if err == nil {
@@ -203,25 +560,66 @@ func (b *Blockchain) calcRequiredWork(header wire.BlockHeader, height int32, pre
 		return prevHeader.Header.Bits, nil
 	}
 	// We are on a difficulty adjustment period so we need to correctly calculate the new difficulty.
-	epoch, err := b.GetEpoch()
+	// The epoch starts the lookback of the rules before the parent of this header, on the
+	// parent's own chain.
+	epoch, err := b.epochStart(prevHeader, src)
 	if err != nil {
 		log.Error(err)
 		return 0, err
 	}
-	return calcDiffAdjust(*epoch, prevHeader.Header, b.params), nil
+	return calcDiffAdjust(b.rules, epoch.Header, prevHeader.Header, b.params), nil
 }
 
-func (b *Blockchain) GetEpoch() (*wire.BlockHeader, error) {
-	sh, err := b.db.GetBestHeader()
-	if err != nil {
-		return &sh.Header, err
+// epochStart returns the first header of the retarget window which ends at sh.
+func (b *Blockchain) epochStart(sh StoredHeader, src headerSource) (StoredHeader, error) {
+	lookback := uint32(b.rules.RetargetLookback(int32(sh.Height) + 1))
+	if sh.Height < lookback {
+		return sh, fmt.Errorf("no retarget window below height %d", sh.Height)
 	}
-	for i := 0; i < 2015; i++ {
-		sh, err = b.db.GetPreviousHeader(sh.Header)
+	return b.ancestor(sh, sh.Height-lookback, src)
+}
+
+// Rules returns the consensus rules headers are validated with.
+func (b *Blockchain) Rules() ConsensusRules {
+	return b.rules
+}
+
+// ancestor returns the ancestor of sh at the given height. Side chain headers are walked
+// back one by one, but as soon as we reach the best chain the height index is used.
+func (b *Blockchain) ancestor(sh StoredHeader, height uint32, src headerSource) (StoredHeader, error) {
+	if height > sh.Height {
+		return sh, fmt.Errorf("header at height %d has no ancestor at height %d", sh.Height, height)
+	}
+	var err error
+	for sh.Height > height {
+		if b.onBestChain(sh) {
+			return b.db.GetHeaderByHeight(height)
+		}
+		sh, err = src.GetPreviousHeader(sh.Header)
 		if err != nil {
-			return &sh.Header, err
+			return sh, err
 		}
 	}
+	return sh, nil
+}
+
+func (b *Blockchain) onBestChain(sh StoredHeader) bool {
+	main, err := b.db.GetHeaderByHeight(sh.Height)
+	return err == nil && main.Header.BlockHash() == sh.Header.BlockHash()
+}
+
+// GetEpoch returns the first header of the retarget window ending at the best header.
+func (b *Blockchain) GetEpoch() (*wire.BlockHeader, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	best, err := b.db.GetBestHeader()
+	if err != nil {
+		return &best.Header, err
+	}
+	sh, err := b.epochStart(best, b.db)
+	if err != nil {
+		return &sh.Header, err
+	}
 	log.Debug("Epoch", sh.Header.BlockHash().String())
 	return &sh.Header, nil
 }
@@ -327,49 +725,164 @@ func (b *Blockchain) GetCommonAncestor(bestHeader, prevBestHeader StoredHeader)
 	}
 }
 
+// Prune deletes the headers the policy no longer retains.
+func (b *Blockchain) Prune(policy PrunePolicy) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if interval := uint32(b.rules.RetargetInterval()); policy.MainChainDepth > 0 && policy.MainChainDepth < interval {
+		policy.MainChainDepth = interval
+	}
+	return b.db.Prune(policy)
+}
+
+type RollbackOptions struct {
+	// Only report what would be removed
+	DryRun bool
+	// Only remove the best chain above the new tip and keep side branches. A kept branch
+	// may have more work than the new tip, it becomes the tip again once it's extended.
+	KeepForks bool
+}
+
+// RollbackReport describes a rollback, or with DryRun what a rollback would do.
+type RollbackReport struct {
+	OldTip StoredHeader
+	NewTip StoredHeader
+	// Best chain headers above the new tip
+	RemovedHeaders uint32
+	// Side branch headers above the new tip and the number of side branches they form
+	RemovedForkHeaders uint32
+	RemovedForks       uint32
+	DryRun             bool
+}
+
 // Rollback the header database to the last header before time t.
 // We shouldn't go back further than the checkpoint
 func (b *Blockchain) Rollback(t time.Time) error {
+	_, err := b.RollbackToTime(t, RollbackOptions{})
+	return err
+}
+
+// RollbackToTime rolls back to the last header on the best chain created before t,
+// or to the checkpoint if we get there first.
+func (b *Blockchain) RollbackToTime(t time.Time, opts RollbackOptions) (*RollbackReport, error) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 	checkpoint := GetCheckpoint(time.Now(), b.params)
 	checkPointHash := checkpoint.Header.BlockHash()
 	sh, err := b.db.GetBestHeader()
 	if err != nil {
-		return err
-	}
-	// If t is greater than the timestamp at the tip then do nothing
-	if sh.Header.Timestamp.Before(t) {
-		return nil
+		return nil, err
 	}
-	// If the tip is our checkpoint then do nothing
+	// If t is greater than the timestamp at the tip or the tip is our checkpoint then do nothing
 	checkHash := sh.Header.BlockHash()
-	if checkHash.IsEqual(&checkPointHash) {
-		return nil
+	if sh.Header.Timestamp.Before(t) || checkHash.IsEqual(&checkPointHash) {
+		return b.rollbackTo(sh, opts)
 	}
-	rollbackHeight := uint32(0)
-	for i := 0; i < 1000000000; i++ {
+	for {
 		sh, err = b.db.GetPreviousHeader(sh.Header)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		checkHash := sh.Header.BlockHash()
-		// If we rolled back to the checkpoint then stop here and set the checkpoint as the tip
-		if checkHash.IsEqual(&checkPointHash) {
-			rollbackHeight = checkpoint.Height
+		// Stop at the checkpoint or at the first header created before t
+		if checkHash.IsEqual(&checkPointHash) || sh.Header.Timestamp.Before(t) {
 			break
 		}
-		// If we hit a header created before t then stop here and set this header as the tip
-		if sh.Header.Timestamp.Before(t) {
-			rollbackHeight = sh.Height
-			break
+	}
+	return b.rollbackTo(sh, opts)
+}
+
+// RollbackToHeight rolls back so that the best chain header at height becomes the tip.
+func (b *Blockchain) RollbackToHeight(height uint32, opts RollbackOptions) (*RollbackReport, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	sh, err := b.db.GetHeaderByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	return b.rollbackTo(sh, opts)
+}
+
+// RollbackToHash rolls back so that the given header becomes the tip. It has to be on the best chain.
+func (b *Blockchain) RollbackToHash(hash chainhash.Hash, opts RollbackOptions) (*RollbackReport, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	sh, err := b.db.GetHeader(hash)
+	if err != nil {
+		return nil, err
+	}
+	if !b.onBestChain(sh) {
+		return nil, fmt.Errorf("header %s is not on the best chain", hash.String())
+	}
+	return b.rollbackTo(sh, opts)
+}
+
+// rollbackTo must be called with the lock held and target on the best chain.
+func (b *Blockchain) rollbackTo(target StoredHeader, opts RollbackOptions) (*RollbackReport, error) {
+	best, err := b.db.GetBestHeader()
+	if err != nil {
+		return nil, err
+	}
+	report := &RollbackReport{
+		OldTip: best,
+		NewTip: target,
+		DryRun: opts.DryRun,
+	}
+	if target.Height >= best.Height {
+		return report, nil
+	}
+	disconnected, err := b.headersDownTo(best, target.Height)
+	if err != nil {
+		return nil, err
+	}
+	report.RemovedHeaders = uint32(len(disconnected))
+
+	if !opts.KeepForks {
+		tips, err := b.db.GetTips()
+		if err != nil {
+			return nil, err
 		}
+		bestHash := best.Header.BlockHash()
+		counted := make(map[chainhash.Hash]bool)
+		for _, tip := range tips {
+			if tip.Height <= target.Height || tip.Header.BlockHash() == bestHash {
+				continue
+			}
+			report.RemovedForks++
+			sh := tip
+			for sh.Height > target.Height && !b.onBestChain(sh) {
+				hash := sh.Header.BlockHash()
+				if counted[hash] {
+					break
+				}
+				counted[hash] = true
+				report.RemovedForkHeaders++
+				sh, err = b.db.GetPreviousHeader(sh.Header)
+				if err != nil {
+					break
+				}
+			}
+		}
+	}
+	if opts.DryRun {
+		return report, nil
 	}
-	err = b.db.DeleteAfter(rollbackHeight)
+
+	log.Warnf("Rolling back from block %d to %d, removing %d best chain headers and %d side branches",
+		best.Height, target.Height, report.RemovedHeaders, report.RemovedForks)
+	err = b.db.DeleteAfter(target.Height, opts.KeepForks)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return b.db.Put(sh, true)
+	b.notifier.send(ReorgEvent{
+		CommonAncestor: target,
+		Disconnected:   disconnected,
+	})
+	b.notifier.send(NewTipEvent{
+		Height: target.Height,
+		Hash:   target.Header.BlockHash(),
+	})
+	return report, nil
 }
 
 func (b *Blockchain) BestBlock() (StoredHeader, error) {
@@ -397,14 +910,27 @@ func (b *Blockchain) GetHeader(hash *chainhash.Hash) (StoredHeader, error) {
 	return sh, nil
 }
 
+// Backup writes a snapshot of the header storage to w if the storage supports it,
+// see HeaderDB.Backup.
+func (b *Blockchain) Backup(w io.Writer) (int64, error) {
+	bk, ok := b.db.(interface {
+		Backup(w io.Writer) (int64, error)
+	})
+	if !ok {
+		return 0, errors.New("header storage doesn't support backups")
+	}
+	return bk.Backup(w)
+}
+
 func (b *Blockchain) Close() {
 	b.lock.Lock()
 	b.db.Close()
+	b.notifier.close()
 	b.lock.Unlock()
 }
 
-// Verifies the header hashes into something lower than specified by the 4-byte bits field.
-func checkProofOfWork(header wire.BlockHeader, p *chaincfg.Params) bool {
+// Verifies the PoW hash of the header is lower than specified by the 4-byte bits field.
+func checkProofOfWork(header wire.BlockHeader, p *chaincfg.Params, rules ConsensusRules) bool {
 	target := blockchain.CompactToBig(header.Bits)
 
 	// The target must more than 0.  Why can you even encode negative...
@@ -418,9 +944,9 @@ func checkProofOfWork(header wire.BlockHeader, p *chaincfg.Params) bool {
 			"higher than max of %064x", target, p.PowLimit.Bytes())
 		return false
 	}
-	// The header hash must be less than the claimed target in the header.
-	blockHash := header.BlockHash()
-	hashNum := blockchain.HashToBig(&blockHash)
+	// The PoW hash must be less than the claimed target in the header.
+	powHash := rules.PoWHash(header)
+	hashNum := blockchain.HashToBig(&powHash)
 	if hashNum.Cmp(target) > 0 {
 		log.Debugf("Block hash %064x is higher than "+
 			"required target of %064x", hashNum, target)
@@ -432,30 +958,6 @@ func checkProofOfWork(header wire.BlockHeader, p *chaincfg.Params) bool {
 // This function takes in a start and end block header and uses the timestamps in each
 // to calculate how much of a difficulty adjustment is needed. It returns a new compact
 // difficulty target.
-func calcDiffAdjust(start, end wire.BlockHeader, p *chaincfg.Params) uint32 {
-	duration := end.Timestamp.UnixNano() - start.Timestamp.UnixNano()
-	if duration < minRetargetTimespan {
-		log.Debugf("Whoa there, block %s off-scale high 4X diff adjustment!",
-			end.BlockHash().String())
-		duration = minRetargetTimespan
-	} else if duration > maxRetargetTimespan {
-		log.Debugf("Uh-oh! block %s off-scale low 0.25X diff adjustment!\n",
-			end.BlockHash().String())
-		duration = maxRetargetTimespan
-	}
-
-	// calculation of new 32-byte difficulty target
-	// first turn the previous target into a big int
-	prevTarget := blockchain.CompactToBig(end.Bits)
-	// new target is old * duration...
-	newTarget := new(big.Int).Mul(prevTarget, big.NewInt(duration))
-	// divided by 2 weeks
-	newTarget.Div(newTarget, big.NewInt(int64(targetTimespan)))
-
-	// clip again if above minimum target (too easy)
-	if newTarget.Cmp(p.PowLimit) > 0 {
-		newTarget.Set(p.PowLimit)
-	}
-
-	return blockchain.BigToCompact(newTarget)
+func calcDiffAdjust(rules ConsensusRules, start, end wire.BlockHeader, p *chaincfg.Params) uint32 {
+	return rules.CalcRetarget(end.Bits, end.Timestamp.Sub(start.Timestamp), p.PowLimit)
 }
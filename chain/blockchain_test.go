@@ -8,6 +8,8 @@ import (
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
+	"io/ioutil"
+	"math"
 	"math/big"
 	"os"
 	"testing"
@@ -66,16 +68,14 @@ func createBlockChain(bc *Blockchain) error {
 			Height:    x,
 			totalWork: big.NewInt(0),
 		}
-		bc.db.(*HeaderDB).put(sh, true)
+		bc.db.(*HeaderDB).Put(sh, true)
 		last = hdr
 	}
 	return nil
 }
 
-var MockCreationTime time.Time
-
 func TestNewBlockchain(t *testing.T) {
-	bc, err := NewBlockchain("", MockCreationTime, &chaincfg.MainNetParams, false)
+	bc, err := NewBlockchain("", &chaincfg.MainNetParams)
 	if err != nil {
 		t.Error(err)
 	}
@@ -84,18 +84,19 @@ func TestNewBlockchain(t *testing.T) {
 		t.Error(err)
 	}
 	bestHash := best.Header.BlockHash()
-	checkHash := mainnetCheckpoints[0].Header.BlockHash()
+	checkpoint := GetCheckpoint(time.Now(), &chaincfg.MainNetParams)
+	checkHash := checkpoint.Header.BlockHash()
 	if !bestHash.IsEqual(&checkHash) {
 		t.Error("Blockchain failed to initialize with correct mainnet checkpoint")
 	}
-	if best.Height != mainnetCheckpoints[0].Height {
+	if best.Height != checkpoint.Height {
 		t.Error("Blockchain failed to initialized with correct mainnet checkpoint height")
 	}
 	if best.totalWork.Uint64() != 0 {
 		t.Error("Blockchain failed to initialized with correct mainnet total work")
 	}
 	os.RemoveAll("headers.bin")
-	bc, err = NewBlockchain("", MockCreationTime, &chaincfg.TestNet3Params, false)
+	bc, err = NewBlockchain("", &chaincfg.TestNet3Params)
 	if err != nil {
 		t.Error(err)
 	}
@@ -104,18 +105,19 @@ func TestNewBlockchain(t *testing.T) {
 		t.Error(err)
 	}
 	bestHash = best.Header.BlockHash()
-	checkHash = testnet3Checkpoints[0].Header.BlockHash()
+	checkpoint = GetCheckpoint(time.Now(), &chaincfg.TestNet3Params)
+	checkHash = checkpoint.Header.BlockHash()
 	if !bestHash.IsEqual(&checkHash) {
 		t.Error("Blockchain failed to initialize with correct testnet checkpoint")
 	}
-	if best.Height != testnet3Checkpoints[0].Height {
+	if best.Height != checkpoint.Height {
 		t.Error("Blockchain failed to initialized with correct testnet checkpoint height")
 	}
 	if best.totalWork.Uint64() != 0 {
 		t.Error("Blockchain failed to initialized with correct testnet total work")
 	}
 	os.RemoveAll("headers.bin")
-	bc, err = NewBlockchain("", MockCreationTime, &chaincfg.RegressionNetParams, false)
+	bc, err = NewBlockchain("", &chaincfg.RegressionNetParams)
 	if err != nil {
 		t.Error(err)
 	}
@@ -138,7 +140,7 @@ func TestNewBlockchain(t *testing.T) {
 }
 
 func TestBlockchain_CommitHeader(t *testing.T) {
-	bc, err := NewBlockchain("", MockCreationTime, &chaincfg.RegressionNetParams, false)
+	bc, err := NewBlockchain("", &chaincfg.RegressionNetParams)
 	if err != nil {
 		t.Error(err)
 	}
@@ -181,7 +183,7 @@ func TestBlockchain_CommitHeader(t *testing.T) {
 }
 
 func Test_Reorg(t *testing.T) {
-	bc, err := NewBlockchain("", MockCreationTime, &chaincfg.RegressionNetParams, false)
+	bc, err := NewBlockchain("", &chaincfg.RegressionNetParams)
 	if err != nil {
 		t.Error(err)
 	}
@@ -254,7 +256,7 @@ func Test_Reorg(t *testing.T) {
 }
 
 func TestBlockchain_GetCommonAncestor(t *testing.T) {
-	bc, err := NewBlockchain("", MockCreationTime, &chaincfg.RegressionNetParams, false)
+	bc, err := NewBlockchain("", &chaincfg.RegressionNetParams)
 	if err != nil {
 		t.Error(err)
 	}
@@ -290,7 +292,7 @@ func TestBlockchain_GetCommonAncestor(t *testing.T) {
 
 func TestBlockchain_CheckHeader(t *testing.T) {
 	params := &chaincfg.RegressionNetParams
-	bc, err := NewBlockchain("", MockCreationTime, params, false)
+	bc, err := NewBlockchain("", params)
 	if err != nil {
 		t.Error(err)
 	}
@@ -314,11 +316,11 @@ func TestBlockchain_CheckHeader(t *testing.T) {
 	hdr1.Deserialize(&buf)
 	sh := StoredHeader{
 		Header:    hdr0,
-		Height:    0,
+		Height:    1,
 		totalWork: big.NewInt(0),
 	}
-	if !bc.CheckHeader(hdr1, sh) {
-		t.Error("Check header incorrectly returned false")
+	if err := bc.CheckHeader(hdr1, sh); err != nil {
+		t.Errorf("Check header incorrectly returned error: %v", err)
 	}
 
 	// Test header doesn't link
@@ -329,30 +331,35 @@ func TestBlockchain_CheckHeader(t *testing.T) {
 	buf.Write(header2)
 	hdr2 := wire.BlockHeader{}
 	hdr2.Deserialize(&buf)
-	if bc.CheckHeader(hdr2, sh) {
+	if !isRuleError(bc.CheckHeader(hdr2, sh), ErrHeadersDontLink) {
 		t.Error("Check header missed headers that don't link")
 	}
 	// Test invalid difficulty
 	params.ReduceMinDifficulty = false
 	invalidDiffHdr := hdr1
 	invalidDiffHdr.Bits = 0
-	if bc.CheckHeader(invalidDiffHdr, sh) {
-		t.Error("Check header did not detect invalid PoW")
+	if !isRuleError(bc.CheckHeader(invalidDiffHdr, sh), ErrUnexpectedDifficulty) {
+		t.Error("Check header did not detect invalid difficulty")
 	}
 
 	// Test invalid proof of work
 	params.ReduceMinDifficulty = true
 	invalidPoWHdr := hdr1
 	invalidPoWHdr.Nonce = 0
-	if bc.CheckHeader(invalidPoWHdr, sh) {
+	if !isRuleError(bc.CheckHeader(invalidPoWHdr, sh), ErrBadProofOfWork) {
 		t.Error("Check header did not detect invalid PoW")
 	}
 
 	os.RemoveAll("headers.bin")
 }
 
+func isRuleError(err error, code RuleErrorCode) bool {
+	rerr, ok := err.(HeaderRuleError)
+	return ok && rerr.Code == code
+}
+
 func TestBlockchain_GetNPrevBlockHashes(t *testing.T) {
-	bc, err := NewBlockchain("", MockCreationTime, &chaincfg.RegressionNetParams, false)
+	bc, err := NewBlockchain("", &chaincfg.RegressionNetParams)
 	if err != nil {
 		t.Error(err)
 	}
@@ -400,21 +407,21 @@ func TestBlockchain_checkProofOfWork(t *testing.T) {
 	buf.Write(header0)
 	hdr0 := wire.BlockHeader{}
 	hdr0.Deserialize(&buf)
-	if !checkProofOfWork(hdr0, &chaincfg.RegressionNetParams) {
+	if !checkProofOfWork(hdr0, &chaincfg.RegressionNetParams, BitcoinRules{}) {
 		t.Error("checkProofOfWork failed")
 	}
 
 	// Test negative target
 	neg := hdr0
 	neg.Bits = 1000000000
-	if checkProofOfWork(neg, &chaincfg.RegressionNetParams) {
+	if checkProofOfWork(neg, &chaincfg.RegressionNetParams, BitcoinRules{}) {
 		t.Error("checkProofOfWork failed to negative target")
 	}
 
 	// Test too high diff
 	params := chaincfg.RegressionNetParams
 	params.PowLimit = big.NewInt(0)
-	if checkProofOfWork(hdr0, &params) {
+	if checkProofOfWork(hdr0, &params, BitcoinRules{}) {
 		t.Error("checkProofOfWork failed to detect above max PoW")
 	}
 
@@ -427,7 +434,7 @@ func TestBlockchain_checkProofOfWork(t *testing.T) {
 	badHdr := wire.BlockHeader{}
 	buf.Write(header0)
 	badHdr.Deserialize(&buf)
-	if checkProofOfWork(badHdr, &chaincfg.RegressionNetParams) {
+	if checkProofOfWork(badHdr, &chaincfg.RegressionNetParams, BitcoinRules{}) {
 		t.Error("checkProofOfWork failed to detect insuffient work")
 	}
 }
@@ -440,7 +447,7 @@ func TestBlockchain_calcDiffAdjust(t *testing.T) {
 	start.Timestamp = time.Unix(1261130161, 0) // Block #30240
 	end.Timestamp = time.Unix(1262152739, 0)   // Block #32255
 	end.Bits = 0x1d00ffff
-	if calcDiffAdjust(start, end, &chaincfg.RegressionNetParams) != 0x1d00d86a {
+	if calcDiffAdjust(BitcoinRules{}, start, end, &chaincfg.RegressionNetParams) != 0x1d00d86a {
 		t.Error("callDiffAdjust returned incorrect difficulty")
 	}
 
@@ -450,7 +457,7 @@ func TestBlockchain_calcDiffAdjust(t *testing.T) {
 	start.Timestamp = time.Unix(1279008237, 0) // Block #0
 	end.Timestamp = time.Unix(1279297671, 0)   // Block #2015
 	end.Bits = 0x1c05a3f4
-	if calcDiffAdjust(start, end, &chaincfg.RegressionNetParams) != 0x1c0168fd {
+	if calcDiffAdjust(BitcoinRules{}, start, end, &chaincfg.RegressionNetParams) != 0x1c0168fd {
 		t.Error("callDiffAdjust returned incorrect difficulty")
 	}
 
@@ -460,7 +467,7 @@ func TestBlockchain_calcDiffAdjust(t *testing.T) {
 	start.Timestamp = time.Unix(1279008237, 0) // Block #66528
 	end.Timestamp = time.Unix(1279297671, 0)   // Block #68543
 	end.Bits = 0x1c05a3f4
-	if calcDiffAdjust(start, end, &chaincfg.RegressionNetParams) != 0x1c0168fd {
+	if calcDiffAdjust(BitcoinRules{}, start, end, &chaincfg.RegressionNetParams) != 0x1c0168fd {
 		t.Error("callDiffAdjust returned incorrect difficulty")
 	}
 
@@ -470,13 +477,13 @@ func TestBlockchain_calcDiffAdjust(t *testing.T) {
 	start.Timestamp = time.Unix(1263163443, 0) // NOTE: Not an actual block time
 	end.Timestamp = time.Unix(1269211443, 0)   // Block #46367
 	end.Bits = 0x1c387f6f
-	if calcDiffAdjust(start, end, &chaincfg.RegressionNetParams) != 0x1d00e1fd {
+	if calcDiffAdjust(BitcoinRules{}, start, end, &chaincfg.RegressionNetParams) != 0x1d00e1fd {
 		t.Error("callDiffAdjust returned incorrect difficulty")
 	}
 }
 
 func TestBlockchain_GetBlockLocator(t *testing.T) {
-	bc, err := NewBlockchain("", MockCreationTime, &chaincfg.RegressionNetParams, false)
+	bc, err := NewBlockchain("", &chaincfg.RegressionNetParams)
 	if err != nil {
 		t.Error(err)
 	}
@@ -519,7 +526,7 @@ func TestBlockchain_GetBlockLocator(t *testing.T) {
 }
 
 func TestBlockchain_GetEpoch(t *testing.T) {
-	bc, err := NewBlockchain("", MockCreationTime, &chaincfg.RegressionNetParams, false)
+	bc, err := NewBlockchain("", &chaincfg.RegressionNetParams)
 	if err != nil {
 		t.Error(err)
 	}
@@ -539,7 +546,7 @@ func TestBlockchain_GetEpoch(t *testing.T) {
 
 func TestBlockchain_calcRequiredWork(t *testing.T) {
 	params := &chaincfg.TestNet3Params
-	bc, err := NewBlockchain("", MockCreationTime, params, false)
+	bc, err := NewBlockchain("", params)
 	if err != nil {
 		t.Error(err)
 	}
@@ -555,7 +562,7 @@ func TestBlockchain_calcRequiredWork(t *testing.T) {
 	// Test during difficulty adjust period
 	newHdr := wire.BlockHeader{}
 	newHdr.PrevBlock = best.Header.BlockHash()
-	work, err := bc.calcRequiredWork(newHdr, 2016, best)
+	work, err := bc.calcRequiredWork(newHdr, 2016, best, bc.db)
 	if err != nil {
 		t.Error(err)
 	}
@@ -574,7 +581,7 @@ func TestBlockchain_calcRequiredWork(t *testing.T) {
 	params.ReduceMinDifficulty = false
 	newHdr1 := wire.BlockHeader{}
 	newHdr1.PrevBlock = newHdr.BlockHash()
-	work1, err := bc.calcRequiredWork(newHdr1, 2017, sh)
+	work1, err := bc.calcRequiredWork(newHdr1, 2017, sh, bc.db)
 	if err != nil {
 		t.Error(err)
 	}
@@ -593,7 +600,7 @@ func TestBlockchain_calcRequiredWork(t *testing.T) {
 	params.ReduceMinDifficulty = true
 	newHdr2 := wire.BlockHeader{}
 	newHdr2.PrevBlock = newHdr1.BlockHash()
-	work2, err := bc.calcRequiredWork(newHdr2, 2018, sh)
+	work2, err := bc.calcRequiredWork(newHdr2, 2018, sh, bc.db)
 	if err != nil {
 		t.Error(err)
 	}
@@ -612,7 +619,7 @@ func TestBlockchain_calcRequiredWork(t *testing.T) {
 	newHdr3 := wire.BlockHeader{}
 	newHdr3.PrevBlock = newHdr2.BlockHash()
 	newHdr3.Timestamp = newHdr2.Timestamp.Add(time.Minute * 21)
-	work3, err := bc.calcRequiredWork(newHdr3, 2019, sh)
+	work3, err := bc.calcRequiredWork(newHdr3, 2019, sh, bc.db)
 	if err != nil {
 		t.Error(err)
 	}
@@ -631,7 +638,7 @@ func TestBlockchain_calcRequiredWork(t *testing.T) {
 	params.ReduceMinDifficulty = true
 	newHdr4 := wire.BlockHeader{}
 	newHdr4.PrevBlock = newHdr3.BlockHash()
-	work4, err := bc.calcRequiredWork(newHdr4, 2020, sh)
+	work4, err := bc.calcRequiredWork(newHdr4, 2020, sh, bc.db)
 	if err != nil {
 		t.Error(err)
 	}
@@ -642,7 +649,7 @@ func TestBlockchain_calcRequiredWork(t *testing.T) {
 }
 
 func TestBlockchain_Rollback(t *testing.T) {
-	bc, err := NewBlockchain("", MockCreationTime, &chaincfg.RegressionNetParams, false)
+	bc, err := NewBlockchain("", &chaincfg.RegressionNetParams)
 	if err != nil {
 		t.Error(err)
 		return
@@ -680,3 +687,837 @@ func TestBlockchain_Rollback(t *testing.T) {
 	}
 	os.RemoveAll("headers.bin")
 }
+
+func decodeTestHeaders(t *testing.T, hexHeaders []string) []wire.BlockHeader {
+	var headers []wire.BlockHeader
+	for _, c := range hexHeaders {
+		b, err := hex.DecodeString(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hdr wire.BlockHeader
+		hdr.Deserialize(bytes.NewReader(b))
+		headers = append(headers, hdr)
+	}
+	return headers
+}
+
+func TestBlockchain_CommitHeaders(t *testing.T) {
+	bc, err := NewBlockchain("", &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("headers.bin")
+	defer bc.Close()
+
+	mainHeaders := decodeTestHeaders(t, chain)
+	results, reorg, err := bc.CommitHeaders(mainHeaders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reorg != nil {
+		t.Error("Incorrectly set reorg when inserting headers")
+	}
+	for i, r := range results {
+		if r.Err != nil || !r.NewTip || r.Known {
+			t.Errorf("Unexpected result for header %d: %+v", i, r)
+		}
+		if r.Height != uint32(i+1) {
+			t.Error("Returned incorrect height when inserting header")
+		}
+	}
+
+	// Resending the same batch is a no-op
+	results, _, err = bc.CommitHeaders(mainHeaders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if !r.Known || r.NewTip {
+			t.Error("Failed to recognize a known header")
+		}
+	}
+
+	forkHeaders := decodeTestHeaders(t, fork)
+	results, reorg, err = bc.CommitHeaders(forkHeaders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reorg == nil || reorg.Height != 5 {
+		t.Error("Failed to return reorg when inserting a batch that caused a reorg")
+	}
+	for i, r := range results {
+		if r.Height != uint32(i+6) {
+			t.Error("Returned incorrect height when inserting header")
+		}
+		if r.NewTip != (i+6 >= 11) {
+			t.Errorf("Incorrect new tip flag for header at height %d", r.Height)
+		}
+	}
+	best, err := bc.BestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if best.Header.BlockHash() != forkHeaders[len(forkHeaders)-1].BlockHash() {
+		t.Error("Batch did not set the chain tip")
+	}
+	sh, err := bc.GetHeaderByHeight(7)
+	if err != nil || sh.Header.BlockHash() != forkHeaders[1].BlockHash() {
+		t.Error("Height index does not follow the reorg")
+	}
+
+	if _, _, err := bc.CommitHeaders([]wire.BlockHeader{mainHeaders[0], mainHeaders[2]}); err != NonContiguousBatchError {
+		t.Error("Failed to reject a batch that doesn't link")
+	}
+}
+
+func TestBlockchain_CommitHeadersInvalid(t *testing.T) {
+	bc, err := NewBlockchain("", &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("headers.bin")
+	defer bc.Close()
+
+	headers := decodeTestHeaders(t, chain[:5])
+	headers[2].Bits = 0
+	headers[3].PrevBlock = headers[2].BlockHash()
+	headers[4].PrevBlock = headers[3].BlockHash()
+	results, _, err := bc.CommitHeaders(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Err != nil || results[1].Err != nil {
+		t.Error("Rejected a valid header")
+	}
+	if !isRuleError(results[2].Err, ErrBadProofOfWork) {
+		t.Error("Failed to reject an invalid header")
+	}
+	if results[3].Err != InvalidAncestorError || results[4].Err != InvalidAncestorError {
+		t.Error("Failed to reject descendants of an invalid header")
+	}
+	h, err := bc.db.Height()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != 2 {
+		t.Error("Valid prefix of the batch was not committed")
+	}
+	if _, err := bc.GetHeader(&results[3].Hash); err == nil {
+		t.Error("Committed a descendant of an invalid header")
+	}
+}
+
+func TestBlockchain_Subscribe(t *testing.T) {
+	bc, err := NewBlockchain("", &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("headers.bin")
+	defer bc.Close()
+
+	sub := bc.Subscribe(100, DropNewest)
+	mainHeaders := decodeTestHeaders(t, chain)
+	for _, h := range mainHeaders {
+		if _, _, _, err := bc.CommitHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range mainHeaders {
+		e := (<-sub.C).(NewTipEvent)
+		if e.Height != uint32(i+1) || e.Hash != mainHeaders[i].BlockHash() {
+			t.Errorf("Incorrect new tip event for height %d", i+1)
+		}
+	}
+
+	forkHeaders := decodeTestHeaders(t, fork)
+	if _, _, err := bc.CommitHeaders(forkHeaders); err != nil {
+		t.Fatal(err)
+	}
+	reorg, ok := (<-sub.C).(ReorgEvent)
+	if !ok {
+		t.Fatal("Failed to send reorg event")
+	}
+	if reorg.CommonAncestor.Height != 5 {
+		t.Error("Incorrect common ancestor in reorg event")
+	}
+	if len(reorg.Disconnected) != 5 || reorg.Disconnected[0].Header.BlockHash() != mainHeaders[9].BlockHash() ||
+		reorg.Disconnected[4].Header.BlockHash() != mainHeaders[5].BlockHash() {
+		t.Error("Incorrect disconnected headers in reorg event")
+	}
+	if len(reorg.Connected) != 7 || reorg.Connected[0].Header.BlockHash() != forkHeaders[0].BlockHash() ||
+		reorg.Connected[6].Header.BlockHash() != forkHeaders[6].BlockHash() {
+		t.Error("Incorrect connected headers in reorg event")
+	}
+	tip := (<-sub.C).(NewTipEvent)
+	if tip.Height != 12 || tip.Hash != forkHeaders[6].BlockHash() {
+		t.Error("Incorrect new tip event after reorg")
+	}
+
+	sub.Unsubscribe()
+	if _, ok := <-sub.C; ok {
+		t.Error("Unsubscribe did not close the channel")
+	}
+}
+
+func TestBlockchain_SubscribeOverflow(t *testing.T) {
+	bc, err := NewBlockchain("", &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("headers.bin")
+	defer bc.Close()
+
+	newest := bc.Subscribe(1, DropNewest)
+	oldest := bc.Subscribe(1, DropOldest)
+	closing := bc.Subscribe(1, CloseOnOverflow)
+	mainHeaders := decodeTestHeaders(t, chain[:3])
+	for _, h := range mainHeaders {
+		if _, _, _, err := bc.CommitHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if e := (<-newest.C).(NewTipEvent); e.Height != 1 {
+		t.Error("DropNewest kept the wrong event")
+	}
+	if newest.Dropped() != 2 {
+		t.Error("Incorrect dropped count")
+	}
+	if e := (<-oldest.C).(NewTipEvent); e.Height != 3 {
+		t.Error("DropOldest kept the wrong event")
+	}
+	if oldest.Dropped() != 2 {
+		t.Error("Incorrect dropped count")
+	}
+	<-closing.C
+	if _, ok := <-closing.C; ok {
+		t.Error("CloseOnOverflow did not close the subscription")
+	}
+}
+
+func TestBlockchain_GetChainTips(t *testing.T) {
+	bc, err := NewBlockchain("", &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("headers.bin")
+	defer bc.Close()
+
+	mainHeaders := decodeTestHeaders(t, chain)
+	if _, _, err := bc.CommitHeaders(mainHeaders); err != nil {
+		t.Fatal(err)
+	}
+	forkHeaders := decodeTestHeaders(t, fork[:3])
+	if _, _, err := bc.CommitHeaders(forkHeaders); err != nil {
+		t.Fatal(err)
+	}
+
+	tips, err := bc.GetChainTips()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tips) != 2 {
+		t.Fatalf("Expected 2 chain tips, got %d", len(tips))
+	}
+	active := tips[0]
+	if active.Status != ChainTipActive || active.Hash != mainHeaders[9].BlockHash() || active.BranchLen != 0 {
+		t.Error("Incorrect active chain tip")
+	}
+	side := tips[1]
+	if side.Status != ChainTipValidFork || side.Hash != forkHeaders[2].BlockHash() {
+		t.Error("Incorrect side chain tip")
+	}
+	if side.Height != 8 || side.BranchLen != 3 || side.ForkHeight != 5 || side.ForkHash != mainHeaders[4].BlockHash() {
+		t.Errorf("Incorrect fork point for side chain: %+v", side)
+	}
+	if side.TotalWork.Cmp(active.TotalWork) >= 0 {
+		t.Error("Side chain has more work than the active chain")
+	}
+	if side.FirstSeen.IsZero() {
+		t.Error("Side chain first seen time not set")
+	}
+}
+
+func TestBlockchain_CheckHeaderTimeAndVersion(t *testing.T) {
+	bc, err := NewBlockchain("", &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("headers.bin")
+	defer bc.Close()
+
+	if _, _, err := bc.CommitHeaders(decodeTestHeaders(t, chain)); err != nil {
+		t.Fatal(err)
+	}
+	best, err := bc.BestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtp, ok := calcMedianTimePast(best, bc.db)
+	if !ok {
+		t.Fatal("Not enough headers for the median time past")
+	}
+	mine := func(ts time.Time) wire.BlockHeader {
+		hdr := best.Header
+		hdr.PrevBlock = best.Header.BlockHash()
+		hdr.Timestamp = ts
+		for !checkProofOfWork(hdr, bc.params, bc.rules) {
+			hdr.Nonce++
+		}
+		return hdr
+	}
+
+	if err := bc.CheckHeader(mine(mtp.Add(time.Second)), best); err != nil {
+		t.Errorf("Rejected a valid header: %v", err)
+	}
+	if !isRuleError(bc.CheckHeader(mine(mtp), best), ErrTimeTooOld) {
+		t.Error("Accepted a header at the median time past")
+	}
+	if !isRuleError(bc.CheckHeader(mine(time.Now().Add(3*time.Hour)), best), ErrTimeTooNew) {
+		t.Error("Accepted a header too far in the future")
+	}
+
+	params := &chaincfg.MainNetParams
+	if err := checkBlockVersion(1, params.BIP0034Height-1, params); err != nil {
+		t.Error("Rejected version 1 before BIP34")
+	}
+	if !isRuleError(checkBlockVersion(1, params.BIP0034Height, params), ErrBadVersion) {
+		t.Error("Accepted version 1 after BIP34")
+	}
+	if !isRuleError(checkBlockVersion(2, params.BIP0066Height, params), ErrBadVersion) {
+		t.Error("Accepted version 2 after BIP66")
+	}
+	if !isRuleError(checkBlockVersion(3, params.BIP0065Height, params), ErrBadVersion) {
+		t.Error("Accepted version 3 after BIP65")
+	}
+	if err := checkBlockVersion(4, params.BIP0065Height, params); err != nil {
+		t.Error("Rejected version 4 after BIP65")
+	}
+}
+
+func TestBlockchain_MedianTimePastAboveCheckpoint(t *testing.T) {
+	params := &chaincfg.RegressionNetParams
+	bc, err := NewBlockchainWithHeaders(NewMemHeaders(), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	mine := func(prev wire.BlockHeader, ts time.Time) wire.BlockHeader {
+		hdr := wire.BlockHeader{
+			Version:   4,
+			PrevBlock: prev.BlockHash(),
+			Timestamp: ts,
+			Bits:      prev.Bits,
+		}
+		for !checkProofOfWork(hdr, bc.params, bc.rules) {
+			hdr.Nonce++
+		}
+		return hdr
+	}
+
+	// Consensus allows a header older than its parent as long as it's after the median of
+	// eleven, right above the checkpoint there aren't eleven to take it of
+	prev := params.GenesisBlock.Header
+	older := mine(prev, prev.Timestamp.Add(-time.Second))
+	if _, _, _, err := bc.CommitHeader(older); err != nil {
+		t.Fatalf("Rejected a header older than its parent above the checkpoint: %v", err)
+	}
+	prev = older
+	for i := 0; i < medianTimeBlocks; i++ {
+		prev = mine(prev, prev.Timestamp.Add(10*time.Minute))
+		if _, _, _, err := bc.CommitHeader(prev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	best, err := bc.BestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtp, ok := calcMedianTimePast(best, bc.db)
+	if !ok {
+		t.Fatal("Not enough headers for the median time past")
+	}
+	if _, _, _, err := bc.CommitHeader(mine(prev, mtp)); !isRuleError(err, ErrTimeTooOld) {
+		t.Errorf("Accepted a header at the median time past: %v", err)
+	}
+}
+
+// buildRetargetChain mines n headers on parent with the given block spacing, computing the
+// bits the way a full node would. epoch is the first header of parent's retarget window.
+func buildRetargetChain(bc *Blockchain, epoch wire.BlockHeader, parent StoredHeader, n int, spacing time.Duration) []wire.BlockHeader {
+	var headers []wire.BlockHeader
+	prev := parent.Header
+	height := parent.Height
+	for i := 0; i < n; i++ {
+		height++
+		hdr := wire.BlockHeader{
+			Version:   4,
+			PrevBlock: prev.BlockHash(),
+			Timestamp: prev.Timestamp.Add(spacing),
+			Bits:      prev.Bits,
+		}
+		if int32(height)%bc.rules.RetargetInterval() == 0 {
+			hdr.Bits = calcDiffAdjust(bc.rules, epoch, prev, bc.params)
+		}
+		for !checkProofOfWork(hdr, bc.params, bc.rules) {
+			hdr.Nonce++
+		}
+		headers = append(headers, hdr)
+		prev = hdr
+	}
+	return headers
+}
+
+func TestBlockchain_RetargetAcrossFork(t *testing.T) {
+	// A simnet-like chain which enforces retargeting
+	params := chaincfg.RegressionNetParams
+	params.Name = "retargettest"
+	params.ReduceMinDifficulty = false
+	bc, err := NewBlockchain("", &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("headers.bin")
+	defer bc.Close()
+
+	genesis, err := bc.BestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Blocks every minute make the main chain retarget to the 4x limit at 2016
+	mainHeaders := buildRetargetChain(bc, genesis.Header, genesis, 2020, time.Minute)
+	results, _, err := bc.CommitHeaders(mainHeaders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Fatalf("Failed to commit main chain header at height %d: %v", r.Height, r.Err)
+		}
+	}
+
+	// Fork at 1900 with hourly blocks so the fork retargets to a different target at 2016
+	forkParent, err := bc.GetHeaderByHeight(1900)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forkHeaders := buildRetargetChain(bc, genesis.Header, forkParent, 120, time.Hour)
+	if forkHeaders[115].Bits == mainHeaders[2015].Bits {
+		t.Fatal("Fork and main chain retarget to the same bits")
+	}
+	// Up to the header before the boundary, validated while best is not its parent
+	results, _, err = bc.CommitHeaders(forkHeaders[:115])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Fatalf("Failed to commit fork header at height %d: %v", r.Height, r.Err)
+		}
+	}
+	forkPrev, err := bc.GetHeader(&results[114].Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongBits := forkHeaders[115]
+	wrongBits.Bits = mainHeaders[2015].Bits
+	if !isRuleError(bc.CheckHeader(wrongBits, forkPrev), ErrUnexpectedDifficulty) {
+		t.Error("Validated a fork header against the main chain's retarget")
+	}
+	// The boundary header, first alone and then inside a batch running past it
+	if err := bc.CheckHeader(forkHeaders[115], forkPrev); err != nil {
+		t.Errorf("Rejected a fork header with the correct retarget: %v", err)
+	}
+	results, _, err = bc.CommitHeaders(forkHeaders[100:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Errorf("Failed to commit fork header at height %d: %v", r.Height, r.Err)
+		}
+	}
+
+	// The epoch start of the side chain is found through the height index
+	forkTip, err := bc.GetHeader(&results[len(results)-1].Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epoch, err := bc.epochStart(forkTip, bc.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mainEpoch, err := bc.GetHeaderByHeight(forkTip.Height - 2015)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if epoch.Header.BlockHash() != mainEpoch.Header.BlockHash() {
+		t.Error("Incorrect epoch start for a side chain header")
+	}
+}
+
+func TestBlockchain_Checkpoints(t *testing.T) {
+	bc, err := NewBlockchain("", &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("headers.bin")
+	defer bc.Close()
+
+	mainHeaders := decodeTestHeaders(t, chain)
+	if _, _, err := bc.CommitHeaders(mainHeaders); err != nil {
+		t.Fatal(err)
+	}
+	err = bc.AddCheckpoints([]Checkpoint{{Height: 7, Header: mainHeaders[6]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fork leaves the main chain at 5, so its header at 7 contradicts the checkpoint
+	forkHeaders := decodeTestHeaders(t, fork)
+	results, reorg, err := bc.CommitHeaders(forkHeaders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Err != nil {
+		t.Errorf("Rejected a fork header below the checkpoint: %v", results[0].Err)
+	}
+	if !isRuleError(results[1].Err, ErrCheckpointMismatch) {
+		t.Error("Accepted a header conflicting with a checkpoint")
+	}
+	if reorg != nil {
+		t.Error("Reorged onto a branch contradicting a checkpoint")
+	}
+	// Committed on its own the rest of the fork is rejected for forking before the checkpoint
+	fork6, err := bc.GetHeader(&results[0].Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isRuleError(bc.CheckHeader(forkHeaders[1], fork6), ErrCheckpointMismatch) {
+		t.Error("Accepted a header conflicting with a checkpoint")
+	}
+
+	err = bc.AddCheckpoints([]Checkpoint{{Height: 7, Header: forkHeaders[1]}})
+	if err == nil {
+		t.Error("Added a checkpoint conflicting with a known checkpoint")
+	}
+	err = bc.AddCheckpoints([]Checkpoint{{Height: 6, Header: forkHeaders[0]}})
+	if err == nil {
+		t.Error("Failed to report a best chain contradicting a new checkpoint")
+	}
+}
+
+func TestLoadCheckpoints(t *testing.T) {
+	headers := decodeTestHeaders(t, chain)
+	hash := headers[4].BlockHash().String()
+	file := `{"regtest": [{"height": 5, "hash": "` + hash + `", "header": "` + chain[4] + `"}],
+		"mainnet": [{"height": 1, "hash": "00", "header": "00"}]}`
+	err := ioutil.WriteFile("checkpoints.json", []byte(file), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("checkpoints.json")
+
+	cps, err := LoadCheckpoints("checkpoints.json", &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cps) != 1 || cps[0].Height != 5 || cps[0].Header.BlockHash().String() != hash {
+		t.Error("Loaded incorrect checkpoints")
+	}
+	if _, err := LoadCheckpoints("checkpoints.json", &chaincfg.MainNetParams); err == nil {
+		t.Error("Loaded an invalid checkpoint")
+	}
+}
+
+func TestBlockchain_RollbackTargets(t *testing.T) {
+	bc, err := NewBlockchain("", &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("headers.bin")
+	defer bc.Close()
+
+	mainHeaders := decodeTestHeaders(t, chain)
+	if _, _, err := bc.CommitHeaders(mainHeaders); err != nil {
+		t.Fatal(err)
+	}
+	forkHeaders := decodeTestHeaders(t, fork[:3])
+	if _, _, err := bc.CommitHeaders(forkHeaders); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := bc.RollbackToHeight(7, RollbackOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.NewTip.Header.BlockHash() != mainHeaders[6].BlockHash() || report.OldTip.Height != 10 {
+		t.Error("Dry run reported the wrong tips")
+	}
+	if report.RemovedHeaders != 3 || report.RemovedForks != 1 || report.RemovedForkHeaders != 1 {
+		t.Errorf("Dry run reported the wrong removals: %+v", report)
+	}
+	if best, _ := bc.BestBlock(); best.Height != 10 {
+		t.Error("Dry run rolled back the chain")
+	}
+
+	sub := bc.Subscribe(10, DropNewest)
+	report, err = bc.RollbackToHash(mainHeaders[4].BlockHash(), RollbackOptions{KeepForks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.RemovedHeaders != 5 || report.RemovedForks != 0 {
+		t.Errorf("Incorrect rollback report: %+v", report)
+	}
+	if best, _ := bc.BestBlock(); best.Header.BlockHash() != mainHeaders[4].BlockHash() {
+		t.Error("Failed to roll back to the given hash")
+	}
+	if _, err := bc.GetHeader(&report.OldTip.Header.PrevBlock); err == nil {
+		t.Error("Failed to delete the best chain")
+	}
+	forkTip := forkHeaders[2].BlockHash()
+	if _, err := bc.GetHeader(&forkTip); err != nil {
+		t.Error("Deleted a side branch with KeepForks")
+	}
+	reorg, ok := (<-sub.C).(ReorgEvent)
+	if !ok || len(reorg.Disconnected) != 5 || reorg.CommonAncestor.Height != 5 {
+		t.Error("Incorrect reorg event for rollback")
+	}
+	if tip := (<-sub.C).(NewTipEvent); tip.Height != 5 {
+		t.Error("Incorrect new tip event for rollback")
+	}
+
+	if _, err := bc.RollbackToHash(forkHeaders[1].BlockHash(), RollbackOptions{}); err == nil {
+		t.Error("Rolled back to a header on a side branch")
+	}
+	report, err = bc.RollbackToHeight(3, RollbackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.RemovedHeaders != 2 || report.RemovedForks != 1 || report.RemovedForkHeaders != 3 {
+		t.Errorf("Incorrect rollback report: %+v", report)
+	}
+	tips, err := bc.GetChainTips()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tips) != 1 || tips[0].Height != 3 {
+		t.Error("Side branch left after rollback")
+	}
+}
+
+func TestBlockchain_ExportImport(t *testing.T) {
+	bc, err := NewBlockchain("", &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("headers.bin")
+	defer bc.Close()
+	mainHeaders := decodeTestHeaders(t, chain)
+	if _, _, err := bc.CommitHeaders(mainHeaders); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := bc.Export(&buf, 1, 10); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 49+80*10 {
+		t.Fatalf("Unexpected export size %d", buf.Len())
+	}
+	if err := bc.Export(&bytes.Buffer{}, 5, 11); err == nil {
+		t.Error("Exported headers above the tip")
+	}
+	exported := buf.Bytes()
+
+	bc2, err := NewBlockchain("import.bin", &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("import.bin")
+	defer bc2.Close()
+
+	if _, err := bc2.Import(bytes.NewReader(exported[:49+80*9+40])); err == nil {
+		t.Error("Imported a truncated file")
+	}
+	// Zero the timestamp of the last header so it fails the median time check
+	tampered := append([]byte{}, exported...)
+	copy(tampered[49+80*9+68:49+80*9+72], []byte{0, 0, 0, 0})
+	if _, err := bc2.Import(bytes.NewReader(tampered)); err == nil {
+		t.Error("Imported an invalid header")
+	}
+
+	n, err := bc2.Import(bytes.NewReader(exported))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 new header after the partial import, got %d", n)
+	}
+	best, err := bc2.BestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if best.Height != 10 || best.Header.BlockHash() != mainHeaders[9].BlockHash() {
+		t.Error("Import didn't reach the exported tip")
+	}
+
+	bc3, err := NewBlockchain("testnet.bin", &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("testnet.bin")
+	defer bc3.Close()
+	if _, err := bc3.Import(bytes.NewReader(exported)); err == nil {
+		t.Error("Imported headers from another network")
+	}
+}
+
+func TestBlockchain_MemHeaders(t *testing.T) {
+	bc, err := NewBlockchainWithHeaders(NewMemHeaders(), &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	if best, _ := bc.BestBlock(); best.Header.BlockHash() != regtestCheckpoint.Header.BlockHash() {
+		t.Fatal("Memory store was not initialized with the checkpoint")
+	}
+	if _, _, err := bc.CommitHeaders(decodeTestHeaders(t, chain)); err != nil {
+		t.Fatal(err)
+	}
+	forkHeaders := decodeTestHeaders(t, fork)
+	_, ancestor, err := bc.CommitHeaders(forkHeaders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ancestor == nil || ancestor.Height != 5 {
+		t.Error("Expected a reorg at height 5")
+	}
+	best, err := bc.BestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if best.Height != 12 || best.Header.BlockHash() != forkHeaders[6].BlockHash() {
+		t.Error("Fork did not become the best chain")
+	}
+	sh, err := bc.GetHeaderByHeight(6)
+	if err != nil || sh.Header.BlockHash() != forkHeaders[0].BlockHash() {
+		t.Error("Height index was not moved to the fork")
+	}
+}
+
+func TestBlockchain_Prune(t *testing.T) {
+	bc, err := NewBlockchainWithHeaders(NewMemHeaders(), &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	parent, err := bc.BestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2500; i++ {
+		hdr := parent.Header
+		hdr.PrevBlock = parent.Header.BlockHash()
+		rand.Read(hdr.MerkleRoot[:])
+		sh := StoredHeader{Header: hdr, Height: parent.Height + 1, totalWork: big.NewInt(int64(i))}
+		if err := bc.db.Put(sh, true); err != nil {
+			t.Fatal(err)
+		}
+		parent = sh
+	}
+
+	// At least a retarget window is kept however small the depth
+	if err := bc.Prune(PrunePolicy{MainChainDepth: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.GetHeaderByHeight(parent.Height - 2016); err == nil {
+		t.Error("Header below the retarget window was kept")
+	}
+	if _, err := bc.GetHeaderByHeight(parent.Height - 2015); err != nil {
+		t.Error("Header of the retarget window was pruned")
+	}
+}
+
+func TestBlockchain_Stats(t *testing.T) {
+	params := &chaincfg.TestNet3Params
+	db := NewMemHeaders()
+	root := StoredHeader{Header: testHdr1, Height: 4028, totalWork: big.NewInt(0)}
+	root.Header.Bits = 0x1c00ffff
+	if err := db.Put(root, true); err != nil {
+		t.Fatal(err)
+	}
+	// Up to the epoch boundary at 4032 the difficulty is 256, after it the regular headers
+	// are at 65536 and the rest at the minimum
+	minutes := []int{30, 10, 80, 20, 50, 40, 70, 60}
+	bits := []uint32{0x1c00ffff, 0x1c00ffff, 0x1c00ffff, params.PowLimitBits, 0x1b00ffff,
+		params.PowLimitBits, params.PowLimitBits, 0x1b00ffff}
+	parent := root
+	var headers []StoredHeader
+	for i := range minutes {
+		hdr := parent.Header
+		hdr.PrevBlock = parent.Header.BlockHash()
+		hdr.Timestamp = parent.Header.Timestamp.Add(time.Duration(minutes[i]) * time.Minute)
+		hdr.Bits = bits[i]
+		sh := StoredHeader{
+			Header:    hdr,
+			Height:    parent.Height + 1,
+			totalWork: new(big.Int).Add(parent.totalWork, blockchain.CalcWork(hdr.Bits)),
+		}
+		headers = append(headers, sh)
+		parent = sh
+	}
+	if err := db.PutHeaders(headers, true); err != nil {
+		t.Fatal(err)
+	}
+	bc, err := NewBlockchainWithHeaders(db, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+
+	if Difficulty(params.PowLimitBits) != 1 || Difficulty(0x1b00ffff) != 65536 {
+		t.Error("Wrong difficulty")
+	}
+	work, err := bc.GetChainWork(4033)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if work.ChainWork.Cmp(headers[4].totalWork) != 0 || work.Hash != headers[4].Header.BlockHash() || work.Difficulty != 65536 {
+		t.Errorf("Wrong chain work %+v", work)
+	}
+	if _, err := bc.GetChainWork(5000); err == nil {
+		t.Error("Returned chain work above the best header")
+	}
+
+	epochs, err := bc.GetDifficultyHistory(0, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(epochs) != 2 {
+		t.Fatalf("Expected 2 epochs, got %d", len(epochs))
+	}
+	if e := epochs[0]; e.Height != 2016 || e.FirstHeight != 4028 || e.Headers != 4 || e.Difficulty != 256 || e.MinDifficultyHeaders != 0 {
+		t.Errorf("Wrong first epoch %+v", e)
+	}
+	if e := epochs[1]; e.Height != 4032 || e.FirstHeight != 4032 || e.Headers != 5 || e.Bits != 0x1b00ffff || e.MinDifficultyHeaders != 3 {
+		t.Errorf("Wrong second epoch %+v", e)
+	}
+
+	stats, err := bc.GetBlockStats(4036, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.From != 4028 || stats.To != 4036 || stats.Mean != 45*time.Minute || stats.Median != 40*time.Minute ||
+		stats.P90 != 80*time.Minute || stats.Min != 10*time.Minute || stats.Max != 80*time.Minute {
+		t.Errorf("Wrong intervals %+v", stats)
+	}
+	hashes, _ := new(big.Float).SetInt(headers[7].totalWork).Float64()
+	if math.Abs(stats.Hashrate-hashes/(360*60)) > 1e-6*stats.Hashrate {
+		t.Errorf("Wrong hashrate %f", stats.Hashrate)
+	}
+	if _, err := bc.GetBlockStats(4036, 9); err == nil {
+		t.Error("Returned stats for a window reaching below the stored headers")
+	}
+}
@@ -0,0 +1,149 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+/*----- bootstrap file ------- */
+/* byteLength   desc          at offset
+    4	       magic "SPVH"        0
+    1	       version             4
+    4	       network magic       5
+    4	       start height        9
+   32	       start hash         13
+    4	       header count       45
+   80*n	       headers            49
+*/
+// Every number is big endian. The start height and hash are those of the first header.
+
+const bootstrapVersion = 1
+
+var bootstrapMagic = []byte("SPVH")
+
+// bootstrapPreamble is the metadata in front of the headers of a bootstrap file
+type bootstrapPreamble struct {
+	Version     uint8
+	Net         wire.BitcoinNet
+	StartHeight uint32
+	StartHash   chainhash.Hash
+	Count       uint32
+}
+
+// Export writes the best chain headers from height from to height to, both included,
+// to w in the bootstrap format.
+func (b *Blockchain) Export(w io.Writer, from, to uint32) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	best, err := b.db.GetBestHeader()
+	if err != nil {
+		return err
+	}
+	if from > to || to > best.Height {
+		return fmt.Errorf("can't export headers %d to %d, best height is %d", from, to, best.Height)
+	}
+	start, err := b.db.GetHeaderByHeight(from)
+	if err != nil {
+		return fmt.Errorf("failed to get header at %d: %v", from, err)
+	}
+
+	if _, err = w.Write(bootstrapMagic); err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.BigEndian, bootstrapPreamble{
+		Version:     bootstrapVersion,
+		Net:         b.params.Net,
+		StartHeight: from,
+		StartHash:   start.Header.BlockHash(),
+		Count:       to - from + 1,
+	})
+	if err != nil {
+		return err
+	}
+	for height := from; height <= to; height++ {
+		sh, err := b.db.GetHeaderByHeight(height)
+		if err != nil {
+			return fmt.Errorf("failed to get header at %d: %v", height, err)
+		}
+		if err = sh.Header.Serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import reads a bootstrap file written by Export and commits its headers, which are
+// checked like any headers we get from a peer. The parent of the first header must
+// already be stored. It returns the number of headers which weren't stored before.
+func (b *Blockchain) Import(r io.Reader) (int, error) {
+	magic := make([]byte, len(bootstrapMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return 0, fmt.Errorf("failed to read bootstrap header: %v", err)
+	}
+	if !bytes.Equal(magic, bootstrapMagic) {
+		return 0, errors.New("not a bootstrap file")
+	}
+	var pre bootstrapPreamble
+	if err := binary.Read(r, binary.BigEndian, &pre); err != nil {
+		return 0, fmt.Errorf("failed to read bootstrap header: %v", err)
+	}
+	if pre.Version != bootstrapVersion {
+		return 0, fmt.Errorf("unsupported bootstrap version %d", pre.Version)
+	}
+	if pre.Net != b.params.Net {
+		return 0, fmt.Errorf("bootstrap file is for network %s, not %s", pre.Net, b.params.Net)
+	}
+
+	imported := 0
+	height := pre.StartHeight
+	var last chainhash.Hash
+	for read := uint32(0); read < pre.Count; {
+		n := pre.Count - read
+		if n > MAX_HEADERS {
+			n = MAX_HEADERS
+		}
+		headers := make([]wire.BlockHeader, n)
+		for i := range headers {
+			if err := headers[i].Deserialize(r); err != nil {
+				return imported, fmt.Errorf("failed to read header at %d: %v", height+uint32(i), err)
+			}
+		}
+		if read == 0 {
+			if headers[0].BlockHash() != pre.StartHash {
+				return 0, fmt.Errorf("first header is %s, expected %s", headers[0].BlockHash().String(), pre.StartHash.String())
+			}
+			parent, err := b.GetHeader(&headers[0].PrevBlock)
+			if err != nil {
+				return 0, fmt.Errorf("parent of the first header %s is not stored", headers[0].PrevBlock.String())
+			}
+			if parent.Height+1 != pre.StartHeight {
+				return 0, fmt.Errorf("first header connects at height %d, expected %d", parent.Height+1, pre.StartHeight)
+			}
+		} else if headers[0].PrevBlock != last {
+			return imported, fmt.Errorf("header at %d doesn't connect to the one before it", height)
+		}
+
+		results, _, err := b.CommitHeaders(headers)
+		if err != nil {
+			return imported, fmt.Errorf("failed to commit headers at %d: %v", height, err)
+		}
+		for _, res := range results {
+			if res.Err != nil {
+				return imported, fmt.Errorf("invalid header %d %s: %v", res.Height, res.Hash.String(), res.Err)
+			}
+			if !res.Known {
+				imported++
+			}
+		}
+		last = headers[n-1].BlockHash()
+		read += n
+		height += n
+	}
+	return imported, nil
+}
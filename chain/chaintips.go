@@ -0,0 +1,108 @@
+package chain
+
+import (
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+const (
+	// The tip of the best chain
+	ChainTipActive = "active"
+	// A side chain which forks off the best chain somewhere we still store
+	ChainTipValidFork = "valid-fork"
+	// A side chain whose fork point has been pruned or was never downloaded
+	ChainTipDetached = "detached"
+)
+
+type ChainTip struct {
+	Height uint32
+	Hash   chainhash.Hash
+	// Number of headers between the tip and the fork point, zero for the active tip
+	BranchLen uint32
+	// The last header the branch shares with the best chain
+	ForkHeight uint32
+	ForkHash   chainhash.Hash
+	TotalWork  *big.Int
+	// Zero if the header was stored before first seen times were recorded
+	FirstSeen time.Time
+	Status    string
+}
+
+// GetChainTips lists every known chain tip, the active one first and the rest
+// ordered by total work.
+func (b *Blockchain) GetChainTips() ([]ChainTip, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	best, err := b.db.GetBestHeader()
+	if err != nil {
+		return nil, err
+	}
+	bestHash := best.Header.BlockHash()
+	tips, err := b.db.GetTips()
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []ChainTip
+	for _, sh := range tips {
+		tip := ChainTip{
+			Height:    sh.Height,
+			Hash:      sh.Header.BlockHash(),
+			TotalWork: sh.totalWork,
+		}
+		tip.FirstSeen, _ = b.db.GetFirstSeen(tip.Hash)
+		if tip.Hash.IsEqual(&bestHash) {
+			tip.Status = ChainTipActive
+			tip.ForkHeight = sh.Height
+			tip.ForkHash = tip.Hash
+		} else {
+			fork, err := b.findForkPoint(sh)
+			if err != nil {
+				tip.Status = ChainTipDetached
+			} else {
+				tip.Status = ChainTipValidFork
+				tip.ForkHeight = fork.Height
+				tip.ForkHash = fork.Header.BlockHash()
+				tip.BranchLen = sh.Height - fork.Height
+			}
+		}
+		ret = append(ret, tip)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Status == ChainTipActive || ret[j].Status == ChainTipActive {
+			return ret[i].Status == ChainTipActive
+		}
+		return ret[i].TotalWork.Cmp(ret[j].TotalWork) > 0
+	})
+	return ret, nil
+}
+
+// ForkPoint returns the last header the branch of hash shares with the best chain, the
+// header itself if it's on the best chain.
+func (b *Blockchain) ForkPoint(hash chainhash.Hash) (StoredHeader, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	sh, err := b.db.GetHeader(hash)
+	if err != nil {
+		return sh, err
+	}
+	return b.findForkPoint(sh)
+}
+
+// findForkPoint walks back from sh until it reaches a header on the best chain.
+func (b *Blockchain) findForkPoint(sh StoredHeader) (StoredHeader, error) {
+	var err error
+	for {
+		if b.onBestChain(sh) {
+			return sh, nil
+		}
+		sh, err = b.db.GetPreviousHeader(sh.Header)
+		if err != nil {
+			return sh, err
+		}
+	}
+}
@@ -1,9 +1,13 @@
 package chain
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
+	"io/ioutil"
+	"sort"
 	"time"
 )
 
@@ -123,24 +127,86 @@ func init() {
 	regtestCheckpoint = Checkpoint{0, chaincfg.RegressionNetParams.GenesisBlock.Header}
 }
 
+// GetCheckpoint returns the checkpoint headers are synced from, the latest one before
+// the wallet was created. Networks without checkpoints start at genesis.
 func GetCheckpoint(walletCreationDate time.Time, params *chaincfg.Params) Checkpoint {
+	cps := builtinCheckpoints(params)
+	for i := len(cps) - 1; i >= 0; i-- {
+		if walletCreationDate.After(cps[i].Header.Timestamp) {
+			return cps[i]
+		}
+	}
+	return cps[0]
+}
+
+// builtinCheckpoints returns every checkpoint compiled in for the network, or loaded with
+// its params, sorted by height
+func builtinCheckpoints(params *chaincfg.Params) []Checkpoint {
 	switch params.Name {
 	case chaincfg.MainNetParams.Name:
-		for i := len(mainnetCheckpoints) - 1; i >= 0; i-- {
-			if walletCreationDate.After(mainnetCheckpoints[i].Header.Timestamp) {
-				return mainnetCheckpoints[i]
-			}
-		}
-		return mainnetCheckpoints[0]
+		return append([]Checkpoint{}, mainnetCheckpoints...)
 	case chaincfg.TestNet3Params.Name:
-		for i := len(testnet3Checkpoints) - 1; i >= 0; i-- {
-			if walletCreationDate.After(testnet3Checkpoints[i].Header.Timestamp) {
-				return testnet3Checkpoints[i]
-			}
+		return append([]Checkpoint{}, testnet3Checkpoints...)
+	case chaincfg.RegressionNetParams.Name:
+		return []Checkpoint{regtestCheckpoint}
+	}
+	customLock.RLock()
+	cps := append([]Checkpoint{}, customCheckpoints[params.Name]...)
+	customLock.RUnlock()
+	if len(cps) == 0 {
+		return []Checkpoint{{0, params.GenesisBlock.Header}}
+	}
+	sort.Slice(cps, func(i, j int) bool {
+		return cps[i].Height < cps[j].Height
+	})
+	return cps
+}
+
+type checkpointJSON struct {
+	Height uint32 `json:"height"`
+	Hash   string `json:"hash"`
+	Header string `json:"header"`
+}
+
+// LoadCheckpoints reads extra checkpoints for the network from a JSON file mapping network
+// names to lists of checkpoints, e.g.
+//
+//	{"mainnet": [{"height": 600000, "hash": "<block hash>", "header": "<80 byte header in hex>"}]}
+//
+// The header of every checkpoint must hash to its hash.
+func LoadCheckpoints(file string, params *chaincfg.Params) ([]Checkpoint, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint file %s: %v", file, err)
+	}
+	var all map[string][]checkpointJSON
+	err = json.Unmarshal(data, &all)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint file %s: %v", file, err)
+	}
+	var cps []Checkpoint
+	for _, c := range all[params.Name] {
+		cp, err := c.checkpoint()
+		if err != nil {
+			return nil, err
 		}
-		return testnet3Checkpoints[0]
+		cps = append(cps, cp)
+	}
+	return cps, nil
+}
 
-	default:
-		return regtestCheckpoint
+// checkpoint decodes the header and checks it hashes to the checkpoint's hash
+func (c checkpointJSON) checkpoint() (Checkpoint, error) {
+	hdr, err := decodeHeader(c.Header)
+	if err != nil {
+		return Checkpoint{}, fmt.Errorf("failed to decode header of checkpoint %d: %v", c.Height, err)
+	}
+	hash := hdr.BlockHash()
+	if hash.String() != c.Hash {
+		return Checkpoint{}, fmt.Errorf("header of checkpoint %d hashes to %s, not %s", c.Height, hash.String(), c.Hash)
 	}
+	return Checkpoint{
+		Height: c.Height,
+		Header: hdr,
+	}, nil
 }
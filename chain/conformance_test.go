@@ -0,0 +1,31 @@
+package chain_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ontio/spvclient/chain"
+	"github.com/ontio/spvclient/chain/headerstest"
+)
+
+func TestHeaderDB_Conformance(t *testing.T) {
+	headerstest.Run(t, func() (chain.Headers, func()) {
+		dir, err := ioutil.TempDir("", "headers")
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := chain.NewHeaderDB(path.Join(dir, "headers.bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h, func() { os.RemoveAll(dir) }
+	})
+}
+
+func TestMemHeaders_Conformance(t *testing.T) {
+	headerstest.Run(t, func() (chain.Headers, func()) {
+		return chain.NewMemHeaders(), func() {}
+	})
+}
@@ -0,0 +1,166 @@
+package chain
+
+import (
+	"bytes"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ontio/spvclient/log"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ConsensusRules are the parts of header validation which differ between bitcoin and
+// the chains forked from it.
+type ConsensusRules interface {
+	// PoWHash is the hash which has to be below the target
+	PoWHash(header wire.BlockHeader) chainhash.Hash
+	// RetargetInterval is the number of blocks between difficulty adjustments
+	RetargetInterval() int32
+	// TargetSpacing is the time a block should take
+	TargetSpacing() time.Duration
+	// RetargetLookback is how many blocks before the parent of the header at height the
+	// window measured for its difficulty adjustment starts
+	RetargetLookback(height int32) int32
+	// CalcRetarget returns the difficulty after a window which took timespan and ended
+	// at difficulty bits
+	CalcRetarget(bits uint32, timespan time.Duration, powLimit *big.Int) uint32
+	// MinDifficultyAllowed tells whether header may be mined at the pow limit on a network
+	// with ReduceMinDifficulty
+	MinDifficultyAllowed(header, prev wire.BlockHeader) bool
+}
+
+const maxDiffAdjust = 4
+
+// BitcoinRules are the rules of bitcoin and its test networks
+type BitcoinRules struct{}
+
+func (BitcoinRules) PoWHash(header wire.BlockHeader) chainhash.Hash {
+	return header.BlockHash()
+}
+
+func (BitcoinRules) RetargetInterval() int32 {
+	return 2016
+}
+
+func (BitcoinRules) TargetSpacing() time.Duration {
+	return 10 * time.Minute
+}
+
+// RetargetLookback is one short of the interval, so the window misses the time between
+// the last block of the previous window and the first of this one.
+func (r BitcoinRules) RetargetLookback(height int32) int32 {
+	return r.RetargetInterval() - 1
+}
+
+func (r BitcoinRules) CalcRetarget(bits uint32, timespan time.Duration, powLimit *big.Int) uint32 {
+	return retarget(bits, timespan, time.Duration(r.RetargetInterval())*r.TargetSpacing(), powLimit, false)
+}
+
+// MinDifficultyAllowed allows the pow limit when the last block is over twice the spacing old
+func (r BitcoinRules) MinDifficultyAllowed(header, prev wire.BlockHeader) bool {
+	return header.Timestamp.After(prev.Timestamp.Add(2 * r.TargetSpacing()))
+}
+
+// LitecoinRules are the rules of litecoin, scrypt proof of work and a block every
+// two and a half minutes.
+type LitecoinRules struct{}
+
+// PoWHash is the scrypt hash of the header with N=1024, r=1 and p=1
+func (LitecoinRules) PoWHash(header wire.BlockHeader) chainhash.Hash {
+	var buf bytes.Buffer
+	buf.Grow(wire.MaxBlockHeaderPayload)
+	header.Serialize(&buf)
+	var hash chainhash.Hash
+	// Only fails on bad parameters
+	key, _ := scrypt.Key(buf.Bytes(), buf.Bytes(), 1024, 1, 1, chainhash.HashSize)
+	copy(hash[:], key)
+	return hash
+}
+
+func (LitecoinRules) RetargetInterval() int32 {
+	return 2016
+}
+
+func (LitecoinRules) TargetSpacing() time.Duration {
+	return 150 * time.Second
+}
+
+// RetargetLookback is the whole interval, which closes the gap bitcoin leaves between
+// windows. The first retarget only has the blocks after genesis to go by.
+func (r LitecoinRules) RetargetLookback(height int32) int32 {
+	if height == r.RetargetInterval() {
+		return r.RetargetInterval() - 1
+	}
+	return r.RetargetInterval()
+}
+
+func (r LitecoinRules) CalcRetarget(bits uint32, timespan time.Duration, powLimit *big.Int) uint32 {
+	return retarget(bits, timespan, time.Duration(r.RetargetInterval())*r.TargetSpacing(), powLimit, true)
+}
+
+func (r LitecoinRules) MinDifficultyAllowed(header, prev wire.BlockHeader) bool {
+	return header.Timestamp.After(prev.Timestamp.Add(2 * r.TargetSpacing()))
+}
+
+// retarget scales the target by how long the window took compared to targetTimespan,
+// by at most maxDiffAdjust either way. Litecoin drops the lowest bit of a target close to
+// the pow limit first, as its 256 bit arithmetic would overflow, and so must we to agree
+// with it.
+func retarget(bits uint32, timespan, targetTimespan time.Duration, powLimit *big.Int, shiftNearLimit bool) uint32 {
+	if timespan < targetTimespan/maxDiffAdjust {
+		log.Debugf("Whoa there, off-scale high 4X diff adjustment!")
+		timespan = targetTimespan / maxDiffAdjust
+	} else if timespan > targetTimespan*maxDiffAdjust {
+		log.Debugf("Uh-oh! off-scale low 0.25X diff adjustment!")
+		timespan = targetTimespan * maxDiffAdjust
+	}
+
+	newTarget := blockchain.CompactToBig(bits)
+	shift := shiftNearLimit && newTarget.BitLen() > powLimit.BitLen()-1
+	if shift {
+		newTarget.Rsh(newTarget, 1)
+	}
+	newTarget.Mul(newTarget, big.NewInt(int64(timespan/time.Second)))
+	newTarget.Div(newTarget, big.NewInt(int64(targetTimespan/time.Second)))
+	if shift {
+		newTarget.Lsh(newTarget, 1)
+	}
+
+	// clip again if above minimum target (too easy)
+	if newTarget.Cmp(powLimit) > 0 {
+		newTarget.Set(powLimit)
+	}
+	return blockchain.BigToCompact(newTarget)
+}
+
+var (
+	rulesLock sync.RWMutex
+	// Networks which don't follow the bitcoin rules, by name
+	netRules = map[string]ConsensusRules{
+		LitecoinParams.Name:        LitecoinRules{},
+		LitecoinRegTestParams.Name: LitecoinRules{},
+	}
+)
+
+// RegisterRules makes headers of the named network follow rules.
+func RegisterRules(net string, rules ConsensusRules) {
+	rulesLock.Lock()
+	netRules[net] = rules
+	rulesLock.Unlock()
+}
+
+// RulesFor returns the consensus rules of the network, the bitcoin ones unless others
+// were registered.
+func RulesFor(params *chaincfg.Params) ConsensusRules {
+	rulesLock.RLock()
+	defer rulesLock.RUnlock()
+	if rules, ok := netRules[params.Name]; ok {
+		return rules
+	}
+	return BitcoinRules{}
+}
@@ -0,0 +1,282 @@
+package chain
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// The first mainnet blocks after genesis
+var bitcoinHeaders = []struct {
+	hash, merkle string
+	time         int64
+	nonce        uint32
+}{
+	{"00000000839a8e6886ab5951d76f411475428afc90947ee320161bbf18eb6048",
+		"0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098", 1231469665, 2573394689},
+	{"000000006a625f06636b8bb6ac7b960a8d03705d1ace08b1a19da3fdcc99ddbd",
+		"9b0fc92260312ce44e74ef369f5c66bbb85848f2eddd5a7a1cde251e54ccfdd5", 1231469744, 1639830024},
+}
+
+// Two consecutive litecoin mainnet headers from July 2013, with their scrypt hashes
+var litecoinHeaders = []struct {
+	header, pow string
+}{
+	{"02000000a72c8a177f523946f42f22c3e86b8023221b4105e8007e59e81f6beb013e29aaf635295cb9ac966213fb56e046dc71df5b3f7f67ceaeab24038e743f883aff1aaafaf551eac7471b0166249b",
+		"00000000000b40f895f288e13244728a6c2d9d59d8aff29c65f8dd5114a8ca81"},
+	{"0200000011503ee6a855e900c00cfdd98f5f55fffeaee9b6bf55bea9b852d9de2ce35828e204eef76acfd36949ae56d1fbe81c1ac9c0209e6331ad56414f9072506a77f8c6faf551eac7471b00389d01",
+		"00000000003a0d11bdd5eb634e08b7feddcfbbf228ed35d250daf19f1c88fc94"},
+}
+
+// A mainnet retarget, the bits of the last block of a window, the time of its first and
+// last block and the bits of the next window
+type retargetVector struct {
+	bits        uint32
+	first, last int64
+	want        uint32
+}
+
+var bitcoinRetargets = []retargetVector{
+	// Blocks 30240 to 32255
+	{0x1d00ffff, 1261130161, 1262152739, 0x1d00d86a},
+	// Blocks 0 to 2015, capped at the pow limit
+	{0x1d00ffff, 1231006505, 1233061996, 0x1d00ffff},
+	// Blocks 66528 to 68543, at most 4 times harder
+	{0x1c05a3f4, 1279008237, 1279297671, 0x1c0168fd},
+	// Block 46367 with the first 2 weeks earlier than it was, at most 4 times easier
+	{0x1c387f6f, 1263163443, 1269211443, 0x1d00e1fd},
+}
+
+var litecoinRetargets = []retargetVector{
+	// Blocks 278207 to 280223
+	{0x1c0ac141, 1358118740, 1358378777, 0x1c093f8d},
+	// Blocks 0 to 2015, capped at the pow limit
+	{0x1e0ffff0, 1317972665, 1318480354, 0x1e0fffff},
+	// Blocks 578591 to 580607, at most 4 times harder
+	{0x1b075cf1, 1401682934, 1401757934, 0x1b01d73c},
+	// Block 1001951 with the first 2 weeks earlier than it was, at most 4 times easier
+	{0x1b015318, 1463690315, 1464900315, 0x1b054c60},
+}
+
+func checkRetargets(t *testing.T, rules ConsensusRules, params *chaincfg.Params, vectors []retargetVector) {
+	for _, v := range vectors {
+		first := wire.BlockHeader{Timestamp: time.Unix(v.first, 0)}
+		last := wire.BlockHeader{Timestamp: time.Unix(v.last, 0), Bits: v.bits}
+		if bits := calcDiffAdjust(rules, first, last, params); bits != v.want {
+			t.Errorf("Retarget from %x over %d seconds gave %x, expected %x", v.bits, v.last-v.first, bits, v.want)
+		}
+	}
+}
+
+func TestBitcoinRules(t *testing.T) {
+	rules := RulesFor(&chaincfg.MainNetParams)
+	if _, ok := rules.(BitcoinRules); !ok {
+		t.Fatalf("Mainnet has rules %T", rules)
+	}
+	prev := chaincfg.MainNetParams.GenesisBlock.Header
+	for _, h := range bitcoinHeaders {
+		hdr := wire.BlockHeader{
+			Version:    1,
+			PrevBlock:  prev.BlockHash(),
+			MerkleRoot: mustHash(h.merkle),
+			Timestamp:  time.Unix(h.time, 0),
+			Bits:       0x1d00ffff,
+			Nonce:      h.nonce,
+		}
+		if hash := rules.PoWHash(hdr); hash.String() != h.hash {
+			t.Errorf("Expected hash %s, got %s", h.hash, hash)
+		}
+		if !checkProofOfWork(hdr, &chaincfg.MainNetParams, rules) {
+			t.Errorf("Header %s failed proof of work", h.hash)
+		}
+		prev = hdr
+		hdr.Nonce++
+		if checkProofOfWork(hdr, &chaincfg.MainNetParams, rules) {
+			t.Errorf("Header %s passed proof of work with a wrong nonce", h.hash)
+		}
+	}
+
+	if rules.RetargetLookback(2016) != 2015 || rules.RetargetLookback(4032) != 2015 {
+		t.Error("Wrong retarget lookback")
+	}
+	genesis := chaincfg.MainNetParams.GenesisBlock.Header
+	next := genesis
+	next.Timestamp = genesis.Timestamp.Add(20 * time.Minute)
+	if rules.MinDifficultyAllowed(next, genesis) {
+		t.Error("Allowed min difficulty after exactly twice the spacing")
+	}
+	next.Timestamp = next.Timestamp.Add(time.Second)
+	if !rules.MinDifficultyAllowed(next, genesis) {
+		t.Error("Min difficulty not allowed after twice the spacing")
+	}
+	checkRetargets(t, rules, &chaincfg.MainNetParams, bitcoinRetargets)
+}
+
+func TestLitecoinRules(t *testing.T) {
+	for _, net := range []string{"litecoin", "litecoin-regtest"} {
+		params, err := NetParams(net)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules := RulesFor(params)
+		if _, ok := rules.(LitecoinRules); !ok {
+			t.Fatalf("%s has rules %T", net, rules)
+		}
+		if !checkProofOfWork(params.GenesisBlock.Header, params, rules) {
+			t.Errorf("%s genesis failed scrypt proof of work", net)
+		}
+	}
+	if LitecoinParams.GenesisHash.String() != "12a765e31ffd4059bada1e25190f6e98c99d9714d334efa41a195a7e7e04bfe2" {
+		t.Errorf("Wrong litecoin genesis %s", LitecoinParams.GenesisHash)
+	}
+	if LitecoinRegTestParams.GenesisHash.String() != "530827f38f93b43ed12af0b3ad25a288dc02ed74d6d7857862df51fc56c416f9" {
+		t.Errorf("Wrong litecoin regtest genesis %s", LitecoinRegTestParams.GenesisHash)
+	}
+	rules := LitecoinRules{}
+	genesis := LitecoinParams.GenesisBlock.Header
+	pow := rules.PoWHash(genesis)
+	if pow == genesis.BlockHash() {
+		t.Error("Litecoin pow hash is the block hash")
+	}
+	// The genesis nonce only satisfies scrypt
+	genesis.Nonce++
+	if checkProofOfWork(genesis, &LitecoinParams, rules) {
+		t.Error("Passed proof of work with a wrong nonce")
+	}
+
+	if rules.RetargetLookback(2016) != 2015 || rules.RetargetLookback(4032) != 2016 {
+		t.Error("Wrong retarget lookback")
+	}
+
+	limit := LitecoinParams.PowLimit
+	timespan := 2016 * 150 * time.Second
+	if bits := rules.CalcRetarget(0x1e0ffff0, timespan, limit); bits != 0x1e0ffff0 {
+		t.Errorf("Expected unchanged difficulty, got %x", bits)
+	}
+	if bits := rules.CalcRetarget(0x1e0ffff0, 2*timespan, limit); bits != LitecoinParams.PowLimitBits {
+		t.Errorf("Expected the pow limit, got %x", bits)
+	}
+	want := blockchain.BigToCompact(new(big.Int).Rsh(blockchain.CompactToBig(0x1d0fffff), 2))
+	if bits := rules.CalcRetarget(0x1d0fffff, timespan/10, limit); bits != want {
+		t.Errorf("Expected a 4x adjustment to %x, got %x", want, bits)
+	}
+	checkRetargets(t, rules, &LitecoinParams, litecoinRetargets)
+
+	var prev chainhash.Hash
+	for _, h := range litecoinHeaders {
+		hdr := mustDecodeHeader(t, h.header)
+		if pow := rules.PoWHash(hdr); pow.String() != h.pow {
+			t.Errorf("Expected scrypt hash %s, got %s", h.pow, pow)
+		}
+		if !checkProofOfWork(hdr, &LitecoinParams, rules) {
+			t.Errorf("Header %s failed proof of work", hdr.BlockHash())
+		}
+		if checkProofOfWork(hdr, &LitecoinParams, BitcoinRules{}) {
+			t.Errorf("Header %s passed proof of work with sha256d", hdr.BlockHash())
+		}
+		if prev != (chainhash.Hash{}) && hdr.PrevBlock != prev {
+			t.Errorf("Header %s doesn't follow %s", hdr.BlockHash(), prev)
+		}
+		prev = hdr.BlockHash()
+	}
+}
+
+func mustDecodeHeader(t *testing.T, s string) wire.BlockHeader {
+	hdr, err := decodeHeader(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hdr
+}
+
+func TestBlockchain_Litecoin(t *testing.T) {
+	bc, err := NewBlockchainWithHeaders(NewMemHeaders(), &LitecoinRegTestParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	if _, ok := bc.Rules().(LitecoinRules); !ok {
+		t.Fatalf("Blockchain has rules %T", bc.Rules())
+	}
+	best, err := bc.BestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var headers []wire.BlockHeader
+	prev := best.Header
+	for i := 0; i < 5; i++ {
+		hdr := wire.BlockHeader{
+			Version:   4,
+			PrevBlock: prev.BlockHash(),
+			Timestamp: prev.Timestamp.Add(150 * time.Second),
+			Bits:      prev.Bits,
+		}
+		for !checkProofOfWork(hdr, bc.params, bc.rules) {
+			hdr.Nonce++
+		}
+		headers = append(headers, hdr)
+		prev = hdr
+	}
+	if _, _, err := bc.CommitHeaders(headers); err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := bc.db.Height(); h != 5 {
+		t.Errorf("Expected height 5, got %d", h)
+	}
+
+	// Meets the target with sha256d but not with scrypt
+	hdr := wire.BlockHeader{
+		Version:   4,
+		PrevBlock: prev.BlockHash(),
+		Timestamp: prev.Timestamp.Add(150 * time.Second),
+		Bits:      prev.Bits,
+	}
+	for checkProofOfWork(hdr, bc.params, bc.rules) || !checkProofOfWork(hdr, bc.params, BitcoinRules{}) {
+		hdr.Nonce++
+	}
+	tip, err := bc.BestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isRuleError(bc.CheckHeader(hdr, tip), ErrBadProofOfWork) {
+		t.Error("Accepted a header without scrypt proof of work")
+	}
+
+	// Recorded mainnet headers, stored from the first on. The height is made up, any
+	// inside a difficulty period will do.
+	db := NewMemHeaders()
+	first := mustDecodeHeader(t, litecoinHeaders[0].header)
+	if err := db.Put(StoredHeader{Header: first, Height: 420001, totalWork: big.NewInt(0)}, true); err != nil {
+		t.Fatal(err)
+	}
+	mainnet, err := NewBlockchainWithHeaders(db, &LitecoinParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mainnet.Close()
+	second := mustDecodeHeader(t, litecoinHeaders[1].header)
+	stored, err := mainnet.BestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mainnet.CheckHeader(second, stored); err != nil {
+		t.Errorf("Recorded header rejected: %v", err)
+	}
+	bad := second
+	bad.Nonce++
+	if !isRuleError(mainnet.CheckHeader(bad, stored), ErrBadProofOfWork) {
+		t.Error("Accepted a recorded header with a wrong nonce")
+	}
+	if _, _, err := mainnet.CommitHeaders([]wire.BlockHeader{second}); err != nil {
+		t.Fatal(err)
+	}
+	if best, err := mainnet.BestBlock(); err != nil || best.Header.BlockHash() != second.BlockHash() {
+		t.Errorf("Recorded header not the tip: %v", err)
+	}
+}
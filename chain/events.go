@@ -0,0 +1,133 @@
+package chain
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// ChainEvent is delivered to subscribers when the best chain changes.
+// It is either a NewTipEvent or a ReorgEvent.
+type ChainEvent interface{}
+
+// NewTipEvent is sent every time the best header changes.
+type NewTipEvent struct {
+	Height uint32
+	Hash   chainhash.Hash
+}
+
+// ReorgEvent is sent when the new best header does not extend the old one.
+// It is followed by a NewTipEvent for the new best header.
+type ReorgEvent struct {
+	CommonAncestor StoredHeader
+	// Headers that left the best chain, from the old tip down to the ancestor
+	Disconnected []StoredHeader
+	// Headers that joined the best chain, from the ancestor up to the new tip.
+	// Empty after a rollback.
+	Connected []StoredHeader
+}
+
+// OverflowPolicy decides what happens when a subscriber's buffer is full.
+// Delivery never blocks the chain.
+type OverflowPolicy int
+
+const (
+	// Drop the event which doesn't fit
+	DropNewest OverflowPolicy = iota
+	// Make room by dropping the oldest queued event
+	DropOldest
+	// Close the subscription, the consumer has to subscribe again and catch up
+	CloseOnOverflow
+)
+
+type Subscription struct {
+	// Events are received from C. It is closed by Unsubscribe or on overflow
+	// with CloseOnOverflow.
+	C <-chan ChainEvent
+
+	ch       chan ChainEvent
+	policy   OverflowPolicy
+	dropped  uint64
+	notifier *notifier
+}
+
+// Dropped returns the number of events lost to overflow.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *Subscription) Unsubscribe() {
+	s.notifier.remove(s)
+}
+
+type notifier struct {
+	lock sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+func newNotifier() *notifier {
+	return &notifier{subs: make(map[*Subscription]struct{})}
+}
+
+func (n *notifier) subscribe(bufferSize int, policy OverflowPolicy) *Subscription {
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+	ch := make(chan ChainEvent, bufferSize)
+	s := &Subscription{
+		C:        ch,
+		ch:       ch,
+		policy:   policy,
+		notifier: n,
+	}
+	n.lock.Lock()
+	n.subs[s] = struct{}{}
+	n.lock.Unlock()
+	return s
+}
+
+func (n *notifier) remove(s *Subscription) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if _, ok := n.subs[s]; ok {
+		delete(n.subs, s)
+		close(s.ch)
+	}
+}
+
+func (n *notifier) send(e ChainEvent) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for s := range n.subs {
+		select {
+		case s.ch <- e:
+			continue
+		default:
+		}
+		atomic.AddUint64(&s.dropped, 1)
+		switch s.policy {
+		case DropOldest:
+			select {
+			case <-s.ch:
+			default:
+			}
+			select {
+			case s.ch <- e:
+			default:
+			}
+		case CloseOnOverflow:
+			delete(n.subs, s)
+			close(s.ch)
+		}
+	}
+}
+
+func (n *notifier) close() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for s := range n.subs {
+		delete(n.subs, s)
+		close(s.ch)
+	}
+}
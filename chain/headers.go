@@ -5,14 +5,19 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"github.com/ontio/spvclient/backup"
 	"github.com/ontio/spvclient/log"
+	"github.com/ontio/spvclient/migration"
 	"io"
+	"math"
 	"math/big"
 	"path"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/cevaris/ordered_map"
@@ -22,8 +27,28 @@ import (
 const (
 	MAX_HEADERS = 2000
 	CACHE_SIZE  = 100
+
+	// Number of queued writes the writer will fold into one bolt transaction
+	maxWriteBatch = 500
 )
 
+var ErrHeaderDBClosed = errors.New("header db is closed")
+
+// PrunePolicy decides which headers Prune keeps.
+type PrunePolicy struct {
+	// Number of best chain headers to keep below the tip, zero keeps the whole best chain.
+	// Blockchain.Prune keeps at least one retarget window so difficulty can still be
+	// checked. Side branches forking off below the cut go with it.
+	MainChainDepth uint32
+	// Side branches whose tip is this many blocks behind the best header are deleted,
+	// zero keeps every branch
+	StaleBranchDepth uint32
+}
+
+var DefaultPrunePolicy = PrunePolicy{
+	StaleBranchDepth: MAX_HEADERS,
+}
+
 // Database interface for storing block headers
 type Headers interface {
 	// Put a block header to the database
@@ -31,11 +56,17 @@ type Headers interface {
 	// If this is the new best header, the chain tip should also be updated
 	Put(header StoredHeader, newBestHeader bool) error
 
-	// Delete all headers after the MAX_HEADERS most recent
-	Prune() error
+	// Put a contiguous run of headers, ordered from parent to child, atomically
+	// If newBestHeader is set the last header becomes the chain tip
+	PutHeaders(headers []StoredHeader, newBestHeader bool) error
 
-	// Delete all headers after the given height
-	DeleteAfter(height uint32) error
+	// Delete the main chain and side branch headers the policy no longer retains
+	Prune(policy PrunePolicy) error
+
+	// Delete all headers after the given height. With keepForks only the best chain
+	// is deleted and side branches are left alone. The best chain header at height
+	// becomes the chain tip.
+	DeleteAfter(height uint32, keepForks bool) error
 
 	// Returns all information about the previous header
 	GetPreviousHeader(header wire.BlockHeader) (StoredHeader, error)
@@ -43,9 +74,12 @@ type Headers interface {
 	// Grab a header given hash
 	GetHeader(hash chainhash.Hash) (StoredHeader, error)
 
-	// add by zou
+	// Grab the header at the given height on the best chain
 	GetHeaderByHeight(height uint32) (StoredHeader, error)
 
+	// Grab the headers from height from to height to on the best chain, all read at once
+	GetHeadersByHeight(from, to uint32) ([]StoredHeader, error)
+
 	// Retrieve the best header from the database
 	GetBestHeader() (StoredHeader, error)
 
@@ -57,6 +91,12 @@ type Headers interface {
 
 	// Print all headers
 	Print(io.Writer)
+
+	// Returns every stored header which no other stored header builds on
+	GetTips() ([]StoredHeader, error)
+
+	// Returns when a header was first stored
+	GetFirstSeen(hash chainhash.Hash) (time.Time, error)
 }
 
 type StoredHeader struct {
@@ -65,32 +105,87 @@ type StoredHeader struct {
 	totalWork *big.Int
 }
 
+// NewStoredHeader is for Headers implementations outside this package which need to
+// build the headers they store
+func NewStoredHeader(header wire.BlockHeader, height uint32, totalWork *big.Int) StoredHeader {
+	return StoredHeader{
+		Header:    header,
+		Height:    height,
+		totalWork: totalWork,
+	}
+}
+
 func (sh *StoredHeader) GetTotalWork() *big.Int {
 	return sh.totalWork
 }
 
 // HeaderDB implements Headers using bolt DB
 type HeaderDB struct {
-	lock      *sync.RWMutex
-	db        *bolt.DB
-	filePath  string
-	bestCache *StoredHeader
-	cache     *HeaderCache
+	lock       *sync.RWMutex
+	db         *bolt.DB
+	filePath   string
+	bestCache  *StoredHeader
+	cache      *HeaderCache
+	writes     chan *writeReq
+	writerDone chan struct{}
+	closed     bool
+}
+
+// writeReq is a unit of work for the writer goroutine. Requests are applied
+// in the order they were queued and the result is sent back on done.
+type writeReq struct {
+	apply func(btx *bolt.Tx) error
+	done  chan error
 }
 
 var (
-	BKTHeaders  = []byte("Headers")
-	BKTChainTip = []byte("ChainTip")
-	KEYChainTip = []byte("ChainTip")
-	//HeadersHeight = []byte("HH")
+	BKTHeaders     = []byte("Headers")
+	BKTChainTip    = []byte("ChainTip")
+	KEYChainTip    = []byte("ChainTip")
+	BKTHeightIndex = []byte("HeightIndex")
+	BKTFirstSeen   = []byte("FirstSeen")
 )
 
-func NewHeaderDB(filePath string) (*HeaderDB, error) {
+// headerMigrations upgrade header dbs written by older builds. Version 0 is the
+// original layout of only the headers and chain tip buckets.
+var headerMigrations = []migration.Migration{
+	{
+		Version:     1,
+		Description: "add the best chain height index and first seen times",
+		Apply: func(btx *bolt.Tx) error {
+			_, err := btx.CreateBucketIfNotExists(BKTFirstSeen)
+			if err != nil {
+				return err
+			}
+			_, err = btx.CreateBucketIfNotExists(BKTHeightIndex)
+			if err != nil {
+				return err
+			}
+			tip := btx.Bucket(BKTChainTip)
+			if tip == nil || tip.Get(KEYChainTip) == nil {
+				return nil
+			}
+			best, err := deserializeHeader(tip.Get(KEYChainTip))
+			if err != nil {
+				return err
+			}
+			return updateHeightIndex(btx, best)
+		},
+	},
+}
+
+// headerDBFile returns the db file for a path which is either the file or its directory
+func headerDBFile(filePath string) string {
 	if !strings.Contains(filePath, ".bin") {
 		filePath = path.Join(filePath, "headers.bin")
 	}
+	return filePath
+}
+
+func NewHeaderDB(filePath string) (*HeaderDB, error) {
+	filePath = headerDBFile(filePath)
 	h := new(HeaderDB)
-	db, err := bolt.Open(filePath, 0644, &bolt.Options{InitialMmapSize: 5000000})
+	db, err := bolt.Open(filePath, 0644, &bolt.Options{InitialMmapSize: 5000000, Timeout: time.Second})
 	if err != nil {
 		return nil, err
 	}
@@ -99,162 +194,397 @@ func NewHeaderDB(filePath string) (*HeaderDB, error) {
 	h.filePath = filePath
 	h.cache = &HeaderCache{ordered_map.NewOrderedMap(), sync.RWMutex{}, CACHE_SIZE}
 
-	db.Update(func(btx *bolt.Tx) error {
-		_, err := btx.CreateBucketIfNotExists(BKTHeaders)
+	err = db.Update(func(btx *bolt.Tx) error {
+		err := migration.Upgrade(btx, "header db", headerMigrations)
 		if err != nil {
 			return err
 		}
-		_, err = btx.CreateBucketIfNotExists(BKTChainTip)
-		if err != nil {
-			return err
+		for _, bkt := range [][]byte{BKTHeaders, BKTChainTip, BKTFirstSeen, BKTHeightIndex} {
+			_, err = btx.CreateBucketIfNotExists(bkt)
+			if err != nil {
+				return err
+			}
 		}
-		//_, err = btx.CreateBucketIfNotExists(HeadersHeight)
-		//if err != nil {
-		//	return err
-		//}
 		return nil
 	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	h.writes = make(chan *writeReq, maxWriteBatch)
+	h.writerDone = make(chan struct{})
+	go h.writeHandler()
 
 	h.initializeCache()
 	return h, nil
 }
 
 func (h *HeaderDB) Put(sh StoredHeader, newBestHeader bool) error {
+	return h.PutHeaders([]StoredHeader{sh}, newBestHeader)
+}
+
+func (h *HeaderDB) PutHeaders(headers []StoredHeader, newBestHeader bool) error {
+	if len(headers) == 0 {
+		return nil
+	}
+	err := h.write(func(btx *bolt.Tx) error {
+		for i, sh := range headers {
+			err := putHeader(btx, sh, newBestHeader && i == len(headers)-1)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Only cache what actually made it to disk
 	h.lock.Lock()
-	h.cache.Set(sh)
+	defer h.lock.Unlock()
+	for _, sh := range headers {
+		h.cache.Set(sh)
+	}
 	if newBestHeader {
-		h.bestCache = &sh
+		best := headers[len(headers)-1]
+		h.bestCache = &best
 	}
-	h.lock.Unlock()
-	go func() {
-		err := h.putToDB(sh, newBestHeader)
-		if err != nil {
-			log.Error(err)
-		}
-	}()
 	return nil
 }
 
-func (h *HeaderDB) put(sh StoredHeader, newBestHeader bool) error {
-	h.lock.Lock()
-	h.cache.Set(sh)
-	if newBestHeader {
-		h.bestCache = &sh
+func putHeader(btx *bolt.Tx, sh StoredHeader, newBestHeader bool) error {
+	hdrs := btx.Bucket(BKTHeaders)
+	ser, err := serializeHeader(sh)
+	if err != nil {
+		return err
 	}
-	h.lock.Unlock()
-	err := h.putToDB(sh, newBestHeader)
+	hash := sh.Header.BlockHash()
+	err = hdrs.Put(hash.CloneBytes(), ser)
 	if err != nil {
-		log.Error(err)
+		return err
+	}
+	fs := btx.Bucket(BKTFirstSeen)
+	if fs.Get(hash[:]) == nil {
+		ts := make([]byte, 8)
+		binary.BigEndian.PutUint64(ts, uint64(time.Now().Unix()))
+		err = fs.Put(hash.CloneBytes(), ts)
+		if err != nil {
+			return err
+		}
 	}
-	return nil
-}
 
-func (h *HeaderDB) putToDB(sh StoredHeader, newBestHeader bool) error {
-	h.lock.Lock()
-	defer h.lock.Unlock()
-	return h.db.Update(func(btx *bolt.Tx) error {
-		hdrs := btx.Bucket(BKTHeaders)
-		ser, err := serializeHeader(sh)
+	if newBestHeader {
+		err = updateHeightIndex(btx, sh)
 		if err != nil {
 			return err
 		}
-		hash := sh.Header.BlockHash()
-		err = hdrs.Put(hash.CloneBytes(), ser)
+		tip := btx.Bucket(BKTChainTip)
+		err = tip.Put(KEYChainTip, ser)
 		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		// add by zou
-		//hhdrs := btx.Bucket(HeadersHeight)
-		//heightKey := make([]byte, 4)
-		//binary.BigEndian.PutUint32(heightKey, sh.Height)
-		//err = hhdrs.Put(heightKey, hash.CloneBytes())
-		//if err != nil {
-		//	return err
-		//}
+// write queues apply on the writer and blocks until it has been committed.
+func (h *HeaderDB) write(apply func(btx *bolt.Tx) error) error {
+	req := &writeReq{
+		apply: apply,
+		done:  make(chan error, 1),
+	}
+	h.lock.RLock()
+	if h.closed {
+		h.lock.RUnlock()
+		return ErrHeaderDBClosed
+	}
+	h.writes <- req
+	h.lock.RUnlock()
+	return <-req.done
+}
 
-		if newBestHeader {
-			tip := btx.Bucket(BKTChainTip)
-			err = tip.Put(KEYChainTip, ser)
+// writeHandler is the only goroutine which writes to bolt. Whatever is queued
+// while a transaction is being committed is folded into the next one, so a burst
+// of headers during initial sync costs one fsync rather than one per header.
+func (h *HeaderDB) writeHandler() {
+	defer close(h.writerDone)
+	for req := range h.writes {
+		batch := []*writeReq{req}
+	collect:
+		for len(batch) < maxWriteBatch {
+			select {
+			case next, ok := <-h.writes:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, next)
+			default:
+				break collect
+			}
+		}
+		h.applyBatch(batch)
+	}
+}
+
+func (h *HeaderDB) applyBatch(batch []*writeReq) {
+	err := h.db.Update(func(btx *bolt.Tx) error {
+		for _, req := range batch {
+			err := req.apply(btx)
 			if err != nil {
 				return err
 			}
 		}
 		return nil
 	})
+	if err == nil || len(batch) == 1 {
+		for _, req := range batch {
+			req.done <- err
+		}
+		return
+	}
+	// One bad request shouldn't fail the rest of the batch, so retry them one by one
+	log.Warnf("Header batch of %d writes failed, retrying individually: %v", len(batch), err)
+	for _, req := range batch {
+		req.done <- h.db.Update(req.apply)
+	}
 }
 
-func (h *HeaderDB) Prune() error {
-	h.lock.Lock()
-	defer h.lock.Unlock()
-	return h.db.Update(func(btx *bolt.Tx) error {
-		hdrs := btx.Bucket(BKTHeaders)
-		numHeaders := hdrs.Stats().KeyN
+func (h *HeaderDB) Prune(policy PrunePolicy) error {
+	var deleted [][]byte
+	err := h.write(func(btx *bolt.Tx) error {
 		tip := btx.Bucket(BKTChainTip)
 		b := tip.Get(KEYChainTip)
 		if b == nil {
 			return errors.New("ChainTip not set")
 		}
-		sh, err := deserializeHeader(b)
+		best, err := deserializeHeader(b)
+		if err != nil {
+			return err
+		}
+
+		hdrs := btx.Bucket(BKTHeaders)
+		byHash := make(map[chainhash.Hash]StoredHeader)
+		err = hdrs.ForEach(func(k, v []byte) error {
+			sh, err := deserializeHeader(v)
+			if err != nil {
+				return err
+			}
+			byHash[sh.Header.BlockHash()] = sh
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		idx := btx.Bucket(BKTHeightIndex)
+		toDelete, pruneHeight := prunable(byHash, best, policy, func(hash chainhash.Hash, height uint32) bool {
+			return bytes.Equal(idx.Get(heightKey(height)), hash[:])
+		})
+
+		deleted = make([][]byte, 0, len(toDelete))
+		for hash := range toDelete {
+			deleted = append(deleted, hash.CloneBytes())
+		}
+		err = deleteHeaders(btx, deleted)
 		if err != nil {
 			return err
 		}
-		height := sh.Height
-		if numHeaders > MAX_HEADERS {
-			var toDelete [][]byte
-			pruneHeight := height - 2000
+		if pruneHeight > 0 {
+			return deleteHeightIndex(btx, 0, pruneHeight)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	h.evict(deleted)
+	return nil
+}
+
+// prunable picks the headers policy deletes from byHash and the height up to which the
+// best chain is cut.
+func prunable(byHash map[chainhash.Hash]StoredHeader, best StoredHeader, policy PrunePolicy,
+	onBestChain func(hash chainhash.Hash, height uint32) bool) (map[chainhash.Hash]bool, uint32) {
+	toDelete := make(map[chainhash.Hash]bool)
+	var pruneHeight uint32
+	if policy.MainChainDepth > 0 {
+		if best.Height > policy.MainChainDepth {
+			pruneHeight = best.Height - policy.MainChainDepth
+		}
+		for hash, sh := range byHash {
+			if sh.Height <= pruneHeight {
+				toDelete[hash] = true
+			}
+		}
+		// Side branches forking off at or below the cut would be left without their fork
+		// point. Walk each down to the best chain and delete the whole branch if so.
+		orphaned := make(map[chainhash.Hash]bool)
+		for hash, sh := range byHash {
+			if sh.Height <= pruneHeight || onBestChain(hash, sh.Height) {
+				continue
+			}
+			var branch []chainhash.Hash
+			orphan := false
+			for cur := hash; ; {
+				csh, ok := byHash[cur]
+				if !ok {
+					break
+				}
+				if known, ok := orphaned[cur]; ok {
+					orphan = known
+					break
+				}
+				if csh.Height <= pruneHeight {
+					orphan = true
+					break
+				}
+				if onBestChain(cur, csh.Height) {
+					break
+				}
+				branch = append(branch, cur)
+				cur = csh.Header.PrevBlock
+			}
+			for _, h := range branch {
+				orphaned[h] = orphan
+				if orphan {
+					toDelete[h] = true
+				}
+			}
+		}
+	}
+
+	if policy.StaleBranchDepth > 0 {
+		children := make(map[chainhash.Hash]int)
+		for _, sh := range byHash {
+			children[sh.Header.PrevBlock]++
+		}
+		// Start from the stale side branch tips and delete towards the fork point.
+		// A header that another live branch builds on is kept.
+		var stale []chainhash.Hash
+		for hash, sh := range byHash {
+			if children[hash] == 0 && sh.Height+policy.StaleBranchDepth <= best.Height && !onBestChain(hash, sh.Height) {
+				stale = append(stale, hash)
+			}
+		}
+		for len(stale) > 0 {
+			hash := stale[len(stale)-1]
+			stale = stale[:len(stale)-1]
+			toDelete[hash] = true
+			prev := byHash[hash].Header.PrevBlock
+			parent, ok := byHash[prev]
+			if !ok || onBestChain(prev, parent.Height) {
+				continue
+			}
+			children[prev]--
+			if children[prev] == 0 && !toDelete[prev] {
+				stale = append(stale, prev)
+			}
+		}
+	}
+	return toDelete, pruneHeight
+}
+
+func (h *HeaderDB) DeleteAfter(height uint32, keepForks bool) error {
+	var toDelete [][]byte
+	var best StoredHeader
+	err := h.write(func(btx *bolt.Tx) error {
+		hdrs := btx.Bucket(BKTHeaders)
+		toDelete = nil
+		if keepForks {
+			c := btx.Bucket(BKTHeightIndex).Cursor()
+			for k, v := c.Seek(heightKey(height + 1)); k != nil; k, v = c.Next() {
+				toDelete = append(toDelete, append([]byte{}, v...))
+			}
+		} else {
 			err := hdrs.ForEach(func(k, v []byte) error {
 				sh, err := deserializeHeader(v)
 				if err != nil {
 					return err
 				}
-				if sh.Height <= pruneHeight {
-					toDelete = append(toDelete, k)
+				if sh.Height > height {
+					toDelete = append(toDelete, append([]byte{}, k...))
 				}
 				return nil
 			})
 			if err != nil {
 				return err
 			}
-			for _, k := range toDelete {
-				err := hdrs.Delete(k)
-				if err != nil {
-					return err
-				}
-			}
-
 		}
-		return nil
+		var err error
+		best, err = tipAfterDelete(btx, height)
+		if err != nil {
+			return err
+		}
+		err = deleteHeaders(btx, toDelete)
+		if err != nil {
+			return err
+		}
+		return deleteHeightIndex(btx, height+1, math.MaxUint32)
 	})
+	if err != nil {
+		return err
+	}
+	h.evict(toDelete)
+	h.lock.Lock()
+	h.bestCache = &best
+	h.lock.Unlock()
+	return nil
 }
 
-func (h *HeaderDB) DeleteAfter(height uint32) error {
+// tipAfterDelete moves the chain tip down to the best chain header at height, unless the
+// tip isn't above it, and returns the new tip.
+func tipAfterDelete(btx *bolt.Tx, height uint32) (StoredHeader, error) {
+	tip := btx.Bucket(BKTChainTip)
+	b := tip.Get(KEYChainTip)
+	if b == nil {
+		return StoredHeader{}, errors.New("ChainTip not set")
+	}
+	best, err := deserializeHeader(b)
+	if err != nil || best.Height <= height {
+		return best, err
+	}
+	hb := btx.Bucket(BKTHeightIndex).Get(heightKey(height))
+	if hb == nil {
+		return best, fmt.Errorf("no header at height %d on the best chain", height)
+	}
+	b = btx.Bucket(BKTHeaders).Get(hb)
+	if b == nil {
+		return best, fmt.Errorf("header at height %d does not exist in database", height)
+	}
+	best, err = deserializeHeader(b)
+	if err != nil {
+		return best, err
+	}
+	return best, tip.Put(KEYChainTip, b)
+}
+
+// evict drops deleted headers from the cache so they can't be served after a delete.
+func (h *HeaderDB) evict(hashes [][]byte) {
 	h.lock.Lock()
 	defer h.lock.Unlock()
-	return h.db.Update(func(btx *bolt.Tx) error {
-		hdrs := btx.Bucket(BKTHeaders)
-		var toDelete [][]byte
-		err := hdrs.ForEach(func(k, v []byte) error {
-			sh, err := deserializeHeader(v)
-			if err != nil {
-				return err
-			}
-			if sh.Height > height {
-				toDelete = append(toDelete, k)
-			}
-			return nil
-		})
+	for _, k := range hashes {
+		var hash chainhash.Hash
+		copy(hash[:], k)
+		h.cache.Delete(hash)
+	}
+}
+
+func deleteHeaders(btx *bolt.Tx, hashes [][]byte) error {
+	hdrs := btx.Bucket(BKTHeaders)
+	fs := btx.Bucket(BKTFirstSeen)
+	for _, k := range hashes {
+		err := hdrs.Delete(k)
 		if err != nil {
 			return err
 		}
-		for _, k := range toDelete {
-			err := hdrs.Delete(k)
-			if err != nil {
-				return err
-			}
+		err = fs.Delete(k)
+		if err != nil {
+			return err
 		}
-		return nil
-	})
+	}
+	return nil
 }
 
 func (h *HeaderDB) GetPreviousHeader(header wire.BlockHeader) (sh StoredHeader, err error) {
@@ -288,86 +618,75 @@ func (h *HeaderDB) GetHeader(hash chainhash.Hash) (sh StoredHeader, err error) {
 	return sh, nil
 }
 
-// add by zou
-//func (h *HeaderDB) GetHeaderByHeight(height uint32) (sh StoredHeader, err error) {
-//	h.lock.Lock()
-//	defer h.lock.Unlock()
-//
-//	hash, err := h.cache.GetHashByHeight(height)
-//	//fmt.Printf("Failed to get from cache: %v", err)
-//	cachedHeader, cerr := h.cache.Get(hash)
-//	if err == nil && cerr == nil {
-//		return cachedHeader, nil
-//	}
-//
-//	heightKey := make([]byte, 4)
-//	binary.BigEndian.PutUint32(heightKey, height)
-//
-//	err = h.db.View(func(btx *bolt.Tx) error {
-//		hdrs := btx.Bucket(BKTHeaders)
-//		hhdrs := btx.Bucket(HeadersHeight)
-//		hb := hhdrs.Get(heightKey)
-//		if hb == nil {
-//			return errors.New("Header's hash does not exist in database")
-//		}
-//		hash, err := chainhash.NewHash(hb)
-//		if err != nil {
-//			return fmt.Errorf("Failed to parse header hash: %v", err)
-//		}
-//
-//		b := hdrs.Get(hash.CloneBytes())
-//		if b == nil {
-//			return errors.New("Header does not exist in database")
-//		}
-//		sh, err = deserializeHeader(b)
-//		if err != nil {
-//			return err
-//		}
-//		return nil
-//	})
-//	if err != nil {
-//		return sh, err
-//	}
-//	return sh, nil
-//}
-
-// add by zou
+// GetHeaderByHeight returns the header at the given height on the current best chain.
 func (h *HeaderDB) GetHeaderByHeight(height uint32) (sh StoredHeader, err error) {
-	hash, err := h.cache.GetHashByHeight(height)
-	cachedHeader, cerr := h.cache.Get(hash)
-	if err == nil && cerr == nil {
-		return cachedHeader, nil
-	}
-
 	h.lock.RLock()
 	defer h.lock.RUnlock()
 
-	best, err := h.GetBestHeader()
+	var hash chainhash.Hash
+	err = h.db.View(func(btx *bolt.Tx) error {
+		hb := btx.Bucket(BKTHeightIndex).Get(heightKey(height))
+		if hb == nil {
+			return fmt.Errorf("no header at height %d on the best chain", height)
+		}
+		copy(hash[:], hb)
+		if cached, cerr := h.cache.Get(hash); cerr == nil {
+			sh = cached
+			return nil
+		}
+		b := btx.Bucket(BKTHeaders).Get(hb)
+		if b == nil {
+			return fmt.Errorf("header %s at height %d does not exist in database", hash.String(), height)
+		}
+		sh, err = deserializeHeader(b)
+		return err
+	})
 	if err != nil {
 		return StoredHeader{}, err
-	} else if best.Height < height {
-		return StoredHeader{}, fmt.Errorf("best block height %d is lower than %d", best.Height, height)
 	}
+	return sh, nil
+}
+
+// GetHeadersByHeight returns the headers from height from to height to on the current
+// best chain, read in a single transaction.
+func (h *HeaderDB) GetHeadersByHeight(from, to uint32) ([]StoredHeader, error) {
+	if from > to {
+		return nil, fmt.Errorf("no headers between height %d and %d", from, to)
+	}
+	h.lock.RLock()
+	defer h.lock.RUnlock()
 
-	ptr := best
-	if err = h.db.View(func(btx *bolt.Tx) error {
+	headers := make([]StoredHeader, 0, to-from+1)
+	err := h.db.View(func(btx *bolt.Tx) error {
+		index := btx.Bucket(BKTHeightIndex)
 		hdrs := btx.Bucket(BKTHeaders)
-		for ptr.Height > height {
-			b := hdrs.Get(ptr.Header.PrevBlock[:])
+		for height := from; height <= to; height++ {
+			hb := index.Get(heightKey(height))
+			if hb == nil {
+				return fmt.Errorf("no header at height %d on the best chain", height)
+			}
+			var hash chainhash.Hash
+			copy(hash[:], hb)
+			if cached, cerr := h.cache.Get(hash); cerr == nil {
+				headers = append(headers, cached)
+				continue
+			}
+			b := hdrs.Get(hb)
 			if b == nil {
-				return errors.New("Header does not exist in database")
+				return fmt.Errorf("header %s at height %d does not exist in database", hash.String(), height)
 			}
-			ptr, err = deserializeHeader(b)
+			sh, err := deserializeHeader(b)
 			if err != nil {
 				return err
 			}
+			headers = append(headers, sh)
 		}
 		return nil
-	}); err != nil {
-		return StoredHeader{}, fmt.Errorf("maybe %d not in db: %v", height, err)
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return ptr, nil
+	return headers, nil
 }
 
 func (h *HeaderDB) GetBestHeader() (sh StoredHeader, err error) {
@@ -417,6 +736,54 @@ func (h *HeaderDB) Height() (uint32, error) {
 	return height, nil
 }
 
+func (h *HeaderDB) GetTips() ([]StoredHeader, error) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	var tips []StoredHeader
+	err := h.db.View(func(btx *bolt.Tx) error {
+		hdrs := btx.Bucket(BKTHeaders)
+		var all []StoredHeader
+		parents := make(map[chainhash.Hash]bool)
+		err := hdrs.ForEach(func(k, v []byte) error {
+			sh, err := deserializeHeader(v)
+			if err != nil {
+				return err
+			}
+			all = append(all, sh)
+			parents[sh.Header.PrevBlock] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, sh := range all {
+			if !parents[sh.Header.BlockHash()] {
+				tips = append(tips, sh)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tips, nil
+}
+
+func (h *HeaderDB) GetFirstSeen(hash chainhash.Hash) (time.Time, error) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	var t time.Time
+	err := h.db.View(func(btx *bolt.Tx) error {
+		b := btx.Bucket(BKTFirstSeen).Get(hash[:])
+		if b == nil {
+			return fmt.Errorf("first seen time of %s is not recorded", hash.String())
+		}
+		t = time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+		return nil
+	})
+	return t, err
+}
+
 func (h *HeaderDB) Print(w io.Writer) {
 	h.lock.RLock()
 	defer h.lock.RUnlock()
@@ -472,12 +839,123 @@ func (h *HeaderDB) initializeCache() {
 	}
 }
 
+// Close stops accepting writes, waits for the queued ones to be committed and
+// then closes the bolt db.
 func (h *HeaderDB) Close() {
+	h.lock.Lock()
+	if h.closed {
+		h.lock.Unlock()
+		return
+	}
+	h.closed = true
+	close(h.writes)
+	h.lock.Unlock()
+
+	<-h.writerDone
 	h.lock.Lock()
 	h.db.Close()
 	h.lock.Unlock()
 }
 
+// Backup writes a consistent snapshot of the db to w. Writes go on while it runs.
+func (h *HeaderDB) Backup(w io.Writer) (int64, error) {
+	h.lock.RLock()
+	closed := h.closed
+	h.lock.RUnlock()
+	if closed {
+		return 0, ErrHeaderDBClosed
+	}
+	// bolt doesn't close the db while the snapshot's read transaction is open
+	return backup.Snapshot(h.db, w)
+}
+
+// RestoreHeaderDB replaces the header db at filePath with a snapshot taken by Backup.
+// The snapshot has to open and pass Verify first. The header db must not be open.
+func RestoreHeaderDB(snapshot, filePath string, params *chaincfg.Params) error {
+	return backup.Restore(snapshot, headerDBFile(filePath), func(file string) error {
+		h, err := NewHeaderDB(file)
+		if err != nil {
+			return err
+		}
+		defer h.Close()
+		report, err := h.Verify(params)
+		if err != nil {
+			return err
+		}
+		if report.Headers == 0 {
+			return errors.New("snapshot has no headers")
+		}
+		if !report.OK() {
+			return fmt.Errorf("snapshot failed verification: %+v", *report)
+		}
+		return nil
+	})
+}
+
+/*----- main chain height index ------- */
+
+func heightKey(height uint32) []byte {
+	k := make([]byte, 4)
+	binary.BigEndian.PutUint32(k, height)
+	return k
+}
+
+// updateHeightIndex points the height index at the chain ending in best. Entries above
+// best are removed, then we walk back from best rewriting entries until we reach a
+// height that already maps to our ancestor, which is the fork point on a reorg.
+func updateHeightIndex(btx *bolt.Tx, best StoredHeader) error {
+	err := deleteHeightIndex(btx, best.Height+1, math.MaxUint32)
+	if err != nil {
+		return err
+	}
+	idx := btx.Bucket(BKTHeightIndex)
+	hdrs := btx.Bucket(BKTHeaders)
+	sh := best
+	for {
+		hash := sh.Header.BlockHash()
+		key := heightKey(sh.Height)
+		if bytes.Equal(idx.Get(key), hash[:]) {
+			return nil
+		}
+		err = idx.Put(key, hash.CloneBytes())
+		if err != nil {
+			return err
+		}
+		if sh.Height == 0 {
+			return nil
+		}
+		b := hdrs.Get(sh.Header.PrevBlock[:])
+		if b == nil {
+			// Reached the bottom of what we store (checkpoint or pruned)
+			return nil
+		}
+		sh, err = deserializeHeader(b)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// deleteHeightIndex removes the index entries for heights in [from, to].
+func deleteHeightIndex(btx *bolt.Tx, from, to uint32) error {
+	if from > to {
+		return nil
+	}
+	idx := btx.Bucket(BKTHeightIndex)
+	var toDelete [][]byte
+	c := idx.Cursor()
+	for k, _ := c.Seek(heightKey(from)); k != nil && binary.BigEndian.Uint32(k) <= to; k, _ = c.Next() {
+		toDelete = append(toDelete, append([]byte{}, k...))
+	}
+	for _, k := range toDelete {
+		err := idx.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 /*----- header serialization ------- */
 /* byteLength   desc          at offset
    80	       header	           0
@@ -550,8 +1028,12 @@ func (h *HeaderCache) Set(sh StoredHeader) {
 	}
 	hash := sh.Header.BlockHash()
 	h.headers.Set(hash.String(), sh)
-	// add by zou
-	h.headers.Set(sh.Height, hash.String())
+}
+
+func (h *HeaderCache) Delete(hash chainhash.Hash) {
+	h.Lock()
+	defer h.Unlock()
+	h.headers.Delete(hash.String())
 }
 
 func (h *HeaderCache) Get(hash chainhash.Hash) (StoredHeader, error) {
@@ -563,19 +1045,3 @@ func (h *HeaderCache) Get(hash chainhash.Hash) (StoredHeader, error) {
 	}
 	return sh.(StoredHeader), nil
 }
-
-// add by zou
-func (h *HeaderCache) GetHashByHeight(height uint32) (chainhash.Hash, error) {
-	h.RLock()
-	defer h.RUnlock()
-	hashVal, ok := h.headers.Get(height)
-	if !ok {
-		return chainhash.Hash{}, errors.New("Not found")
-	}
-
-	hash, err := chainhash.NewHashFromStr(hashVal.(string))
-	if err != nil {
-		return chainhash.Hash{}, err
-	}
-	return *hash, nil
-}
@@ -3,11 +3,17 @@ package chain
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
 	"github.com/boltdb/bolt"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
+	"github.com/ontio/spvclient/migration"
+	"io/ioutil"
 	"math/big"
 	"os"
+	"path"
 	"strings"
 	"testing"
 	"time"
@@ -111,7 +117,7 @@ func TestHeaderDB_put(t *testing.T) {
 		t.Error(err)
 	}
 	// Test put with new tip
-	err = headers.put(testSh1, true)
+	err = headers.Put(testSh1, true)
 	if err != nil {
 		t.Error(err)
 	}
@@ -151,7 +157,7 @@ func TestHeaderDB_put(t *testing.T) {
 	}
 
 	// Test header without new tip
-	err = headers.put(testSh2, false)
+	err = headers.Put(testSh2, false)
 	if err != nil {
 		t.Error(err)
 	}
@@ -190,7 +196,7 @@ func TestHeaderDB_put(t *testing.T) {
 		t.Error(err)
 	}
 	// Test put duplicate
-	err = headers.put(testSh2, true)
+	err = headers.Put(testSh2, true)
 	if err != nil {
 		t.Error(err)
 	}
@@ -202,7 +208,7 @@ func TestHeaderDB_GetPreviousHeader(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	err = headers.put(testSh1, false)
+	err = headers.Put(testSh1, false)
 	if err != nil {
 		t.Error(err)
 	}
@@ -223,7 +229,7 @@ func TestHeaderDB_GetBestHeader(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	err = headers.put(testSh1, false)
+	err = headers.Put(testSh1, false)
 	if err != nil {
 		t.Error(err)
 	}
@@ -232,11 +238,11 @@ func TestHeaderDB_GetBestHeader(t *testing.T) {
 		t.Error("Didn't receive error when fetching best header without one set")
 	}
 
-	err = headers.put(testSh1, true)
+	err = headers.Put(testSh1, true)
 	if err != nil {
 		t.Error(err)
 	}
-	err = headers.put(testSh2, false)
+	err = headers.Put(testSh2, false)
 	if err != nil {
 		t.Error(err)
 	}
@@ -263,7 +269,7 @@ func TestHeaderDB_Height(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	err = headers.put(testSh1, true)
+	err = headers.Put(testSh1, true)
 	if err != nil {
 		t.Error(err)
 	}
@@ -294,18 +300,18 @@ func TestHeaderDB_Prune(t *testing.T) {
 			t.Error(err)
 		}
 		hdr.Header.PrevBlock = *prevHash
-		err = headers.put(hdr, true)
+		err = headers.Put(hdr, true)
 		if err != nil {
 			t.Error(err)
 		}
-		if i < 500 {
+		if i < 2500-1000 {
 			toDelete = append(toDelete, hdr.Header.BlockHash())
 		} else {
 			toStay = append(toStay, hdr.Header.BlockHash())
 		}
 	}
 
-	err = headers.Prune()
+	err = headers.Prune(PrunePolicy{MainChainDepth: 1000})
 	if err != nil {
 		t.Error(err)
 	}
@@ -338,15 +344,15 @@ func TestHeaderDB_Print(t *testing.T) {
 		t.Error(err)
 	}
 	// Test put with new tip
-	err = headers.put(testSh1, true)
+	err = headers.Put(testSh1, true)
 	if err != nil {
 		t.Error(err)
 	}
-	err = headers.put(testSh2, true)
+	err = headers.Put(testSh2, true)
 	if err != nil {
 		t.Error(err)
 	}
-	err = headers.put(testSh3, true)
+	err = headers.Put(testSh3, true)
 	if err != nil {
 		t.Error(err)
 	}
@@ -383,7 +389,7 @@ func TestHeaderDB_DeleteAfter(t *testing.T) {
 		}
 		hdr.Header.PrevBlock = *prevHash
 		hdr.Header.Timestamp = time.Now().Add(time.Minute * time.Duration(i))
-		err = headers.put(hdr, true)
+		err = headers.Put(hdr, true)
 		if err != nil {
 			t.Error(err)
 		}
@@ -394,7 +400,7 @@ func TestHeaderDB_DeleteAfter(t *testing.T) {
 		}
 	}
 
-	err = headers.DeleteAfter(500)
+	err = headers.DeleteAfter(500, false)
 	if err != nil {
 		t.Error(err)
 	}
@@ -412,6 +418,11 @@ func TestHeaderDB_DeleteAfter(t *testing.T) {
 				t.Error("Failed to prune a header")
 			}
 		}
+		// The stored tip moves with the cached one
+		tip, err := deserializeHeader(btx.Bucket(BKTChainTip).Get(KEYChainTip))
+		if err != nil || tip.Header.BlockHash() != toStay[len(toStay)-1] {
+			t.Error("Chain tip still points at a deleted header")
+		}
 		return nil
 	})
 	if err != nil {
@@ -419,3 +430,536 @@ func TestHeaderDB_DeleteAfter(t *testing.T) {
 	}
 	os.RemoveAll("headers.bin")
 }
+
+func buildTestBranch(parent StoredHeader, n int) []StoredHeader {
+	var branch []StoredHeader
+	for i := 0; i < n; i++ {
+		hdr := testHdr1
+		hdr.PrevBlock = parent.Header.BlockHash()
+		mr := make([]byte, 32)
+		rand.Read(mr)
+		copy(hdr.MerkleRoot[:], mr)
+		sh := StoredHeader{
+			Header:    hdr,
+			Height:    parent.Height + 1,
+			totalWork: new(big.Int).Add(parent.totalWork, big.NewInt(1)),
+		}
+		branch = append(branch, sh)
+		parent = sh
+	}
+	return branch
+}
+
+func TestHeaderDB_GetHeaderByHeight(t *testing.T) {
+	headers, err := NewHeaderDB("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("headers.bin")
+	defer headers.Close()
+
+	root := StoredHeader{Header: testHdr1, Height: 100, totalWork: big.NewInt(0)}
+	err = headers.Put(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	main := buildTestBranch(root, 10)
+	for _, sh := range main {
+		if err := headers.Put(sh, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkHeights := func(want []StoredHeader) {
+		for _, sh := range want {
+			got, err := headers.GetHeaderByHeight(sh.Height)
+			if err != nil {
+				t.Errorf("height %d: %v", sh.Height, err)
+				continue
+			}
+			if got.Header.BlockHash() != sh.Header.BlockHash() {
+				t.Errorf("height %d returned a header that is not on the best chain", sh.Height)
+			}
+		}
+	}
+	checkHeights(main)
+
+	// Fork off at height 105 with a longer branch
+	fork := buildTestBranch(main[4], 8)
+	for i, sh := range fork {
+		if err := headers.Put(sh, i >= 5); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkHeights(main[:5])
+	checkHeights(fork)
+
+	// Reorg back onto a shorter branch with more work
+	heavy := buildTestBranch(main[6], 1)
+	heavy[0].totalWork = big.NewInt(1000)
+	if err := headers.Put(heavy[0], true); err != nil {
+		t.Fatal(err)
+	}
+	checkHeights(main[:7])
+	checkHeights(heavy)
+	if _, err := headers.GetHeaderByHeight(heavy[0].Height + 1); err == nil {
+		t.Error("Height index kept an entry above the best header")
+	}
+
+	// Rolling back must drop the index above the new tip
+	if err := headers.DeleteAfter(103, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := headers.Put(main[2], true); err != nil {
+		t.Fatal(err)
+	}
+	checkHeights(main[:3])
+	if _, err := headers.GetHeaderByHeight(104); err == nil {
+		t.Error("Height index kept an entry after rollback")
+	}
+}
+
+func TestHeaderDB_PutHeaders(t *testing.T) {
+	headers, err := NewHeaderDB("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("headers.bin")
+
+	root := StoredHeader{Header: testHdr1, Height: 100, totalWork: big.NewInt(0)}
+	err = headers.Put(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	branch := buildTestBranch(root, 50)
+	err = headers.PutHeaders(branch[:40], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent writers are committed in the order they were queued
+	done := make(chan error)
+	for _, sh := range branch[40:] {
+		go func(sh StoredHeader) {
+			done <- headers.Put(sh, false)
+		}(sh)
+	}
+	for range branch[40:] {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Closing drains the queue, nothing is lost when we reopen
+	headers.Close()
+	if err := headers.Put(branch[0], false); err != ErrHeaderDBClosed {
+		t.Error("Put succeeded after close")
+	}
+	headers, err = NewHeaderDB("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer headers.Close()
+	for _, sh := range branch {
+		if _, err := headers.GetHeader(sh.Header.BlockHash()); err != nil {
+			t.Errorf("Header at height %d was not persisted", sh.Height)
+		}
+	}
+	best, err := headers.GetBestHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if best.Header.BlockHash() != branch[39].Header.BlockHash() {
+		t.Error("Chain tip does not point at the last header of the batch")
+	}
+	sh, err := headers.GetHeaderByHeight(branch[20].Height)
+	if err != nil || sh.Header.BlockHash() != branch[20].Header.BlockHash() {
+		t.Error("Height index was not written for the batch")
+	}
+}
+
+func TestHeaderDB_GetTips(t *testing.T) {
+	headers, err := NewHeaderDB("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("headers.bin")
+	defer headers.Close()
+
+	before := time.Now().Unix()
+	root := StoredHeader{Header: testHdr1, Height: 100, totalWork: big.NewInt(0)}
+	err = headers.Put(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	main := buildTestBranch(root, 5)
+	if err := headers.PutHeaders(main, true); err != nil {
+		t.Fatal(err)
+	}
+	fork := buildTestBranch(main[1], 2)
+	if err := headers.PutHeaders(fork, false); err != nil {
+		t.Fatal(err)
+	}
+
+	tips, err := headers.GetTips()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tips) != 2 {
+		t.Fatalf("Expected 2 tips, got %d", len(tips))
+	}
+	found := make(map[chainhash.Hash]bool)
+	for _, tip := range tips {
+		found[tip.Header.BlockHash()] = true
+	}
+	if !found[main[4].Header.BlockHash()] || !found[fork[1].Header.BlockHash()] {
+		t.Error("GetTips returned the wrong headers")
+	}
+
+	seen, err := headers.GetFirstSeen(fork[1].Header.BlockHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen.Unix() < before || seen.After(time.Now()) {
+		t.Error("Incorrect first seen time")
+	}
+	if err := headers.DeleteAfter(main[1].Height, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := headers.GetFirstSeen(fork[1].Header.BlockHash()); err == nil {
+		t.Error("First seen time was not deleted with the header")
+	}
+}
+
+func TestHeaderDB_PruneStaleBranches(t *testing.T) {
+	headers, err := NewHeaderDB("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("headers.bin")
+	defer headers.Close()
+
+	root := StoredHeader{Header: testHdr1, Height: 100, totalWork: big.NewInt(0)}
+	err = headers.Put(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	main := buildTestBranch(root, 30)
+	// stale is 25 blocks behind the tip, live is 5 behind and builds on part of stale
+	stale := buildTestBranch(main[0], 4)
+	live := buildTestBranch(stale[1], 22)
+	for _, branch := range [][]StoredHeader{stale, live} {
+		if err := headers.PutHeaders(branch, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := headers.PutHeaders(main, true); err != nil {
+		t.Fatal(err)
+	}
+
+	err = headers.Prune(PrunePolicy{StaleBranchDepth: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists := func(sh StoredHeader) bool {
+		_, err := headers.GetHeader(sh.Header.BlockHash())
+		return err == nil
+	}
+	if exists(stale[2]) || exists(stale[3]) {
+		t.Error("Failed to prune a stale branch")
+	}
+	if !exists(stale[0]) || !exists(stale[1]) {
+		t.Error("Pruned headers a live branch builds on")
+	}
+	for _, sh := range append([]StoredHeader{root}, append(main, live...)...) {
+		if !exists(sh) {
+			t.Errorf("Pruned header at height %d that should have stayed", sh.Height)
+		}
+	}
+
+	err = headers.Prune(PrunePolicy{StaleBranchDepth: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sh := range append(stale, live...) {
+		if exists(sh) {
+			t.Errorf("Failed to prune side branch header at height %d", sh.Height)
+		}
+	}
+	tips, err := headers.GetTips()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tips) != 1 || tips[0].Header.BlockHash() != main[29].Header.BlockHash() {
+		t.Error("Side branches left after pruning")
+	}
+}
+
+// mineTestBranch builds headers which pass proof of work against the regtest limit
+func mineTestBranch(parent StoredHeader, n int) []StoredHeader {
+	var branch []StoredHeader
+	for i := 0; i < n; i++ {
+		hdr := wire.BlockHeader{
+			Version:   4,
+			PrevBlock: parent.Header.BlockHash(),
+			Timestamp: parent.Header.Timestamp.Add(time.Minute * 10),
+			Bits:      chaincfg.RegressionNetParams.PowLimitBits,
+		}
+		rand.Read(hdr.MerkleRoot[:])
+		for !checkProofOfWork(hdr, &chaincfg.RegressionNetParams, BitcoinRules{}) {
+			hdr.Nonce++
+		}
+		sh := StoredHeader{
+			Header:    hdr,
+			Height:    parent.Height + 1,
+			totalWork: new(big.Int).Add(parent.totalWork, blockchain.CalcWork(hdr.Bits)),
+		}
+		branch = append(branch, sh)
+		parent = sh
+	}
+	return branch
+}
+
+func TestHeaderDB_VerifyRepair(t *testing.T) {
+	headers, err := NewHeaderDB("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("headers.bin")
+	defer headers.Close()
+	params := &chaincfg.RegressionNetParams
+
+	root := StoredHeader{Header: testHdr1, Height: 100, totalWork: big.NewInt(0)}
+	main := mineTestBranch(root, 5)
+	fork := mineTestBranch(main[1], 2)
+	if err := headers.PutHeaders(append([]StoredHeader{root}, main...), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := headers.PutHeaders(fork, false); err != nil {
+		t.Fatal(err)
+	}
+	report, err := headers.Verify(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Headers != 8 || !report.BestTip.IsEqual(&report.StoredTip) {
+		t.Fatalf("Expected a clean report, got %+v", report)
+	}
+
+	// Break some records the way a crash mid write would
+	badWork := main[2]
+	badWork.totalWork = big.NewInt(1)
+	badHeight := main[3]
+	badHeight.Height = 500
+	invalid := mineTestBranch(fork[1], 1)[0]
+	for checkProofOfWork(invalid.Header, params, BitcoinRules{}) {
+		invalid.Header.Nonce++
+	}
+	orphan := mineTestBranch(StoredHeader{Header: testHdr2, Height: 150, totalWork: big.NewInt(0)}, 1)[0]
+	if err := headers.PutHeaders([]StoredHeader{badWork, badHeight, invalid}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := headers.Put(orphan, true); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = headers.Verify(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() {
+		t.Fatal("Verify didn't find any problems")
+	}
+	orphanHash := orphan.Header.BlockHash()
+	if len(report.Orphans) != 1 || !report.Orphans[0].IsEqual(&orphanHash) {
+		t.Errorf("Expected the orphan to be reported, got %v", report.Orphans)
+	}
+	if len(report.BadPoW) != 1 || len(report.BadWork) != 1 || len(report.BadHeight) != 1 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	best := main[4].Header.BlockHash()
+	if !report.BadTip || !report.BestTip.IsEqual(&best) || report.BadIndex == 0 {
+		t.Errorf("Expected the tip to be reported, got %+v", report)
+	}
+
+	if _, err := headers.Repair(params); err != nil {
+		t.Fatal(err)
+	}
+	report, err = headers.Verify(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Headers != 8 {
+		t.Fatalf("Expected a clean report after repair, got %+v", report)
+	}
+	tip, err := headers.GetBestHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tip.Header.BlockHash() != best || tip.Height != main[4].Height || tip.totalWork.Cmp(main[4].totalWork) != 0 {
+		t.Error("Repair set the wrong chain tip")
+	}
+	sh, err := headers.GetHeaderByHeight(main[3].Height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sh.Header.BlockHash() != main[3].Header.BlockHash() || sh.Height != main[3].Height {
+		t.Error("Height index was not rebuilt")
+	}
+	if _, err := headers.GetHeader(orphanHash); err == nil {
+		t.Error("Orphan was not deleted")
+	}
+}
+
+func TestNewHeaderDB_Migrate(t *testing.T) {
+	// Write a db in the original layout, only headers and the chain tip
+	db, err := bolt.Open("headers.bin", 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("headers.bin")
+	root := StoredHeader{Header: testHdr1, Height: 100, totalWork: big.NewInt(0)}
+	branch := buildTestBranch(root, 3)
+	err = db.Update(func(btx *bolt.Tx) error {
+		hdrs, err := btx.CreateBucket(BKTHeaders)
+		if err != nil {
+			return err
+		}
+		tip, err := btx.CreateBucket(BKTChainTip)
+		if err != nil {
+			return err
+		}
+		for _, sh := range append([]StoredHeader{root}, branch...) {
+			ser, err := serializeHeader(sh)
+			if err != nil {
+				return err
+			}
+			hash := sh.Header.BlockHash()
+			if err = hdrs.Put(hash[:], ser); err != nil {
+				return err
+			}
+			if err = tip.Put(KEYChainTip, ser); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers, err := NewHeaderDB("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh, err := headers.GetHeaderByHeight(102)
+	if err != nil || sh.Header.BlockHash() != branch[1].Header.BlockHash() {
+		t.Error("Height index was not built by the migration")
+	}
+	headers.db.View(func(btx *bolt.Tx) error {
+		if v := migration.GetVersion(btx); v != migration.Latest(headerMigrations) {
+			t.Errorf("Expected the latest schema version, got %d", v)
+		}
+		return nil
+	})
+	// Pretend a newer build wrote the db
+	headers.db.Update(func(btx *bolt.Tx) error {
+		v := make([]byte, 4)
+		binary.BigEndian.PutUint32(v, migration.Latest(headerMigrations)+1)
+		return btx.Bucket(migration.BKTMeta).Put(migration.KEYVersion, v)
+	})
+	headers.Close()
+	if _, err := NewHeaderDB(""); err == nil {
+		t.Error("Opened a header db from a newer version")
+	}
+}
+
+func TestHeaderDB_BackupRestore(t *testing.T) {
+	headers, err := NewHeaderDB("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("headers.bin")
+	defer headers.Close()
+	params := &chaincfg.RegressionNetParams
+
+	root := StoredHeader{Header: testHdr1, Height: 100, totalWork: big.NewInt(0)}
+	main := mineTestBranch(root, 5)
+	if err := headers.PutHeaders(append([]StoredHeader{root}, main...), true); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create("snapshot.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("snapshot.bin")
+	n, err := headers.Backup(f)
+	f.Close()
+	if err != nil || n == 0 {
+		t.Fatalf("Backup failed, %d bytes: %v", n, err)
+	}
+	// Headers written after the snapshot was taken are not in it
+	if err := headers.PutHeaders(mineTestBranch(main[4], 1), true); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := RestoreHeaderDB("snapshot.bin", dir, params); err != nil {
+		t.Fatal(err)
+	}
+	// A db which is still open can't be replaced
+	restored, err := NewHeaderDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreHeaderDB("snapshot.bin", dir, params); err == nil {
+		t.Error("Replaced a header db which is in use")
+	}
+	restored.Close()
+
+	if err := RestoreHeaderDB("snapshot.bin", dir, params); err != nil {
+		t.Fatal(err)
+	}
+	restored, err = NewHeaderDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	tip, err := restored.GetBestHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tip.Header.BlockHash() != main[4].Header.BlockHash() {
+		t.Error("Restored the wrong chain tip")
+	}
+	if _, err := os.Stat(path.Join(dir, "headers.bin.old")); err != nil {
+		t.Error("Replaced header db was not kept")
+	}
+
+	// A snapshot which doesn't verify is refused
+	bad := main[2]
+	bad.Height = 500
+	if err := headers.Put(bad, false); err != nil {
+		t.Fatal(err)
+	}
+	f, err = os.Create("snapshot.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = headers.Backup(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored.Close()
+	if err := RestoreHeaderDB("snapshot.bin", dir, params); err == nil {
+		t.Error("Restored a snapshot which failed verification")
+	}
+	if _, err := os.Stat(path.Join(dir, "headers.bin.restore")); !os.IsNotExist(err) {
+		t.Error("Refused snapshot was left behind")
+	}
+}
@@ -0,0 +1,438 @@
+// Package headerstest is the conformance suite every chain.Headers implementation
+// has to pass.
+package headerstest
+
+import (
+	"crypto/rand"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ontio/spvclient/chain"
+)
+
+// Factory returns an empty store and a function which removes whatever it left behind
+type Factory func() (chain.Headers, func())
+
+// Run runs the whole suite, every case on a fresh store from newHeaders.
+func Run(t *testing.T, newHeaders Factory) {
+	cases := []struct {
+		name string
+		test func(t *testing.T, h chain.Headers)
+	}{
+		{"PutAndTip", testPutAndTip},
+		{"HeightIndexReorg", testHeightIndexReorg},
+		{"HeadersByHeight", testHeadersByHeight},
+		{"GetTips", testGetTips},
+		{"DeleteAfter", testDeleteAfter},
+		{"DeleteAfterKeepForks", testDeleteAfterKeepForks},
+		{"Prune", testPrune},
+		{"PruneForks", testPruneForks},
+		{"ConcurrentReaders", testConcurrentReaders},
+		{"Close", testClose},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			h, cleanup := newHeaders()
+			defer cleanup()
+			defer h.Close()
+			c.test(t, h)
+		})
+	}
+}
+
+var rootHeader = wire.BlockHeader{
+	Version:   4,
+	Timestamp: time.Unix(1500000000, 0),
+	Bits:      0x207fffff,
+}
+
+// Branch builds n headers on top of parent. They link up and have increasing work
+// but no proof of work.
+func Branch(parent chain.StoredHeader, n int) []chain.StoredHeader {
+	var branch []chain.StoredHeader
+	for i := 0; i < n; i++ {
+		hdr := rootHeader
+		hdr.PrevBlock = parent.Header.BlockHash()
+		hdr.Timestamp = parent.Header.Timestamp.Add(10 * time.Minute)
+		rand.Read(hdr.MerkleRoot[:])
+		sh := chain.NewStoredHeader(hdr, parent.Height+1, new(big.Int).Add(parent.GetTotalWork(), big.NewInt(1)))
+		branch = append(branch, sh)
+		parent = sh
+	}
+	return branch
+}
+
+func putRoot(t *testing.T, h chain.Headers) chain.StoredHeader {
+	root := chain.NewStoredHeader(rootHeader, 100, big.NewInt(0))
+	if err := h.Put(root, true); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func hashOf(sh chain.StoredHeader) chainhash.Hash {
+	return sh.Header.BlockHash()
+}
+
+func checkHeight(t *testing.T, h chain.Headers, want chain.StoredHeader) {
+	t.Helper()
+	sh, err := h.GetHeaderByHeight(want.Height)
+	if err != nil {
+		t.Errorf("No header at height %d: %v", want.Height, err)
+		return
+	}
+	if hashOf(sh) != hashOf(want) {
+		t.Errorf("Wrong header at height %d", want.Height)
+	}
+}
+
+func checkStored(t *testing.T, h chain.Headers, sh chain.StoredHeader, stored bool) {
+	t.Helper()
+	_, err := h.GetHeader(hashOf(sh))
+	if stored && err != nil {
+		t.Errorf("Header at %d is missing: %v", sh.Height, err)
+	}
+	if !stored && err == nil {
+		t.Errorf("Header at %d was not deleted", sh.Height)
+	}
+}
+
+func testPutAndTip(t *testing.T, h chain.Headers) {
+	if _, err := h.GetBestHeader(); err == nil {
+		t.Error("Empty store returned a best header")
+	}
+	root := putRoot(t, h)
+	main := Branch(root, 3)
+	if err := h.PutHeaders(main, true); err != nil {
+		t.Fatal(err)
+	}
+	side := Branch(root, 1)[0]
+	if err := h.Put(side, false); err != nil {
+		t.Fatal(err)
+	}
+
+	best, err := h.GetBestHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashOf(best) != hashOf(main[2]) || best.Height != 103 || best.GetTotalWork().Cmp(big.NewInt(3)) != 0 {
+		t.Error("Wrong best header")
+	}
+	if height, err := h.Height(); err != nil || height != 103 {
+		t.Errorf("Wrong height %d: %v", height, err)
+	}
+	got, err := h.GetHeader(hashOf(side))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Height != side.Height || got.GetTotalWork().Cmp(side.GetTotalWork()) != 0 || got.Header != side.Header {
+		t.Error("Stored header changed")
+	}
+	prev, err := h.GetPreviousHeader(main[1].Header)
+	if err != nil || hashOf(prev) != hashOf(main[0]) {
+		t.Error("Wrong previous header")
+	}
+	if _, err := h.GetHeader(chainhash.Hash{}); err == nil {
+		t.Error("Returned a header which was never stored")
+	}
+	if _, err := h.GetFirstSeen(hashOf(side)); err != nil {
+		t.Error(err)
+	}
+	if _, err := h.GetFirstSeen(chainhash.Hash{}); err == nil {
+		t.Error("Returned a first seen time for a header which was never stored")
+	}
+	if err := h.PutHeaders(nil, true); err != nil {
+		t.Error(err)
+	}
+}
+
+func testHeightIndexReorg(t *testing.T, h chain.Headers) {
+	root := putRoot(t, h)
+	main := Branch(root, 5)
+	if err := h.PutHeaders(main, true); err != nil {
+		t.Fatal(err)
+	}
+	// A longer fork off height 102 becomes the best chain
+	fork := Branch(main[1], 6)
+	if err := h.PutHeaders(fork, true); err != nil {
+		t.Fatal(err)
+	}
+	checkHeight(t, h, root)
+	checkHeight(t, h, main[1])
+	for _, sh := range fork {
+		checkHeight(t, h, sh)
+	}
+
+	// And back to the original chain, which is now longer but shorter than the fork was
+	more := Branch(main[4], 1)
+	if err := h.PutHeaders(more, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, sh := range append(main, more...) {
+		checkHeight(t, h, sh)
+	}
+	for _, height := range []uint32{107, 108} {
+		if _, err := h.GetHeaderByHeight(height); err == nil {
+			t.Errorf("Height %d above the best header is still indexed", height)
+		}
+	}
+	checkStored(t, h, fork[5], true)
+}
+
+func testHeadersByHeight(t *testing.T, h chain.Headers) {
+	root := putRoot(t, h)
+	main := Branch(root, 3)
+	if err := h.PutHeaders(main, true); err != nil {
+		t.Fatal(err)
+	}
+	fork := Branch(main[0], 4)
+	if err := h.PutHeaders(fork, true); err != nil {
+		t.Fatal(err)
+	}
+	want := append([]chain.StoredHeader{root, main[0]}, fork...)
+	headers, err := h.GetHeadersByHeight(100, 105)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != len(want) {
+		t.Fatalf("Expected %d headers, got %d", len(want), len(headers))
+	}
+	for i, sh := range headers {
+		if hashOf(sh) != hashOf(want[i]) || sh.Height != want[i].Height {
+			t.Errorf("Wrong header at height %d", want[i].Height)
+		}
+	}
+	if _, err := h.GetHeadersByHeight(104, 106); err == nil {
+		t.Error("Read headers above the best header")
+	}
+	if _, err := h.GetHeadersByHeight(103, 102); err == nil {
+		t.Error("Read a range ending below its start")
+	}
+}
+
+func testGetTips(t *testing.T, h chain.Headers) {
+	root := putRoot(t, h)
+	main := Branch(root, 4)
+	if err := h.PutHeaders(main, true); err != nil {
+		t.Fatal(err)
+	}
+	fork := Branch(main[0], 2)
+	if err := h.PutHeaders(fork, false); err != nil {
+		t.Fatal(err)
+	}
+	tips, err := h.GetTips()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[chainhash.Hash]bool)
+	for _, tip := range tips {
+		found[hashOf(tip)] = true
+	}
+	if len(tips) != 2 || !found[hashOf(main[3])] || !found[hashOf(fork[1])] {
+		t.Errorf("Wrong tips %v", tips)
+	}
+}
+
+func testDeleteAfter(t *testing.T, h chain.Headers) {
+	root := putRoot(t, h)
+	main := Branch(root, 5)
+	if err := h.PutHeaders(main, true); err != nil {
+		t.Fatal(err)
+	}
+	fork := Branch(main[0], 3)
+	if err := h.PutHeaders(fork, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.DeleteAfter(main[1].Height, false); err != nil {
+		t.Fatal(err)
+	}
+	if best, err := h.GetBestHeader(); err != nil || hashOf(best) != hashOf(main[1]) {
+		t.Error("Chain tip was not moved down to the remaining best chain")
+	}
+	checkStored(t, h, main[1], true)
+	checkStored(t, h, fork[0], true)
+	checkStored(t, h, main[2], false)
+	checkStored(t, h, fork[1], false)
+	checkStored(t, h, fork[2], false)
+	checkHeight(t, h, main[1])
+	if _, err := h.GetHeaderByHeight(main[2].Height); err == nil {
+		t.Error("Deleted height is still indexed")
+	}
+	if _, err := h.GetFirstSeen(hashOf(main[4])); err == nil {
+		t.Error("First seen time was not deleted with the header")
+	}
+}
+
+func testDeleteAfterKeepForks(t *testing.T, h chain.Headers) {
+	root := putRoot(t, h)
+	main := Branch(root, 5)
+	if err := h.PutHeaders(main, true); err != nil {
+		t.Fatal(err)
+	}
+	fork := Branch(main[0], 3)
+	if err := h.PutHeaders(fork, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.DeleteAfter(main[1].Height, true); err != nil {
+		t.Fatal(err)
+	}
+	if best, err := h.GetBestHeader(); err != nil || hashOf(best) != hashOf(main[1]) {
+		t.Error("Chain tip was not moved down to the remaining best chain")
+	}
+	checkStored(t, h, main[2], false)
+	checkStored(t, h, main[4], false)
+	for _, sh := range fork {
+		checkStored(t, h, sh, true)
+	}
+	if _, err := h.GetHeaderByHeight(main[2].Height); err == nil {
+		t.Error("Deleted height is still indexed")
+	}
+}
+
+func testPrune(t *testing.T, h chain.Headers) {
+	if err := h.Prune(chain.PrunePolicy{MainChainDepth: 1}); err == nil {
+		t.Error("Pruned without a chain tip")
+	}
+	root := putRoot(t, h)
+	main := Branch(root, 2500)
+	if err := h.PutHeaders(main, true); err != nil {
+		t.Fatal(err)
+	}
+	stale := Branch(main[2099], 2)
+	if err := h.PutHeaders(stale, false); err != nil {
+		t.Fatal(err)
+	}
+	recent := Branch(main[2489], 2)
+	if err := h.PutHeaders(recent, false); err != nil {
+		t.Fatal(err)
+	}
+
+	err := h.Prune(chain.PrunePolicy{MainChainDepth: 2016, StaleBranchDepth: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	best := main[2499]
+	pruneHeight := best.Height - 2016
+	for _, sh := range append([]chain.StoredHeader{root}, main...) {
+		checkStored(t, h, sh, sh.Height > pruneHeight)
+	}
+	if _, err := h.GetHeaderByHeight(pruneHeight); err == nil {
+		t.Error("Pruned height is still indexed")
+	}
+	checkHeight(t, h, main[2499-2015])
+	checkStored(t, h, stale[0], false)
+	checkStored(t, h, stale[1], false)
+	checkStored(t, h, recent[1], true)
+	if got, err := h.GetBestHeader(); err != nil || hashOf(got) != hashOf(best) {
+		t.Error("Prune changed the best header")
+	}
+}
+
+func testPruneForks(t *testing.T, h chain.Headers) {
+	root := putRoot(t, h)
+	main := Branch(root, 2100)
+	if err := h.PutHeaders(main, true); err != nil {
+		t.Fatal(err)
+	}
+	// Forks at heights 180 and 190, around the cut at 184
+	below := Branch(main[79], 30)
+	if err := h.PutHeaders(below, false); err != nil {
+		t.Fatal(err)
+	}
+	above := Branch(main[89], 5)
+	if err := h.PutHeaders(above, false); err != nil {
+		t.Fatal(err)
+	}
+	split := Branch(below[10], 3)
+	if err := h.PutHeaders(split, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Prune(chain.PrunePolicy{MainChainDepth: 2016}); err != nil {
+		t.Fatal(err)
+	}
+	for _, sh := range append(below, split...) {
+		checkStored(t, h, sh, false)
+	}
+	for _, sh := range above {
+		checkStored(t, h, sh, true)
+	}
+	checkStored(t, h, main[84], true)
+	tips, err := h.GetTips()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tips) != 2 {
+		t.Errorf("Expected the best header and one side branch tip, got %d tips", len(tips))
+	}
+}
+
+func testConcurrentReaders(t *testing.T, h chain.Headers) {
+	root := putRoot(t, h)
+	headers := Branch(root, 100)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	errs := make(chan string, 8)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var last uint32
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				best, err := h.GetBestHeader()
+				if err != nil {
+					errs <- err.Error()
+					return
+				}
+				if best.Height < last {
+					errs <- "best height went backwards"
+					return
+				}
+				last = best.Height
+				// The chain only grows so the best height stays indexed
+				sh, err := h.GetHeaderByHeight(best.Height)
+				if err != nil {
+					errs <- err.Error()
+					return
+				}
+				if sh.Height != best.Height {
+					errs <- "header at the wrong height"
+					return
+				}
+			}
+		}()
+	}
+	for _, sh := range headers {
+		if err := h.Put(sh, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	checkHeight(t, h, headers[99])
+}
+
+func testClose(t *testing.T, h chain.Headers) {
+	root := putRoot(t, h)
+	h.Close()
+	if err := h.Put(Branch(root, 1)[0], true); err == nil {
+		t.Error("Put after Close succeeded")
+	}
+	// A second Close is harmless
+	h.Close()
+}
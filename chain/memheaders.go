@@ -0,0 +1,258 @@
+package chain
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// MemHeaders implements Headers in memory. Nothing survives Close, it's meant for tests
+// and for embedders which keep the headers somewhere else.
+type MemHeaders struct {
+	lock      sync.RWMutex
+	headers   map[chainhash.Hash]StoredHeader
+	firstSeen map[chainhash.Hash]time.Time
+	// Best chain hash at each height, like the bolt height index
+	heights map[uint32]chainhash.Hash
+	best    *StoredHeader
+	closed  bool
+}
+
+func NewMemHeaders() *MemHeaders {
+	return &MemHeaders{
+		headers:   make(map[chainhash.Hash]StoredHeader),
+		firstSeen: make(map[chainhash.Hash]time.Time),
+		heights:   make(map[uint32]chainhash.Hash),
+	}
+}
+
+func (m *MemHeaders) Put(sh StoredHeader, newBestHeader bool) error {
+	return m.PutHeaders([]StoredHeader{sh}, newBestHeader)
+}
+
+func (m *MemHeaders) PutHeaders(headers []StoredHeader, newBestHeader bool) error {
+	if len(headers) == 0 {
+		return nil
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return ErrHeaderDBClosed
+	}
+	now := time.Unix(time.Now().Unix(), 0)
+	for _, sh := range headers {
+		hash := sh.Header.BlockHash()
+		m.headers[hash] = sh
+		if _, ok := m.firstSeen[hash]; !ok {
+			m.firstSeen[hash] = now
+		}
+	}
+	if newBestHeader {
+		best := headers[len(headers)-1]
+		m.best = &best
+		m.updateHeights(best)
+	}
+	return nil
+}
+
+// updateHeights points the height index at the chain ending in best, see updateHeightIndex
+func (m *MemHeaders) updateHeights(best StoredHeader) {
+	for height := range m.heights {
+		if height > best.Height {
+			delete(m.heights, height)
+		}
+	}
+	sh := best
+	for {
+		hash := sh.Header.BlockHash()
+		if cur, ok := m.heights[sh.Height]; ok && cur == hash {
+			return
+		}
+		m.heights[sh.Height] = hash
+		if sh.Height == 0 {
+			return
+		}
+		prev, ok := m.headers[sh.Header.PrevBlock]
+		if !ok {
+			return
+		}
+		sh = prev
+	}
+}
+
+func (m *MemHeaders) Prune(policy PrunePolicy) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return ErrHeaderDBClosed
+	}
+	if m.best == nil {
+		return errors.New("ChainTip not set")
+	}
+	toDelete, pruneHeight := prunable(m.headers, *m.best, policy, func(hash chainhash.Hash, height uint32) bool {
+		cur, ok := m.heights[height]
+		return ok && cur == hash
+	})
+	for hash := range toDelete {
+		m.delete(hash)
+	}
+	if pruneHeight > 0 {
+		for height := range m.heights {
+			if height <= pruneHeight {
+				delete(m.heights, height)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MemHeaders) DeleteAfter(height uint32, keepForks bool) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return ErrHeaderDBClosed
+	}
+	if m.best != nil && m.best.Height > height {
+		hash, ok := m.heights[height]
+		if !ok {
+			return fmt.Errorf("no header at height %d on the best chain", height)
+		}
+		best := m.headers[hash]
+		m.best = &best
+	}
+	for h, hash := range m.heights {
+		if h > height {
+			m.delete(hash)
+			delete(m.heights, h)
+		}
+	}
+	if !keepForks {
+		for hash, sh := range m.headers {
+			if sh.Height > height {
+				m.delete(hash)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MemHeaders) delete(hash chainhash.Hash) {
+	delete(m.headers, hash)
+	delete(m.firstSeen, hash)
+}
+
+func (m *MemHeaders) GetPreviousHeader(header wire.BlockHeader) (StoredHeader, error) {
+	return m.GetHeader(header.PrevBlock)
+}
+
+func (m *MemHeaders) GetHeader(hash chainhash.Hash) (StoredHeader, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	sh, ok := m.headers[hash]
+	if !ok {
+		return sh, errors.New("Header does not exist in database")
+	}
+	return sh, nil
+}
+
+func (m *MemHeaders) GetHeaderByHeight(height uint32) (StoredHeader, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	hash, ok := m.heights[height]
+	if !ok {
+		return StoredHeader{}, fmt.Errorf("no header at height %d on the best chain", height)
+	}
+	sh, ok := m.headers[hash]
+	if !ok {
+		return StoredHeader{}, fmt.Errorf("header %s at height %d does not exist in database", hash.String(), height)
+	}
+	return sh, nil
+}
+
+func (m *MemHeaders) GetHeadersByHeight(from, to uint32) ([]StoredHeader, error) {
+	if from > to {
+		return nil, fmt.Errorf("no headers between height %d and %d", from, to)
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	headers := make([]StoredHeader, 0, to-from+1)
+	for height := from; height <= to; height++ {
+		hash, ok := m.heights[height]
+		if !ok {
+			return nil, fmt.Errorf("no header at height %d on the best chain", height)
+		}
+		sh, ok := m.headers[hash]
+		if !ok {
+			return nil, fmt.Errorf("header %s at height %d does not exist in database", hash.String(), height)
+		}
+		headers = append(headers, sh)
+	}
+	return headers, nil
+}
+
+func (m *MemHeaders) GetBestHeader() (StoredHeader, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.best == nil {
+		return StoredHeader{}, errors.New("ChainTip not set")
+	}
+	return *m.best, nil
+}
+
+func (m *MemHeaders) Height() (uint32, error) {
+	best, err := m.GetBestHeader()
+	return best.Height, err
+}
+
+func (m *MemHeaders) Close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.closed = true
+}
+
+func (m *MemHeaders) Print(w io.Writer) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var all []StoredHeader
+	for _, sh := range m.headers {
+		all = append(all, sh)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Height < all[j].Height
+	})
+	for _, sh := range all {
+		fmt.Fprintf(w, "Height: %d, Hash: %s, Parent: %s\n", sh.Height, sh.Header.BlockHash().String(), sh.Header.PrevBlock.String())
+	}
+}
+
+func (m *MemHeaders) GetTips() ([]StoredHeader, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	parents := make(map[chainhash.Hash]bool)
+	for _, sh := range m.headers {
+		parents[sh.Header.PrevBlock] = true
+	}
+	var tips []StoredHeader
+	for hash, sh := range m.headers {
+		if !parents[hash] {
+			tips = append(tips, sh)
+		}
+	}
+	return tips, nil
+}
+
+func (m *MemHeaders) GetFirstSeen(hash chainhash.Hash) (time.Time, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	t, ok := m.firstSeen[hash]
+	if !ok {
+		return t, fmt.Errorf("first seen time of %s is not recorded", hash.String())
+	}
+	return t, nil
+}
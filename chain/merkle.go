@@ -0,0 +1,204 @@
+package chain
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// A block can't hold more transactions than this, the max block weight over the
+// weight of the smallest transaction
+const maxMerkleTxs = 4000000 / 240
+
+// ProofErrorCode identifies why a merkle proof was rejected
+type ProofErrorCode int
+
+const (
+	ErrBadProof ProofErrorCode = iota
+	ErrBadMerkleTree
+	ErrMerkleRootMismatch
+	ErrTxNotMatched
+	ErrUnknownBlock
+	ErrWrongHeight
+)
+
+// ProofError is returned when a merkle proof doesn't show a transaction is in a block
+type ProofError struct {
+	Code ProofErrorCode
+	Err  error
+}
+
+func (err ProofError) Error() string {
+	return err.Err.Error()
+}
+
+func proofError(code ProofErrorCode, format string, args ...interface{}) ProofError {
+	return ProofError{
+		Code: code,
+		Err:  fmt.Errorf(format, args...),
+	}
+}
+
+// InclusionResult describes the block a transaction was proven to be in
+type InclusionResult struct {
+	TxHash    chainhash.Hash
+	BlockHash chainhash.Hash
+	Height    uint32
+	// The block is on the best chain
+	MainChain bool
+	// Zero unless the block is on the best chain, one if it is the best header
+	Confirmations uint32
+}
+
+// VerifyTxInclusion checks that proof, a serialized merkleblock message, proves tx is
+// in a block we have at height. The block doesn't have to be on the best chain, the
+// result tells whether it is.
+func (b *Blockchain) VerifyTxInclusion(tx *wire.MsgTx, proof []byte, height uint32) (*InclusionResult, error) {
+	mb := wire.MsgMerkleBlock{}
+	err := mb.BtcDecode(bytes.NewReader(proof), wire.ProtocolVersion, wire.LatestEncoding)
+	if err != nil {
+		return nil, proofError(ErrBadProof, "failed to decode proof: %v", err)
+	}
+	matches, err := MerkleBlockMatches(&mb)
+	if err != nil {
+		return nil, err
+	}
+	blockHash := mb.Header.BlockHash()
+	res := &InclusionResult{
+		TxHash:    tx.TxHash(),
+		BlockHash: blockHash,
+		Height:    height,
+	}
+	matched := false
+	for _, hash := range matches {
+		if hash == res.TxHash {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return nil, proofError(ErrTxNotMatched, "transaction %s not found in proof", res.TxHash.String())
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	// The header in the proof is only trusted once we have it
+	sh, err := b.db.GetHeader(blockHash)
+	if err != nil {
+		return nil, proofError(ErrUnknownBlock, "block %s in proof is unknown: %v", blockHash.String(), err)
+	}
+	if sh.Height != height {
+		return nil, proofError(ErrWrongHeight, "block %s is at height %d not %d", blockHash.String(), sh.Height, height)
+	}
+	if b.onBestChain(sh) {
+		best, err := b.db.GetBestHeader()
+		if err != nil {
+			return nil, err
+		}
+		res.MainChain = true
+		res.Confirmations = best.Height - height + 1
+	}
+	return res, nil
+}
+
+// MerkleBlockMatches returns the hashes of the transactions a merkleblock message says
+// matched the filter, after checking its partial merkle tree hashes to the merkle root in
+// its header. The header itself is not checked. None matching is no error.
+func MerkleBlockMatches(mb *wire.MsgMerkleBlock) ([]chainhash.Hash, error) {
+	root, matches, err := extractMatches(mb)
+	if err != nil {
+		return nil, err
+	}
+	if root != mb.Header.MerkleRoot {
+		return nil, proofError(ErrMerkleRootMismatch, "merkle root should be %s not %s, block hash in proof is %s",
+			mb.Header.MerkleRoot.String(), root.String(), mb.Header.BlockHash().String())
+	}
+	return matches, nil
+}
+
+// partialMerkleTree walks the partial merkle tree of a merkleblock message, see BIP37.
+type partialMerkleTree struct {
+	numTx    uint32
+	hashes   []*chainhash.Hash
+	flags    []byte
+	bitsUsed uint32
+	hashUsed uint32
+	matches  []chainhash.Hash
+	bad      bool
+}
+
+// width is the number of nodes at height, the leaves are at height 0
+func (t *partialMerkleTree) width(height uint32) uint32 {
+	return (t.numTx + (1 << height) - 1) >> height
+}
+
+func (t *partialMerkleTree) traverse(height, pos uint32) chainhash.Hash {
+	if t.bitsUsed >= uint32(len(t.flags))*8 {
+		t.bad = true
+		return chainhash.Hash{}
+	}
+	parentOfMatch := t.flags[t.bitsUsed/8]&(1<<(t.bitsUsed%8)) != 0
+	t.bitsUsed++
+	if height == 0 || !parentOfMatch {
+		if t.hashUsed >= uint32(len(t.hashes)) {
+			t.bad = true
+			return chainhash.Hash{}
+		}
+		hash := *t.hashes[t.hashUsed]
+		t.hashUsed++
+		if height == 0 && parentOfMatch {
+			t.matches = append(t.matches, hash)
+		}
+		return hash
+	}
+	left := t.traverse(height-1, pos*2)
+	right := left
+	if pos*2+1 < t.width(height-1) {
+		right = t.traverse(height-1, pos*2+1)
+		// Two equal children would let a tree with a duplicated transaction pass
+		// for the real one (CVE-2012-2459)
+		if right == left {
+			t.bad = true
+		}
+	}
+	var buf [chainhash.HashSize * 2]byte
+	copy(buf[:], left[:])
+	copy(buf[chainhash.HashSize:], right[:])
+	return chainhash.DoubleHashH(buf[:])
+}
+
+// extractMatches returns the merkle root the tree in mb hashes to and the transactions
+// it matches, an empty slice if none. Every hash and flag has to be used for the tree to
+// be valid.
+func extractMatches(mb *wire.MsgMerkleBlock) (chainhash.Hash, []chainhash.Hash, error) {
+	t := &partialMerkleTree{
+		numTx:  mb.Transactions,
+		hashes: mb.Hashes,
+		flags:  mb.Flags,
+	}
+	switch {
+	case t.numTx == 0:
+		return chainhash.Hash{}, nil, proofError(ErrBadMerkleTree, "proof has no transactions")
+	case t.numTx > maxMerkleTxs:
+		return chainhash.Hash{}, nil, proofError(ErrBadMerkleTree, "proof has %d transactions", t.numTx)
+	case uint32(len(t.hashes)) > t.numTx:
+		return chainhash.Hash{}, nil, proofError(ErrBadMerkleTree, "proof has more hashes than transactions")
+	case len(t.flags)*8 < len(t.hashes):
+		return chainhash.Hash{}, nil, proofError(ErrBadMerkleTree, "proof has fewer flag bits than hashes")
+	}
+	var height uint32
+	for t.width(height) > 1 {
+		height++
+	}
+	root := t.traverse(height, 0)
+	if t.bad || (t.bitsUsed+7)/8 != uint32(len(t.flags)) || t.hashUsed != uint32(len(t.hashes)) {
+		return chainhash.Hash{}, nil, proofError(ErrBadMerkleTree, "bad merkle tree")
+	}
+	// Most blocks match nothing a filter watches, that's no error
+	if t.matches == nil {
+		t.matches = []chainhash.Hash{}
+	}
+	return root, t.matches, nil
+}
@@ -0,0 +1,185 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// A testnet transaction and its proof from gettxoutproof, the block is at height 1151182
+const (
+	proofTx       = "010000000162148b88c5fd22eb3ae97c650f9638a749c7b31cce84687603cde618609d2c0b020000006b48304502210086f3948f23da16275d804dafeb576cc6ecbd8e1ee50012f8b523148130d37846022015a313dee224fb971b75a4c395726d7e471d45c272982bc1bbe04426d89993ea012103128a2c4525179e47f38cf3fefca37a61548ca4610255b3fb4ee86de2d3e80c0fffffffff03102700000000000017a91487a9652e9b396545598c0fc72cb5a98848bf93d3870000000000000000276a2566000000000000000200000000000000000a7714eb5a0b4f369bd080bb4cd30e2d4d35f44c00710200000000001976a91428d2e8cee08857f569e5a1b147c5d5e87339e08188ac00000000"
+	txProof       = "000040202afc0fedbeb00d166634257e563f6cf74c458d876ca7bd9db801000000000000e95b4b17d1ad5e27ed395a900e708e3a091e22632318cdc49a98d07e70739c445f33675d31f7011a9b129d340e00000005c99aefe1d8373df4c5ef1486dd59391cb62ae52f6c20d0ac051e656ca7a9ac3762c1687386aa9a88b58a00416f72cacbdfb9d2ae9f0e0f16c2bf2dc7ba6c84295fe1a969548ddce398c9c880f02af141437053f7f1d913f93fc176beac6173c82b61dc50c63375da1922d1e5196304b66e3df3f3a78fba5e40708d5417572d130c32a0d5f59eddaee756eca9381824ea95985b3e9cc4b91b30ed95000e488193023b00"
+	proofTxHeight = uint32(1151182)
+)
+
+func isProofError(err error, code ProofErrorCode) bool {
+	perr, ok := err.(ProofError)
+	return ok && perr.Code == code
+}
+
+func decodeProof(t *testing.T) (*wire.MsgTx, []byte, wire.MsgMerkleBlock) {
+	rawTx, _ := hex.DecodeString(proofTx)
+	tx := wire.NewMsgTx(wire.TxVersion)
+	if err := tx.BtcDecode(bytes.NewReader(rawTx), wire.ProtocolVersion, wire.LatestEncoding); err != nil {
+		t.Fatal(err)
+	}
+	proof, _ := hex.DecodeString(txProof)
+	mb := wire.MsgMerkleBlock{}
+	if err := mb.BtcDecode(bytes.NewReader(proof), wire.ProtocolVersion, wire.LatestEncoding); err != nil {
+		t.Fatal(err)
+	}
+	return tx, proof, mb
+}
+
+func encodeProof(t *testing.T, mb *wire.MsgMerkleBlock) []byte {
+	var buf bytes.Buffer
+	if err := mb.BtcEncode(&buf, wire.ProtocolVersion, wire.LatestEncoding); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBlockchain_VerifyTxInclusion(t *testing.T) {
+	tx, proof, mb := decodeProof(t)
+	db := NewMemHeaders()
+	block := StoredHeader{Header: mb.Header, Height: proofTxHeight, totalWork: big.NewInt(0)}
+	if err := db.Put(block, true); err != nil {
+		t.Fatal(err)
+	}
+	bc, err := NewBlockchainWithHeaders(db, &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+
+	res, err := bc.VerifyTxInclusion(tx, proof, proofTxHeight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.MainChain || res.Confirmations != 1 || res.BlockHash != mb.Header.BlockHash() || res.TxHash != tx.TxHash() {
+		t.Errorf("Wrong result %+v", res)
+	}
+	main := buildTestBranch(block, 2)
+	if err := db.PutHeaders(main, true); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := bc.VerifyTxInclusion(tx, proof, proofTxHeight); err != nil || res.Confirmations != 3 {
+		t.Errorf("Expected 3 confirmations, got %+v: %v", res, err)
+	}
+
+	if _, err := bc.VerifyTxInclusion(tx, proof, proofTxHeight+1); !isProofError(err, ErrWrongHeight) {
+		t.Errorf("Expected a wrong height error, got %v", err)
+	}
+	if _, err := bc.VerifyTxInclusion(tx, proof[:len(proof)-1], proofTxHeight); !isProofError(err, ErrBadProof) {
+		t.Errorf("Expected a bad proof error, got %v", err)
+	}
+	other := tx.Copy()
+	other.LockTime++
+	if _, err := bc.VerifyTxInclusion(other, proof, proofTxHeight); !isProofError(err, ErrTxNotMatched) {
+		t.Errorf("Expected a tx not matched error, got %v", err)
+	}
+
+	tampered := mb
+	tampered.Hashes = append([]*chainhash.Hash{}, mb.Hashes...)
+	tampered.Hashes[0] = &chainhash.Hash{1}
+	if _, err := bc.VerifyTxInclusion(tx, encodeProof(t, &tampered), proofTxHeight); !isProofError(err, ErrMerkleRootMismatch) {
+		t.Errorf("Expected a root mismatch error, got %v", err)
+	}
+	tampered = mb
+	tampered.Hashes = append(append([]*chainhash.Hash{}, mb.Hashes...), &chainhash.Hash{1})
+	if _, err := bc.VerifyTxInclusion(tx, encodeProof(t, &tampered), proofTxHeight); !isProofError(err, ErrBadMerkleTree) {
+		t.Errorf("Expected a bad tree error for an unused hash, got %v", err)
+	}
+	tampered = mb
+	tampered.Flags = append(append([]byte{}, mb.Flags...), 0)
+	if _, err := bc.VerifyTxInclusion(tx, encodeProof(t, &tampered), proofTxHeight); !isProofError(err, ErrBadMerkleTree) {
+		t.Errorf("Expected a bad tree error for unused flags, got %v", err)
+	}
+
+	// A heavier branch takes over the height
+	fork := buildTestBranch(StoredHeader{Header: testHdr2, Height: proofTxHeight - 1, totalWork: big.NewInt(0)}, 4)
+	if err := db.PutHeaders(fork, true); err != nil {
+		t.Fatal(err)
+	}
+	res, err = bc.VerifyTxInclusion(tx, proof, proofTxHeight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.MainChain || res.Confirmations != 0 {
+		t.Errorf("Block is not on the best chain any more, got %+v", res)
+	}
+
+	unknown, err := NewBlockchainWithHeaders(NewMemHeaders(), &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unknown.Close()
+	if _, err := unknown.VerifyTxInclusion(tx, proof, proofTxHeight); !isProofError(err, ErrUnknownBlock) {
+		t.Errorf("Expected an unknown block error, got %v", err)
+	}
+}
+
+func TestExtractMatches_DuplicateLeaves(t *testing.T) {
+	// Two transactions with the same hash both matched, the root is the same as for a
+	// single transaction duplicated to fill the tree
+	hash := chainhash.Hash{7}
+	mb := &wire.MsgMerkleBlock{
+		Transactions: 2,
+		Hashes:       []*chainhash.Hash{&hash, &hash},
+		Flags:        []byte{0x07},
+	}
+	if _, _, err := extractMatches(mb); !isProofError(err, ErrBadMerkleTree) {
+		t.Errorf("Expected a bad tree error, got %v", err)
+	}
+	mb.Hashes[1] = &chainhash.Hash{8}
+	root, matches, err := extractMatches(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := chainhash.DoubleHashH(append(hash[:], mb.Hashes[1][:]...))
+	if root != want || len(matches) != 2 {
+		t.Errorf("Wrong root %s or matches %v", root, matches)
+	}
+}
+
+func TestMerkleBlockMatches_NoMatches(t *testing.T) {
+	// A block none of whose transactions matched the filter, the tree is just the root
+	tx, _, block := decodeProof(t)
+	mb := &wire.MsgMerkleBlock{
+		Header:       block.Header,
+		Transactions: block.Transactions,
+		Hashes:       []*chainhash.Hash{&block.Header.MerkleRoot},
+		Flags:        []byte{0x00},
+	}
+	proof := encodeProof(t, mb)
+	decoded := wire.MsgMerkleBlock{}
+	if err := decoded.BtcDecode(bytes.NewReader(proof), wire.ProtocolVersion, wire.LatestEncoding); err != nil {
+		t.Fatal(err)
+	}
+	matches, err := MerkleBlockMatches(&decoded)
+	if err != nil {
+		t.Fatalf("Error for a merkle block matching nothing: %v", err)
+	}
+	if matches == nil || len(matches) != 0 {
+		t.Errorf("Wrong matches %v", matches)
+	}
+
+	db := NewMemHeaders()
+	if err := db.Put(StoredHeader{Header: block.Header, Height: proofTxHeight, totalWork: big.NewInt(0)}, true); err != nil {
+		t.Fatal(err)
+	}
+	bc, err := NewBlockchainWithHeaders(db, &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	if _, err := bc.VerifyTxInclusion(tx, proof, proofTxHeight); !isProofError(err, ErrTxNotMatched) {
+		t.Errorf("Expected a tx not matched error, got %v", err)
+	}
+}
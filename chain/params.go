@@ -0,0 +1,262 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Networks btcd doesn't know about. An spv client only needs the genesis header, the
+// rest of the genesis block is left out.
+var (
+	TestNet4Params = newParams(chaincfg.TestNet3Params, "testnet4", 0x283f161c, "48333",
+		[]chaincfg.DNSSeed{{Host: "seed.testnet4.bitcoin.sprovoost.nl"}, {Host: "seed.testnet4.wiz.biz"}},
+		wire.BlockHeader{
+			Version:    1,
+			MerkleRoot: mustHash("7aa0a7ae1e223414cb807e40cd57e667b718e42aaf9306db9102fe28912b7b4e"),
+			Timestamp:  time.Unix(1714777860, 0),
+			Bits:       0x1d00ffff,
+			Nonce:      393743547,
+		})
+	LitecoinParams = newParams(chaincfg.MainNetParams, "litecoin", 0xdbb6c0fb, "9333",
+		[]chaincfg.DNSSeed{{Host: "seed-a.litecoin.loshan.co.uk", HasFiltering: true},
+			{Host: "dnsseed.thrasher.io", HasFiltering: true}, {Host: "dnsseed.litecointools.com"},
+			{Host: "dnsseed.litecoinpool.org"}},
+		wire.BlockHeader{
+			Version:    1,
+			MerkleRoot: mustHash("97ddfbbae6be97fd6cdf3e7ca13232a3afff2353e29badfab7f73011edd4ced9"),
+			Timestamp:  time.Unix(1317972665, 0),
+			Bits:       0x1e0ffff0,
+			Nonce:      2084524493,
+		})
+	// Shares its magic with bitcoin regtest, so its addresses can't be registered
+	LitecoinRegTestParams = newParams(chaincfg.RegressionNetParams, "litecoin-regtest", 0xdab5bffa, "19444", nil,
+		wire.BlockHeader{
+			Version:    1,
+			MerkleRoot: mustHash("97ddfbbae6be97fd6cdf3e7ca13232a3afff2353e29badfab7f73011edd4ced9"),
+			Timestamp:  time.Unix(1296688602, 0),
+			Bits:       0x207fffff,
+			Nonce:      0,
+		})
+)
+
+func init() {
+	TestNet4Params.BIP0034Height = 1
+	TestNet4Params.BIP0065Height = 1
+	TestNet4Params.BIP0066Height = 1
+
+	LitecoinParams.PowLimit = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 236), big.NewInt(1))
+	LitecoinParams.PowLimitBits = 0x1e0fffff
+	LitecoinParams.BIP0034Height = 710000
+	LitecoinParams.BIP0065Height = 918684
+	LitecoinParams.BIP0066Height = 811879
+	LitecoinParams.TargetTimespan = 302400 * time.Second
+	LitecoinParams.TargetTimePerBlock = 150 * time.Second
+	LitecoinParams.Bech32HRPSegwit = "ltc"
+	LitecoinParams.PubKeyHashAddrID = 0x30
+	LitecoinParams.ScriptHashAddrID = 0x32
+	LitecoinParams.PrivateKeyID = 0xb0
+	LitecoinParams.HDCoinType = 2
+
+	LitecoinRegTestParams.TargetTimespan = 302400 * time.Second
+	LitecoinRegTestParams.TargetTimePerBlock = 150 * time.Second
+	LitecoinRegTestParams.Bech32HRPSegwit = "rltc"
+	LitecoinRegTestParams.ScriptHashAddrID = 0x3a
+
+	// btcd has signet but doesn't register it
+	for _, p := range []*chaincfg.Params{&TestNet4Params, &chaincfg.SigNetParams, &LitecoinParams} {
+		if err := chaincfg.Register(p); err != nil {
+			panic(fmt.Sprintf("failed to register network %s: %v", p.Name, err))
+		}
+	}
+}
+
+func mustHash(s string) chainhash.Hash {
+	hash, err := chainhash.NewHashFromStr(s)
+	if err != nil {
+		panic(err)
+	}
+	return *hash
+}
+
+// newParams copies base and makes it a different network with its own genesis header
+func newParams(base chaincfg.Params, name string, net wire.BitcoinNet, port string, seeds []chaincfg.DNSSeed,
+	genesis wire.BlockHeader) chaincfg.Params {
+	p := base
+	p.Name = name
+	p.Net = net
+	p.DefaultPort = port
+	p.DNSSeeds = seeds
+	p.GenesisBlock = &wire.MsgBlock{Header: genesis}
+	hash := genesis.BlockHash()
+	p.GenesisHash = &hash
+	p.Checkpoints = nil
+	return p
+}
+
+// NetParams returns the params of a network by the name used in the config.
+func NetParams(net string) (*chaincfg.Params, error) {
+	switch net {
+	case "main", "mainnet":
+		return &chaincfg.MainNetParams, nil
+	case "test", "testnet3":
+		return &chaincfg.TestNet3Params, nil
+	case "testnet4":
+		return &TestNet4Params, nil
+	case "signet":
+		return &chaincfg.SigNetParams, nil
+	case "regtest":
+		return &chaincfg.RegressionNetParams, nil
+	case "sim", "simnet":
+		return &chaincfg.SimNetParams, nil
+	case "litecoin":
+		return &LitecoinParams, nil
+	case "litecoin-regtest":
+		return &LitecoinRegTestParams, nil
+	default:
+		return nil, fmt.Errorf("wrong net type: %s", net)
+	}
+}
+
+var (
+	customLock sync.RWMutex
+	// Checkpoints of networks loaded by LoadParams, by network name
+	customCheckpoints = make(map[string][]Checkpoint)
+)
+
+type paramsJSON struct {
+	// Network whose params are copied before the fields below are set, regtest if empty
+	Base                 string           `json:"base"`
+	Rules                string           `json:"rules"`
+	Name                 string           `json:"name"`
+	Net                  uint32           `json:"net"`
+	DefaultPort          string           `json:"default_port"`
+	DNSSeeds             []string         `json:"dns_seeds"`
+	GenesisHeader        string           `json:"genesis_header"`
+	PowLimitBits         *uint32          `json:"pow_limit_bits"`
+	ReduceMinDifficulty  *bool            `json:"reduce_min_difficulty"`
+	MinDiffReductionTime *int64           `json:"min_diff_reduction_time"`
+	Bech32HRP            string           `json:"bech32_hrp"`
+	PubKeyHashAddrID     *byte            `json:"pubkey_hash_addr_id"`
+	ScriptHashAddrID     *byte            `json:"script_hash_addr_id"`
+	PrivateKeyID         *byte            `json:"private_key_id"`
+	Checkpoints          []checkpointJSON `json:"checkpoints"`
+}
+
+// LoadParams reads the params of a custom network from a JSON file, e.g.
+//
+//	{"base": "regtest", "name": "privnet", "net": 3652501241, "default_port": "18555",
+//	 "dns_seeds": ["seed.example.org"], "genesis_header": "<80 byte header in hex>",
+//	 "pow_limit_bits": 545259519, "checkpoints": [{"height": 1000, "hash": "...", "header": "..."}]}
+//
+// Fields left out keep the value of the base network. "rules" picks the consensus rules,
+// bitcoin or litecoin, by default those of the base network. The checkpoints become the
+// built in ones of the network, headers are synced from the latest one before the wallet
+// was created.
+func LoadParams(file string) (*chaincfg.Params, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read params file %s: %v", file, err)
+	}
+	var pj paramsJSON
+	err = json.Unmarshal(data, &pj)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse params file %s: %v", file, err)
+	}
+	if pj.Name == "" || pj.Net == 0 || pj.GenesisHeader == "" {
+		return nil, fmt.Errorf("params file %s needs a name, net and genesis_header", file)
+	}
+	if pj.Base == "" {
+		pj.Base = "regtest"
+	}
+	base, err := NetParams(pj.Base)
+	if err != nil {
+		return nil, err
+	}
+	genesis, err := decodeHeader(pj.GenesisHeader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode genesis header: %v", err)
+	}
+	var seeds []chaincfg.DNSSeed
+	for _, host := range pj.DNSSeeds {
+		seeds = append(seeds, chaincfg.DNSSeed{Host: host})
+	}
+	port := base.DefaultPort
+	if pj.DefaultPort != "" {
+		port = pj.DefaultPort
+	}
+	p := newParams(*base, pj.Name, wire.BitcoinNet(pj.Net), port, seeds, genesis)
+	if pj.PowLimitBits != nil {
+		p.PowLimitBits = *pj.PowLimitBits
+		p.PowLimit = blockchain.CompactToBig(*pj.PowLimitBits)
+	}
+	if pj.ReduceMinDifficulty != nil {
+		p.ReduceMinDifficulty = *pj.ReduceMinDifficulty
+	}
+	if pj.MinDiffReductionTime != nil {
+		p.MinDiffReductionTime = time.Duration(*pj.MinDiffReductionTime) * time.Second
+	}
+	if pj.Bech32HRP != "" {
+		p.Bech32HRPSegwit = pj.Bech32HRP
+	}
+	if pj.PubKeyHashAddrID != nil {
+		p.PubKeyHashAddrID = *pj.PubKeyHashAddrID
+	}
+	if pj.ScriptHashAddrID != nil {
+		p.ScriptHashAddrID = *pj.ScriptHashAddrID
+	}
+	if pj.PrivateKeyID != nil {
+		p.PrivateKeyID = *pj.PrivateKeyID
+	}
+	if p.PowLimit.Cmp(big.NewInt(0)) <= 0 {
+		return nil, fmt.Errorf("pow limit of %s must be positive", pj.Name)
+	}
+	var rules ConsensusRules
+	switch pj.Rules {
+	case "":
+		rules = RulesFor(base)
+	case "bitcoin":
+		rules = BitcoinRules{}
+	case "litecoin":
+		rules = LitecoinRules{}
+	default:
+		return nil, fmt.Errorf("unknown consensus rules %s", pj.Rules)
+	}
+
+	cps := make([]Checkpoint, 0, len(pj.Checkpoints))
+	for _, c := range pj.Checkpoints {
+		cp, err := c.checkpoint()
+		if err != nil {
+			return nil, err
+		}
+		cps = append(cps, cp)
+	}
+	if err = chaincfg.Register(&p); err != nil {
+		return nil, fmt.Errorf("failed to register network %s: %v", pj.Name, err)
+	}
+	customLock.Lock()
+	customCheckpoints[p.Name] = cps
+	customLock.Unlock()
+	RegisterRules(p.Name, rules)
+	return &p, nil
+}
+
+func decodeHeader(s string) (wire.BlockHeader, error) {
+	var hdr wire.BlockHeader
+	raw, err := hex.DecodeString(s)
+	if err != nil {
+		return hdr, err
+	}
+	err = hdr.Deserialize(bytes.NewReader(raw))
+	return hdr, err
+}
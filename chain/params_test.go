@@ -0,0 +1,110 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+func TestNetParams(t *testing.T) {
+	for name, genesis := range map[string]string{
+		"main":     "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f",
+		"test":     "000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943",
+		"testnet4": "00000000da84f2bafbbc53dee25a72ae507ff4914b867c565be350b0da8bf043",
+		"signet":   "00000008819873e925422c1ff0f99f7cc9bbb232af63a077a480a3633bee1ef6",
+		"regtest":  "0f9188f13cb7b2c71f2a335e3a4fc328bf5beb436012afca590b1a11466e2206",
+	} {
+		p, err := NetParams(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.GenesisHash.String() != genesis || p.GenesisBlock.Header.BlockHash().String() != genesis {
+			t.Errorf("Wrong genesis for %s", name)
+		}
+	}
+	if _, err := NetParams("foo"); err == nil {
+		t.Error("Returned params for an unknown network")
+	}
+	// Without checkpoints headers are synced from genesis
+	if cp := GetCheckpoint(time.Now(), &TestNet4Params); cp.Height != 0 || cp.Header.BlockHash() != *TestNet4Params.GenesisHash {
+		t.Error("Testnet4 doesn't start at genesis")
+	}
+}
+
+func TestLoadParams(t *testing.T) {
+	var buf bytes.Buffer
+	chaincfg.RegressionNetParams.GenesisBlock.Header.Serialize(&buf)
+	genesis := hex.EncodeToString(buf.Bytes())
+	headers := decodeTestHeaders(t, chain)
+	file := `{"name": "privnet", "net": 305419896, "default_port": "18555", "dns_seeds": ["seed.example.org"],
+		"genesis_header": "` + genesis + `", "bech32_hrp": "prv",
+		"checkpoints": [{"height": 5, "hash": "` + headers[4].BlockHash().String() + `", "header": "` + chain[4] + `"}]}`
+	err := ioutil.WriteFile("params.json", []byte(file), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("params.json")
+
+	p, err := LoadParams("params.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "privnet" || p.Net != 0x12345678 || p.DefaultPort != "18555" || len(p.DNSSeeds) != 1 ||
+		p.Bech32HRPSegwit != "prv" || *p.GenesisHash != *chaincfg.RegressionNetParams.GenesisHash {
+		t.Errorf("Loaded wrong params %+v", p)
+	}
+	// The rest comes from regtest, which must be left alone
+	if p.PowLimitBits != chaincfg.RegressionNetParams.PowLimitBits || chaincfg.RegressionNetParams.Name != "regtest" {
+		t.Error("Base params were not copied")
+	}
+	if !chaincfg.IsBech32SegwitPrefix("prv1") {
+		t.Error("Network was not registered")
+	}
+	if _, ok := RulesFor(p).(BitcoinRules); !ok {
+		t.Errorf("Regtest based network has rules %T", RulesFor(p))
+	}
+
+	bc, err := NewBlockchainWithHeaders(NewMemHeaders(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	best, err := bc.BestBlock()
+	if err != nil || best.Height != 5 || best.Header.BlockHash() != headers[4].BlockHash() {
+		t.Fatal("Custom network didn't start at its checkpoint")
+	}
+	if _, _, err := bc.CommitHeaders(headers[5:]); err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := bc.db.Height(); h != uint32(len(headers)) {
+		t.Errorf("Expected height %d, got %d", len(headers), h)
+	}
+
+	// Rules are inherited from the base network
+	ioutil.WriteFile("params.json", []byte(`{"name": "ltcnet", "net": 305419897, "base": "litecoin-regtest",
+		"genesis_header": "`+genesis+`"}`), 0644)
+	if p, err := LoadParams("params.json"); err != nil {
+		t.Error(err)
+	} else if _, ok := RulesFor(p).(LitecoinRules); !ok {
+		t.Errorf("Litecoin based network has rules %T", RulesFor(p))
+	}
+
+	for _, bad := range []string{
+		`{"name": "privnet2", "net": 1}`,
+		`{"name": "privnet2", "net": 1, "genesis_header": "00"}`,
+		`{"name": "privnet2", "net": 1, "base": "foo", "genesis_header": "` + genesis + `"}`,
+		`{"name": "privnet2", "net": 1, "rules": "foo", "genesis_header": "` + genesis + `"}`,
+		// Clashes with bitcoin regtest
+		`{"name": "privnet2", "net": 3669344250, "genesis_header": "` + genesis + `"}`,
+	} {
+		ioutil.WriteFile("params.json", []byte(bad), 0644)
+		if _, err := LoadParams("params.json"); err == nil {
+			t.Errorf("Loaded invalid params %s", bad)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package chain
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// The most headers one stats call reads, 10 bitcoin retarget epochs
+const maxStatsHeaders = 20160
+
+// Target at difficulty 1. Full nodes use the mainnet value on every network so we do too,
+// that way the numbers can be compared.
+var diffOneTarget = blockchain.CompactToBig(0x1d00ffff)
+
+// Difficulty converts compact bits to the difficulty full nodes report.
+func Difficulty(bits uint32) float64 {
+	target := blockchain.CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return 0
+	}
+	d, _ := new(big.Float).Quo(new(big.Float).SetInt(diffOneTarget), new(big.Float).SetInt(target)).Float64()
+	return d
+}
+
+type HeaderWork struct {
+	Height     uint32
+	Hash       chainhash.Hash
+	Bits       uint32
+	Difficulty float64
+	// Counted from the checkpoint the header db was started from, not from genesis
+	ChainWork *big.Int
+}
+
+// GetChainWork returns the chainwork of the best chain at height.
+func (b *Blockchain) GetChainWork(height uint32) (*HeaderWork, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	sh, err := b.db.GetHeaderByHeight(height)
+	if err != nil {
+		return nil, fmt.Errorf("no header at height %d: %v", height, err)
+	}
+	return &HeaderWork{
+		Height:     sh.Height,
+		Hash:       sh.Header.BlockHash(),
+		Bits:       sh.Header.Bits,
+		Difficulty: Difficulty(sh.Header.Bits),
+		ChainWork:  sh.totalWork,
+	}, nil
+}
+
+type DifficultyEpoch struct {
+	// First height of the retarget epoch
+	Height uint32
+	// The first header of the epoch we have, which is the epoch start unless it was
+	// pruned or is below the requested range
+	FirstHeight uint32
+	FirstHash   chainhash.Hash
+	FirstTime   time.Time
+	Bits        uint32
+	Difficulty  float64
+	// Headers of the epoch we looked at
+	Headers uint32
+	// Headers mined at the minimum difficulty under the testnet 20 minute rule
+	MinDifficultyHeaders uint32
+}
+
+// GetDifficultyHistory returns the difficulty of every retarget epoch from height from to
+// height to on the best chain. from is raised to the lowest height we still have. On
+// networks with the testnet 20 minute rule the difficulty of an epoch is the one its
+// regular headers were mined at. The headers are read at once without holding up the
+// chain.
+func (b *Blockchain) GetDifficultyHistory(from, to uint32) ([]DifficultyEpoch, error) {
+	best, err := b.db.GetBestHeader()
+	if err != nil {
+		return nil, err
+	}
+	if to > best.Height {
+		to = best.Height
+	}
+	if lowest := b.lowestHeight(best.Height); from < lowest {
+		from = lowest
+	}
+	if from > to {
+		return nil, fmt.Errorf("no headers between height %d and %d", from, to)
+	}
+	if to-from >= maxStatsHeaders {
+		return nil, fmt.Errorf("range of %d headers is over the limit of %d", to-from+1, maxStatsHeaders)
+	}
+
+	headers, err := b.db.GetHeadersByHeight(from, to)
+	if err != nil {
+		return nil, err
+	}
+	interval := uint32(b.rules.RetargetInterval())
+	var epochs []DifficultyEpoch
+	var cur *DifficultyEpoch
+	for _, sh := range headers {
+		height := sh.Height
+		minDiff := b.params.ReduceMinDifficulty && sh.Header.Bits == b.params.PowLimitBits
+		if cur == nil || height%interval == 0 {
+			epochs = append(epochs, DifficultyEpoch{
+				Height:      height - height%interval,
+				FirstHeight: height,
+				FirstHash:   sh.Header.BlockHash(),
+				FirstTime:   sh.Header.Timestamp,
+				Bits:        b.params.PowLimitBits,
+			})
+			cur = &epochs[len(epochs)-1]
+			if !minDiff {
+				cur.Bits = sh.Header.Bits
+			}
+		} else if cur.MinDifficultyHeaders == cur.Headers && !minDiff {
+			// Every header so far was at the minimum, this is the first regular one
+			cur.Bits = sh.Header.Bits
+		}
+		cur.Headers++
+		if minDiff {
+			cur.MinDifficultyHeaders++
+		}
+	}
+	for i := range epochs {
+		epochs[i].Difficulty = Difficulty(epochs[i].Bits)
+	}
+	return epochs, nil
+}
+
+type BlockStats struct {
+	// The window runs from the header at From to the one at To
+	From uint32
+	To   uint32
+	// Time between consecutive headers. Timestamps don't have to increase, so an
+	// interval can be negative.
+	Mean   time.Duration
+	Median time.Duration
+	P90    time.Duration
+	P99    time.Duration
+	Min    time.Duration
+	Max    time.Duration
+	// Estimated hashes per second, the work done in the window over the time it took
+	Hashrate float64
+}
+
+// GetBlockStats returns the block intervals and network hashrate over the window
+// headers of the best chain ending at height to. Like GetDifficultyHistory it doesn't
+// hold up the chain.
+func (b *Blockchain) GetBlockStats(to, window uint32) (*BlockStats, error) {
+	if window == 0 || window > maxStatsHeaders {
+		return nil, fmt.Errorf("window must be between 1 and %d headers", maxStatsHeaders)
+	}
+	if to < window {
+		return nil, fmt.Errorf("no window of %d headers below height %d", window, to)
+	}
+	headers, err := b.db.GetHeadersByHeight(to-window, to)
+	if err != nil {
+		return nil, err
+	}
+	intervals := make([]time.Duration, window)
+	for i := range intervals {
+		intervals[i] = headers[i+1].Header.Timestamp.Sub(headers[i].Header.Timestamp)
+	}
+	first, last := headers[0], headers[window]
+	elapsed := last.Header.Timestamp.Sub(first.Header.Timestamp)
+
+	stats := &BlockStats{
+		From: first.Height,
+		To:   last.Height,
+		Mean: elapsed / time.Duration(window),
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+	stats.Min = intervals[0]
+	stats.Max = intervals[window-1]
+	stats.Median = percentile(intervals, 0.5)
+	stats.P90 = percentile(intervals, 0.9)
+	stats.P99 = percentile(intervals, 0.99)
+	if elapsed > 0 {
+		work := new(big.Int).Sub(last.totalWork, first.totalWork)
+		hashes, _ := new(big.Float).SetInt(work).Float64()
+		stats.Hashrate = hashes / elapsed.Seconds()
+	}
+	return stats, nil
+}
+
+// percentile picks the nearest rank from sorted values
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// lowestHeight finds the lowest height in the height index. The index has no gaps below
+// the best header, pruning only removes from the bottom.
+func (b *Blockchain) lowestHeight(best uint32) uint32 {
+	return uint32(sort.Search(int(best), func(i int) bool {
+		_, err := b.db.GetHeaderByHeight(uint32(i))
+		return err == nil
+	}))
+}
@@ -0,0 +1,285 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/boltdb/bolt"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/cevaris/ordered_map"
+)
+
+// VerifyReport is what Verify found wrong with the header db. The base is the lowest
+// stored header whose parent we don't have, i.e. the checkpoint or where the chain was
+// pruned; its height and total work are taken as they are.
+type VerifyReport struct {
+	// Number of records in the headers bucket
+	Headers int
+	Base    chainhash.Hash
+	// Records which can't be decoded or aren't stored under their own hash
+	Corrupt [][]byte
+	// Headers which don't connect to the base through stored headers
+	Orphans []chainhash.Hash
+	// Headers failing proof of work and everything built on them
+	BadPoW []chainhash.Hash
+	// Headers whose stored height or total work differs from the recomputed value
+	BadHeight []chainhash.Hash
+	BadWork   []chainhash.Hash
+	// The stored chain tip and the valid header with the most work
+	StoredTip chainhash.Hash
+	BestTip   chainhash.Hash
+	// Set if the chain tip is missing, invalid or isn't the most work header
+	BadTip bool
+	// Number of height index entries which don't match the best chain
+	BadIndex int
+}
+
+// OK reports whether the db passed every check.
+func (r *VerifyReport) OK() bool {
+	return len(r.Corrupt) == 0 && len(r.Orphans) == 0 && len(r.BadPoW) == 0 && len(r.BadHeight) == 0 &&
+		len(r.BadWork) == 0 && !r.BadTip && r.BadIndex == 0
+}
+
+// verifyState is what a verify pass works out, Repair writes it back.
+type verifyState struct {
+	report  VerifyReport
+	valid   map[chainhash.Hash]StoredHeader
+	changed []StoredHeader
+	remove  [][]byte
+	best    StoredHeader
+}
+
+// Verify walks every stored header checking proof of work and linkage, recomputes
+// heights and total work from the base and checks the chain tip and height index
+// against the result. Nothing is modified. It is meant to run offline, after a crash
+// left the db in a state the node can't start from.
+func (h *HeaderDB) Verify(params *chaincfg.Params) (*VerifyReport, error) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	var st *verifyState
+	err := h.db.View(func(btx *bolt.Tx) error {
+		var err error
+		st, err = verify(btx, params)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &st.report, nil
+}
+
+// Repair verifies the db and then deletes corrupt, orphaned and invalid records,
+// rewrites wrong heights and total work, points the chain tip at the most work header
+// and rebuilds the height index and cache from what is left. It returns the report
+// from before the repair.
+func (h *HeaderDB) Repair(params *chaincfg.Params) (*VerifyReport, error) {
+	var st *verifyState
+	err := h.write(func(btx *bolt.Tx) error {
+		var err error
+		st, err = verify(btx, params)
+		if err != nil {
+			return err
+		}
+		if len(st.valid) == 0 {
+			return errors.New("no valid headers left to repair from")
+		}
+		err = deleteHeaders(btx, st.remove)
+		if err != nil {
+			return err
+		}
+		for _, sh := range st.changed {
+			err = putHeader(btx, sh, false)
+			if err != nil {
+				return err
+			}
+		}
+		ser, err := serializeHeader(st.best)
+		if err != nil {
+			return err
+		}
+		err = btx.Bucket(BKTChainTip).Put(KEYChainTip, ser)
+		if err != nil {
+			return err
+		}
+		err = deleteHeightIndex(btx, 0, math.MaxUint32)
+		if err != nil {
+			return err
+		}
+		return updateHeightIndex(btx, st.best)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	h.lock.Lock()
+	h.cache = &HeaderCache{ordered_map.NewOrderedMap(), sync.RWMutex{}, CACHE_SIZE}
+	h.bestCache = nil
+	h.lock.Unlock()
+	h.initializeCache()
+	return &st.report, nil
+}
+
+func verify(btx *bolt.Tx, params *chaincfg.Params) (*verifyState, error) {
+	st := &verifyState{valid: make(map[chainhash.Hash]StoredHeader)}
+	r := &st.report
+
+	stored := make(map[chainhash.Hash]StoredHeader)
+	children := make(map[chainhash.Hash][]chainhash.Hash)
+	err := btx.Bucket(BKTHeaders).ForEach(func(k, v []byte) error {
+		r.Headers++
+		sh, err := deserializeHeader(v)
+		hash := sh.Header.BlockHash()
+		if err != nil || !bytes.Equal(k, hash[:]) {
+			key := append([]byte{}, k...)
+			r.Corrupt = append(r.Corrupt, key)
+			st.remove = append(st.remove, key)
+			return nil
+		}
+		stored[hash] = sh
+		children[sh.Header.PrevBlock] = append(children[sh.Header.PrevBlock], hash)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The base is the lowest header without a stored parent, on a tie the one with more work
+	var base *StoredHeader
+	for _, sh := range stored {
+		if _, ok := stored[sh.Header.PrevBlock]; ok {
+			continue
+		}
+		if base == nil || sh.Height < base.Height ||
+			(sh.Height == base.Height && sh.totalWork.Cmp(base.totalWork) > 0) {
+			sh := sh
+			base = &sh
+		}
+	}
+
+	rules := RulesFor(params)
+	reached := make(map[chainhash.Hash]bool)
+	if base != nil {
+		r.Base = base.Header.BlockHash()
+		queue := []StoredHeader{*base}
+		reached[r.Base] = true
+		for len(queue) > 0 {
+			sh := queue[0]
+			queue = queue[1:]
+			hash := sh.Header.BlockHash()
+			if !checkProofOfWork(sh.Header, params, rules) {
+				markInvalid(hash, children, reached, r)
+				continue
+			}
+			st.valid[hash] = sh
+			if st.best.totalWork == nil || sh.totalWork.Cmp(st.best.totalWork) > 0 {
+				st.best = sh
+			}
+			for _, ch := range children[hash] {
+				child := stored[ch]
+				reached[ch] = true
+				work := new(big.Int).Add(sh.totalWork, blockchain.CalcWork(child.Header.Bits))
+				dirty := false
+				if child.Height != sh.Height+1 {
+					r.BadHeight = append(r.BadHeight, ch)
+					child.Height = sh.Height + 1
+					dirty = true
+				}
+				if child.totalWork.Cmp(work) != 0 {
+					r.BadWork = append(r.BadWork, ch)
+					child.totalWork = work
+					dirty = true
+				}
+				if dirty {
+					st.changed = append(st.changed, child)
+				}
+				queue = append(queue, child)
+			}
+		}
+	}
+	for hash := range stored {
+		if !reached[hash] {
+			r.Orphans = append(r.Orphans, hash)
+		}
+	}
+	for _, hash := range append(r.Orphans, r.BadPoW...) {
+		st.remove = append(st.remove, hash.CloneBytes())
+	}
+	// Headers which get deleted don't need rewriting
+	kept := st.changed[:0]
+	for _, sh := range st.changed {
+		if _, ok := st.valid[sh.Header.BlockHash()]; ok {
+			kept = append(kept, sh)
+		}
+	}
+	st.changed = kept
+	sortHashes(r.Orphans)
+	sortHashes(r.BadPoW)
+
+	if len(st.valid) == 0 {
+		r.BadTip = btx.Bucket(BKTChainTip).Get(KEYChainTip) != nil
+		return st, nil
+	}
+	r.BestTip = st.best.Header.BlockHash()
+	r.BadTip = true
+	if b := btx.Bucket(BKTChainTip).Get(KEYChainTip); b != nil {
+		tip, err := deserializeHeader(b)
+		if err == nil {
+			r.StoredTip = tip.Header.BlockHash()
+			// Another header with the same work is as good a tip as the max-work one
+			if valid, ok := st.valid[r.StoredTip]; ok && valid.totalWork.Cmp(st.best.totalWork) == 0 &&
+				valid.Height == tip.Height && valid.totalWork.Cmp(tip.totalWork) == 0 {
+				r.BadTip = false
+				st.best = valid
+				r.BestTip = r.StoredTip
+			}
+		}
+	}
+
+	// Every height from the base to the best header should map to the best chain and nothing else
+	want := make(map[uint32][]byte)
+	for sh, ok := st.best, true; ok; sh, ok = st.valid[sh.Header.PrevBlock] {
+		hash := sh.Header.BlockHash()
+		want[sh.Height] = hash[:]
+	}
+	idx := btx.Bucket(BKTHeightIndex)
+	err = idx.ForEach(func(k, v []byte) error {
+		if len(k) != 4 || !bytes.Equal(want[binary.BigEndian.Uint32(k)], v) {
+			r.BadIndex++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for height := range want {
+		if idx.Get(heightKey(height)) == nil {
+			r.BadIndex++
+		}
+	}
+	return st, nil
+}
+
+// markInvalid records hash and everything built on it as failing proof of work.
+func markInvalid(hash chainhash.Hash, children map[chainhash.Hash][]chainhash.Hash, reached map[chainhash.Hash]bool, r *VerifyReport) {
+	stack := []chainhash.Hash{hash}
+	for len(stack) > 0 {
+		h := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		reached[h] = true
+		r.BadPoW = append(r.BadPoW, h)
+		stack = append(stack, children[h]...)
+	}
+}
+
+func sortHashes(hashes []chainhash.Hash) {
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+}
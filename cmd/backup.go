@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/ontio/spvclient/alliance"
+	"github.com/ontio/spvclient/backup"
+	"github.com/ontio/spvclient/chain"
+	"github.com/ontio/spvclient/rest/http/common"
+	"github.com/urfave/cli"
+)
+
+var (
+	backupDBFlag = cli.StringFlag{
+		Name:  "db",
+		Usage: "which db, " + common.BACKUP_HEADERS + " or " + common.BACKUP_WAITING,
+		Value: common.BACKUP_HEADERS,
+	}
+	snapshotFileFlag = cli.StringFlag{
+		Name:  "file",
+		Usage: "the snapshot `<file>`",
+	}
+)
+
+var backupCommand = cli.Command{
+	Name:   "backup",
+	Usage:  "download a snapshot of a db from the running spv client, needs RunRest and BackupToken",
+	Action: backupDB,
+	Flags: []cli.Flag{
+		backupDBFlag,
+		snapshotFileFlag,
+	},
+}
+
+var restoreCommand = cli.Command{
+	Name:   "restore",
+	Usage:  "check a snapshot and replace a db with it, the spv client must not be running",
+	Action: restoreDB,
+	Flags: []cli.Flag{
+		backupDBFlag,
+		snapshotFileFlag,
+	},
+}
+
+func backupDB(ctx *cli.Context) error {
+	file := ctx.String(snapshotFileFlag.Name)
+	if file == "" {
+		return fmt.Errorf("--%s is required", snapshotFileFlag.Name)
+	}
+	conf, err := loadConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if conf.BackupToken == "" {
+		return fmt.Errorf("BackupToken is not set in the config")
+	}
+
+	url := fmt.Sprintf("http://127.0.0.1:%d%s?db=%s", conf.RestPort, common.BACKUP, ctx.String(backupDBFlag.Name))
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+conf.BackupToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the spv client: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("backup refused: %s %s", resp.Status, msg)
+	}
+
+	var n int64
+	err = backup.WriteFile(file, func(w io.Writer) error {
+		n, err = io.Copy(w, resp.Body)
+		if err != nil {
+			return err
+		}
+		// Trailers are only there once the body has been read
+		if msg := resp.Trailer.Get(backup.TrailerError); msg != "" {
+			return fmt.Errorf("spv client failed to take the snapshot: %s", msg)
+		}
+		size, err := strconv.ParseInt(resp.Trailer.Get(backup.TrailerSize), 10, 64)
+		if err != nil || size != n {
+			return fmt.Errorf("snapshot is incomplete, got %d bytes", n)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save snapshot: %v", err)
+	}
+	fmt.Printf("saved a %d byte snapshot to %s\n", n, file)
+	return nil
+}
+
+func restoreDB(ctx *cli.Context) error {
+	file := ctx.String(snapshotFileFlag.Name)
+	if file == "" {
+		return fmt.Errorf("--%s is required", snapshotFileFlag.Name)
+	}
+	conf, err := loadConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch db := ctx.String(backupDBFlag.Name); db {
+	case common.BACKUP_HEADERS:
+		params, err := getNetParams(conf)
+		if err != nil {
+			return err
+		}
+		err = chain.RestoreHeaderDB(file, getRepoPath(conf, params), params)
+		if err != nil {
+			return fmt.Errorf("failed to restore header db: %v", err)
+		}
+	case common.BACKUP_WAITING:
+		err = alliance.RestoreWaitingDB(file, conf.WaitingDBPath)
+		if err != nil {
+			return fmt.Errorf("failed to restore waiting db: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown db %s", db)
+	}
+	fmt.Printf("restored the %s db from %s, the old one was kept with a .old suffix\n", ctx.String(backupDBFlag.Name), file)
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/ontio/spvclient"
+	"github.com/ontio/spvclient/chain"
+	"github.com/ontio/spvclient/config"
+	"github.com/ontio/spvclient/log"
+	"github.com/urfave/cli"
+)
+
+var repairFlag = cli.BoolFlag{
+	Name:  "repair",
+	Usage: "delete broken records and rebuild the chain tip, height index and cache from the rest",
+}
+
+var verifyCommand = cli.Command{
+	Name:   "verify",
+	Usage:  "check the header db for broken records, the spv client must not be running",
+	Action: verifyHeaders,
+	Flags: []cli.Flag{
+		repairFlag,
+	},
+}
+
+var (
+	bootstrapFileFlag = cli.StringFlag{
+		Name:  "file",
+		Usage: "the bootstrap `<file>` of headers",
+	}
+	fromFlag = cli.UintFlag{
+		Name:  "from",
+		Usage: "first `<height>` to export, defaults to the one above the lowest stored header",
+	}
+	toFlag = cli.UintFlag{
+		Name:  "to",
+		Usage: "last `<height>` to export, defaults to the best header",
+	}
+)
+
+var exportCommand = cli.Command{
+	Name:   "export",
+	Usage:  "write the best chain headers to a bootstrap file, the spv client must not be running",
+	Action: exportHeaders,
+	Flags: []cli.Flag{
+		bootstrapFileFlag,
+		fromFlag,
+		toFlag,
+	},
+}
+
+var importCommand = cli.Command{
+	Name:   "import",
+	Usage:  "validate and store the headers of a bootstrap file, the spv client must not be running",
+	Action: importHeaders,
+	Flags: []cli.Flag{
+		bootstrapFileFlag,
+	},
+}
+
+// loadConfig sets up logging and reads the config like the spv client does
+func loadConfig(ctx *cli.Context) (*config.Config, error) {
+	log.InitLog(ctx.GlobalInt(spvclient.GetFlagName(spvclient.LogLevelFlag)), log.Stdout)
+	conf, err := config.NewConfig(ctx.GlobalString(spvclient.GetFlagName(spvclient.ConfigFile)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to new a config: %v", err)
+	}
+	return conf, nil
+}
+
+// openHeaderDB opens the header db the config points at
+func openHeaderDB(ctx *cli.Context) (*chain.HeaderDB, *chaincfg.Params, error) {
+	conf, err := loadConfig(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	params, err := getNetParams(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := chain.NewHeaderDB(getRepoPath(conf, params))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open header db: %v", err)
+	}
+	return db, params, nil
+}
+
+// openBlockchain opens the header db the config points at with the checkpoints it sets
+func openBlockchain(ctx *cli.Context) (*chain.Blockchain, error) {
+	conf, err := loadConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	params, err := getNetParams(conf)
+	if err != nil {
+		return nil, err
+	}
+	// A new node is seeded by importing before it ever ran, so the repo may not exist yet
+	repoPath := getRepoPath(conf, params)
+	if err = os.MkdirAll(repoPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+	bc, err := chain.NewBlockchain(repoPath, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open header db: %v", err)
+	}
+	if conf.CheckpointFile != "" {
+		cps, err := chain.LoadCheckpoints(conf.CheckpointFile, params)
+		if err == nil {
+			err = bc.AddCheckpoints(cps)
+		}
+		if err != nil {
+			bc.Close()
+			return nil, err
+		}
+	}
+	return bc, nil
+}
+
+func exportHeaders(ctx *cli.Context) error {
+	file := ctx.String(bootstrapFileFlag.Name)
+	if file == "" {
+		return fmt.Errorf("--%s is required", bootstrapFileFlag.Name)
+	}
+	bc, err := openBlockchain(ctx)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	best, err := bc.BestBlock()
+	if err != nil {
+		return err
+	}
+	from, to := uint32(ctx.Uint(fromFlag.Name)), best.Height
+	if !ctx.IsSet(fromFlag.Name) {
+		// Start above the lowest header we store, which the importing node has as its
+		// checkpoint too. The height index has no gaps, so it can be searched.
+		lowest := sort.Search(int(best.Height), func(h int) bool {
+			_, err := bc.GetHeaderByHeight(uint32(h))
+			return err == nil
+		})
+		from = uint32(lowest) + 1
+	}
+	if ctx.IsSet(toFlag.Name) {
+		to = uint32(ctx.Uint(toFlag.Name))
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	err = bc.Export(f, from, to)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(file)
+		return fmt.Errorf("failed to export headers: %v", err)
+	}
+	fmt.Printf("exported headers %d to %d to %s\n", from, to, file)
+	return nil
+}
+
+func importHeaders(ctx *cli.Context) error {
+	file := ctx.String(bootstrapFileFlag.Name)
+	if file == "" {
+		return fmt.Errorf("--%s is required", bootstrapFileFlag.Name)
+	}
+	bc, err := openBlockchain(ctx)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := bc.Import(bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("failed to import headers after %d new ones: %v", n, err)
+	}
+	best, err := bc.BestBlock()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d new headers, best height is %d\n", n, best.Height)
+	return nil
+}
+
+func verifyHeaders(ctx *cli.Context) error {
+	db, params, err := openHeaderDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	report, err := db.Verify(params)
+	if err != nil {
+		return fmt.Errorf("failed to verify header db: %v", err)
+	}
+	printVerifyReport(report)
+	if report.OK() {
+		return nil
+	}
+	if !ctx.Bool(repairFlag.Name) {
+		return fmt.Errorf("header db is broken, run with --%s to repair it", repairFlag.Name)
+	}
+
+	if _, err = db.Repair(params); err != nil {
+		return fmt.Errorf("failed to repair header db: %v", err)
+	}
+	report, err = db.Verify(params)
+	if err != nil {
+		return fmt.Errorf("failed to verify header db: %v", err)
+	}
+	if !report.OK() {
+		printVerifyReport(report)
+		return fmt.Errorf("header db is still broken after repair")
+	}
+	fmt.Printf("repaired, chain tip is now %s\n", report.BestTip.String())
+	return nil
+}
+
+func printVerifyReport(r *chain.VerifyReport) {
+	fmt.Printf("headers:        %d\n", r.Headers)
+	fmt.Printf("base:           %s\n", r.Base.String())
+	fmt.Printf("stored tip:     %s\n", r.StoredTip.String())
+	fmt.Printf("most work tip:  %s\n", r.BestTip.String())
+	fmt.Printf("corrupt:        %d\n", len(r.Corrupt))
+	fmt.Printf("orphaned:       %d\n", len(r.Orphans))
+	fmt.Printf("bad pow:        %d\n", len(r.BadPoW))
+	fmt.Printf("wrong height:   %d\n", len(r.BadHeight))
+	fmt.Printf("wrong work:     %d\n", len(r.BadWork))
+	fmt.Printf("tip wrong:      %v\n", r.BadTip)
+	fmt.Printf("bad index keys: %d\n", r.BadIndex)
+}
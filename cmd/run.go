@@ -9,8 +9,10 @@ import (
 	"github.com/ontio/multi-chain/native/service/cross_chain_manager/btc"
 	"github.com/ontio/spvclient"
 	"github.com/ontio/spvclient/alliance"
+	"github.com/ontio/spvclient/chain"
 	"github.com/ontio/spvclient/config"
 	"github.com/ontio/spvclient/log"
+	"github.com/ontio/spvclient/netserv"
 	"github.com/ontio/spvclient/rest/http/restful"
 	"github.com/ontio/spvclient/rest/service"
 	"github.com/urfave/cli"
@@ -33,6 +35,13 @@ func setupApp() *cli.App {
 		spvclient.ConfigFile,
 		spvclient.GoMaxProcs,
 	}
+	app.Commands = []cli.Command{
+		verifyCommand,
+		exportCommand,
+		importCommand,
+		backupCommand,
+		restoreCommand,
+	}
 	app.Before = func(context *cli.Context) error {
 		cores := context.GlobalInt(spvclient.GoMaxProcs.Name)
 		runtime.GOMAXPROCS(cores)
@@ -65,16 +74,9 @@ func run(ctx *cli.Context) {
 		config.SleepTime = time.Duration(conf.SleepTime)
 	}
 
-	var netType *chaincfg.Params
-	switch conf.ConfigBitcoinNet {
-	case "regtest":
-		netType = &chaincfg.RegressionNetParams
-	case "test":
-		netType = &chaincfg.TestNet3Params
-	case "sim":
-		netType = &chaincfg.SimNetParams
-	default:
-		log.Errorf("wrong net type: %s", conf.ConfigBitcoinNet)
+	netType, err := getNetParams(conf)
+	if err != nil {
+		log.Errorf("%v", err)
 		os.Exit(1)
 	}
 
@@ -83,8 +85,17 @@ func run(ctx *cli.Context) {
 		log.Errorf("failed to start spv: %v", err)
 		os.Exit(1)
 	}
+	// The waiting db is shared by the voter and the rest service
+	var wdb *alliance.WaitingDB
+	if conf.RunVote == 1 {
+		wdb, err = alliance.NewWaitingDB(conf.WaitingDBPath, conf.MaxReadSize)
+		if err != nil {
+			log.Fatalf("Failed to open waiting db: %v", err)
+			os.Exit(1)
+		}
+	}
 	if conf.RunRest == 1 {
-		_, err = startServer(conf, wallet)
+		_, err = startServer(conf, wallet, wdb)
 		if err != nil {
 			log.Fatalf("Failed to start rest service: %v", err)
 			os.Exit(1)
@@ -94,34 +105,100 @@ func run(ctx *cli.Context) {
 	voting := make(chan *btc.BtcProof, 10)
 	txchan := make(chan *alliance.ToSignItem, 10)
 	if conf.RunVote == 1 {
-		_, _, err = startAllianceService(conf, wallet, voting, txchan, netType)
+		_, _, err = startAllianceService(conf, wallet, wdb, voting, txchan, netType)
 		if err != nil {
 			log.Fatalf("Failed to start alliance service: %v", err)
 		}
 	}
 
-	if conf.IsRestart == 1 {
-		resyncSpv(wallet, conf.RestartDuration)
-	} else {
-		waitToExit()
-	}
+	waitToExit()
 }
 
-func startSpv(c *config.Config, netType *chaincfg.Params) (*spvclient.SPVWallet, error) {
-	conf := spvclient.NewDefaultConfig()
-	conf.IsVote = c.RunVote == 1
+func getNetParams(c *config.Config) (*chaincfg.Params, error) {
+	if c.NetParamsFile != "" {
+		return chain.LoadParams(c.NetParamsFile)
+	}
+	return chain.NetParams(c.ConfigBitcoinNet)
+}
 
+// getRepoPath returns the directory the spv wallet keeps its dbs in
+func getRepoPath(c *config.Config, netType *chaincfg.Params) string {
+	repoPath := spvclient.NewDefaultConfig().RepoPath
 	if c.ConfigDBPath != "" {
-		conf.RepoPath = c.ConfigDBPath
+		repoPath = c.ConfigDBPath
+	}
+	// Networks other than these came later and get a directory of their own
+	switch netType.Name {
+	case chaincfg.MainNetParams.Name, chaincfg.TestNet3Params.Name, chaincfg.SimNetParams.Name:
+		return repoPath
+	default:
+		return path.Join(repoPath, netType.Name)
 	}
+}
 
-	conf.Params = netType
-	if netType.Name == "regtest" {
-		conf.RepoPath = path.Join(conf.RepoPath, "regtest")
+// resolvePeer resolves a trusted peer given as host or host:port
+func resolvePeer(addr, defaultPort string) (net.Addr, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, defaultPort)
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve trusted peer %s: %v", addr, err)
 	}
+	return tcpAddr, nil
+}
+
+func startSpv(c *config.Config, netType *chaincfg.Params) (*spvclient.SPVWallet, error) {
+	conf := spvclient.NewDefaultConfig()
+	conf.RepoPath = getRepoPath(c, netType)
+	conf.Params = netType
 	if c.TrustedPeer != "" {
 		conf.TrustedPeer, _ = net.ResolveTCPAddr("tcp", c.TrustedPeer+":"+conf.Params.DefaultPort)
 	}
+	for _, p := range c.TrustedPeers {
+		addr, err := resolvePeer(p.Addr, conf.Params.DefaultPort)
+		if err != nil {
+			return nil, err
+		}
+		conf.TrustedPeers.Peers = append(conf.TrustedPeers.Peers, netserv.TrustedPeer{Addr: addr, Priority: p.Priority})
+	}
+	conf.TrustedPeers.Quorum = c.TrustedQuorum
+	conf.PrunePolicy.MainChainDepth = c.PruneMainChainDepth
+	if c.PruneStaleBranchDepth > 0 {
+		conf.PrunePolicy.StaleBranchDepth = c.PruneStaleBranchDepth
+	}
+	if c.PruneInterval > 0 {
+		conf.PruneInterval = time.Duration(c.PruneInterval) * time.Minute
+	}
+	// The stale tip monitor replaces restarting the sync from here
+	if c.IsRestart != 1 {
+		conf.StaleTip.CheckInterval = 0
+	} else if c.RestartDuration > 0 {
+		conf.StaleTip.StaleAfter = time.Duration(c.RestartDuration) * time.Minute
+	}
+	if c.Redeem != "" {
+		redeem, err := hex.DecodeString(c.Redeem)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode redeem %s: %v", c.Redeem, err)
+		}
+		conf.Filter.Redeem = redeem
+	}
+	mode, err := netserv.ParseSyncMode(c.SyncMode)
+	if err != nil {
+		return nil, err
+	}
+	conf.SyncMode = mode
+	conf.CFilter.StartHeight = c.CFilterStartHeight
+	if c.RebroadcastInterval > 0 {
+		conf.Broadcast.RebroadcastInterval = time.Duration(c.RebroadcastInterval) * time.Minute
+	}
+	if c.CheckpointFile != "" {
+		cps, err := chain.LoadCheckpoints(c.CheckpointFile, netType)
+		if err != nil {
+			return nil, err
+		}
+		conf.Checkpoints = cps
+	}
 
 	wallet, err := spvclient.NewSPVWallet(conf)
 	if err != nil {
@@ -132,26 +209,32 @@ func startSpv(c *config.Config, netType *chaincfg.Params) (*spvclient.SPVWallet,
 	return wallet, nil
 }
 
-func startServer(conf *config.Config, wallet *spvclient.SPVWallet) (restful.ApiServer, error) {
-	serv := service.NewService(wallet)
+func startServer(conf *config.Config, wallet *spvclient.SPVWallet, wdb *alliance.WaitingDB) (restful.ApiServer, error) {
+	var waiting service.WaitingDB
+	if wdb != nil {
+		waiting = wdb
+	}
+	serv := service.NewService(wallet, waiting, conf.BackupToken)
 	restServer := restful.InitRestServer(serv, conf.RestPort)
 	go restServer.Start()
 
 	return restServer, nil
 }
 
-func startAllianceService(conf *config.Config, wallet *spvclient.SPVWallet, voting chan *btc.BtcProof,
-	txchan chan *alliance.ToSignItem, params *chaincfg.Params) (*alliance.Observer, *alliance.Voter, error) {
+func startAllianceService(conf *config.Config, wallet *spvclient.SPVWallet, wdb *alliance.WaitingDB,
+	voting chan *btc.BtcProof, txchan chan *alliance.ToSignItem, params *chaincfg.Params) (*alliance.Observer, *alliance.Voter, error) {
+	if conf.AlliaCheckpointFile != "" {
+		err := alliance.LoadCheckpoints(conf.AlliaCheckpointFile)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 	allia := sdk.NewMultiChainSdk()
 	allia.NewRpcClient().SetAddress(conf.AllianceJsonRpcAddress)
 	acct, err := alliance.GetAccountByPassword(allia, conf.WalletFile, conf.WalletPwd)
 	if err != nil {
 		return nil, nil, fmt.Errorf("GetAccountByPassword failed: %v", err)
 	}
-	wdb, err := alliance.NewWaitingDB(conf.WaitingDBPath, conf.MaxReadSize)
-	if err != nil {
-		return nil, nil, err
-	}
 	ob := alliance.NewObserver(allia, voting, txchan, conf.AlliaObLoopWaitTime, conf.WatchingKey, conf.WatchingMakeTxKey,
 		conf.AlliaNet, wdb, conf.CircleToSaveHeight)
 	go ob.Listen()
@@ -164,6 +247,7 @@ func startAllianceService(conf *config.Config, wallet *spvclient.SPVWallet, voti
 	if err != nil {
 		return ob, v, fmt.Errorf("failed to new a voter: %v", err)
 	}
+	v.CrossCheck = conf.CrossCheckProof == 1
 
 	go v.Vote()
 	go v.WaitingRetry()
@@ -177,82 +261,6 @@ func startAllianceService(conf *config.Config, wallet *spvclient.SPVWallet, voti
 	return ob, v, nil
 }
 
-func resyncSpv(wallet *spvclient.SPVWallet, dura int) {
-	sh, err := wallet.Blockchain.BestBlock()
-	if err != nil {
-		log.Fatalf("Failed to get best block: %v", err)
-		os.Exit(1)
-	}
-	lasth := sh.Height
-
-	again := false
-	td := time.Duration(dura) * time.Minute
-	timer := time.NewTimer(td)
-	for {
-		select {
-		case <-timer.C:
-			sh, err = wallet.Blockchain.BestBlock()
-			if err != nil {
-				log.Fatalf("Failed to get best block: %v", err)
-				continue
-			}
-			if lasth >= sh.Height {
-				isrb := false
-				log.Debugf("Restart now")
-				//if isVote {
-				//	log.Debugf("stop voter")
-				//	voter.Stop()
-				//}
-				//if restServer != nil {
-				//	log.Debugf("stop rest service")
-				//	restServer.Stop()
-				//}
-
-				if again {
-					log.Debugf("It happened TWICE")
-					err = wallet.Blockchain.Rollback(sh.Header.Timestamp.Add(-180 * time.Minute))
-					if err != nil {
-						log.Fatalf("Failed to rollback: %v", err)
-						continue
-					}
-					isrb = true
-					//_ = os.RemoveAll(path.Join(config.RepoPath, "peers.json"))
-				}
-
-				wallet.ReSync()
-				//wallet.Close()
-				//
-				//wallet, _ = spvclient.NewSPVWallet(config)
-				//wallet.Start()
-
-				//if ctx.GlobalInt(spvclient.RunRest.Name) == 1 {
-				//	restServer, err = startServer(ctx, wallet)
-				//	if err != nil {
-				//		log.Fatalf("Failed to restart rest service: %v", err)
-				//		continue
-				//	}
-				//}
-
-				//if isVote {
-				//	voter.Restart(wallet)
-				//}
-
-				log.Info("The block header is not updated for a long time. Restart the service")
-				if isrb {
-					again = false
-				} else {
-					again = true
-				}
-				timer.Reset(td / 2)
-			} else {
-				again = false
-				timer.Reset(td)
-			}
-			lasth = sh.Height
-		}
-	}
-}
-
 func waitToExit() {
 	exit := make(chan bool, 0)
 	sc := make(chan os.Signal, 1)
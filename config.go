@@ -3,6 +3,8 @@ package spvclient
 import (
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/mitchellh/go-homedir"
+	"github.com/ontio/spvclient/chain"
+	"github.com/ontio/spvclient/netserv"
 	"github.com/urfave/cli"
 	"golang.org/x/net/proxy"
 	"net"
@@ -10,6 +12,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 )
 
 const (
@@ -59,10 +62,37 @@ type Config struct {
 	// If you wish to connect to a single trusted peer set this. Otherwise leave nil.
 	TrustedPeer net.Addr
 
+	// Our own nodes to connect to instead of peers from the network, TrustedPeer comes first
+	// among them if set. The healthiest is synced from.
+	TrustedPeers netserv.TrustedPeersConfig
+
 	// A Tor proxy can be set here causing the wallet will use Tor
 	Proxy proxy.Dialer
 
-	IsVote bool
+	// Which headers to keep and how often to prune the rest. Pruning is off if the interval is zero.
+	PrunePolicy   chain.PrunePolicy
+	PruneInterval time.Duration
+
+	// Checkpoints to enforce on top of the built in ones
+	Checkpoints []chain.Checkpoint
+
+	// Header storage to use instead of the bolt db in RepoPath
+	Headers chain.Headers
+
+	// When the tip stops moving while peers announce greater heights, the sync peer is
+	// rotated and, if peers follow a branch we know, the best chain rolled back to its fork
+	StaleTip netserv.StaleTipConfig
+
+	// What the bloom filter loaded into peers watches
+	Filter netserv.FilterConfig
+
+	// Bloom filtered merkle blocks by default. With compact filters, filter headers are taken
+	// from several peers and the filters matched against what Filter watches.
+	SyncMode netserv.SyncMode
+	CFilter  netserv.CFilterConfig
+
+	// Transactions we broadcast are announced again until they are seen in a block
+	Broadcast netserv.BroadcastConfig
 }
 
 func NewDefaultConfig() *Config {
@@ -72,9 +102,14 @@ func NewDefaultConfig() *Config {
 		os.Mkdir(repoPath, os.ModePerm)
 	}
 	return &Config{
-		IsVote:    false,
-		UserAgent: "spvclient",
-		RepoPath:  repoPath,
+		UserAgent:     "spvclient",
+		RepoPath:      repoPath,
+		PrunePolicy:   chain.DefaultPrunePolicy,
+		PruneInterval: time.Hour,
+		StaleTip: netserv.StaleTipConfig{
+			CheckInterval: time.Minute,
+			StaleAfter:    30 * time.Minute,
+		},
 	}
 }
 
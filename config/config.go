@@ -22,8 +22,11 @@ type Config struct {
 	BtcPrivkFile           string
 	WatchingMakeTxKey      string
 	ConfigBitcoinNet       string
+	NetParamsFile          string
 	ConfigDBPath           string
 	TrustedPeer            string
+	TrustedPeers           []TrustedPeer
+	TrustedQuorum          int
 	RunRest                int
 	RunVote                int
 	RestartDuration        int
@@ -33,6 +36,21 @@ type Config struct {
 	AlliaNet               string
 	CircleToSaveHeight     uint32
 	MaxReadSize            int64
+	PruneMainChainDepth    uint32
+	PruneStaleBranchDepth  uint32
+	PruneInterval          int
+	CheckpointFile         string
+	AlliaCheckpointFile    string
+	BackupToken            string
+	SyncMode               string
+	CFilterStartHeight     uint32
+	CrossCheckProof        int
+	RebroadcastInterval    int
+}
+
+type TrustedPeer struct {
+	Addr     string
+	Priority int
 }
 
 func NewConfig(file string) (*Config, error) {
@@ -0,0 +1,93 @@
+// Package migration keeps track of the schema version of a bolt db and upgrades
+// older dbs in place when they are opened.
+package migration
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/ontio/spvclient/log"
+)
+
+var (
+	BKTMeta    = []byte("Meta")
+	KEYVersion = []byte("version")
+)
+
+// Migration brings a db from Version-1 to Version. Apply runs in the same transaction
+// as the version bump, so a failed migration leaves the db as it was.
+type Migration struct {
+	Version     uint32
+	Description string
+	Apply       func(btx *bolt.Tx) error
+}
+
+// Latest is the schema version a db is at once every migration has run.
+func Latest(migrations []Migration) uint32 {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// GetVersion returns the schema version of the db. Dbs written before versions were
+// recorded are at version 0.
+func GetVersion(btx *bolt.Tx) uint32 {
+	meta := btx.Bucket(BKTMeta)
+	if meta == nil {
+		return 0
+	}
+	v := meta.Get(KEYVersion)
+	if len(v) != 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(v)
+}
+
+func setVersion(btx *bolt.Tx, version uint32) error {
+	meta, err := btx.CreateBucketIfNotExists(BKTMeta)
+	if err != nil {
+		return err
+	}
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, version)
+	return meta.Put(KEYVersion, v)
+}
+
+// Upgrade runs the migrations the db hasn't had yet, in order. migrations must be sorted
+// by version starting at 1 with no gaps. A new db has nothing to migrate and is stamped
+// with the latest version, so Upgrade has to run before the caller creates its buckets.
+// A db from a newer build is refused since we can't know what it changed.
+func Upgrade(btx *bolt.Tx, name string, migrations []Migration) error {
+	for i, m := range migrations {
+		if m.Version != uint32(i+1) {
+			return fmt.Errorf("%s migration %d is out of order", name, m.Version)
+		}
+	}
+	latest := Latest(migrations)
+
+	empty := true
+	btx.ForEach(func(_ []byte, _ *bolt.Bucket) error {
+		empty = false
+		return nil
+	})
+	if empty {
+		return setVersion(btx, latest)
+	}
+
+	version := GetVersion(btx)
+	if version > latest {
+		return fmt.Errorf("%s is at schema version %d but this build only supports up to %d", name, version, latest)
+	}
+	for _, m := range migrations[version:] {
+		log.Infof("Migrating %s to schema version %d: %s", name, m.Version, m.Description)
+		if err := m.Apply(btx); err != nil {
+			return fmt.Errorf("failed to migrate %s to schema version %d: %v", name, m.Version, err)
+		}
+	}
+	if version == latest {
+		return nil
+	}
+	return setVersion(btx, latest)
+}
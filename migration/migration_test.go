@@ -0,0 +1,164 @@
+package migration
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+var bktData = []byte("data")
+
+func openTestDB(t *testing.T) (*bolt.DB, func()) {
+	dir, err := ioutil.TempDir("", "migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(path.Join(dir, "test.bin"), 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func testMigrations(applied *[]uint32) []Migration {
+	var ms []Migration
+	for i := uint32(1); i <= 3; i++ {
+		v := i
+		ms = append(ms, Migration{
+			Version:     v,
+			Description: "test",
+			Apply: func(btx *bolt.Tx) error {
+				*applied = append(*applied, v)
+				return nil
+			},
+		})
+	}
+	return ms
+}
+
+func TestUpgrade_NewDB(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	var applied []uint32
+	err := db.Update(func(btx *bolt.Tx) error {
+		return Upgrade(btx, "test db", testMigrations(&applied))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Error("Ran migrations on a new db")
+	}
+	db.View(func(btx *bolt.Tx) error {
+		if v := GetVersion(btx); v != 3 {
+			t.Errorf("Expected version 3, got %d", v)
+		}
+		return nil
+	})
+}
+
+func TestUpgrade_OldDB(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	// A db from before versions were recorded
+	err := db.Update(func(btx *bolt.Tx) error {
+		_, err := btx.CreateBucket(bktData)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applied []uint32
+	err = db.Update(func(btx *bolt.Tx) error {
+		return Upgrade(btx, "test db", testMigrations(&applied)[:2])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 2 || applied[0] != 1 || applied[1] != 2 {
+		t.Errorf("Expected migrations 1 and 2, got %v", applied)
+	}
+
+	applied = nil
+	err = db.Update(func(btx *bolt.Tx) error {
+		return Upgrade(btx, "test db", testMigrations(&applied))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 1 || applied[0] != 3 {
+		t.Errorf("Expected only migration 3, got %v", applied)
+	}
+	db.View(func(btx *bolt.Tx) error {
+		if v := GetVersion(btx); v != 3 {
+			t.Errorf("Expected version 3, got %d", v)
+		}
+		return nil
+	})
+}
+
+func TestUpgrade_Refuse(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	var applied []uint32
+	err := db.Update(func(btx *bolt.Tx) error {
+		return Upgrade(btx, "test db", testMigrations(&applied))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(btx *bolt.Tx) error {
+		return Upgrade(btx, "test db", testMigrations(&applied)[:1])
+	})
+	if err == nil {
+		t.Error("Opened a db from a newer version")
+	}
+
+	ms := testMigrations(&applied)
+	ms[1], ms[2] = ms[2], ms[1]
+	err = db.Update(func(btx *bolt.Tx) error {
+		return Upgrade(btx, "test db", ms)
+	})
+	if err == nil {
+		t.Error("Accepted migrations out of order")
+	}
+}
+
+func TestUpgrade_Failed(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	err := db.Update(func(btx *bolt.Tx) error {
+		_, err := btx.CreateBucket(bktData)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := []Migration{
+		{Version: 1, Description: "ok", Apply: func(btx *bolt.Tx) error {
+			return btx.Bucket(bktData).Put([]byte("k"), []byte("v"))
+		}},
+		{Version: 2, Description: "broken", Apply: func(btx *bolt.Tx) error {
+			return errors.New("broken")
+		}},
+	}
+	err = db.Update(func(btx *bolt.Tx) error {
+		return Upgrade(btx, "test db", ms)
+	})
+	if err == nil {
+		t.Fatal("Failed migration didn't return an error")
+	}
+	db.View(func(btx *bolt.Tx) error {
+		if GetVersion(btx) != 0 || btx.Bucket(bktData).Get([]byte("k")) != nil {
+			t.Error("Failed migration was partly applied")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,424 @@
+package netserv
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	peerpkg "github.com/btcsuite/btcd/peer"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ontio/spvclient/chain"
+	"github.com/ontio/spvclient/log"
+)
+
+const (
+	defaultRebroadcastInterval = 5 * time.Minute
+	// How often pending transactions are checked for confirmations and rebroadcast
+	broadcastCheckInterval = time.Minute
+	// Transactions confirmed this deep are forgotten
+	broadcastForgetDepth = 144
+)
+
+// TxStatus is how far a transaction we broadcast got
+type TxStatus int
+
+const (
+	// Announced to peers and announced again until it is seen in a block
+	TxPending TxStatus = iota
+	// Every peer it was announced to rejected it, or one found it invalid. It isn't
+	// announced anymore.
+	TxRejected
+	// In a block of the best chain
+	TxConfirmed
+)
+
+func (s TxStatus) String() string {
+	switch s {
+	case TxPending:
+		return "pending"
+	case TxRejected:
+		return "rejected"
+	case TxConfirmed:
+		return "confirmed"
+	default:
+		return "unknown"
+	}
+}
+
+type BroadcastConfig struct {
+	// How often a transaction is announced again until it is seen in a block. Defaults to
+	// 5 minutes.
+	RebroadcastInterval time.Duration
+}
+
+// BroadcastStatus describes a transaction we broadcast
+type BroadcastStatus struct {
+	Txid   chainhash.Hash
+	Status TxStatus
+	// When it was first and last announced to peers and how often
+	FirstSent     time.Time
+	LastSent      time.Time
+	Announcements int
+	// How often peers asked for it
+	Served int
+	// Peers which rejected it and the reject message of the last one
+	Rejections   int
+	RejectPeer   string
+	RejectCode   wire.RejectCode
+	RejectReason string
+	// The block it was confirmed in, confirmations are one in the best block
+	BlockHash     chainhash.Hash
+	Height        uint32
+	Confirmations uint32
+}
+
+type broadcastTx struct {
+	tx     *wire.MsgTx
+	status BroadcastStatus
+	// Peers it was announced to and those of them which rejected it
+	sentTo   map[string]struct{}
+	rejected map[string]struct{}
+}
+
+// broadcaster keeps the transactions we broadcast until they are confirmed, the wire
+// service announces them and serves them to peers which ask.
+type broadcaster struct {
+	cfg   BroadcastConfig
+	chain *chain.Blockchain
+
+	lock sync.Mutex
+	txs  map[chainhash.Hash]*broadcastTx
+}
+
+func newBroadcaster(cfg BroadcastConfig, bc *chain.Blockchain) *broadcaster {
+	if cfg.RebroadcastInterval <= 0 {
+		cfg.RebroadcastInterval = defaultRebroadcastInterval
+	}
+	return &broadcaster{
+		cfg:   cfg,
+		chain: bc,
+		txs:   make(map[chainhash.Hash]*broadcastTx),
+	}
+}
+
+// add keeps tx as pending, a rejected one is tried again.
+func (b *broadcaster) add(tx *wire.MsgTx) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	hash := tx.TxHash()
+	btx, ok := b.txs[hash]
+	if !ok {
+		btx = &broadcastTx{
+			tx:       tx,
+			status:   BroadcastStatus{Txid: hash},
+			sentTo:   make(map[string]struct{}),
+			rejected: make(map[string]struct{}),
+		}
+		b.txs[hash] = btx
+	} else if btx.status.Status == TxRejected {
+		btx.status.Status = TxPending
+		btx.rejected = make(map[string]struct{})
+		btx.status.Rejections = 0
+		btx.status.RejectPeer = ""
+		btx.status.RejectCode = 0
+		btx.status.RejectReason = ""
+	}
+}
+
+// announced records tx was announced to peers at now.
+func (b *broadcaster) announced(hash chainhash.Hash, now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	btx, ok := b.txs[hash]
+	if !ok {
+		return
+	}
+	if btx.status.FirstSent.IsZero() {
+		btx.status.FirstSent = now
+	}
+	btx.status.LastSent = now
+	btx.status.Announcements++
+}
+
+// sent records tx was announced to peer. It returns false if peer rejected it, it isn't
+// announced to it again.
+func (b *broadcaster) sent(hash chainhash.Hash, peer string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	btx, ok := b.txs[hash]
+	if !ok {
+		return true
+	}
+	if _, ok := btx.rejected[peer]; ok {
+		return false
+	}
+	btx.sentTo[peer] = struct{}{}
+	return true
+}
+
+// serve returns the transaction a peer asked for.
+func (b *broadcaster) serve(hash chainhash.Hash) (*wire.MsgTx, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	btx, ok := b.txs[hash]
+	if !ok {
+		return nil, false
+	}
+	btx.status.Served++
+	return btx.tx, true
+}
+
+// reject records peer rejected a pending transaction, it returns false if there is none.
+// Policies differ between peers, so the transaction is only rejected once every peer it was
+// announced to rejected it, unless it breaks the consensus rules.
+func (b *broadcaster) reject(hash chainhash.Hash, peer string, msg *wire.MsgReject) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	btx, ok := b.txs[hash]
+	if !ok || btx.status.Status != TxPending {
+		return false
+	}
+	if _, ok := btx.rejected[peer]; !ok {
+		btx.rejected[peer] = struct{}{}
+		btx.status.Rejections++
+	}
+	all := len(btx.sentTo) > 0
+	for p := range btx.sentTo {
+		if _, ok := btx.rejected[p]; !ok {
+			all = false
+			break
+		}
+	}
+	if all || msg.Code == wire.RejectInvalid || msg.Code == wire.RejectObsolete {
+		btx.status.Status = TxRejected
+	}
+	btx.status.RejectPeer = peer
+	btx.status.RejectCode = msg.Code
+	btx.status.RejectReason = msg.Reason
+	return true
+}
+
+// pending returns the transactions announced until they are confirmed.
+func (b *broadcaster) pending() []*wire.MsgTx {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var txs []*wire.MsgTx
+	for _, btx := range b.txs {
+		if btx.status.Status == TxPending {
+			txs = append(txs, btx.tx)
+		}
+	}
+	return txs
+}
+
+// update confirms the transactions filter matched in a block of the best chain and returns
+// those due to be announced again at now. Transactions in a block which left the best chain
+// are pending again and due at once.
+func (b *broadcaster) update(filter *FilterManager, now time.Time) []*wire.MsgTx {
+	// The proofs are checked against the chain without holding the lock
+	b.lock.Lock()
+	hashes := make([]chainhash.Hash, 0, len(b.txs))
+	for hash := range b.txs {
+		hashes = append(hashes, hash)
+	}
+	b.lock.Unlock()
+	included := make(map[chainhash.Hash]*chain.InclusionResult)
+	if filter != nil {
+		for _, hash := range hashes {
+			if m, ok := filter.GetMatchedTx(hash); ok {
+				if res, err := b.chain.VerifyTxInclusion(m.Tx, m.Proof, m.Height); err == nil {
+					included[hash] = res
+				}
+			}
+		}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var due []*wire.MsgTx
+	for _, hash := range hashes {
+		btx, ok := b.txs[hash]
+		if !ok {
+			continue
+		}
+		st := &btx.status
+		res := included[hash]
+		switch {
+		case res != nil && res.MainChain:
+			st.Status = TxConfirmed
+			st.BlockHash = res.BlockHash
+			st.Height = res.Height
+			st.Confirmations = res.Confirmations
+			if st.Confirmations >= broadcastForgetDepth {
+				delete(b.txs, hash)
+			}
+			continue
+		case st.Status == TxConfirmed:
+			st.Status = TxPending
+			st.BlockHash = chainhash.Hash{}
+			st.Height = 0
+			st.Confirmations = 0
+			st.LastSent = time.Time{}
+		case st.Status == TxRejected:
+			continue
+		}
+		if now.Sub(st.LastSent) >= b.cfg.RebroadcastInterval {
+			due = append(due, btx.tx)
+		}
+	}
+	return due
+}
+
+// Status returns the status of a transaction we broadcast.
+func (b *broadcaster) Status(hash chainhash.Hash) (BroadcastStatus, bool) {
+	best := b.bestHeight()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	btx, ok := b.txs[hash]
+	if !ok {
+		return BroadcastStatus{}, false
+	}
+	return withDepth(btx.status, best), true
+}
+
+// Statuses returns the status of every transaction we broadcast, the first sent first.
+func (b *broadcaster) Statuses() []BroadcastStatus {
+	best := b.bestHeight()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	statuses := make([]BroadcastStatus, 0, len(b.txs))
+	for _, btx := range b.txs {
+		statuses = append(statuses, withDepth(btx.status, best))
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].FirstSent.Before(statuses[j].FirstSent)
+	})
+	return statuses
+}
+
+func (b *broadcaster) bestHeight() uint32 {
+	best, err := b.chain.BestBlock()
+	if err != nil {
+		return 0
+	}
+	return best.Height
+}
+
+// withDepth counts the confirmations up to the best height rather than up to the last update
+func withDepth(st BroadcastStatus, best uint32) BroadcastStatus {
+	if st.Status == TxConfirmed && best >= st.Height {
+		st.Confirmations = best - st.Height + 1
+	}
+	return st
+}
+
+// Broadcast announces tx to every peer and serves it to those which ask for it, until it is
+// seen in a block. The wire service has to be running.
+func (ws *WireService) Broadcast(tx *wire.MsgTx) BroadcastStatus {
+	reply := make(chan BroadcastStatus, 1)
+	ws.msgChan <- broadcastMsg{tx: tx, reply: reply}
+	return <-reply
+}
+
+// BroadcastStatus returns the status of a transaction we broadcast.
+func (ws *WireService) BroadcastStatus(txid chainhash.Hash) (BroadcastStatus, bool) {
+	return ws.broadcasts.Status(txid)
+}
+
+// BroadcastStatuses returns the status of every transaction we broadcast and didn't forget.
+func (ws *WireService) BroadcastStatuses() []BroadcastStatus {
+	return ws.broadcasts.Statuses()
+}
+
+func (ws *WireService) handleBroadcastMsg(bmsg *broadcastMsg) {
+	tx := bmsg.tx
+	hash := tx.TxHash()
+	ws.broadcasts.add(tx)
+	// The filter has to match it to see the block it gets into
+	if filter := ws.watchedFilter(); filter != nil {
+		filter.WatchTx(tx)
+		if ws.filter != nil {
+			ws.reloadFilter(ws.filter.FilterLoad())
+		}
+	}
+	for peer := range ws.peerStates {
+		ws.announce(peer, hash)
+	}
+	ws.broadcasts.announced(hash, time.Now())
+	log.Infof("Announced transaction %s to %d peers", hash.String(), len(ws.peerStates))
+	st, _ := ws.broadcasts.Status(hash)
+	bmsg.reply <- st
+}
+
+// watchedFilter returns what the bloom filter or the compact filters are matched against.
+func (ws *WireService) watchedFilter() *FilterManager {
+	if ws.cf != nil {
+		return ws.cf.filter
+	}
+	return ws.filter
+}
+
+// announce sends peer an inv of the transaction unless it rejected it.
+func (ws *WireService) announce(peer *peerpkg.Peer, hash chainhash.Hash) {
+	if !ws.broadcasts.sent(hash, peer.String()) {
+		return
+	}
+	inv := wire.NewMsgInv()
+	inv.AddInvVect(wire.NewInvVect(wire.InvTypeTx, &hash))
+	peer.QueueMessage(inv, nil)
+}
+
+// rebroadcast announces the pending transactions due at now again.
+func (ws *WireService) rebroadcast(now time.Time) {
+	for _, tx := range ws.broadcasts.update(ws.watchedFilter(), now) {
+		hash := tx.TxHash()
+		for peer := range ws.peerStates {
+			ws.announce(peer, hash)
+		}
+		ws.broadcasts.announced(hash, now)
+		log.Infof("Announced transaction %s again to %d peers", hash.String(), len(ws.peerStates))
+	}
+}
+
+// handleGetDataMsg serves the transactions we broadcast, we have nothing else to give.
+func (ws *WireService) handleGetDataMsg(gmsg *getDataMsg) {
+	peer := gmsg.peer
+	notFound := wire.NewMsgNotFound()
+	for _, iv := range gmsg.getData.InvList {
+		var tx *wire.MsgTx
+		ok := false
+		if iv.Type == wire.InvTypeTx || iv.Type == wire.InvTypeWitnessTx {
+			tx, ok = ws.broadcasts.serve(iv.Hash)
+		}
+		if !ok {
+			notFound.AddInvVect(iv)
+			continue
+		}
+		encoding := wire.BaseEncoding
+		if iv.Type == wire.InvTypeWitnessTx {
+			encoding = wire.WitnessEncoding
+		}
+		peer.QueueMessageWithEncoding(tx, nil, encoding)
+		log.Debugf("Sent transaction %s to %s", iv.Hash.String(), peer)
+	}
+	if len(notFound.InvList) > 0 {
+		peer.QueueMessage(notFound, nil)
+	}
+}
+
+// handleRejectMsg records the transaction a peer rejected.
+func (ws *WireService) handleRejectMsg(rmsg *rejectMsg) {
+	msg := rmsg.reject
+	// A peer which has it already didn't reject it
+	if msg.Cmd != wire.CmdTx || msg.Code == wire.RejectDuplicate {
+		return
+	}
+	if !ws.broadcasts.reject(msg.Hash, rmsg.peer.String(), msg) {
+		return
+	}
+	log.Warnf("Peer %s rejected transaction %s: %s, %s", rmsg.peer, msg.Hash.String(), msg.Code.String(), msg.Reason)
+	if st, _ := ws.broadcasts.Status(msg.Hash); st.Status == TxRejected {
+		log.Warnf("Transaction %s rejected, not announcing it anymore", msg.Hash.String())
+	}
+}
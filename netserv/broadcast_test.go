@@ -0,0 +1,206 @@
+package netserv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	peerpkg "github.com/btcsuite/btcd/peer"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/bloom"
+	"github.com/ontio/spvclient/chain"
+)
+
+func TestBroadcaster(t *testing.T) {
+	params := &chaincfg.RegressionNetParams
+	other, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := payTo(t, other, wire.OutPoint{Hash: chainhash.Hash{1}})
+	txid := tx.TxHash()
+	c := newCFTestChain()
+	for h := 1; h <= 5; h++ {
+		if h == 3 {
+			c.addBlock(t, []*wire.MsgTx{tx}, nil)
+		} else {
+			c.addBlock(t, nil, nil)
+		}
+	}
+	bc, err := chain.NewBlockchainWithHeaders(chain.NewMemHeaders(), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var headers []wire.BlockHeader
+	for _, block := range c.blocks[1:] {
+		headers = append(headers, block.Header)
+	}
+	if _, _, err := bc.CommitHeaders(headers); err != nil {
+		t.Fatal(err)
+	}
+
+	fm := NewFilterManager(FilterConfig{Redeem: testRedeem})
+	fm.WatchTx(tx)
+	if !bloom.LoadFilter(fm.FilterLoad()).MatchTxAndUpdate(btcutil.NewTx(tx)) {
+		t.Error("Filter doesn't match a watched transaction")
+	}
+	if scripts := fm.Scripts(); len(scripts) != 3 {
+		t.Errorf("Output of a watched transaction not in %d scripts", len(scripts))
+	}
+	if !fm.match(tx) {
+		t.Error("Watched transaction is no match")
+	}
+
+	b := newBroadcaster(BroadcastConfig{}, bc)
+	if b.cfg.RebroadcastInterval != defaultRebroadcastInterval {
+		t.Errorf("Wrong default interval %s", b.cfg.RebroadcastInterval)
+	}
+	now := time.Now()
+	b.add(tx)
+	b.announced(txid, now)
+	if due := b.update(fm, now.Add(time.Minute)); len(due) != 0 {
+		t.Errorf("%d transactions due before the interval", len(due))
+	}
+	if due := b.update(fm, now.Add(defaultRebroadcastInterval)); len(due) != 1 || due[0] != tx {
+		t.Fatalf("%d transactions due after the interval", len(due))
+	}
+	if _, ok := b.serve(chainhash.Hash{2}); ok {
+		t.Error("Served a transaction never broadcast")
+	}
+	if served, ok := b.serve(txid); !ok || served != tx {
+		t.Error("Transaction not served")
+	}
+
+	// Rejected once every peer it was sent to rejected it, announced to the others until
+	// then and not at all unless it is broadcast again
+	b.sent(txid, "a")
+	b.sent(txid, "b")
+	reject := wire.NewMsgReject(wire.CmdTx, wire.RejectInsufficientFee, "min relay fee not met")
+	if !b.reject(txid, "a", reject) {
+		t.Fatal("Reject of a pending transaction not recorded")
+	}
+	st, _ := b.Status(txid)
+	if st.Status != TxPending || st.Rejections != 1 || st.RejectPeer != "a" {
+		t.Errorf("Wrong status %+v after one of two peers rejected it", st)
+	}
+	if b.sent(txid, "a") || !b.sent(txid, "b") {
+		t.Error("Announced to a peer which rejected it")
+	}
+	if due := b.update(fm, now.Add(time.Hour)); len(due) != 1 {
+		t.Error("Transaction some peers rejected not due")
+	}
+	b.reject(txid, "b", reject)
+	st, _ = b.Status(txid)
+	if st.Status != TxRejected || st.RejectCode != wire.RejectInsufficientFee || st.RejectPeer != "b" || st.Rejections != 2 {
+		t.Errorf("Wrong status %+v", st)
+	}
+	if due := b.update(fm, now.Add(time.Hour)); len(due) != 0 {
+		t.Error("Rejected transaction due")
+	}
+	b.add(tx)
+	if st, _ := b.Status(txid); st.Status != TxPending || st.RejectReason != "" || st.Rejections != 0 || !b.sent(txid, "a") {
+		t.Errorf("Wrong status %+v after broadcasting again", st)
+	}
+	// A single peer is enough for a transaction breaking the consensus rules
+	b.reject(txid, "a", wire.NewMsgReject(wire.CmdTx, wire.RejectInvalid, "bad-txns-inputs-missingorspent"))
+	if st, _ := b.Status(txid); st.Status != TxRejected {
+		t.Errorf("Wrong status %+v after an invalid reject", st)
+	}
+	b.add(tx)
+
+	// Confirmed once matched in a block of the best chain, deeper as the chain grows
+	proof, err := merkleProof(c.blocks[3], []*wire.MsgTx{tx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm.addMatched(MatchedTx{Tx: tx, BlockHash: c.blocks[3].BlockHash(), Height: 3, Proof: proof})
+	if due := b.update(fm, now.Add(time.Hour)); len(due) != 0 {
+		t.Error("Confirmed transaction due")
+	}
+	st, _ = b.Status(txid)
+	if st.Status != TxConfirmed || st.Height != 3 || st.BlockHash != c.blocks[3].BlockHash() || st.Confirmations != 3 {
+		t.Errorf("Wrong status %+v", st)
+	}
+	next := c.addBlock(t, nil, nil)
+	if _, _, _, err := bc.CommitHeader(next.Header); err != nil {
+		t.Fatal(err)
+	}
+	if statuses := b.Statuses(); len(statuses) != 1 || statuses[0].Confirmations != 4 {
+		t.Errorf("Wrong statuses %+v", statuses)
+	}
+	if b.reject(txid, "peer", reject) {
+		t.Error("Confirmed transaction rejected")
+	}
+
+	// Pending and due at once when its block leaves the best chain
+	if _, err := bc.RollbackToHeight(2, chain.RollbackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if due := b.update(fm, now.Add(time.Hour)); len(due) != 1 {
+		t.Errorf("%d transactions due after a reorg", len(due))
+	}
+	if st, _ := b.Status(txid); st.Status != TxPending || st.Height != 0 {
+		t.Errorf("Wrong status %+v after a reorg", st)
+	}
+}
+
+func TestWireService_Broadcast(t *testing.T) {
+	params := &chaincfg.RegressionNetParams
+	other, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := chain.NewBlockchainWithHeaders(chain.NewMemHeaders(), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm := NewFilterManager(FilterConfig{})
+	ws := NewWireService(&WireServiceConfig{Params: params, Chain: bc, Filter: fm})
+	peer := newTestPeer(t, "127.0.0.1:18444")
+	peer2 := newTestPeer(t, "127.0.0.2:18444")
+	for _, p := range []*peerpkg.Peer{peer, peer2} {
+		ws.peerStates[p] = &peerSyncState{requestedBlocks: make(map[chainhash.Hash]struct{})}
+	}
+
+	tx := payTo(t, other, wire.OutPoint{Hash: chainhash.Hash{1}})
+	txid := tx.TxHash()
+	reply := make(chan BroadcastStatus, 1)
+	ws.handleBroadcastMsg(&broadcastMsg{tx: tx, reply: reply})
+	st := <-reply
+	if st.Status != TxPending || st.Announcements != 1 || st.FirstSent.IsZero() {
+		t.Errorf("Wrong status %+v", st)
+	}
+	if !fm.match(tx) {
+		t.Error("Broadcast transaction not watched")
+	}
+
+	getData := wire.NewMsgGetData()
+	getData.AddInvVect(wire.NewInvVect(wire.InvTypeWitnessTx, &txid))
+	getData.AddInvVect(wire.NewInvVect(wire.InvTypeTx, &chainhash.Hash{2}))
+	ws.handleGetDataMsg(&getDataMsg{getData: getData, peer: peer})
+	if st, _ := ws.BroadcastStatus(txid); st.Served != 1 {
+		t.Errorf("Served %d times", st.Served)
+	}
+
+	ws.handleRejectMsg(&rejectMsg{reject: &wire.MsgReject{Cmd: wire.CmdTx, Code: wire.RejectDuplicate, Hash: txid}, peer: peer})
+	if st, _ := ws.BroadcastStatus(txid); st.Status != TxPending {
+		t.Error("Rejected as a duplicate")
+	}
+	ws.handleRejectMsg(&rejectMsg{reject: &wire.MsgReject{Cmd: wire.CmdTx, Code: wire.RejectNonstandard, Hash: txid}, peer: peer})
+	if st, _ := ws.BroadcastStatus(txid); st.Status != TxPending || st.Rejections != 1 {
+		t.Errorf("Wrong status %+v after one peer rejected it", st)
+	}
+	ws.rebroadcast(time.Now().Add(time.Hour))
+	if st, _ := ws.BroadcastStatus(txid); st.Announcements != 2 {
+		t.Error("Not announced again to the peer which didn't reject it")
+	}
+	ws.handleRejectMsg(&rejectMsg{reject: &wire.MsgReject{Cmd: wire.CmdTx, Code: wire.RejectNonstandard, Hash: txid}, peer: peer2})
+	if st, _ := ws.BroadcastStatus(txid); st.Status != TxRejected || st.RejectPeer != peer2.String() {
+		t.Errorf("Wrong status %+v after every peer rejected it", st)
+	}
+	if statuses := ws.BroadcastStatuses(); len(statuses) != 1 || statuses[0].Txid != txid {
+		t.Errorf("Wrong statuses %+v", statuses)
+	}
+}
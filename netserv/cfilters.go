@@ -0,0 +1,802 @@
+package netserv
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/gcs"
+	"github.com/btcsuite/btcutil/gcs/builder"
+	"github.com/ontio/spvclient/chain"
+	"github.com/ontio/spvclient/log"
+)
+
+// SyncMode is how the wire service learns about the transactions in blocks
+type SyncMode int
+
+const (
+	// Merkle blocks filtered by the BIP37 bloom filter loaded into every peer
+	SyncBloom SyncMode = iota
+	// BIP157/158 compact block filters matched locally, only the blocks which match are
+	// downloaded. Peers don't learn what we watch.
+	SyncCompactFilters
+)
+
+func (m SyncMode) String() string {
+	switch m {
+	case SyncBloom:
+		return "bloom"
+	case SyncCompactFilters:
+		return "cfilters"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseSyncMode returns the sync mode named s, bloom or cfilters. Empty is bloom.
+func ParseSyncMode(s string) (SyncMode, error) {
+	switch s {
+	case "", SyncBloom.String():
+		return SyncBloom, nil
+	case SyncCompactFilters.String():
+		return SyncCompactFilters, nil
+	default:
+		return SyncBloom, fmt.Errorf("unknown sync mode %s", s)
+	}
+}
+
+const (
+	// How long peers have to answer a request for filter headers, filters or a block
+	cfRequestTimeout  = 30 * time.Second
+	defaultCFMinPeers = 2
+)
+
+type CFilterConfig struct {
+	// Filter headers and filters are downloaded from this height on. The filter header
+	// before it can only be checked against other peers. Defaults to our tip when the
+	// compact filter sync starts.
+	StartHeight uint32
+	// Peers which have to agree on every batch of filter headers. Defaults to 2.
+	MinPeers int
+}
+
+type CFilterStats struct {
+	// Height of the last filter header verified and of the last filter matched
+	HeaderHeight uint32
+	FilterHeight uint32
+	// Filters which matched what we watch, a block was downloaded for each
+	Matched uint64
+	// Batches of filter headers peers disagreed on
+	Conflicts uint64
+	// Peers disconnected for serving filter headers or filters which turned out wrong
+	BadPeers uint64
+}
+
+// cfPeer is the part of a peer the compact filter sync talks to
+type cfPeer interface {
+	String() string
+	QueueMessage(msg wire.Message, doneChan chan<- struct{})
+	Disconnect()
+}
+
+type cfHeader struct {
+	blockHash chainhash.Hash
+	header    chainhash.Hash
+}
+
+// cfHeadersQuery is a batch of filter headers asked from every peer
+type cfHeadersQuery struct {
+	start    uint32
+	stop     uint32
+	stopHash chainhash.Hash
+	sent     time.Time
+	waiting  map[cfPeer]struct{}
+	// The filter header before start followed by those of the batch, by peer
+	answers map[cfPeer][]chainhash.Hash
+}
+
+// cfConflict is a block peers claim different filter headers for. The filter behind each
+// claim is checked against the block, peers claiming a filter which leaves out an output of
+// the block are lying.
+type cfConflict struct {
+	height    uint32
+	blockHash chainhash.Hash
+	sent      time.Time
+	// The filter header before the block, which all peers agree on. For the block before
+	// the first we sync there is none, each claim comes with its own then.
+	prev    chainhash.Hash
+	anchor  bool
+	prevs   map[chainhash.Hash]chainhash.Hash
+	claims  map[chainhash.Hash][]cfPeer
+	filters map[chainhash.Hash][]byte
+	block   *wire.MsgBlock
+}
+
+type cfFiltersQuery struct {
+	peer cfPeer
+	stop uint32
+	sent time.Time
+}
+
+type cfBlockRequest struct {
+	height uint32
+	// Nil while no peer could be asked
+	peer cfPeer
+	sent time.Time
+	// Kept until the blocks below it are in, spends only match once the outputs they
+	// spend did
+	block *wire.MsgBlock
+}
+
+// cfSyncer downloads the filter headers of the best chain from all peers and accepts them
+// once enough peers agree, then matches the filters against the scripts we watch and
+// downloads the blocks which match. Like the wire service it is single threaded.
+type cfSyncer struct {
+	cfg    CFilterConfig
+	chain  *chain.Blockchain
+	filter *FilterManager
+	peers  map[cfPeer]struct{}
+
+	// Verified filter headers of the best chain, headers[i] is at height start+i and prev is
+	// the one before start
+	started bool
+	start   uint32
+	prev    chainhash.Hash
+	headers []cfHeader
+	// Height of the next filter to match
+	next uint32
+
+	headersQuery *cfHeadersQuery
+	conflict     *cfConflict
+	filtersQuery *cfFiltersQuery
+	blocks       map[chainhash.Hash]cfBlockRequest
+
+	lock  sync.Mutex
+	stats CFilterStats
+}
+
+func newCFSyncer(cfg CFilterConfig, bc *chain.Blockchain, filter *FilterManager) *cfSyncer {
+	if cfg.MinPeers <= 0 {
+		cfg.MinPeers = defaultCFMinPeers
+	}
+	return &cfSyncer{
+		cfg:    cfg,
+		chain:  bc,
+		filter: filter,
+		peers:  make(map[cfPeer]struct{}),
+		blocks: make(map[chainhash.Hash]cfBlockRequest),
+	}
+}
+
+func (s *cfSyncer) Stats() CFilterStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stats
+}
+
+// addPeer starts asking p too, for the blocks nobody could be asked for first.
+func (s *cfSyncer) addPeer(p cfPeer, now time.Time) {
+	s.peers[p] = struct{}{}
+	for hash, req := range s.blocks {
+		if req.peer == nil && req.block == nil {
+			s.requestBlock(hash, req.height, now)
+		}
+	}
+}
+
+// removePeer forgets a disconnected peer and asks others for what it still owed us.
+func (s *cfSyncer) removePeer(p cfPeer, now time.Time) {
+	if _, ok := s.peers[p]; !ok {
+		return
+	}
+	delete(s.peers, p)
+	if q := s.headersQuery; q != nil {
+		delete(q.answers, p)
+		if _, ok := q.waiting[p]; ok {
+			delete(q.waiting, p)
+			if len(q.waiting) == 0 {
+				s.resolveHeaders(now)
+			}
+		}
+	}
+	if c := s.conflict; c != nil {
+		for claim, peers := range c.claims {
+			for i, cp := range peers {
+				if cp == p {
+					peers = append(peers[:i], peers[i+1:]...)
+					break
+				}
+			}
+			c.claims[claim] = peers
+			if len(peers) == 0 {
+				delete(c.claims, claim)
+				delete(c.filters, claim)
+				delete(c.prevs, claim)
+			}
+		}
+		if len(c.claims) < 2 {
+			s.conflict = nil
+		}
+	}
+	if q := s.filtersQuery; q != nil && q.peer == p {
+		s.filtersQuery = nil
+		s.requestFilters(now)
+	}
+	for hash, req := range s.blocks {
+		if req.peer == p && req.block == nil {
+			s.requestBlock(hash, req.height, now)
+		}
+	}
+}
+
+// dropPeer disconnects a peer which sent us something wrong.
+func (s *cfSyncer) dropPeer(p cfPeer, now time.Time) {
+	s.lock.Lock()
+	s.stats.BadPeers++
+	s.lock.Unlock()
+	p.Disconnect()
+	s.removePeer(p, now)
+}
+
+// anyPeer returns a peer to ask for something only one peer needs to send, nil if there
+// are none.
+func (s *cfSyncer) anyPeer(except cfPeer) cfPeer {
+	var ret cfPeer
+	for p := range s.peers {
+		ret = p
+		if p != except {
+			break
+		}
+	}
+	return ret
+}
+
+// sync asks for what comes next, the filter headers up to our tip and then the filters.
+func (s *cfSyncer) sync(now time.Time) {
+	best, err := s.chain.BestBlock()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if !s.started {
+		s.started = true
+		s.start = s.cfg.StartHeight
+		if s.start == 0 || s.start > best.Height {
+			s.start = best.Height
+		}
+		s.next = s.start
+		log.Infof("Starting compact filter sync at height %d", s.start)
+	}
+	s.reorg()
+	if s.headersQuery != nil || s.conflict != nil {
+		return
+	}
+	height := s.start + uint32(len(s.headers))
+	if height <= best.Height {
+		s.requestHeaders(height, best.Height, now)
+		return
+	}
+	s.requestFilters(now)
+}
+
+// reorg drops the filter headers of blocks which left the best chain, and the requests
+// built on them.
+func (s *cfSyncer) reorg() {
+	popped := false
+	for len(s.headers) > 0 {
+		last := s.headers[len(s.headers)-1]
+		if s.inBestChain(s.start+uint32(len(s.headers))-1, last.blockHash) {
+			break
+		}
+		s.headers = s.headers[:len(s.headers)-1]
+		popped = true
+	}
+	if q := s.headersQuery; q != nil && (popped || !s.inBestChain(q.stop, q.stopHash)) {
+		log.Debugf("Dropping the request for filter headers %d to %d, the best chain changed", q.start, q.stop)
+		s.headersQuery = nil
+	}
+	if c := s.conflict; c != nil && (popped || !s.inBestChain(c.height, c.blockHash)) {
+		log.Debugf("Dropping the conflict on block %s, the best chain changed", c.blockHash.String())
+		s.conflict = nil
+	}
+	tip := s.start + uint32(len(s.headers))
+	if s.next > tip {
+		s.next = tip
+	}
+	if q := s.filtersQuery; q != nil && q.stop >= tip {
+		s.filtersQuery = nil
+	}
+}
+
+// inBestChain tells whether the block at height in the best chain is hash.
+func (s *cfSyncer) inBestChain(height uint32, hash chainhash.Hash) bool {
+	sh, err := s.chain.GetHeaderByHeight(height)
+	return err == nil && sh.Header.BlockHash() == hash
+}
+
+func (s *cfSyncer) requestHeaders(height, tip uint32, now time.Time) {
+	if len(s.peers) < s.cfg.MinPeers {
+		log.Debugf("Waiting for %d peers to ask for filter headers, %d connected", s.cfg.MinPeers, len(s.peers))
+		return
+	}
+	stop := height + wire.MaxCFHeadersPerMsg - 1
+	if stop > tip {
+		stop = tip
+	}
+	sh, err := s.chain.GetHeaderByHeight(stop)
+	if err != nil {
+		log.Errorf("Failed to get header at height %d: %v", stop, err)
+		return
+	}
+	q := &cfHeadersQuery{
+		start:    height,
+		stop:     stop,
+		stopHash: sh.Header.BlockHash(),
+		sent:     now,
+		waiting:  make(map[cfPeer]struct{}),
+		answers:  make(map[cfPeer][]chainhash.Hash),
+	}
+	msg := wire.NewMsgGetCFHeaders(wire.GCSFilterRegular, height, &q.stopHash)
+	for p := range s.peers {
+		q.waiting[p] = struct{}{}
+		p.QueueMessage(msg, nil)
+	}
+	s.headersQuery = q
+	log.Debugf("Requesting filter headers %d to %d from %d peers", height, stop, len(s.peers))
+}
+
+// filterHeader chains the hash of a filter to the filter header of the block before, see
+// BIP157.
+func filterHeader(filterHash, prev chainhash.Hash) chainhash.Hash {
+	var buf [2 * chainhash.HashSize]byte
+	copy(buf[:], filterHash[:])
+	copy(buf[chainhash.HashSize:], prev[:])
+	return chainhash.DoubleHashH(buf[:])
+}
+
+func (s *cfSyncer) handleCFHeaders(p cfPeer, msg *wire.MsgCFHeaders, now time.Time) {
+	if c := s.conflict; c != nil && c.anchor && msg.StopHash == c.blockHash {
+		s.handleAnchorHeaders(p, msg, now)
+		return
+	}
+	q := s.headersQuery
+	if q == nil {
+		return
+	}
+	if _, ok := q.waiting[p]; !ok {
+		return
+	}
+	// Answers to a request dropped after a reorg may still come in
+	if msg.StopHash != q.stopHash {
+		log.Debugf("Peer %s sent filter headers up to block %s, not the last we asked for", p, msg.StopHash.String())
+		return
+	}
+	if msg.FilterType != wire.GCSFilterRegular || len(msg.FilterHashes) != int(q.stop-q.start)+1 {
+		log.Warnf("Peer %s sent filter headers we didn't ask for", p)
+		s.dropPeer(p, now)
+		return
+	}
+	if len(s.headers) > 0 && msg.PrevFilterHeader != s.headers[len(s.headers)-1].header {
+		log.Warnf("Peer %s disagrees with filter headers other peers agreed on", p)
+		s.dropPeer(p, now)
+		return
+	}
+	if q.start == 0 && msg.PrevFilterHeader != (chainhash.Hash{}) {
+		log.Warnf("Peer %s sent a filter header before the genesis block", p)
+		s.dropPeer(p, now)
+		return
+	}
+	answer := make([]chainhash.Hash, 0, len(msg.FilterHashes)+1)
+	answer = append(answer, msg.PrevFilterHeader)
+	for _, filterHash := range msg.FilterHashes {
+		answer = append(answer, filterHeader(*filterHash, answer[len(answer)-1]))
+	}
+	delete(q.waiting, p)
+	q.answers[p] = answer
+	if len(q.waiting) == 0 {
+		s.resolveHeaders(now)
+	}
+}
+
+// resolveHeaders accepts a batch of filter headers if enough peers sent it and all agree,
+// otherwise it checks the first filter they disagree on.
+func (s *cfSyncer) resolveHeaders(now time.Time) {
+	q := s.headersQuery
+	s.headersQuery = nil
+	if q.start != s.start+uint32(len(s.headers)) || !s.inBestChain(q.stop, q.stopHash) {
+		log.Debugf("Dropping filter headers %d to %d, the best chain changed", q.start, q.stop)
+		return
+	}
+	if len(q.answers) < s.cfg.MinPeers {
+		log.Warnf("Only %d peers sent filter headers %d to %d, %d needed", len(q.answers), q.start, q.stop, s.cfg.MinPeers)
+		return
+	}
+	var ref []chainhash.Hash
+	for _, answer := range q.answers {
+		ref = answer
+		break
+	}
+	diverge := -1
+	for i := 0; i < len(ref) && diverge < 0; i++ {
+		for _, answer := range q.answers {
+			if answer[i] != ref[i] {
+				diverge = i
+				break
+			}
+		}
+	}
+
+	if diverge < 0 {
+		headers := make([]cfHeader, 0, len(ref)-1)
+		for i, header := range ref[1:] {
+			sh, err := s.chain.GetHeaderByHeight(q.start + uint32(i))
+			if err != nil {
+				log.Errorf("Failed to get header at height %d: %v", q.start+uint32(i), err)
+				return
+			}
+			headers = append(headers, cfHeader{blockHash: sh.Header.BlockHash(), header: header})
+		}
+		if len(s.headers) == 0 {
+			s.prev = ref[0]
+		}
+		s.headers = append(s.headers, headers...)
+		s.lock.Lock()
+		s.stats.HeaderHeight = q.stop
+		s.lock.Unlock()
+		log.Infof("%d peers agree on filter headers %d to %d", len(q.answers), q.start, q.stop)
+		s.sync(now)
+		return
+	}
+
+	s.lock.Lock()
+	s.stats.Conflicts++
+	s.lock.Unlock()
+	// Peers disagreeing on the filter header before the batch only happens on the first,
+	// the filter header before that block comes from each peer then
+	height := q.start + uint32(diverge) - 1
+	sh, err := s.chain.GetHeaderByHeight(height)
+	if err != nil {
+		log.Errorf("Failed to get header at height %d: %v", height, err)
+		return
+	}
+	c := &cfConflict{
+		height:    height,
+		blockHash: sh.Header.BlockHash(),
+		sent:      now,
+		anchor:    diverge == 0,
+		prevs:     make(map[chainhash.Hash]chainhash.Hash),
+		claims:    make(map[chainhash.Hash][]cfPeer),
+		filters:   make(map[chainhash.Hash][]byte),
+	}
+	if !c.anchor {
+		c.prev = ref[diverge-1]
+	}
+	for p, answer := range q.answers {
+		c.claims[answer[diverge]] = append(c.claims[answer[diverge]], p)
+	}
+	log.Warnf("Peers claim %d different filter headers for block %s at height %d, checking their filters",
+		len(c.claims), c.blockHash.String(), height)
+	getFilter := wire.NewMsgGetCFilters(wire.GCSFilterRegular, height, &c.blockHash)
+	getHeader := wire.NewMsgGetCFHeaders(wire.GCSFilterRegular, height, &c.blockHash)
+	for _, peers := range c.claims {
+		peers[0].QueueMessage(getFilter, nil)
+		if c.anchor {
+			peers[0].QueueMessage(getHeader, nil)
+		}
+	}
+	getBlock := wire.NewMsgGetData()
+	getBlock.AddInvVect(wire.NewInvVect(wire.InvTypeWitnessBlock, &c.blockHash))
+	s.anyPeer(nil).QueueMessage(getBlock, nil)
+	s.conflict = c
+}
+
+// handleAnchorHeaders takes the filter header before the block of a conflict on the first
+// filter header we sync from the peer behind a claim. The claim has to follow from it.
+func (s *cfSyncer) handleAnchorHeaders(p cfPeer, msg *wire.MsgCFHeaders, now time.Time) {
+	c := s.conflict
+	for claim, peers := range c.claims {
+		if peers[0] != p {
+			continue
+		}
+		if _, ok := c.prevs[claim]; ok {
+			return
+		}
+		if msg.FilterType != wire.GCSFilterRegular || len(msg.FilterHashes) != 1 ||
+			filterHeader(*msg.FilterHashes[0], msg.PrevFilterHeader) != claim {
+			log.Warnf("Peer %s sent a filter header for block %s which doesn't lead to its claim", p, c.blockHash.String())
+			s.dropPeer(p, now)
+			if s.conflict == c {
+				s.checkConflict(now)
+			}
+			return
+		}
+		c.prevs[claim] = msg.PrevFilterHeader
+		s.checkConflict(now)
+		return
+	}
+}
+
+func (s *cfSyncer) handleCFilter(p cfPeer, msg *wire.MsgCFilter, now time.Time) {
+	if msg.FilterType != wire.GCSFilterRegular {
+		return
+	}
+	if c := s.conflict; c != nil && msg.BlockHash == c.blockHash {
+		for claim, peers := range c.claims {
+			for _, cp := range peers {
+				if cp == p {
+					c.filters[claim] = msg.Data
+				}
+			}
+		}
+		s.checkConflict(now)
+		return
+	}
+
+	q := s.filtersQuery
+	if q == nil || q.peer != p {
+		return
+	}
+	i := int(s.next - s.start)
+	if i >= len(s.headers) || msg.BlockHash != s.headers[i].blockHash {
+		log.Debugf("Peer %s sent filter for block %s we didn't expect", p, msg.BlockHash.String())
+		s.filtersQuery = nil
+		return
+	}
+	prev := s.prev
+	if i > 0 {
+		prev = s.headers[i-1].header
+	}
+	if filterHeader(chainhash.DoubleHashH(msg.Data), prev) != s.headers[i].header {
+		log.Warnf("Peer %s sent a filter for block %s which doesn't match its filter header", p, msg.BlockHash.String())
+		s.dropPeer(p, now)
+		return
+	}
+	q.sent = now
+	matched, err := s.matchFilter(msg.BlockHash, msg.Data)
+	if err != nil {
+		log.Errorf("Failed to match filter of block %s: %v", msg.BlockHash.String(), err)
+	}
+	if matched {
+		s.requestBlock(msg.BlockHash, s.next, now)
+	}
+	s.lock.Lock()
+	s.stats.FilterHeight = s.next
+	if matched {
+		s.stats.Matched++
+	}
+	s.lock.Unlock()
+	s.next++
+	if s.next > q.stop {
+		s.filtersQuery = nil
+		s.requestFilters(now)
+	}
+}
+
+func (s *cfSyncer) matchFilter(blockHash chainhash.Hash, data []byte) (bool, error) {
+	scripts := s.filter.Scripts()
+	if len(scripts) == 0 {
+		return false, nil
+	}
+	f, err := gcs.FromNBytes(builder.DefaultP, builder.DefaultM, data)
+	if err != nil {
+		return false, err
+	}
+	if f.N() == 0 {
+		return false, nil
+	}
+	return f.MatchAny(builder.DeriveKey(&blockHash), scripts)
+}
+
+// requestFilters asks a peer for the filters of the next blocks with verified filter headers.
+func (s *cfSyncer) requestFilters(now time.Time) {
+	if s.filtersQuery != nil {
+		return
+	}
+	tip := s.start + uint32(len(s.headers))
+	p := s.anyPeer(nil)
+	if s.next >= tip || p == nil {
+		return
+	}
+	stop := s.next + wire.MaxGetCFiltersReqRange - 1
+	if stop >= tip {
+		stop = tip - 1
+	}
+	stopHash := s.headers[stop-s.start].blockHash
+	p.QueueMessage(wire.NewMsgGetCFilters(wire.GCSFilterRegular, s.next, &stopHash), nil)
+	s.filtersQuery = &cfFiltersQuery{peer: p, stop: stop, sent: now}
+}
+
+// requestBlock asks for a block whose filter matched, from another peer than before if
+// it was asked for already. Without peers the request waits for the next one.
+func (s *cfSyncer) requestBlock(hash chainhash.Hash, height uint32, now time.Time) {
+	p := s.anyPeer(s.blocks[hash].peer)
+	if p == nil {
+		log.Debugf("No peer to ask for block %s at height %d", hash.String(), height)
+		s.blocks[hash] = cfBlockRequest{height: height, sent: now}
+		return
+	}
+	getData := wire.NewMsgGetData()
+	getData.AddInvVect(wire.NewInvVect(wire.InvTypeWitnessBlock, &hash))
+	p.QueueMessage(getData, nil)
+	s.blocks[hash] = cfBlockRequest{height: height, peer: p, sent: now}
+}
+
+func (s *cfSyncer) handleBlock(p cfPeer, block *wire.MsgBlock, now time.Time) {
+	hash := block.BlockHash()
+	c := s.conflict
+	req, requested := s.blocks[hash]
+	if (c == nil || c.blockHash != hash || c.block != nil) && !requested {
+		return
+	}
+	if err := checkBlock(block); err != nil {
+		log.Warnf("Peer %s sent bad block %s: %v", p, hash.String(), err)
+		s.dropPeer(p, now)
+		return
+	}
+	if c != nil && c.blockHash == hash && c.block == nil {
+		c.block = block
+		s.checkConflict(now)
+	}
+	if requested && req.block == nil {
+		req.block = block
+		s.blocks[hash] = req
+		s.scanBlocks()
+	}
+}
+
+// scanBlocks scans the blocks downloaded in height order, up to the first one still
+// missing.
+func (s *cfSyncer) scanBlocks() {
+	for len(s.blocks) > 0 {
+		var lowest chainhash.Hash
+		var req cfBlockRequest
+		first := true
+		for hash, r := range s.blocks {
+			if first || r.height < req.height {
+				lowest, req, first = hash, r, false
+			}
+		}
+		if req.block == nil {
+			return
+		}
+		delete(s.blocks, lowest)
+		s.scanBlock(req.block, req.height)
+	}
+}
+
+// checkBlock checks the transactions of a block are those its header commits to.
+func checkBlock(block *wire.MsgBlock) error {
+	if len(block.Transactions) == 0 {
+		return errors.New("no transactions")
+	}
+	b := btcutil.NewBlock(block)
+	merkles := blockchain.BuildMerkleTreeStore(b.Transactions(), false)
+	if root := merkles[len(merkles)-1]; *root != block.Header.MerkleRoot {
+		return fmt.Errorf("merkle root should be %s not %s", block.Header.MerkleRoot.String(), root.String())
+	}
+	return blockchain.ValidateWitnessCommitment(b)
+}
+
+// scanBlock collects the transactions of a block whose filter matched, each with a proof
+// in the form of a merkle block.
+func (s *cfSyncer) scanBlock(block *wire.MsgBlock, height uint32) {
+	hash := block.BlockHash()
+	var matched []*wire.MsgTx
+	for _, tx := range block.Transactions {
+		if s.filter.scan(tx) {
+			matched = append(matched, tx)
+		}
+	}
+	if len(matched) == 0 {
+		log.Debugf("Filter of block %s at height %d was a false positive", hash.String(), height)
+		return
+	}
+	proof, err := merkleProof(block, matched)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, tx := range matched {
+		m := MatchedTx{
+			Tx:        tx,
+			BlockHash: hash,
+			Height:    height,
+			Proof:     proof,
+		}
+		s.filter.addMatched(m)
+		log.Infof("Matched transaction %s in block %s at height %d", tx.TxHash().String(), hash.String(), height)
+		if s.filter.cfg.OnMatch != nil {
+			s.filter.cfg.OnMatch(m)
+		}
+	}
+}
+
+// checkConflict settles a conflict once the block and the filter behind every claim are in.
+// Filters are checked against the headers claimed and the outputs of the block, the peers
+// behind a wrong one are disconnected.
+func (s *cfSyncer) checkConflict(now time.Time) {
+	c := s.conflict
+	if c.block == nil || len(c.filters) < len(c.claims) || (c.anchor && len(c.prevs) < len(c.claims)) {
+		return
+	}
+	s.conflict = nil
+	dropped := false
+	for claim, peers := range c.claims {
+		prev := c.prev
+		if c.anchor {
+			prev = c.prevs[claim]
+		}
+		if err := checkFilter(c.block, prev, claim, c.filters[claim]); err != nil {
+			log.Warnf("Bad filter for block %s at height %d: %v", c.blockHash.String(), c.height, err)
+			for _, p := range peers {
+				s.dropPeer(p, now)
+			}
+			dropped = true
+		}
+	}
+	if !dropped {
+		log.Warnf("Can't tell which peers serve a wrong filter for block %s at height %d", c.blockHash.String(), c.height)
+		return
+	}
+	s.sync(now)
+}
+
+// checkFilter checks data is the filter the header claimed commits to and that it has every
+// output script of the block. It can't tell if the scripts spent are missing.
+func checkFilter(block *wire.MsgBlock, prev, claim chainhash.Hash, data []byte) error {
+	if filterHeader(chainhash.DoubleHashH(data), prev) != claim {
+		return errors.New("filter doesn't match its header")
+	}
+	f, err := gcs.FromNBytes(builder.DefaultP, builder.DefaultM, data)
+	if err != nil {
+		return err
+	}
+	blockHash := block.BlockHash()
+	key := builder.DeriveKey(&blockHash)
+	for _, tx := range block.Transactions {
+		for _, out := range tx.TxOut {
+			if len(out.PkScript) == 0 || out.PkScript[0] == txscript.OP_RETURN {
+				continue
+			}
+			ok, err := f.Match(key, out.PkScript)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("filter misses output script %x", out.PkScript)
+			}
+		}
+	}
+	return nil
+}
+
+// tick gives up on requests peers didn't answer in time and asks again.
+func (s *cfSyncer) tick(now time.Time) {
+	if q := s.headersQuery; q != nil && now.Sub(q.sent) >= cfRequestTimeout {
+		log.Warnf("%d peers didn't send filter headers %d to %d in time", len(q.waiting), q.start, q.stop)
+		q.waiting = make(map[cfPeer]struct{})
+		s.resolveHeaders(now)
+	}
+	if c := s.conflict; c != nil && now.Sub(c.sent) >= cfRequestTimeout {
+		log.Warnf("Didn't get the filters or block %s to settle a conflict in time", c.blockHash.String())
+		s.conflict = nil
+	}
+	if q := s.filtersQuery; q != nil && now.Sub(q.sent) >= cfRequestTimeout {
+		log.Warnf("Peer %s didn't send filters in time", q.peer)
+		s.filtersQuery = nil
+	}
+	for hash, req := range s.blocks {
+		if req.block == nil && (req.peer == nil || now.Sub(req.sent) >= cfRequestTimeout) {
+			s.requestBlock(hash, req.height, now)
+		}
+	}
+	if s.started {
+		s.sync(now)
+	}
+}
@@ -0,0 +1,503 @@
+package netserv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/gcs/builder"
+	"github.com/ontio/spvclient/chain"
+)
+
+// cfTestChain is a regtest chain of full blocks with their basic filters
+type cfTestChain struct {
+	blocks  []*wire.MsgBlock
+	heights map[chainhash.Hash]uint32
+	// The scripts spent by the inputs of each block, for its filter
+	spent   [][][]byte
+	filters [][]byte
+}
+
+func newCFTestChain() *cfTestChain {
+	genesis := chaincfg.RegressionNetParams.GenesisBlock
+	return &cfTestChain{
+		blocks:  []*wire.MsgBlock{genesis},
+		heights: map[chainhash.Hash]uint32{genesis.BlockHash(): 0},
+		spent:   [][][]byte{nil},
+	}
+}
+
+// addBlock mines a block with a coinbase and txs, whose inputs spend spent
+func (c *cfTestChain) addBlock(t *testing.T, txs []*wire.MsgTx, spent [][]byte) *wire.MsgBlock {
+	height := uint32(len(c.blocks))
+	prev := c.blocks[height-1].Header
+	coinbase := wire.NewMsgTx(wire.TxVersion)
+	sigScript, _ := txscript.NewScriptBuilder().AddInt64(int64(height)).AddOp(txscript.OP_0).Script()
+	coinbase.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), sigScript, nil))
+	coinbase.AddTxOut(wire.NewTxOut(50e8, []byte{txscript.OP_TRUE}))
+	block := &wire.MsgBlock{Transactions: append([]*wire.MsgTx{coinbase}, txs...)}
+	merkles := blockchain.BuildMerkleTreeStore(btcutil.NewBlock(block).Transactions(), false)
+	block.Header = mineHeaders(prev, 1, 0)[0]
+	block.Header.MerkleRoot = *merkles[len(merkles)-1]
+	block.Header.Nonce = 0
+	for {
+		hash := block.Header.BlockHash()
+		if blockchain.HashToBig(&hash).Cmp(blockchain.CompactToBig(block.Header.Bits)) <= 0 {
+			break
+		}
+		block.Header.Nonce++
+	}
+	c.blocks = append(c.blocks, block)
+	c.heights[block.BlockHash()] = height
+	c.spent = append(c.spent, spent)
+	return block
+}
+
+// build computes the filters once all blocks are in
+func (c *cfTestChain) build(t *testing.T) {
+	for i, block := range c.blocks {
+		c.filters = append(c.filters, c.filter(t, block, c.spent[i]))
+	}
+}
+
+func (c *cfTestChain) filter(t *testing.T, block *wire.MsgBlock, spent [][]byte) []byte {
+	f, err := builder.BuildBasicFilter(block, spent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := f.NBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// fakeCFPeer answers the requests of the compact filter sync from a cfTestChain, with its
+// own filters so it can lie about them
+type fakeCFPeer struct {
+	name    string
+	chain   *cfTestChain
+	filters [][]byte
+	// Filters served instead of the one behind the filter header, by height
+	wrongFilters map[uint32][]byte
+	// Blocks asked for aren't sent
+	withhold     bool
+	inbox        []wire.Message
+	disconnected bool
+}
+
+func newFakeCFPeer(name string, c *cfTestChain) *fakeCFPeer {
+	return &fakeCFPeer{name: name, chain: c, filters: append([][]byte(nil), c.filters...)}
+}
+
+func (p *fakeCFPeer) String() string { return p.name }
+
+func (p *fakeCFPeer) QueueMessage(msg wire.Message, doneChan chan<- struct{}) {
+	p.inbox = append(p.inbox, msg)
+}
+
+func (p *fakeCFPeer) Disconnect() { p.disconnected = true }
+
+func (p *fakeCFPeer) filterHeader(height uint32) chainhash.Hash {
+	var header chainhash.Hash
+	for i := uint32(0); i <= height; i++ {
+		header = filterHeader(chainhash.DoubleHashH(p.filters[i]), header)
+	}
+	return header
+}
+
+// answer serves the messages queued for p
+func (p *fakeCFPeer) answer(s *cfSyncer, now time.Time) {
+	for len(p.inbox) > 0 && !p.disconnected {
+		msg := p.inbox[0]
+		p.inbox = p.inbox[1:]
+		switch m := msg.(type) {
+		case *wire.MsgGetCFHeaders:
+			stop := p.chain.heights[m.StopHash]
+			reply := wire.NewMsgCFHeaders()
+			reply.FilterType = m.FilterType
+			reply.StopHash = m.StopHash
+			if m.StartHeight > 0 {
+				reply.PrevFilterHeader = p.filterHeader(m.StartHeight - 1)
+			}
+			for h := m.StartHeight; h <= stop; h++ {
+				filterHash := chainhash.DoubleHashH(p.filters[h])
+				reply.AddCFHash(&filterHash)
+			}
+			s.handleCFHeaders(p, reply, now)
+		case *wire.MsgGetCFilters:
+			stop := p.chain.heights[m.StopHash]
+			for h := m.StartHeight; h <= stop; h++ {
+				hash := p.chain.blocks[h].BlockHash()
+				data, ok := p.wrongFilters[h]
+				if !ok {
+					data = p.filters[h]
+				}
+				s.handleCFilter(p, wire.NewMsgCFilter(m.FilterType, &hash, data), now)
+			}
+		case *wire.MsgGetData:
+			if p.withhold {
+				continue
+			}
+			for _, iv := range m.InvList {
+				s.handleBlock(p, p.chain.blocks[p.chain.heights[iv.Hash]], now)
+			}
+		}
+	}
+}
+
+// deliver lets the peers answer until nothing is asked anymore
+func deliver(s *cfSyncer, now time.Time, peers ...*fakeCFPeer) {
+	for busy := true; busy; {
+		busy = false
+		for _, p := range peers {
+			if len(p.inbox) > 0 && !p.disconnected {
+				busy = true
+				p.answer(s, now)
+			}
+		}
+	}
+}
+
+func TestCFSyncer(t *testing.T) {
+	params := &chaincfg.RegressionNetParams
+	p2sh, err := btcutil.NewAddressScriptHash(testRedeem, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherScript, _ := txscript.PayToAddrScript(other)
+	depositScript, _ := txscript.PayToAddrScript(p2sh)
+
+	c := newCFTestChain()
+	deposit := payTo(t, p2sh, wire.OutPoint{Hash: chainhash.Hash{1}})
+	spend := payTo(t, other, wire.OutPoint{Hash: deposit.TxHash()})
+	for h := 1; h <= 10; h++ {
+		switch h {
+		case 6:
+			c.addBlock(t, []*wire.MsgTx{deposit}, [][]byte{otherScript})
+		case 8:
+			c.addBlock(t, []*wire.MsgTx{spend}, [][]byte{depositScript})
+		default:
+			c.addBlock(t, nil, nil)
+		}
+	}
+	c.build(t)
+
+	newSyncer := func() (*cfSyncer, *chain.Blockchain, *FilterManager) {
+		bc, err := chain.NewBlockchainWithHeaders(chain.NewMemHeaders(), params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var headers []wire.BlockHeader
+		for _, block := range c.blocks[1:] {
+			headers = append(headers, block.Header)
+		}
+		if _, _, err := bc.CommitHeaders(headers); err != nil {
+			t.Fatal(err)
+		}
+		fm := NewFilterManager(FilterConfig{Redeem: testRedeem})
+		return newCFSyncer(CFilterConfig{StartHeight: 2}, bc, fm), bc, fm
+	}
+	checkMatched := func(bc *chain.Blockchain, fm *FilterManager) {
+		matched := fm.MatchedTxs()
+		if len(matched) != 2 || matched[0].Tx.TxHash() != deposit.TxHash() || matched[1].Tx.TxHash() != spend.TxHash() {
+			t.Fatalf("Expected the deposit and its spend to match, got %d transactions", len(matched))
+		}
+		for i, height := range []uint32{6, 8} {
+			m := matched[i]
+			if m.Height != height || m.BlockHash != c.blocks[height].BlockHash() {
+				t.Errorf("Transaction %s matched in block %s at height %d", m.Tx.TxHash(), m.BlockHash, m.Height)
+			}
+			if _, err := bc.VerifyTxInclusion(m.Tx, m.Proof, m.Height); err != nil {
+				t.Errorf("Bad proof for %s: %v", m.Tx.TxHash(), err)
+			}
+		}
+	}
+
+	// Honest peers
+	s, bc, fm := newSyncer()
+	defer bc.Close()
+	a, b := newFakeCFPeer("a", c), newFakeCFPeer("b", c)
+	now := time.Now()
+	s.addPeer(a, now)
+	s.sync(now)
+	if s.headersQuery != nil || len(a.inbox) != 0 {
+		t.Error("Asked for filter headers with less than the minimum of peers")
+	}
+	s.addPeer(b, now)
+	s.sync(now)
+	deliver(s, now, a, b)
+	checkMatched(bc, fm)
+	stats := s.Stats()
+	if stats.HeaderHeight != 10 || stats.FilterHeight != 10 || stats.Matched < 2 || stats.Conflicts != 0 || stats.BadPeers != 0 {
+		t.Errorf("Wrong stats %+v", stats)
+	}
+	if s.prev != a.filterHeader(1) {
+		t.Error("Wrong filter header before the start")
+	}
+
+	// A new block only needs its own filter header and filter
+	block := c.addBlock(t, nil, nil)
+	c.filters = append(c.filters, c.filter(t, block, nil))
+	a.filters, b.filters = c.filters, c.filters
+	if _, _, err := bc.CommitHeaders([]wire.BlockHeader{block.Header}); err != nil {
+		t.Fatal(err)
+	}
+	s.sync(now)
+	if q := s.headersQuery; q == nil || q.start != 11 || q.stop != 11 {
+		t.Fatal("Didn't ask for the filter header of the new block")
+	}
+	deliver(s, now, a, b)
+	if stats := s.Stats(); stats.HeaderHeight != 11 || stats.FilterHeight != 11 {
+		t.Errorf("Wrong stats after a new block %+v", stats)
+	}
+	c.blocks, c.filters, c.spent = c.blocks[:11], c.filters[:11], c.spent[:11]
+
+	// A peer hiding the deposit from us
+	s, bc, fm = newSyncer()
+	defer bc.Close()
+	a, b = newFakeCFPeer("a", c), newFakeCFPeer("b", c)
+	liar := newFakeCFPeer("liar", c)
+	hidden := *c.blocks[6]
+	hidden.Transactions = hidden.Transactions[:1]
+	liar.filters[6] = c.filter(t, &hidden, nil)
+	for _, p := range []*fakeCFPeer{a, liar, b} {
+		s.addPeer(p, now)
+	}
+	s.sync(now)
+	deliver(s, now, a, liar, b)
+	if !liar.disconnected || a.disconnected || b.disconnected {
+		t.Errorf("Expected only the liar to be disconnected")
+	}
+	checkMatched(bc, fm)
+	if stats := s.Stats(); stats.Conflicts != 1 || stats.BadPeers != 1 || stats.FilterHeight != 10 {
+		t.Errorf("Wrong stats %+v", stats)
+	}
+
+	// A peer lying about the filter header before the first we sync
+	s, bc, fm = newSyncer()
+	defer bc.Close()
+	a, b = newFakeCFPeer("a", c), newFakeCFPeer("b", c)
+	liar = newFakeCFPeer("liar", c)
+	liar.filters[1] = c.filters[0]
+	for _, p := range []*fakeCFPeer{a, liar, b} {
+		s.addPeer(p, now)
+	}
+	s.sync(now)
+	deliver(s, now, a, liar, b)
+	if !liar.disconnected || a.disconnected || b.disconnected {
+		t.Errorf("Expected only the liar to be disconnected")
+	}
+	checkMatched(bc, fm)
+	if stats := s.Stats(); stats.Conflicts != 1 || stats.BadPeers != 1 {
+		t.Errorf("Wrong stats %+v", stats)
+	}
+	if s.prev != a.filterHeader(1) {
+		t.Error("Wrong filter header before the start")
+	}
+
+	// A filter which doesn't match the filter header
+	s, bc, fm = newSyncer()
+	defer bc.Close()
+	s.cfg.MinPeers = 1
+	a, b = newFakeCFPeer("a", c), newFakeCFPeer("b", c)
+	a.wrongFilters = map[uint32][]byte{4: c.filters[5]}
+	s.addPeer(a, now)
+	s.sync(now)
+	deliver(s, now, a)
+	if !a.disconnected {
+		t.Error("Peer serving a wrong filter wasn't disconnected")
+	}
+	if stats := s.Stats(); stats.BadPeers != 1 || stats.FilterHeight != 3 {
+		t.Errorf("Wrong stats %+v", stats)
+	}
+	s.addPeer(b, now)
+	s.sync(now)
+	deliver(s, now, b)
+	checkMatched(bc, fm)
+
+	// The only peer leaves before sending the blocks which matched
+	s, bc, fm = newSyncer()
+	defer bc.Close()
+	s.cfg.MinPeers = 1
+	a, b = newFakeCFPeer("a", c), newFakeCFPeer("b", c)
+	a.withhold = true
+	s.addPeer(a, now)
+	s.sync(now)
+	deliver(s, now, a)
+	s.removePeer(a, now)
+	if len(s.blocks) != 2 || len(fm.MatchedTxs()) != 0 {
+		t.Fatalf("Expected the 2 blocks which matched to wait for a peer, %d wait", len(s.blocks))
+	}
+	s.tick(now.Add(cfRequestTimeout))
+	if len(s.blocks) != 2 {
+		t.Fatal("Blocks which matched dropped without peers")
+	}
+	s.addPeer(b, now)
+	deliver(s, now, b)
+	checkMatched(bc, fm)
+}
+
+func TestCFSyncer_Reorg(t *testing.T) {
+	c := newCFTestChain()
+	for h := 1; h <= 5; h++ {
+		c.addBlock(t, nil, nil)
+	}
+	c.build(t)
+	bc, err := chain.NewBlockchainWithHeaders(chain.NewMemHeaders(), &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	var headers []wire.BlockHeader
+	for _, block := range c.blocks[1:] {
+		headers = append(headers, block.Header)
+	}
+	if _, _, err := bc.CommitHeaders(headers); err != nil {
+		t.Fatal(err)
+	}
+	s := newCFSyncer(CFilterConfig{StartHeight: 1, MinPeers: 1}, bc, NewFilterManager(FilterConfig{}))
+	a := newFakeCFPeer("a", c)
+	now := time.Now()
+	s.addPeer(a, now)
+	s.sync(now)
+	deliver(s, now, a)
+	if len(s.headers) != 5 || s.next != 6 {
+		t.Fatalf("Expected 5 filter headers, got %d", len(s.headers))
+	}
+
+	// A longer branch from height 3
+	side := mineHeaders(c.blocks[3].Header, 3, 9)
+	if _, _, err := bc.CommitHeaders(side); err != nil {
+		t.Fatal(err)
+	}
+	s.sync(now)
+	if len(s.headers) != 3 || s.next != 4 {
+		t.Errorf("Expected to keep the filter headers up to the fork, got %d", len(s.headers))
+	}
+	if q := s.headersQuery; q == nil || q.start != 4 || q.stop != 6 || q.stopHash != side[2].BlockHash() {
+		t.Error("Didn't ask for the filter headers of the new branch")
+	}
+
+	// Nobody answers
+	s.tick(now.Add(cfRequestTimeout))
+	if s.headersQuery == nil || s.headersQuery.sent != now.Add(cfRequestTimeout) {
+		t.Error("Didn't ask again after the timeout")
+	}
+}
+
+func TestCFSyncer_ReorgWhileAsking(t *testing.T) {
+	params := &chaincfg.RegressionNetParams
+	other, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newCFTestChain()
+	for h := 1; h <= 5; h++ {
+		c.addBlock(t, nil, nil)
+	}
+	c.build(t)
+	// A longer branch from height 2
+	fork := &cfTestChain{
+		blocks:  append([]*wire.MsgBlock(nil), c.blocks[:3]...),
+		heights: make(map[chainhash.Hash]uint32),
+		spent:   append([][][]byte(nil), c.spent[:3]...),
+	}
+	for h, block := range fork.blocks {
+		fork.heights[block.BlockHash()] = uint32(h)
+	}
+	for h := 3; h <= 6; h++ {
+		fork.addBlock(t, []*wire.MsgTx{payTo(t, other, wire.OutPoint{Hash: chainhash.Hash{byte(h)}})}, nil)
+	}
+	fork.build(t)
+
+	bc, err := chain.NewBlockchainWithHeaders(chain.NewMemHeaders(), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	commit := func(blocks []*wire.MsgBlock) {
+		var headers []wire.BlockHeader
+		for _, block := range blocks {
+			headers = append(headers, block.Header)
+		}
+		if _, _, err := bc.CommitHeaders(headers); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit(c.blocks[1:4])
+	s := newCFSyncer(CFilterConfig{StartHeight: 1}, bc, NewFilterManager(FilterConfig{}))
+	a, b := newFakeCFPeer("a", c), newFakeCFPeer("b", c)
+	now := time.Now()
+	s.addPeer(a, now)
+	s.addPeer(b, now)
+	s.sync(now)
+	deliver(s, now, a, b)
+	if len(s.headers) != 3 {
+		t.Fatalf("Expected 3 filter headers, got %d", len(s.headers))
+	}
+
+	// The branch wins while only one peer answered
+	commit(c.blocks[4:])
+	s.sync(now)
+	a.answer(s, now)
+	commit(fork.blocks[3:])
+	s.sync(now)
+	if len(s.headers) != 2 {
+		t.Errorf("Expected to keep the filter headers up to the fork, got %d", len(s.headers))
+	}
+	if q := s.headersQuery; q == nil || q.start != 3 || q.stop != 6 || len(q.answers) != 0 {
+		t.Fatal("Didn't ask for the filter headers of the branch")
+	}
+	a.chain, a.filters = fork, fork.filters
+	b.chain, b.filters = fork, fork.filters
+	deliver(s, now, a, b)
+	if a.disconnected || b.disconnected {
+		t.Error("Peer disconnected for answering before the reorg")
+	}
+	if len(s.headers) != 6 || s.headers[5].blockHash != fork.blocks[6].BlockHash() || s.headers[5].header != a.filterHeader(6) {
+		t.Fatalf("Wrong filter headers of the branch, got %d", len(s.headers))
+	}
+	if stats := s.Stats(); stats.BadPeers != 0 || stats.Conflicts != 0 || stats.HeaderHeight != 6 {
+		t.Errorf("Wrong stats %+v", stats)
+	}
+
+	// A batch the best chain left behind before it was resolved
+	tip := fork.blocks[6].Header
+	commit([]*wire.MsgBlock{{Header: mineHeaders(tip, 1, 0)[0]}})
+	s.sync(now)
+	q := s.headersQuery
+	if q == nil || q.start != 7 {
+		t.Fatal("Didn't ask for the filter header of the new block")
+	}
+	if _, _, err := bc.CommitHeaders(mineHeaders(tip, 2, 1)); err != nil {
+		t.Fatal(err)
+	}
+	q.answers[a] = []chainhash.Hash{s.headers[5].header, {1}}
+	q.answers[b] = q.answers[a]
+	q.waiting = make(map[cfPeer]struct{})
+	s.resolveHeaders(now)
+	if len(s.headers) != 6 {
+		t.Errorf("Filter headers of blocks which left the best chain accepted, got %d", len(s.headers))
+	}
+}
+
+func TestParseSyncMode(t *testing.T) {
+	for s, want := range map[string]SyncMode{"": SyncBloom, "bloom": SyncBloom, "cfilters": SyncCompactFilters} {
+		if mode, err := ParseSyncMode(s); err != nil || mode != want {
+			t.Errorf("Parsed %q as %s, %v", s, mode, err)
+		}
+	}
+	if _, err := ParseSyncMode("neutrino"); err == nil {
+		t.Error("Parsed an unknown sync mode")
+	}
+}
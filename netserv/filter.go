@@ -0,0 +1,295 @@
+package netserv
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/bloom"
+)
+
+const (
+	defaultFalsePositiveRate = 0.0001
+	defaultMaxFalsePositives = 100
+	// Matched transactions kept, the oldest are dropped first
+	maxMatchedTxs = 10000
+)
+
+type FilterConfig struct {
+	// Redeem script of the multisig deposits are sent to, its P2SH and P2WSH outputs and
+	// their spends are watched
+	Redeem []byte
+	// More addresses to watch
+	Addresses []btcutil.Address
+	// False positive rate of the filter. Defaults to 0.0001.
+	FalsePositiveRate float64
+	// The filter is loaded again with a new tweak once a peer sent this many transactions
+	// which didn't match. Defaults to 100.
+	MaxFalsePositives uint32
+	// Called from the wire service for every matched transaction, it must not block
+	OnMatch func(MatchedTx)
+}
+
+// MatchedTx is a transaction our filter matched, in a block we have the header of
+type MatchedTx struct {
+	Tx        *wire.MsgTx
+	BlockHash chainhash.Hash
+	Height    uint32
+	// The merkleblock message the transaction came with, a proof VerifyTxInclusion takes
+	Proof []byte
+}
+
+type FilterStats struct {
+	// Script hashes, scripts and addresses watched
+	Elements int
+	// Outputs paying to them
+	OutPoints      int
+	Matched        uint64
+	FalsePositives uint64
+	Refreshes      uint64
+}
+
+// FilterManager builds the BIP37 filter loaded into every peer and keeps the transactions
+// it matched. Outputs paying to what we watch are watched too so their spends match.
+type FilterManager struct {
+	lock      sync.Mutex
+	cfg       FilterConfig
+	addrs     []btcutil.Address
+	elements  map[string]struct{}
+	outPoints map[wire.OutPoint]struct{}
+	// Transactions watched by hash and the output scripts they pay to
+	txs       map[chainhash.Hash]struct{}
+	txScripts [][]byte
+	filter    *wire.MsgFilterLoad
+
+	matched map[chainhash.Hash]MatchedTx
+	order   []chainhash.Hash
+	stats   FilterStats
+}
+
+func NewFilterManager(cfg FilterConfig) *FilterManager {
+	if cfg.FalsePositiveRate <= 0 {
+		cfg.FalsePositiveRate = defaultFalsePositiveRate
+	}
+	if cfg.MaxFalsePositives == 0 {
+		cfg.MaxFalsePositives = defaultMaxFalsePositives
+	}
+	fm := &FilterManager{
+		cfg:       cfg,
+		addrs:     append([]btcutil.Address(nil), cfg.Addresses...),
+		elements:  make(map[string]struct{}),
+		outPoints: make(map[wire.OutPoint]struct{}),
+		txs:       make(map[chainhash.Hash]struct{}),
+		matched:   make(map[chainhash.Hash]MatchedTx),
+	}
+	if len(cfg.Redeem) > 0 {
+		// P2SH outputs push the hash160 of the script, P2WSH ones its sha256 and
+		// P2SH spends the script itself
+		fm.elements[string(btcutil.Hash160(cfg.Redeem))] = struct{}{}
+		witnessHash := sha256.Sum256(cfg.Redeem)
+		fm.elements[string(witnessHash[:])] = struct{}{}
+		fm.elements[string(cfg.Redeem)] = struct{}{}
+	}
+	for _, addr := range cfg.Addresses {
+		fm.elements[string(addr.ScriptAddress())] = struct{}{}
+	}
+	fm.build()
+	return fm
+}
+
+// build must be called with the lock held
+func (fm *FilterManager) build() {
+	n := len(fm.elements) + len(fm.outPoints) + len(fm.txs)
+	if n == 0 {
+		n = 1
+	}
+	// A new tweak every time, so peers can't link the filters and see which false
+	// positives are common to them
+	var tweak [4]byte
+	rand.Read(tweak[:])
+	filter := bloom.NewFilter(uint32(n), binary.LittleEndian.Uint32(tweak[:]), fm.cfg.FalsePositiveRate, wire.BloomUpdateAll)
+	for e := range fm.elements {
+		filter.Add([]byte(e))
+	}
+	for op := range fm.outPoints {
+		op := op
+		filter.AddOutPoint(&op)
+	}
+	for hash := range fm.txs {
+		hash := hash
+		filter.AddHash(&hash)
+	}
+	fm.filter = filter.MsgFilterLoad()
+}
+
+// FilterLoad returns the message loading the current filter into a peer.
+func (fm *FilterManager) FilterLoad() *wire.MsgFilterLoad {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+	return fm.filter
+}
+
+// Refresh builds the filter again with a new tweak and the outpoints watched so far.
+func (fm *FilterManager) Refresh() *wire.MsgFilterLoad {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+	fm.build()
+	fm.stats.Refreshes++
+	return fm.filter
+}
+
+// AddAddress watches addr too. Peers only learn about it once the filter is loaded again.
+func (fm *FilterManager) AddAddress(addr btcutil.Address) {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+	fm.addrs = append(fm.addrs, addr)
+	fm.elements[string(addr.ScriptAddress())] = struct{}{}
+	fm.build()
+}
+
+// WatchTx watches tx itself, e.g. one we broadcast, so the block it gets into matches.
+// Peers only learn about it once the filter is loaded again.
+func (fm *FilterManager) WatchTx(tx *wire.MsgTx) {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+	hash := tx.TxHash()
+	if _, ok := fm.txs[hash]; ok {
+		return
+	}
+	fm.txs[hash] = struct{}{}
+	for _, out := range tx.TxOut {
+		// Compact filters leave these out
+		if len(out.PkScript) == 0 || out.PkScript[0] == txscript.OP_RETURN {
+			continue
+		}
+		fm.txScripts = append(fm.txScripts, out.PkScript)
+	}
+	fm.build()
+}
+
+// Scripts returns the output scripts watched, which compact filters are matched against.
+func (fm *FilterManager) Scripts() [][]byte {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+	var scripts [][]byte
+	if len(fm.cfg.Redeem) > 0 {
+		p2sh, _ := txscript.NewScriptBuilder().AddOp(txscript.OP_HASH160).
+			AddData(btcutil.Hash160(fm.cfg.Redeem)).AddOp(txscript.OP_EQUAL).Script()
+		witnessHash := sha256.Sum256(fm.cfg.Redeem)
+		p2wsh, _ := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(witnessHash[:]).Script()
+		scripts = append(scripts, p2sh, p2wsh)
+	}
+	for _, addr := range fm.addrs {
+		script, err := txscript.PayToAddrScript(addr)
+		if err != nil {
+			continue
+		}
+		scripts = append(scripts, script)
+	}
+	return append(scripts, fm.txScripts...)
+}
+
+// match tells whether tx pays to or spends from what we watch, rather than being a
+// false positive of the filter. Outputs paying to us are watched from then on.
+func (fm *FilterManager) match(tx *wire.MsgTx) bool {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+	matched := fm.matchTx(tx)
+	if !matched {
+		fm.stats.FalsePositives++
+	}
+	return matched
+}
+
+// scan is match for the transactions of a whole block, those not matching aren't counted
+// as false positives.
+func (fm *FilterManager) scan(tx *wire.MsgTx) bool {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+	return fm.matchTx(tx)
+}
+
+// matchTx must be called with the lock held
+func (fm *FilterManager) matchTx(tx *wire.MsgTx) bool {
+	txHash := tx.TxHash()
+	_, matched := fm.txs[txHash]
+	for i, out := range tx.TxOut {
+		if fm.matchesScript(out.PkScript) {
+			matched = true
+			fm.outPoints[wire.OutPoint{Hash: txHash, Index: uint32(i)}] = struct{}{}
+		}
+	}
+	for _, in := range tx.TxIn {
+		if _, ok := fm.outPoints[in.PreviousOutPoint]; ok || fm.matchesScript(in.SignatureScript) {
+			matched = true
+		}
+		for _, item := range in.Witness {
+			if _, ok := fm.elements[string(item)]; ok {
+				matched = true
+			}
+		}
+	}
+	return matched
+}
+
+// matchesScript must be called with the lock held
+func (fm *FilterManager) matchesScript(script []byte) bool {
+	pushes, err := txscript.PushedData(script)
+	if err != nil {
+		return false
+	}
+	for _, data := range pushes {
+		if _, ok := fm.elements[string(data)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (fm *FilterManager) addMatched(m MatchedTx) {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+	hash := m.Tx.TxHash()
+	if _, ok := fm.matched[hash]; !ok {
+		fm.order = append(fm.order, hash)
+	}
+	fm.matched[hash] = m
+	fm.stats.Matched++
+	for len(fm.order) > maxMatchedTxs {
+		delete(fm.matched, fm.order[0])
+		fm.order = fm.order[1:]
+	}
+}
+
+// GetMatchedTx returns a matched transaction by hash.
+func (fm *FilterManager) GetMatchedTx(hash chainhash.Hash) (MatchedTx, bool) {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+	m, ok := fm.matched[hash]
+	return m, ok
+}
+
+// MatchedTxs returns the matched transactions kept, oldest first.
+func (fm *FilterManager) MatchedTxs() []MatchedTx {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+	ret := make([]MatchedTx, 0, len(fm.order))
+	for _, hash := range fm.order {
+		ret = append(ret, fm.matched[hash])
+	}
+	return ret
+}
+
+func (fm *FilterManager) Stats() FilterStats {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+	stats := fm.stats
+	stats.Elements = len(fm.elements)
+	stats.OutPoints = len(fm.outPoints)
+	return stats
+}
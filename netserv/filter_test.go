@@ -0,0 +1,126 @@
+package netserv
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/bloom"
+)
+
+// A 1 of 1 multisig, the key doesn't matter
+var testRedeem = []byte{txscript.OP_1, 33,
+	0x02, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+	17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32,
+	txscript.OP_1, txscript.OP_CHECKMULTISIG}
+
+func payTo(t *testing.T, addr btcutil.Address, prev wire.OutPoint) *wire.MsgTx {
+	script, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(&prev, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(1000, script))
+	return tx
+}
+
+func TestFilterManager(t *testing.T) {
+	params := &chaincfg.RegressionNetParams
+	p2sh, err := btcutil.NewAddressScriptHash(testRedeem, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	witnessHash := sha256.Sum256(testRedeem)
+	p2wsh, err := btcutil.NewAddressWitnessScriptHash(witnessHash[:], params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fm := NewFilterManager(FilterConfig{Redeem: testRedeem})
+	if fm.cfg.FalsePositiveRate != defaultFalsePositiveRate || fm.cfg.MaxFalsePositives != defaultMaxFalsePositives {
+		t.Errorf("Wrong defaults %+v", fm.cfg)
+	}
+	deposit := payTo(t, p2sh, wire.OutPoint{Hash: chainhash.Hash{1}})
+	segwitDeposit := payTo(t, p2wsh, wire.OutPoint{Hash: chainhash.Hash{2}})
+	unrelated := payTo(t, other, wire.OutPoint{Hash: chainhash.Hash{3}})
+
+	filter := bloom.LoadFilter(fm.FilterLoad())
+	for _, tx := range []*wire.MsgTx{deposit, segwitDeposit} {
+		if !filter.MatchTxAndUpdate(btcutil.NewTx(tx)) {
+			t.Errorf("Filter didn't match deposit %s", tx.TxHash())
+		}
+		if !fm.match(tx) {
+			t.Errorf("Deposit %s is no match", tx.TxHash())
+		}
+	}
+	if fm.match(unrelated) {
+		t.Error("Unrelated transaction is a match")
+	}
+
+	// Spending a deposit matches through its outpoint, even without the script
+	spend := payTo(t, other, wire.OutPoint{Hash: deposit.TxHash()})
+	if !fm.match(spend) {
+		t.Error("Spend of a deposit is no match")
+	}
+	stats := fm.Stats()
+	if stats.Elements != 3 || stats.OutPoints != 2 || stats.FalsePositives != 1 {
+		t.Errorf("Wrong stats %+v", stats)
+	}
+
+	// A new filter has a new tweak and the outpoints seen so far
+	old := fm.FilterLoad()
+	refreshed := fm.Refresh()
+	if refreshed.Tweak == old.Tweak {
+		t.Error("Refreshed filter has the same tweak")
+	}
+	if !bloom.LoadFilter(refreshed).MatchesOutPoint(&wire.OutPoint{Hash: segwitDeposit.TxHash()}) {
+		t.Error("Refreshed filter doesn't watch a deposit output")
+	}
+
+	fm.AddAddress(other)
+	if !fm.match(unrelated) {
+		t.Error("Transaction to an added address is no match")
+	}
+	if !bloom.LoadFilter(fm.FilterLoad()).MatchTxAndUpdate(btcutil.NewTx(payTo(t, other, wire.OutPoint{}))) {
+		t.Error("Filter doesn't watch an added address")
+	}
+	if stats := fm.Stats(); stats.Elements != 4 || stats.Refreshes != 1 {
+		t.Errorf("Wrong stats %+v", stats)
+	}
+}
+
+func TestFilterManager_Matched(t *testing.T) {
+	fm := NewFilterManager(FilterConfig{})
+	var first chainhash.Hash
+	for i := 0; i < maxMatchedTxs+1; i++ {
+		tx := wire.NewMsgTx(wire.TxVersion)
+		tx.LockTime = uint32(i)
+		if i == 0 {
+			first = tx.TxHash()
+		}
+		fm.addMatched(MatchedTx{Tx: tx, Height: uint32(i)})
+	}
+	if _, ok := fm.GetMatchedTx(first); ok {
+		t.Error("Oldest matched transaction was kept")
+	}
+	matched := fm.MatchedTxs()
+	if len(matched) != maxMatchedTxs || matched[0].Height != 1 || matched[maxMatchedTxs-1].Height != maxMatchedTxs {
+		t.Fatalf("Wrong matched transactions, %d kept", len(matched))
+	}
+	m, ok := fm.GetMatchedTx(matched[10].Tx.TxHash())
+	if !ok || m.Height != 11 {
+		t.Error("Matched transaction not found by hash")
+	}
+	if fm.Stats().Matched != maxMatchedTxs+1 {
+		t.Errorf("Wrong matched count %d", fm.Stats().Matched)
+	}
+}
@@ -57,6 +57,10 @@ type PeerManagerConfig struct {
 	// If this field is not nil the PeerManager will only connect to this address
 	TrustedPeer net.Addr
 
+	// If this field is not nil the PeerManager will only connect to these peers, all of them
+	// at once. It takes precedence over TrustedPeer.
+	Trusted *TrustedPeers
+
 	// Listeners to handle messages from peers. If nil, no messages will be handled.
 	Listeners *peer.MessageListeners
 
@@ -68,6 +72,9 @@ type PeerManagerConfig struct {
 
 	// The main channel over which to send outgoing events
 	MsgChan chan interface{}
+
+	// Peers have to serve bloom filtered merkle blocks or compact filters depending on it
+	SyncMode SyncMode
 }
 
 type PeerManager struct {
@@ -76,12 +83,13 @@ type PeerManager struct {
 	sourceAddr             *wire.NetAddress
 	peerConfig             *peer.Config
 	peerMutex              *sync.RWMutex
-	trustedPeer            net.Addr
+	trusted                *TrustedPeers
 	targetOutbound         uint32
 	proxy                  proxy.Dialer
 	recentlyTriedAddresses map[string]bool
 	connectedPeers         map[uint64]*peer.Peer
 	msgChan                chan interface{}
+	syncMode               SyncMode
 }
 
 func NewPeerManager(config *PeerManagerConfig) (*PeerManager, error) {
@@ -95,11 +103,12 @@ func NewPeerManager(config *PeerManagerConfig) (*PeerManager, error) {
 		addrManager:            addrmgr.New(config.AddressCacheDir, nil),
 		peerMutex:              new(sync.RWMutex),
 		sourceAddr:             wire.NewNetAddressIPPort(net.ParseIP("0.0.0.0"), defaultPort, 0),
-		trustedPeer:            config.TrustedPeer,
+		trusted:                config.Trusted,
 		proxy:                  config.Proxy,
 		recentlyTriedAddresses: make(map[string]bool),
 		connectedPeers:         make(map[uint64]*peer.Peer),
 		msgChan:                config.MsgChan,
+		syncMode:               config.SyncMode,
 	}
 
 	targetOutbound := config.TargetOutbound
@@ -107,8 +116,14 @@ func NewPeerManager(config *PeerManagerConfig) (*PeerManager, error) {
 		targetOutbound = defaultTargetOutbound
 	}
 
-	if config.TrustedPeer != nil {
-		targetOutbound = 1
+	if pm.trusted == nil && config.TrustedPeer != nil {
+		pm.trusted, err = NewTrustedPeers(TrustedPeersConfig{Peers: []TrustedPeer{{Addr: config.TrustedPeer}}})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pm.trusted != nil {
+		targetOutbound = uint32(len(pm.trusted.peers))
 	}
 	pm.targetOutbound = targetOutbound
 
@@ -129,7 +144,11 @@ func NewPeerManager(config *PeerManagerConfig) (*PeerManager, error) {
 		OnDisconnection: pm.onDisconnection,
 		GetNewAddress:   pm.getNewAddress,
 		Dial: func(addr net.Addr) (net.Conn, error) {
-			return dial("tcp", addr.String())
+			conn, err := dial("tcp", addr.String())
+			if err != nil && pm.trusted != nil {
+				pm.trusted.failed(addr, time.Now())
+			}
+			return conn, err
 		},
 	}
 
@@ -148,7 +167,12 @@ func NewPeerManager(config *PeerManagerConfig) (*PeerManager, error) {
 	listeners.OnHeaders = pm.onHeaders
 	listeners.OnMerkleBlock = pm.onMerkleBlock
 	listeners.OnInv = pm.onInv
+	listeners.OnTx = pm.onTx
+	listeners.OnCFHeaders = pm.onCFHeaders
+	listeners.OnCFilter = pm.onCFilter
+	listeners.OnBlock = pm.onBlock
 	listeners.OnReject = pm.onReject
+	listeners.OnGetData = pm.onGetData
 
 	pm.peerConfig = &peer.Config{
 		UserAgentName:    config.UserAgentName,
@@ -188,6 +212,9 @@ func (pm *PeerManager) onConnection(req *connmgr.ConnReq, conn net.Conn) {
 	// Associate the connection with the peer
 	p.AssociateConnection(conn)
 	pm.connectedPeers[req.ID()] = p
+	if pm.trusted != nil {
+		pm.trusted.connected(req.Addr, p)
+	}
 
 	// Tell the addr service we made a connection
 	pm.addrManager.Connected(p.NA())
@@ -200,13 +227,17 @@ func (pm *PeerManager) onConnection(req *connmgr.ConnReq, conn net.Conn) {
 }
 
 func (pm *PeerManager) onVerack(p *peer.Peer, msg *wire.MsgVerAck) {
-	// Check this peer offers bloom filtering services. If not dump them.
+	// Check this peer offers bloom filtering or compact filter services. If not dump them.
 	p.NA().Services = p.Services()
-	if !(p.NA().HasService(wire.SFNodeBloom) && p.NA().HasService(wire.SFNodeNetwork) && p.NA().HasService(wire.SFNodeWitness)) ||
+	filtering := wire.SFNodeBloom
+	if pm.syncMode == SyncCompactFilters {
+		filtering = wire.SFNodeCF
+	}
+	if !(p.NA().HasService(filtering) && p.NA().HasService(wire.SFNodeNetwork) && p.NA().HasService(wire.SFNodeWitness)) ||
 		p.NA().HasService(SFNodeBitcoinCash) { // Don't connect to bitcoin cash nodes
 		// onDisconnection will be called
 		// which will remove the peer from openPeers
-		log.Warnf("Peer %s does not support bloom filtering, diconnecting", p)
+		log.Warnf("Peer %s does not support %s, diconnecting", p, filtering)
 		p.Disconnect()
 		return
 	}
@@ -222,6 +253,9 @@ func (pm *PeerManager) onDisconnection(req *connmgr.ConnReq) {
 	// Remove from connected peers
 	pm.peerMutex.Lock()
 	defer pm.peerMutex.Unlock()
+	if pm.trusted != nil {
+		pm.trusted.disconnected(req.Addr, time.Now())
+	}
 	peer, ok := pm.connectedPeers[req.ID()]
 	if !ok {
 		return
@@ -235,8 +269,8 @@ func (pm *PeerManager) onDisconnection(req *connmgr.ConnReq) {
 
 // Called by connManager when it adds a new connection
 func (pm *PeerManager) getNewAddress() (net.Addr, error) {
-	// If we have a trusted peer we'll just return it
-	if pm.trustedPeer == nil {
+	// If we have trusted peers we'll just return the next one
+	if pm.trusted == nil {
 		pm.peerMutex.Lock()
 		defer pm.peerMutex.Unlock()
 		// We're going to loop here and pull addresses from the addrManager until we get one that we
@@ -276,7 +310,7 @@ func (pm *PeerManager) getNewAddress() (net.Addr, error) {
 		}
 		return nil, errors.New("failed to find appropriate address to return")
 	} else {
-		return pm.trustedPeer, nil
+		return pm.trusted.nextAddr(time.Now())
 	}
 }
 
@@ -357,14 +391,47 @@ func (pm *PeerManager) onInv(p *peer.Peer, msg *wire.MsgInv) {
 	}
 }
 
+func (pm *PeerManager) onTx(p *peer.Peer, msg *wire.MsgTx) {
+	if pm.msgChan != nil {
+		pm.msgChan <- txMsg{msg, p}
+	}
+}
+
+func (pm *PeerManager) onCFHeaders(p *peer.Peer, msg *wire.MsgCFHeaders) {
+	if pm.msgChan != nil {
+		pm.msgChan <- cfHeadersMsg{msg, p}
+	}
+}
+
+func (pm *PeerManager) onCFilter(p *peer.Peer, msg *wire.MsgCFilter) {
+	if pm.msgChan != nil {
+		pm.msgChan <- cfilterMsg{msg, p}
+	}
+}
+
+func (pm *PeerManager) onBlock(p *peer.Peer, msg *wire.MsgBlock, buf []byte) {
+	if pm.msgChan != nil {
+		pm.msgChan <- blockMsg{msg, p}
+	}
+}
+
 func (pm *PeerManager) onReject(p *peer.Peer, msg *wire.MsgReject) {
 	log.Warnf("Received reject message from peer %d: Code: %s, Hash %s, Reason: %s", int(p.ID()), msg.Code.String(), msg.Hash.String(), msg.Reason)
+	if pm.msgChan != nil {
+		pm.msgChan <- rejectMsg{msg, p}
+	}
+}
+
+func (pm *PeerManager) onGetData(p *peer.Peer, msg *wire.MsgGetData) {
+	if pm.msgChan != nil {
+		pm.msgChan <- getDataMsg{msg, p}
+	}
 }
 
 func (pm *PeerManager) Start() {
 	pm.addrManager.Start()
 	log.Infof("Loaded %d peers from cache", pm.addrManager.NumAddresses())
-	if pm.trustedPeer == nil && pm.addrManager.NeedMoreAddresses() {
+	if pm.trusted == nil && pm.addrManager.NeedMoreAddresses() {
 		log.Info("Querying DNS seeds")
 		pm.queryDNSSeeds()
 	}
@@ -0,0 +1,258 @@
+package netserv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	peerpkg "github.com/btcsuite/btcd/peer"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/bloom"
+	"github.com/ontio/spvclient/chain"
+	"github.com/ontio/spvclient/log"
+)
+
+// How often proof requests past their deadline are dropped
+const proofCheckInterval = time.Second * 5
+
+var (
+	ProofTimeoutError = errors.New("timed out fetching the proof from peers")
+	NoPeersError      = errors.New("no peers to fetch the proof from")
+)
+
+// fetchProofMsg asks the handler for the proof that a transaction is in a block.
+type fetchProofMsg struct {
+	req *proofRequest
+}
+
+type proofResult struct {
+	tx    *wire.MsgTx
+	proof []byte
+	err   error
+}
+
+// proofRequest is a proof asked for from one peer at a time
+type proofRequest struct {
+	blockHash chainhash.Hash
+	txid      chainhash.Hash
+	deadline  time.Time
+	peer      *peerpkg.Peer
+	// A merkle block was asked for rather than the whole block
+	filtered bool
+	// The merkle block which matched the transaction, the peer sends it right after
+	merkleBlock []byte
+	reply       chan proofResult
+}
+
+// FetchProof asks a peer for the block with blockHash and returns the transaction txid in
+// it with a proof VerifyTxInclusion takes, a serialized merkleblock message. With a bloom
+// filter a merkle block is asked for, the whole block if it doesn't match the transaction
+// or with compact filters, the proof is then built from it. The header of the block isn't
+// checked, the wire service has to be running.
+func (ws *WireService) FetchProof(blockHash, txid chainhash.Hash, timeout time.Duration) (*wire.MsgTx, []byte, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	req := &proofRequest{
+		blockHash: blockHash,
+		txid:      txid,
+		deadline:  time.Now().Add(timeout),
+		reply:     make(chan proofResult, 1),
+	}
+	select {
+	case ws.msgChan <- fetchProofMsg{req}:
+	case <-timer.C:
+		return nil, nil, ProofTimeoutError
+	}
+	select {
+	case res := <-req.reply:
+		return res.tx, res.proof, res.err
+	case <-timer.C:
+		return nil, nil, ProofTimeoutError
+	}
+}
+
+func (ws *WireService) handleFetchProof(req *proofRequest) {
+	req.filtered = ws.filter != nil
+	ws.proofs[req.blockHash] = append(ws.proofs[req.blockHash], req)
+	ws.requestProof(req, nil)
+}
+
+// requestProof asks a peer other than except for what req needs, the sync peer if it can.
+func (ws *WireService) requestProof(req *proofRequest, except *peerpkg.Peer) {
+	peer := ws.syncPeer
+	if peer == nil || peer == except {
+		peer = nil
+		for p := range ws.peerStates {
+			if p != except {
+				peer = p
+				break
+			}
+		}
+	}
+	if peer == nil {
+		ws.finishProof(req, proofResult{err: NoPeersError})
+		return
+	}
+	req.peer = peer
+	req.merkleBlock = nil
+	invType := wire.InvTypeWitnessBlock
+	if req.filtered {
+		invType = wire.InvTypeFilteredBlock
+	}
+	getData := wire.NewMsgGetData()
+	getData.AddInvVect(wire.NewInvVect(invType, &req.blockHash))
+	peer.QueueMessage(getData, nil)
+	log.Debugf("Requesting block %s from %s for the proof of %s", req.blockHash.String(), peer, req.txid.String())
+}
+
+func (ws *WireService) finishProof(req *proofRequest, res proofResult) {
+	reqs := ws.proofs[req.blockHash]
+	for i, r := range reqs {
+		if r == req {
+			reqs = append(reqs[:i:i], reqs[i+1:]...)
+			break
+		}
+	}
+	if len(reqs) == 0 {
+		delete(ws.proofs, req.blockHash)
+	} else {
+		ws.proofs[req.blockHash] = reqs
+	}
+	req.reply <- res
+}
+
+// handleProofMerkleBlock takes a merkle block a proof request asked for, it returns false
+// if none did.
+func (ws *WireService) handleProofMerkleBlock(peer *peerpkg.Peer, merkleBlock *wire.MsgMerkleBlock) bool {
+	hash := merkleBlock.Header.BlockHash()
+	handled := false
+	for _, req := range append([]*proofRequest(nil), ws.proofs[hash]...) {
+		if req.peer != peer || !req.filtered || req.merkleBlock != nil {
+			continue
+		}
+		handled = true
+		matches, err := chain.MerkleBlockMatches(merkleBlock)
+		if err != nil {
+			log.Warnf("Peer %s sent bad merkle block %s: %v", peer, hash.String(), err)
+			peer.Disconnect()
+			ws.requestProof(req, peer)
+			continue
+		}
+		matched := false
+		for _, match := range matches {
+			if match == req.txid {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			// Our filter doesn't watch the transaction, the block may match nothing at all. The
+			// whole block has it.
+			req.filtered = false
+			ws.requestProof(req, nil)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := merkleBlock.BtcEncode(&buf, wire.ProtocolVersion, wire.LatestEncoding); err != nil {
+			ws.finishProof(req, proofResult{err: err})
+			continue
+		}
+		req.merkleBlock = buf.Bytes()
+	}
+	return handled
+}
+
+// handleProofTx takes a transaction which came after a merkle block a proof request asked
+// for, it returns false if none waits for it.
+func (ws *WireService) handleProofTx(peer *peerpkg.Peer, tx *wire.MsgTx) bool {
+	txid := tx.TxHash()
+	for _, reqs := range ws.proofs {
+		for _, req := range reqs {
+			if req.peer == peer && req.merkleBlock != nil && req.txid == txid {
+				ws.finishProof(req, proofResult{tx: tx, proof: req.merkleBlock})
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleProofBlock builds the proofs of the requests which asked peer for block.
+func (ws *WireService) handleProofBlock(peer *peerpkg.Peer, block *wire.MsgBlock) {
+	hash := block.BlockHash()
+	var reqs []*proofRequest
+	for _, req := range ws.proofs[hash] {
+		if req.peer == peer && !req.filtered {
+			reqs = append(reqs, req)
+		}
+	}
+	if len(reqs) == 0 {
+		return
+	}
+	if err := checkBlock(block); err != nil {
+		log.Warnf("Peer %s sent bad block %s: %v", peer, hash.String(), err)
+		peer.Disconnect()
+		for _, req := range reqs {
+			ws.requestProof(req, peer)
+		}
+		return
+	}
+	for _, req := range reqs {
+		tx, proof, err := blockProof(block, req.txid)
+		ws.finishProof(req, proofResult{tx: tx, proof: proof, err: err})
+	}
+}
+
+// retryProofs asks other peers for what was asked from peer, which disconnected.
+func (ws *WireService) retryProofs(peer *peerpkg.Peer) {
+	for _, reqs := range ws.proofs {
+		for _, req := range append([]*proofRequest(nil), reqs...) {
+			if req.peer == peer {
+				ws.requestProof(req, peer)
+			}
+		}
+	}
+}
+
+// expireProofs drops the requests past their deadline at now.
+func (ws *WireService) expireProofs(now time.Time) {
+	for _, reqs := range ws.proofs {
+		for _, req := range append([]*proofRequest(nil), reqs...) {
+			if now.After(req.deadline) {
+				ws.finishProof(req, proofResult{err: ProofTimeoutError})
+			}
+		}
+	}
+}
+
+// blockProof finds the transaction txid in block and proves it's there.
+func blockProof(block *wire.MsgBlock, txid chainhash.Hash) (*wire.MsgTx, []byte, error) {
+	for _, tx := range block.Transactions {
+		if tx.TxHash() == txid {
+			proof, err := merkleProof(block, []*wire.MsgTx{tx})
+			if err != nil {
+				return nil, nil, err
+			}
+			return tx, proof, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("transaction %s is not in block %s", txid.String(), block.BlockHash().String())
+}
+
+// merkleProof returns a serialized merkleblock message matching txs in block.
+func merkleProof(block *wire.MsgBlock, txs []*wire.MsgTx) ([]byte, error) {
+	bf := bloom.NewFilter(uint32(len(txs)), 0, 0.000001, wire.BloomUpdateNone)
+	for _, tx := range txs {
+		txHash := tx.TxHash()
+		bf.AddHash(&txHash)
+	}
+	mb, _ := bloom.NewMerkleBlock(btcutil.NewBlock(block), bf)
+	var buf bytes.Buffer
+	if err := mb.BtcEncode(&buf, wire.ProtocolVersion, wire.LatestEncoding); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
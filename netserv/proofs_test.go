@@ -0,0 +1,176 @@
+package netserv
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	peerpkg "github.com/btcsuite/btcd/peer"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/bloom"
+	"github.com/ontio/spvclient/chain"
+)
+
+// newTestPeer returns a peer which never connects, messages queued to it are dropped
+func newTestPeer(t *testing.T, addr string) *peerpkg.Peer {
+	p, err := peerpkg.NewOutboundPeer(&peerpkg.Config{ChainParams: &chaincfg.RegressionNetParams}, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func fetchProof(ws *WireService, blockHash, txid chainhash.Hash) *proofRequest {
+	req := &proofRequest{
+		blockHash: blockHash,
+		txid:      txid,
+		deadline:  time.Now().Add(time.Minute),
+		reply:     make(chan proofResult, 1),
+	}
+	ws.handleFetchProof(req)
+	return req
+}
+
+func proofOf(t *testing.T, req *proofRequest) proofResult {
+	select {
+	case res := <-req.reply:
+		return res
+	default:
+		t.Fatalf("No proof of %s yet", req.txid.String())
+	}
+	return proofResult{}
+}
+
+func checkProof(t *testing.T, res proofResult, txid chainhash.Hash) {
+	if res.err != nil {
+		t.Fatalf("Failed to fetch the proof of %s: %v", txid.String(), res.err)
+	}
+	if res.tx.TxHash() != txid {
+		t.Fatalf("Got transaction %s instead of %s", res.tx.TxHash().String(), txid.String())
+	}
+	mb := wire.MsgMerkleBlock{}
+	if err := mb.BtcDecode(bytes.NewReader(res.proof), wire.ProtocolVersion, wire.LatestEncoding); err != nil {
+		t.Fatal(err)
+	}
+	matches, err := chain.MerkleBlockMatches(&mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, match := range matches {
+		if match == txid {
+			return
+		}
+	}
+	t.Errorf("Proof doesn't match %s", txid.String())
+}
+
+func TestFetchProof(t *testing.T) {
+	params := &chaincfg.RegressionNetParams
+	p2sh, err := btcutil.NewAddressScriptHash(testRedeem, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newCFTestChain()
+	deposit := payTo(t, p2sh, wire.OutPoint{Hash: chainhash.Hash{1}})
+	unrelated := payTo(t, other, wire.OutPoint{Hash: chainhash.Hash{2}})
+	block := c.addBlock(t, []*wire.MsgTx{deposit, unrelated}, nil)
+	blockHash := block.BlockHash()
+
+	fm := NewFilterManager(FilterConfig{Redeem: testRedeem})
+	ws := NewWireService(&WireServiceConfig{Params: params, Filter: fm})
+	peerA := newTestPeer(t, "127.0.0.1:18444")
+	peerB := newTestPeer(t, "127.0.0.2:18444")
+	ws.peerStates[peerA] = &peerSyncState{requestedBlocks: make(map[chainhash.Hash]struct{})}
+	ws.peerStates[peerB] = &peerSyncState{requestedBlocks: make(map[chainhash.Hash]struct{})}
+	ws.syncPeer = peerA
+
+	// A merkle block matching the deposit, followed by the deposit
+	req := fetchProof(ws, blockHash, deposit.TxHash())
+	if !req.filtered || req.peer != peerA {
+		t.Fatalf("Asked %s for a filtered block %v", req.peer, req.filtered)
+	}
+	mb, _ := bloom.NewMerkleBlock(btcutil.NewBlock(block), bloom.LoadFilter(fm.FilterLoad()))
+	if ws.handleProofMerkleBlock(peerB, mb) {
+		t.Error("Took a merkle block from a peer not asked")
+	}
+	ws.handleMerkleBlockMsg(&merkleBlockMsg{merkleBlock: mb, peer: peerA})
+	if req.merkleBlock == nil {
+		t.Fatal("Merkle block matching the deposit not kept")
+	}
+	ws.handleTxMsg(&txMsg{tx: deposit, peer: peerA})
+	checkProof(t, proofOf(t, req), deposit.TxHash())
+
+	// The filter doesn't match the other transaction, its proof comes from the whole block
+	req = fetchProof(ws, blockHash, unrelated.TxHash())
+	ws.handleMerkleBlockMsg(&merkleBlockMsg{merkleBlock: mb, peer: peerA})
+	if req.filtered {
+		t.Fatal("Whole block not asked for after the merkle block didn't match")
+	}
+	ws.handleProofBlock(peerA, block)
+	checkProof(t, proofOf(t, req), unrelated.TxHash())
+
+	// Nothing in the block matches the filter, the whole block is asked from the same peer
+	other2 := payTo(t, other, wire.OutPoint{Hash: chainhash.Hash{4}})
+	unmatched := c.addBlock(t, []*wire.MsgTx{other2}, nil)
+	req = fetchProof(ws, unmatched.BlockHash(), other2.TxHash())
+	empty, matched := bloom.NewMerkleBlock(btcutil.NewBlock(unmatched), bloom.LoadFilter(fm.FilterLoad()))
+	if len(matched) != 0 {
+		t.Fatal("Filter matches the block")
+	}
+	ws.handleMerkleBlockMsg(&merkleBlockMsg{merkleBlock: empty, peer: peerA})
+	if req.filtered || req.peer != peerA {
+		t.Fatalf("Asked %s for a filtered block %v after a merkle block matching nothing", req.peer, req.filtered)
+	}
+	ws.handleProofBlock(peerA, unmatched)
+	checkProof(t, proofOf(t, req), other2.TxHash())
+
+	// A block missing a transaction is asked from another peer
+	req = fetchProof(ws, blockHash, deposit.TxHash())
+	req.filtered = false
+	bad := *block
+	bad.Transactions = block.Transactions[:2]
+	ws.handleProofBlock(peerA, &bad)
+	if req.peer != peerB {
+		t.Fatalf("Asked %s after a bad block", req.peer)
+	}
+	ws.handleProofBlock(peerB, block)
+	checkProof(t, proofOf(t, req), deposit.TxHash())
+
+	// Not in the block
+	req = fetchProof(ws, blockHash, chainhash.Hash{3})
+	req.filtered = false
+	ws.handleProofBlock(peerA, block)
+	if res := proofOf(t, req); res.err == nil {
+		t.Error("Proof of a transaction not in the block")
+	}
+
+	// Peers disconnecting
+	ws.syncPeer = nil
+	req = fetchProof(ws, blockHash, deposit.TxHash())
+	first := req.peer
+	ws.handleDonePeerMsg(first)
+	if req.peer == nil || req.peer == first {
+		t.Fatalf("Asked %s after the peer disconnected", req.peer)
+	}
+	ws.handleDonePeerMsg(req.peer)
+	if res := proofOf(t, req); res.err != NoPeersError {
+		t.Errorf("Wrong error %v without peers", res.err)
+	}
+
+	ws.peerStates[peerB] = &peerSyncState{requestedBlocks: make(map[chainhash.Hash]struct{})}
+	req = fetchProof(ws, blockHash, deposit.TxHash())
+	ws.expireProofs(time.Now().Add(time.Hour))
+	if res := proofOf(t, req); res.err != ProofTimeoutError {
+		t.Errorf("Wrong error %v after the deadline", res.err)
+	}
+	if len(ws.proofs) != 0 {
+		t.Errorf("%d blocks still asked for", len(ws.proofs))
+	}
+}
@@ -0,0 +1,239 @@
+package netserv
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/ontio/spvclient/chain"
+	"github.com/ontio/spvclient/log"
+)
+
+// StaleTipAction is what the stale tip monitor did about a peer or a tip which stopped moving
+type StaleTipAction int
+
+const (
+	// A peer announcing a greater height than our tip was made the sync peer
+	RotateSyncPeer StaleTipAction = iota
+	// A peer whose height stayed below our tip was disconnected
+	EvictPeer
+	// A peer ahead of us announced a header we store off the best chain, on a branch with
+	// more work than the best chain. The best chain was rolled back to where that branch
+	// forks off and synced again from the peer. Each peer can only do this once.
+	RollbackToFork
+)
+
+func (a StaleTipAction) String() string {
+	switch a {
+	case RotateSyncPeer:
+		return "rotate sync peer"
+	case EvictPeer:
+		return "evict peer"
+	case RollbackToFork:
+		return "rollback to fork"
+	default:
+		return "unknown"
+	}
+}
+
+// StaleTipEvent describes one action of the stale tip monitor
+type StaleTipEvent struct {
+	Action StaleTipAction
+	// Our tip when the action was taken
+	Height uint32
+	Hash   chainhash.Hash
+	// How long the tip had not moved
+	TipAge     time.Duration
+	Peer       string
+	PeerHeight int32
+	// The fork point rolled back to, only set for RollbackToFork
+	ForkHeight uint32
+	ForkHash   chainhash.Hash
+}
+
+// StaleTipStats counts the checks and decisions of the stale tip monitor
+type StaleTipStats struct {
+	Checks uint64
+	// Checks which found the tip stale while a peer announced a greater height
+	StaleTips uint64
+	Rotations uint64
+	Evictions uint64
+	Rollbacks uint64
+	// When the monitor last saw the tip change
+	LastTipChange time.Time
+}
+
+type StaleTipConfig struct {
+	// How often the tip is checked, zero turns the monitor off
+	CheckInterval time.Duration
+	// The tip is stale once it hasn't moved for this long while a peer announces a greater
+	// height, after that the monitor acts every half of it until the tip moves. Peers whose
+	// height stays below our tip for this long are evicted.
+	StaleAfter time.Duration
+	// Called from the wire service for every action, it must not block
+	OnEvent func(StaleTipEvent)
+}
+
+// tipPeer is the part of a peer the monitor looks at
+type tipPeer interface {
+	String() string
+	LastBlock() int32
+	LastAnnouncedBlock() *chainhash.Hash
+}
+
+// peerHeight remembers since when a peer is behind our tip at the same height
+type peerHeight struct {
+	height int32
+	behind time.Time
+}
+
+type staleTipStep struct {
+	event StaleTipEvent
+	peer  tipPeer
+}
+
+// staleTipMonitor decides what to do about a tip which stopped moving. It only reads the
+// chain, the wire service carries the decisions out.
+type staleTipMonitor struct {
+	cfg   StaleTipConfig
+	chain *chain.Blockchain
+
+	tip        chainhash.Hash
+	nextAction time.Time
+	heights    map[tipPeer]peerHeight
+	// Peers which had us roll back already
+	rolledBack map[tipPeer]bool
+
+	lock  sync.Mutex
+	stats StaleTipStats
+}
+
+func newStaleTipMonitor(cfg StaleTipConfig, bc *chain.Blockchain) *staleTipMonitor {
+	return &staleTipMonitor{
+		cfg:        cfg,
+		chain:      bc,
+		heights:    make(map[tipPeer]peerHeight),
+		rolledBack: make(map[tipPeer]bool),
+	}
+}
+
+func (m *staleTipMonitor) Stats() StaleTipStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.stats
+}
+
+// check compares our tip with the heights the connected peers announce at time now.
+func (m *staleTipMonitor) check(now time.Time, peers []tipPeer, syncPeer tipPeer) []staleTipStep {
+	best, err := m.chain.BestBlock()
+	if err != nil {
+		log.Errorf("Stale tip check failed: %v", err)
+		return nil
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.stats.Checks++
+	hash := best.Header.BlockHash()
+	if hash != m.tip || m.stats.LastTipChange.IsZero() {
+		m.tip = hash
+		m.stats.LastTipChange = now
+		m.nextAction = now.Add(m.cfg.StaleAfter)
+	}
+	height := int32(best.Height)
+	step := func(action StaleTipAction, p tipPeer) staleTipStep {
+		return staleTipStep{
+			event: StaleTipEvent{
+				Action:     action,
+				Height:     best.Height,
+				Hash:       hash,
+				TipAge:     now.Sub(m.stats.LastTipChange),
+				Peer:       p.String(),
+				PeerHeight: p.LastBlock(),
+			},
+			peer: p,
+		}
+	}
+
+	// Track since when each peer is stuck behind, forgetting the disconnected ones
+	heights := make(map[tipPeer]peerHeight, len(peers))
+	rolledBack := make(map[tipPeer]bool)
+	var ahead []tipPeer
+	keepingUp := 0
+	for _, p := range peers {
+		h := p.LastBlock()
+		ph, ok := m.heights[p]
+		if !ok || ph.height != h || h >= height {
+			ph = peerHeight{height: h}
+		}
+		if h < height && ph.behind.IsZero() {
+			ph.behind = now
+		}
+		heights[p] = ph
+		if m.rolledBack[p] {
+			rolledBack[p] = true
+		}
+		if h > height {
+			ahead = append(ahead, p)
+		}
+		if h >= height {
+			keepingUp++
+		}
+	}
+	m.heights = heights
+	m.rolledBack = rolledBack
+
+	var steps []staleTipStep
+	// Peers stuck behind are only evicted while others keep up, otherwise it's us who is wrong
+	if keepingUp > 0 {
+		for _, p := range peers {
+			ph := heights[p]
+			if !ph.behind.IsZero() && now.Sub(ph.behind) >= m.cfg.StaleAfter {
+				steps = append(steps, step(EvictPeer, p))
+				delete(m.heights, p)
+				m.stats.Evictions++
+			}
+		}
+	}
+
+	if len(ahead) == 0 || now.Before(m.nextAction) {
+		return steps
+	}
+	m.stats.StaleTips++
+	m.nextAction = now.Add(m.cfg.StaleAfter / 2)
+
+	// Peers ahead of us following a branch we store but don't follow. A lighter branch is
+	// no reason to drop the best chain, the headers the peer sends on a plain sync take
+	// over by themselves if they end up heavier.
+	for _, p := range ahead {
+		announced := p.LastAnnouncedBlock()
+		if announced == nil || m.rolledBack[p] {
+			continue
+		}
+		sh, err := m.chain.GetHeader(announced)
+		if err != nil || sh.GetTotalWork().Cmp(best.GetTotalWork()) <= 0 {
+			continue
+		}
+		fork, err := m.chain.ForkPoint(*announced)
+		if err != nil || fork.Header.BlockHash() == *announced {
+			continue
+		}
+		s := step(RollbackToFork, p)
+		s.event.ForkHeight = fork.Height
+		s.event.ForkHash = fork.Header.BlockHash()
+		m.rolledBack[p] = true
+		m.stats.Rollbacks++
+		return append(steps, s)
+	}
+
+	// Otherwise sync from the highest peer, a different one than before if there is one
+	sort.SliceStable(ahead, func(i, j int) bool {
+		return ahead[i].LastBlock() > ahead[j].LastBlock()
+	})
+	next := ahead[0]
+	if next == syncPeer && len(ahead) > 1 {
+		next = ahead[1]
+	}
+	m.stats.Rotations++
+	return append(steps, step(RotateSyncPeer, next))
+}
@@ -0,0 +1,162 @@
+package netserv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ontio/spvclient/chain"
+)
+
+type testPeer struct {
+	name      string
+	height    int32
+	announced *chainhash.Hash
+}
+
+func (p *testPeer) String() string                      { return p.name }
+func (p *testPeer) LastBlock() int32                    { return p.height }
+func (p *testPeer) LastAnnouncedBlock() *chainhash.Hash { return p.announced }
+
+// mineHeaders builds n regtest headers on prev, salt tells branches apart
+func mineHeaders(prev wire.BlockHeader, n int, salt byte) []wire.BlockHeader {
+	var headers []wire.BlockHeader
+	for i := 0; i < n; i++ {
+		hdr := wire.BlockHeader{
+			Version:    4,
+			PrevBlock:  prev.BlockHash(),
+			MerkleRoot: chainhash.Hash{salt},
+			Timestamp:  prev.Timestamp.Add(10 * time.Minute),
+			Bits:       prev.Bits,
+		}
+		for {
+			hash := hdr.BlockHash()
+			if blockchain.HashToBig(&hash).Cmp(blockchain.CompactToBig(hdr.Bits)) <= 0 {
+				break
+			}
+			hdr.Nonce++
+		}
+		headers = append(headers, hdr)
+		prev = hdr
+	}
+	return headers
+}
+
+func actions(steps []staleTipStep) []StaleTipAction {
+	var ret []StaleTipAction
+	for _, s := range steps {
+		ret = append(ret, s.event.Action)
+	}
+	return ret
+}
+
+func TestStaleTipMonitor(t *testing.T) {
+	bc, err := chain.NewBlockchainWithHeaders(chain.NewMemHeaders(), &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	main := mineHeaders(chaincfg.RegressionNetParams.GenesisBlock.Header, 5, 1)
+	if _, _, err := bc.CommitHeaders(main); err != nil {
+		t.Fatal(err)
+	}
+
+	stale := 30 * time.Minute
+	m := newStaleTipMonitor(StaleTipConfig{CheckInterval: time.Minute, StaleAfter: stale}, bc)
+	a := &testPeer{name: "a", height: 5}
+	b := &testPeer{name: "b", height: 5}
+	c := &testPeer{name: "c", height: 5}
+	peers := []tipPeer{a, b, c}
+	now := time.Now()
+	if steps := m.check(now, peers, a); len(steps) != 0 {
+		t.Errorf("Acted on a fresh tip: %v", actions(steps))
+	}
+
+	// Peers ahead, but not for long enough
+	a.height, b.height = 7, 6
+	if steps := m.check(now.Add(stale-time.Second), peers, a); len(steps) != 0 {
+		t.Errorf("Acted before the tip was stale: %v", actions(steps))
+	}
+	steps := m.check(now.Add(stale), peers, a)
+	if len(steps) != 1 || steps[0].event.Action != RotateSyncPeer || steps[0].peer != b {
+		t.Fatalf("Expected to rotate to b, got %v", actions(steps))
+	}
+	if steps[0].event.Height != 5 || steps[0].event.PeerHeight != 6 || steps[0].event.TipAge != stale {
+		t.Errorf("Wrong event %+v", steps[0].event)
+	}
+	// Wait half the stale time before acting again
+	if steps := m.check(now.Add(stale+stale/2-time.Second), peers, b); len(steps) != 0 {
+		t.Errorf("Acted again too soon: %v", actions(steps))
+	}
+	steps = m.check(now.Add(stale+stale/2), peers, b)
+	if len(steps) != 1 || steps[0].event.Action != RotateSyncPeer || steps[0].peer != a {
+		t.Fatalf("Expected to rotate back to a, got %v", actions(steps))
+	}
+
+	// The tip moves, c stays behind and gets evicted once it's been there long enough
+	if _, _, err := bc.CommitHeaders(mineHeaders(main[4], 2, 1)); err != nil {
+		t.Fatal(err)
+	}
+	b.height = 7
+	later := now.Add(time.Hour)
+	if steps := m.check(later, peers, a); len(steps) != 0 {
+		t.Errorf("Acted after the tip moved: %v", actions(steps))
+	}
+	steps = m.check(later.Add(stale), peers, a)
+	if len(steps) != 1 || steps[0].event.Action != EvictPeer || steps[0].peer != c {
+		t.Errorf("Expected to evict c, got %v", actions(steps))
+	}
+
+	// b follows a lighter branch forking off at height 3 which we know about, it's only
+	// synced from
+	side := mineHeaders(main[2], 3, 2)
+	if _, _, err := bc.CommitHeaders(side); err != nil {
+		t.Fatal(err)
+	}
+	sideTip := side[2].BlockHash()
+	b.height, b.announced = 8, &sideTip
+	steps = m.check(later.Add(2*stale), []tipPeer{a, b}, a)
+	if len(steps) != 1 || steps[0].event.Action != RotateSyncPeer || steps[0].peer != b {
+		t.Fatalf("Expected to rotate to b on a lighter branch, got %v", actions(steps))
+	}
+
+	// The branch overtakes the best chain and is rolled back to its first header, the
+	// branch we left is now heavier than the best chain
+	top := mineHeaders(main[4], 2, 1)
+	tip := top[1].BlockHash()
+	if _, _, err := bc.CommitHeaders(mineHeaders(side[2], 2, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.RollbackToHash(side[0].BlockHash(), chain.RollbackOptions{KeepForks: true}); err != nil {
+		t.Fatal(err)
+	}
+	b.announced = &tip
+	next := later.Add(3 * stale)
+	steps = m.check(next, []tipPeer{a, b}, a)
+	if len(steps) != 0 {
+		t.Fatalf("Acted on a tip which just moved: %v", actions(steps))
+	}
+	steps = m.check(next.Add(stale), []tipPeer{a, b}, a)
+	if len(steps) != 1 || steps[0].event.Action != RollbackToFork || steps[0].peer != b {
+		t.Fatalf("Expected to roll back, got %v", actions(steps))
+	}
+	if e := steps[0].event; e.ForkHeight != 3 || e.ForkHash != main[2].BlockHash() {
+		t.Errorf("Wrong fork point %d %s", e.ForkHeight, e.ForkHash)
+	}
+	// Once per peer
+	steps = m.check(next.Add(stale+stale/2), []tipPeer{a, b}, b)
+	if len(steps) != 1 || steps[0].event.Action != RotateSyncPeer {
+		t.Fatalf("Expected to rotate rather than roll back again, got %v", actions(steps))
+	}
+
+	stats := m.Stats()
+	if stats.Checks != 11 || stats.StaleTips != 5 || stats.Rotations != 4 || stats.Evictions != 1 || stats.Rollbacks != 1 {
+		t.Errorf("Wrong stats %+v", stats)
+	}
+	if !stats.LastTipChange.Equal(next) {
+		t.Errorf("Wrong last tip change %s", stats.LastTipChange)
+	}
+}
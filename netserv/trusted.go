@@ -0,0 +1,490 @@
+package netserv
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	peerpkg "github.com/btcsuite/btcd/peer"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ontio/spvclient/log"
+)
+
+const (
+	defaultTrustedMaxLatency    = 5 * time.Second
+	defaultTrustedCheckInterval = 10 * time.Second
+	// Connections to a trusted peer which keeps failing are retried at most this far apart
+	maxTrustedRetry = 5 * time.Minute
+)
+
+var NoTrustedPeerError = errors.New("no trusted peer to connect to")
+
+// TrustedPeer is one of our own nodes
+type TrustedPeer struct {
+	Addr net.Addr
+	// The healthy peer with the lowest priority is synced from
+	Priority int
+}
+
+type TrustedPeersConfig struct {
+	// Connected to instead of peers from the network, all of them at once
+	Peers []TrustedPeer
+	// How many trusted peers have to have our tip before we are current, none if zero
+	Quorum int
+	// Peers taking longer to answer a ping aren't healthy. Defaults to 5 seconds.
+	MaxLatency time.Duration
+	// How often the health of the sync peer is checked and the other peers are asked if
+	// they have our tip. Defaults to 10 seconds.
+	CheckInterval time.Duration
+}
+
+// TrustedPeerStatus describes one of the trusted peers
+type TrustedPeerStatus struct {
+	Addr      string
+	Priority  int
+	Connected bool
+	// Not behind another trusted peer and answering pings in time
+	Healthy bool
+	Height  int32
+	Latency time.Duration
+	// Whether it has our tip on its chain
+	HasTip bool
+	// Connections which failed in a row and when the last one did
+	Failures    int
+	LastFailure time.Time
+}
+
+// TrustedPeerStats tells how the trusted peers are doing
+type TrustedPeerStats struct {
+	Peers []TrustedPeerStatus
+	// Trusted peers which have our tip and how many have to
+	Agreeing int
+	Quorum   int
+}
+
+// trustedConn is the part of a connected peer its health is judged by
+type trustedConn interface {
+	String() string
+	LastBlock() int32
+	LastPingMicros() int64
+}
+
+type trustedState struct {
+	TrustedPeer
+	addr    string
+	dialing bool
+	conn    trustedConn
+	// Connected and through the version handshake, the wire service knows it
+	ready       bool
+	failures    int
+	lastFailure time.Time
+	retryAt     time.Time
+	// The last block seen on the tip of its chain
+	tip chainhash.Hash
+	// The tip it was last asked about and when, zero once it answered
+	probe     chainhash.Hash
+	probeSent time.Time
+}
+
+// trustedHealth is how a ready trusted peer is doing at a check
+type trustedHealth struct {
+	state   *trustedState
+	height  int32
+	latency time.Duration
+	healthy bool
+}
+
+// TrustedPeers keeps track of our own nodes. The peer manager connects to them and the
+// wire service syncs from the healthiest one, it only considers itself current once a
+// quorum of them has our tip.
+type TrustedPeers struct {
+	cfg TrustedPeersConfig
+
+	lock  sync.Mutex
+	peers []*trustedState
+}
+
+func NewTrustedPeers(cfg TrustedPeersConfig) (*TrustedPeers, error) {
+	if len(cfg.Peers) == 0 {
+		return nil, errors.New("no trusted peers")
+	}
+	if cfg.Quorum > len(cfg.Peers) {
+		return nil, fmt.Errorf("quorum of %d trusted peers but only %d configured", cfg.Quorum, len(cfg.Peers))
+	}
+	if cfg.MaxLatency <= 0 {
+		cfg.MaxLatency = defaultTrustedMaxLatency
+	}
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = defaultTrustedCheckInterval
+	}
+	tp := &TrustedPeers{cfg: cfg}
+	seen := make(map[string]bool)
+	for _, p := range cfg.Peers {
+		if p.Addr == nil {
+			return nil, errors.New("trusted peer without an address")
+		}
+		addr := p.Addr.String()
+		if seen[addr] {
+			return nil, fmt.Errorf("trusted peer %s configured twice", addr)
+		}
+		seen[addr] = true
+		tp.peers = append(tp.peers, &trustedState{TrustedPeer: p, addr: addr})
+	}
+	sort.SliceStable(tp.peers, func(i, j int) bool {
+		return tp.peers[i].Priority < tp.peers[j].Priority
+	})
+	return tp, nil
+}
+
+func (tp *TrustedPeers) get(addr net.Addr) *trustedState {
+	for _, st := range tp.peers {
+		if st.addr == addr.String() {
+			return st
+		}
+	}
+	return nil
+}
+
+func (tp *TrustedPeers) lookup(conn trustedConn) *trustedState {
+	for _, st := range tp.peers {
+		if st.conn != nil && st.conn == conn {
+			return st
+		}
+	}
+	return nil
+}
+
+// nextAddr returns the trusted peer to connect to at now, the one with the lowest priority
+// among those neither connected nor waiting to be tried again.
+func (tp *TrustedPeers) nextAddr(now time.Time) (net.Addr, error) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	for _, st := range tp.peers {
+		if st.dialing || st.conn != nil || now.Before(st.retryAt) {
+			continue
+		}
+		st.dialing = true
+		return st.Addr, nil
+	}
+	return nil, NoTrustedPeerError
+}
+
+// failed records a connection to addr failing at now, it's tried again later the more
+// often it failed in a row.
+func (tp *TrustedPeers) failed(addr net.Addr, now time.Time) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	if st := tp.get(addr); st != nil {
+		st.fail(now)
+	}
+}
+
+// disconnected records the connection to addr closed at now. A peer which went through the
+// version handshake is tried again at once, we likely dropped it ourselves. One which didn't
+// failed.
+func (tp *TrustedPeers) disconnected(addr net.Addr, now time.Time) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	st := tp.get(addr)
+	if st == nil {
+		return
+	}
+	if !st.ready {
+		st.fail(now)
+		return
+	}
+	st.closed()
+	st.retryAt = time.Time{}
+	log.Infof("Trusted peer %s disconnected", st.addr)
+}
+
+// closed forgets the connection to the peer.
+func (st *trustedState) closed() {
+	st.dialing = false
+	st.conn = nil
+	st.ready = false
+	st.tip = chainhash.Hash{}
+	st.probe = chainhash.Hash{}
+}
+
+func (st *trustedState) fail(now time.Time) {
+	st.closed()
+	st.failures++
+	st.lastFailure = now
+	retry := time.Duration(st.failures) * defaultRetryDuration
+	if retry > maxTrustedRetry {
+		retry = maxTrustedRetry
+	}
+	st.retryAt = now.Add(retry)
+	log.Warnf("Lost trusted peer %s, %d failures in a row, trying again in %s", st.addr, st.failures, retry)
+}
+
+// connected records conn connected to addr.
+func (tp *TrustedPeers) connected(addr net.Addr, conn trustedConn) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	if st := tp.get(addr); st != nil {
+		st.dialing = false
+		st.conn = conn
+	}
+}
+
+// ready marks conn through the version handshake, it returns false if it isn't trusted.
+func (tp *TrustedPeers) ready(conn trustedConn) bool {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	st := tp.lookup(conn)
+	if st == nil {
+		return false
+	}
+	st.ready = true
+	st.failures = 0
+	return true
+}
+
+// seenTip records hash on the tip of the chain of conn.
+func (tp *TrustedPeers) seenTip(conn trustedConn, hash chainhash.Hash) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	if st := tp.lookup(conn); st != nil {
+		st.tip = hash
+	}
+}
+
+// probeDue returns whether conn has to be asked if it has tip at now. It's asked again
+// if it didn't answer within the check interval.
+func (tp *TrustedPeers) probeDue(conn trustedConn, tip chainhash.Hash, now time.Time) bool {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	st := tp.lookup(conn)
+	if st == nil || !st.ready || st.tip == tip {
+		return false
+	}
+	if st.probe == tip && now.Sub(st.probeSent) < tp.cfg.CheckInterval {
+		return false
+	}
+	st.probe = tip
+	st.probeSent = now
+	return true
+}
+
+// probeAnswer takes the headers conn sent in answer to being asked if it has a tip. It
+// returns the tip, whether conn has it and false if conn wasn't asked. Asked from the parent
+// of the tip on, the first header is the tip if it has it.
+func (tp *TrustedPeers) probeAnswer(conn trustedConn, headers []*wire.BlockHeader) (chainhash.Hash, bool, bool) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	st := tp.lookup(conn)
+	if st == nil || st.probe == (chainhash.Hash{}) {
+		return chainhash.Hash{}, false, false
+	}
+	tip := st.probe
+	st.probe = chainhash.Hash{}
+	if len(headers) > 0 && headers[0].BlockHash() == tip {
+		st.tip = tip
+		return tip, true, true
+	}
+	st.tip = chainhash.Hash{}
+	return tip, false, true
+}
+
+// agreeing counts the ready trusted peers which have tip.
+func (tp *TrustedPeers) agreeing(tip chainhash.Hash) int {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	n := 0
+	for _, st := range tp.peers {
+		if st.ready && st.tip == tip {
+			n++
+		}
+	}
+	return n
+}
+
+// quorumMet returns whether enough trusted peers have tip.
+func (tp *TrustedPeers) quorumMet(tip chainhash.Hash) bool {
+	return tp.cfg.Quorum <= 0 || tp.agreeing(tip) >= tp.cfg.Quorum
+}
+
+// health ranks the ready trusted peers, the healthy ones first, then by priority and
+// latency. A peer is healthy if no other trusted peer announces a greater height and it
+// answers pings within the max latency, those it didn't ping yet count as answering.
+func (tp *TrustedPeers) health() []trustedHealth {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	var ranked []trustedHealth
+	var maxHeight int32
+	for _, st := range tp.peers {
+		if !st.ready {
+			continue
+		}
+		h := trustedHealth{
+			state:   st,
+			height:  st.conn.LastBlock(),
+			latency: time.Duration(st.conn.LastPingMicros()) * time.Microsecond,
+		}
+		if h.height > maxHeight {
+			maxHeight = h.height
+		}
+		ranked = append(ranked, h)
+	}
+	latency := func(h trustedHealth) time.Duration {
+		if h.latency == 0 {
+			return tp.cfg.MaxLatency
+		}
+		return h.latency
+	}
+	for i := range ranked {
+		ranked[i].healthy = ranked[i].height >= maxHeight && ranked[i].latency <= tp.cfg.MaxLatency
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if a.healthy != b.healthy {
+			return a.healthy
+		}
+		if a.state.Priority != b.state.Priority {
+			return a.state.Priority < b.state.Priority
+		}
+		return latency(a) < latency(b)
+	})
+	return ranked
+}
+
+// healthiest returns the trusted peer to sync from, nil if none is ready.
+func (tp *TrustedPeers) healthiest() trustedConn {
+	ranked := tp.health()
+	if len(ranked) == 0 {
+		return nil
+	}
+	return ranked[0].state.conn
+}
+
+// failover returns the trusted peer to sync from instead of syncPeer, nil to stay with it.
+// It moves away from a sync peer which isn't healthy or isn't trusted, and back to a
+// healthy peer of lower priority.
+func (tp *TrustedPeers) failover(syncPeer trustedConn) trustedConn {
+	ranked := tp.health()
+	if len(ranked) == 0 || !ranked[0].healthy || ranked[0].state.conn == syncPeer {
+		return nil
+	}
+	for _, h := range ranked {
+		if h.state.conn == syncPeer && h.healthy && h.state.Priority <= ranked[0].state.Priority {
+			return nil
+		}
+	}
+	return ranked[0].state.conn
+}
+
+func (tp *TrustedPeers) stats(tip chainhash.Hash) TrustedPeerStats {
+	healthy := make(map[*trustedState]trustedHealth)
+	for _, h := range tp.health() {
+		healthy[h.state] = h
+	}
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	stats := TrustedPeerStats{Quorum: tp.cfg.Quorum}
+	for _, st := range tp.peers {
+		status := TrustedPeerStatus{
+			Addr:        st.addr,
+			Priority:    st.Priority,
+			Connected:   st.ready,
+			HasTip:      st.ready && st.tip == tip,
+			Failures:    st.failures,
+			LastFailure: st.lastFailure,
+		}
+		if h, ok := healthy[st]; ok {
+			status.Healthy = h.healthy
+			status.Height = h.height
+			status.Latency = h.latency
+		}
+		if status.HasTip {
+			stats.Agreeing++
+		}
+		stats.Peers = append(stats.Peers, status)
+	}
+	return stats
+}
+
+// TrustedPeerStats returns how the trusted peers are doing, nothing without them.
+func (ws *WireService) TrustedPeerStats() TrustedPeerStats {
+	if ws.trusted == nil {
+		return TrustedPeerStats{}
+	}
+	var tip chainhash.Hash
+	if best, err := ws.chain.BestBlock(); err == nil {
+		tip = best.Header.BlockHash()
+	}
+	return ws.trusted.stats(tip)
+}
+
+// trustedTip records hash on the chain tip of peer if it's trusted.
+func (ws *WireService) trustedTip(peer *peerpkg.Peer, hash chainhash.Hash) {
+	if ws.trusted != nil {
+		ws.trusted.seenTip(peer, hash)
+	}
+}
+
+// handleTrustedHeaders takes the headers a trusted peer sent in answer to being asked if it
+// has our tip, it returns false if they answer something else.
+func (ws *WireService) handleTrustedHeaders(peer *peerpkg.Peer, headers []*wire.BlockHeader) bool {
+	if ws.trusted == nil || peer == ws.syncPeer {
+		return false
+	}
+	tip, has, ok := ws.trusted.probeAnswer(peer, headers)
+	if !ok {
+		return false
+	}
+	if !has {
+		log.Warnf("Trusted peer %s doesn't have our tip %s", peer, tip.String())
+		return true
+	}
+	if sh, err := ws.chain.GetHeader(&tip); err == nil && int32(sh.Height) > peer.LastBlock() {
+		peer.UpdateLastBlockHeight(int32(sh.Height))
+	}
+	return true
+}
+
+// checkTrusted asks the trusted peers other than the sync peer if they have our tip and
+// syncs from another one if the sync peer isn't the healthiest.
+func (ws *WireService) checkTrusted(now time.Time) {
+	best, err := ws.chain.BestBlock()
+	if err != nil {
+		log.Errorf("Trusted peer check failed: %v", err)
+		return
+	}
+	tip := best.Header.BlockHash()
+	// Asked from the parent of our tip on up to the tip, a peer which has it sends it first
+	locator := ws.chain.GetBlockLocator()
+	if len(locator) > 1 {
+		for peer := range ws.peerStates {
+			if peer == ws.syncPeer || !ws.trusted.probeDue(peer, tip, now) {
+				continue
+			}
+			msg := wire.NewMsgGetHeaders()
+			msg.HashStop = tip
+			for _, hash := range locator[1:] {
+				msg.AddBlockLocatorHash(hash)
+			}
+			peer.QueueMessage(msg, nil)
+		}
+	}
+
+	if ws.syncPeer == nil {
+		if !ws.Current() {
+			ws.startSync(nil)
+		}
+		return
+	}
+	if next := ws.trusted.failover(ws.syncPeer); next != nil {
+		peer := next.(*peerpkg.Peer)
+		if _, ok := ws.peerStates[peer]; !ok {
+			return
+		}
+		log.Warnf("Switching sync peer from %s to healthier trusted peer %s", ws.syncPeer, peer)
+		ws.startSync(peer)
+	}
+}
@@ -0,0 +1,232 @@
+package netserv
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ontio/spvclient/chain"
+)
+
+type fakeTrustedConn struct {
+	name   string
+	height int32
+	ping   time.Duration
+}
+
+func (c *fakeTrustedConn) String() string        { return c.name }
+func (c *fakeTrustedConn) LastBlock() int32      { return c.height }
+func (c *fakeTrustedConn) LastPingMicros() int64 { return int64(c.ping / time.Microsecond) }
+
+func trustedAddr(t *testing.T, addr string) net.Addr {
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestTrustedPeers(t *testing.T) {
+	a := trustedAddr(t, "127.0.0.1:18444")
+	b := trustedAddr(t, "127.0.0.2:18444")
+	c := trustedAddr(t, "127.0.0.3:18444")
+	if _, err := NewTrustedPeers(TrustedPeersConfig{}); err == nil {
+		t.Error("No error without peers")
+	}
+	if _, err := NewTrustedPeers(TrustedPeersConfig{Peers: []TrustedPeer{{Addr: a}}, Quorum: 2}); err == nil {
+		t.Error("No error with a quorum greater than the peers")
+	}
+	if _, err := NewTrustedPeers(TrustedPeersConfig{Peers: []TrustedPeer{{Addr: a}, {Addr: a}}}); err == nil {
+		t.Error("No error with a peer configured twice")
+	}
+	tp, err := NewTrustedPeers(TrustedPeersConfig{
+		Peers:  []TrustedPeer{{Addr: c, Priority: 2}, {Addr: a}, {Addr: b, Priority: 1}},
+		Quorum: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Connected in order of priority, one that failed is tried again later
+	now := time.Now()
+	for _, want := range []net.Addr{a, b, c} {
+		addr, err := tp.nextAddr(now)
+		if err != nil || addr.String() != want.String() {
+			t.Fatalf("Connecting to %v instead of %s: %v", addr, want, err)
+		}
+	}
+	if _, err := tp.nextAddr(now); err != NoTrustedPeerError {
+		t.Errorf("Wrong error %v with every peer dialed", err)
+	}
+	tp.failed(a, now)
+	if _, err := tp.nextAddr(now); err != NoTrustedPeerError {
+		t.Error("Failed peer tried again at once")
+	}
+	if addr, err := tp.nextAddr(now.Add(defaultRetryDuration)); err != nil || addr.String() != a.String() {
+		t.Errorf("Failed peer not tried again: %v", err)
+	}
+
+	connA := &fakeTrustedConn{name: "a", height: 100}
+	connB := &fakeTrustedConn{name: "b", height: 100, ping: 20 * time.Millisecond}
+	connC := &fakeTrustedConn{name: "c", height: 100, ping: 10 * time.Millisecond}
+	for addr, conn := range map[net.Addr]*fakeTrustedConn{a: connA, b: connB, c: connC} {
+		tp.connected(addr, conn)
+		if !tp.ready(conn) {
+			t.Fatalf("%s not trusted", conn)
+		}
+	}
+	if tp.ready(&fakeTrustedConn{name: "other"}) {
+		t.Error("Unknown peer trusted")
+	}
+	if st := tp.stats(chainhash.Hash{}); st.Peers[0].Failures != 0 || !st.Peers[0].LastFailure.Equal(now) {
+		t.Errorf("Wrong status %+v after connecting", st.Peers[0])
+	}
+
+	// The healthy peer of lowest priority is synced from
+	if tp.healthiest() != connA {
+		t.Fatalf("Syncing from %s", tp.healthiest())
+	}
+	if next := tp.failover(connA); next != nil {
+		t.Errorf("Moving from the healthiest peer to %s", next)
+	}
+	connA.height = 99
+	if next := tp.failover(connA); next != connB {
+		t.Errorf("Moving from a peer behind to %v", next)
+	}
+	connA.height = 100
+	connA.ping = 10 * time.Second
+	if next := tp.failover(connA); next != connB {
+		t.Errorf("Moving from a slow peer to %v", next)
+	}
+	connB.ping = 10 * time.Second
+	if next := tp.failover(connA); next != connC {
+		t.Errorf("Moving from a slow peer to %v", next)
+	}
+	if next := tp.failover(connC); next != nil {
+		t.Errorf("Moving from a healthy peer to the slow %s", next)
+	}
+	connA.ping = time.Millisecond
+	if next := tp.failover(connC); next != connA {
+		t.Errorf("Not moving back to the peer of lowest priority but to %v", next)
+	}
+	if next := tp.failover(&fakeTrustedConn{name: "other"}); next != connA {
+		t.Errorf("Moving from an untrusted peer to %v", next)
+	}
+
+	// Current once two of them have our tip
+	tip := chainhash.Hash{1}
+	tp.seenTip(connA, tip)
+	if tp.quorumMet(tip) {
+		t.Error("Quorum met by a single peer")
+	}
+	tp.seenTip(connC, tip)
+	if !tp.quorumMet(tip) {
+		t.Error("Quorum not met by two peers")
+	}
+	st := tp.stats(tip)
+	if st.Agreeing != 2 || st.Quorum != 2 || len(st.Peers) != 3 {
+		t.Fatalf("Wrong stats %+v", st)
+	}
+	if p := st.Peers[1]; p.Addr != b.String() || p.Healthy || p.HasTip || !p.Connected {
+		t.Errorf("Wrong status %+v of a slow peer", p)
+	}
+	tp.failed(c, now)
+	if tp.quorumMet(tip) {
+		t.Error("Quorum met after a peer disconnected")
+	}
+
+	// A peer dropped after the handshake isn't backed off, one dropping before it is
+	tp.disconnected(a, now)
+	st = tp.stats(tip)
+	if p := st.Peers[0]; p.Connected || p.Failures != 0 {
+		t.Errorf("Wrong status %+v after dropping a peer", p)
+	}
+	if addr, err := tp.nextAddr(now); err != nil || addr.String() != a.String() {
+		t.Fatalf("Dropped peer not dialed again at once: %v", err)
+	}
+	tp.connected(a, connA)
+	tp.disconnected(a, now)
+	if st := tp.stats(tip); st.Peers[0].Failures != 1 {
+		t.Errorf("Wrong status %+v after a peer dropped before the handshake", st.Peers[0])
+	}
+	if _, err := tp.nextAddr(now); err != NoTrustedPeerError {
+		t.Error("Peer dropping before the handshake dialed again at once")
+	}
+}
+
+func TestWireService_TrustedPeers(t *testing.T) {
+	params := &chaincfg.RegressionNetParams
+	bc, err := chain.NewBlockchainWithHeaders(chain.NewMemHeaders(), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := mineHeaders(params.GenesisBlock.Header, 3, 0)
+	if _, _, err := bc.CommitHeaders(headers); err != nil {
+		t.Fatal(err)
+	}
+	tip := headers[2].BlockHash()
+
+	addrA := trustedAddr(t, "127.0.0.1:18444")
+	addrB := trustedAddr(t, "127.0.0.2:18444")
+	tp, err := NewTrustedPeers(TrustedPeersConfig{
+		Peers:  []TrustedPeer{{Addr: addrA}, {Addr: addrB, Priority: 1}},
+		Quorum: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := NewWireService(&WireServiceConfig{Params: params, Chain: bc, Trusted: tp})
+	peerA := newTestPeer(t, addrA.String())
+	peerB := newTestPeer(t, addrB.String())
+	peerA.UpdateLastBlockHeight(3)
+	peerB.UpdateLastBlockHeight(3)
+	tp.connected(addrB, peerB)
+	ws.handleNewPeerMsg(peerB)
+	if ws.syncPeer != peerB {
+		t.Fatalf("Syncing from %s with a single trusted peer", ws.syncPeer)
+	}
+	tp.connected(addrA, peerA)
+	ws.handleNewPeerMsg(peerA)
+	if ws.syncPeer != peerA {
+		t.Fatalf("Syncing from %s rather than the peer of lowest priority", ws.syncPeer)
+	}
+
+	// The peer which isn't synced from was asked whether it has our tip
+	ws.trustedTip(peerA, tip)
+	if ws.trusted.quorumMet(tip) {
+		t.Fatal("Quorum met by the sync peer alone")
+	}
+	ws.handleHeadersMsg(&headersMsg{headers: &wire.MsgHeaders{Headers: []*wire.BlockHeader{&headers[2]}}, peer: peerB})
+	if !ws.trusted.quorumMet(tip) {
+		t.Fatal("Quorum not met after the other peer sent our tip")
+	}
+	if st := ws.TrustedPeerStats(); st.Agreeing != 2 || !st.Peers[1].HasTip {
+		t.Errorf("Wrong stats %+v", st)
+	}
+	if ws.trusted.probeDue(peerB, tip, time.Now()) {
+		t.Error("Peer which has our tip asked again")
+	}
+
+	// A peer on another branch doesn't have our tip
+	fork := mineHeaders(headers[1], 2, 1)
+	next := time.Now().Add(time.Hour)
+	ws.trusted.seenTip(peerB, chainhash.Hash{})
+	ws.checkTrusted(next)
+	ws.handleHeadersMsg(&headersMsg{headers: &wire.MsgHeaders{Headers: []*wire.BlockHeader{&fork[0], &fork[1]}}, peer: peerB})
+	if ws.trusted.quorumMet(tip) {
+		t.Error("Quorum met with a peer on another branch")
+	}
+	if ws.handleTrustedHeaders(peerB, nil) {
+		t.Error("Headers taken as an answer after the peer answered")
+	}
+
+	// Moved to the other peer once the sync peer falls behind
+	peerB.UpdateLastBlockHeight(4)
+	ws.checkTrusted(next.Add(time.Hour))
+	if ws.syncPeer != peerB {
+		t.Errorf("Syncing from %s behind the other trusted peer", ws.syncPeer)
+	}
+}
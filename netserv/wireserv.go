@@ -1,6 +1,7 @@
 package netserv
 
 import (
+	"bytes"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	peerpkg "github.com/btcsuite/btcd/peer"
@@ -35,6 +36,57 @@ type merkleBlockMsg struct {
 	peer        *peerpkg.Peer
 }
 
+// txMsg packages a transaction which came after a merkle block and the peer it came
+// from together so the handler has access to that information.
+type txMsg struct {
+	tx   *wire.MsgTx
+	peer *peerpkg.Peer
+}
+
+// cfHeadersMsg packages a cfheaders message and the peer it came from together so the
+// handler has access to that information.
+type cfHeadersMsg struct {
+	cfHeaders *wire.MsgCFHeaders
+	peer      *peerpkg.Peer
+}
+
+// cfilterMsg packages a cfilter message and the peer it came from together so the handler
+// has access to that information.
+type cfilterMsg struct {
+	cfilter *wire.MsgCFilter
+	peer    *peerpkg.Peer
+}
+
+// blockMsg packages a block message and the peer it came from together so the handler has
+// access to that information.
+type blockMsg struct {
+	block *wire.MsgBlock
+	peer  *peerpkg.Peer
+}
+
+// getDataMsg packages a getdata message and the peer it came from together so the handler
+// has access to that information.
+type getDataMsg struct {
+	getData *wire.MsgGetData
+	peer    *peerpkg.Peer
+}
+
+// rejectMsg packages a reject message and the peer it came from together so the handler
+// has access to that information.
+type rejectMsg struct {
+	reject *wire.MsgReject
+	peer   *peerpkg.Peer
+}
+
+// broadcastMsg hands the handler a transaction to announce to every peer.
+type broadcastMsg struct {
+	tx    *wire.MsgTx
+	reply chan BroadcastStatus
+}
+
+// reloadFilterMsg makes the handler load the current filter into every peer.
+type reloadFilterMsg struct{}
+
 // invMsg packages a bitcoin inv message and the peer it came from together
 // so the handler has access to that information.
 type invMsg struct {
@@ -46,6 +98,15 @@ type WireServiceConfig struct {
 	Params *chaincfg.Params
 	Chain  *chain.Blockchain
 	MinPeersForSync int
+	StaleTip        StaleTipConfig
+	// Loaded into every peer so merkle blocks carry our transactions, none if nil. With
+	// compact filters it's what the filters are matched against.
+	Filter    *FilterManager
+	SyncMode  SyncMode
+	CFilter   CFilterConfig
+	Broadcast BroadcastConfig
+	// Our own nodes, the healthiest is synced from. None if nil.
+	Trusted *TrustedPeers
 }
 
 // peerSyncState stores additional information that the WireService tracks
@@ -56,6 +117,14 @@ type peerSyncState struct {
 	requestedBlocks map[chainhash.Hash]struct{}
 	falsePositives  uint32
 	blockScore      int32
+	// Transactions the last merkle block matched, the peer sends them right after it
+	pendingTxs map[chainhash.Hash]pendingTx
+}
+
+type pendingTx struct {
+	blockHash chainhash.Hash
+	height    uint32
+	proof     []byte
 }
 
 type WireService struct {
@@ -68,17 +137,39 @@ type WireService struct {
 	quit            chan struct{}
 	minPeersForSync int
 	zeroHash        chainhash.Hash
+	staleTip        *staleTipMonitor
+	filter          *FilterManager
+	cf              *cfSyncer
+	// Proofs asked for by block hash
+	proofs     map[chainhash.Hash][]*proofRequest
+	broadcasts *broadcaster
+	trusted    *TrustedPeers
 }
 
 func NewWireService(config *WireServiceConfig) *WireService {
-	return &WireService{
+	ws := &WireService{
 		params: config.Params,
 		chain:  config.Chain,
 		minPeersForSync: config.MinPeersForSync,
 		peerStates:      make(map[*peerpkg.Peer]*peerSyncState),
 		requestedBlocks: make(map[chainhash.Hash]struct{}),
 		msgChan: make(chan interface{}),
+		staleTip:        newStaleTipMonitor(config.StaleTip, config.Chain),
+		filter:          config.Filter,
+		proofs:          make(map[chainhash.Hash][]*proofRequest),
+		broadcasts:      newBroadcaster(config.Broadcast, config.Chain),
+		trusted:         config.Trusted,
+	}
+	// Peers never see our filter when we match compact filters ourselves
+	if config.SyncMode == SyncCompactFilters {
+		filter := config.Filter
+		if filter == nil {
+			filter = NewFilterManager(FilterConfig{})
+		}
+		ws.filter = nil
+		ws.cf = newCFSyncer(config.CFilter, config.Chain, filter)
 	}
+	return ws
 }
 
 func (ws *WireService) MsgChan() chan interface{} {
@@ -95,9 +186,41 @@ func (ws *WireService) Start() {
 		log.Error(err)
 	}
 	log.Infof("Starting wire service at height %d", int(best.Height))
+	var staleTipCheck <-chan time.Time
+	if ws.staleTip.cfg.CheckInterval > 0 {
+		ticker := time.NewTicker(ws.staleTip.cfg.CheckInterval)
+		defer ticker.Stop()
+		staleTipCheck = ticker.C
+	}
+	proofCheck := time.NewTicker(proofCheckInterval)
+	defer proofCheck.Stop()
+	broadcastCheck := time.NewTicker(broadcastCheckInterval)
+	defer broadcastCheck.Stop()
+	var trustedCheck <-chan time.Time
+	if ws.trusted != nil {
+		ticker := time.NewTicker(ws.trusted.cfg.CheckInterval)
+		defer ticker.Stop()
+		trustedCheck = ticker.C
+	}
+	var cfTick <-chan time.Time
+	if ws.cf != nil {
+		ticker := time.NewTicker(cfRequestTimeout / 3)
+		defer ticker.Stop()
+		cfTick = ticker.C
+	}
 out:
 	for {
 		select {
+		case <-staleTipCheck:
+			ws.checkStaleTip()
+		case now := <-cfTick:
+			ws.cf.tick(now)
+		case now := <-proofCheck.C:
+			ws.expireProofs(now)
+		case now := <-broadcastCheck.C:
+			ws.rebroadcast(now)
+		case now := <-trustedCheck:
+			ws.checkTrusted(now)
 		case m := <-ws.msgChan:
 			switch msg := m.(type) {
 			case newPeerMsg:
@@ -110,6 +233,33 @@ out:
 				ws.handleMerkleBlockMsg(&msg)
 			case invMsg:
 				ws.handleInvMsg(&msg)
+			case txMsg:
+				ws.handleTxMsg(&msg)
+			case cfHeadersMsg:
+				if ws.cf != nil {
+					ws.cf.handleCFHeaders(msg.peer, msg.cfHeaders, time.Now())
+				}
+			case cfilterMsg:
+				if ws.cf != nil {
+					ws.cf.handleCFilter(msg.peer, msg.cfilter, time.Now())
+				}
+			case blockMsg:
+				ws.handleProofBlock(msg.peer, msg.block)
+				if ws.cf != nil {
+					ws.cf.handleBlock(msg.peer, msg.block, time.Now())
+				}
+			case fetchProofMsg:
+				ws.handleFetchProof(msg.req)
+			case getDataMsg:
+				ws.handleGetDataMsg(&msg)
+			case rejectMsg:
+				ws.handleRejectMsg(&msg)
+			case broadcastMsg:
+				ws.handleBroadcastMsg(&msg)
+			case reloadFilterMsg:
+				if ws.filter != nil {
+					ws.reloadFilter(ws.filter.FilterLoad())
+				}
 			default:
 				log.Warnf("Unknown message type sent to WireService message chan: %T", msg)
 			}
@@ -132,16 +282,83 @@ func (ws *WireService) ResyncWithNil() {
 	ws.startSync(nil)
 }
 
+// StaleTipStats returns the counters of the stale tip monitor.
+func (ws *WireService) StaleTipStats() StaleTipStats {
+	return ws.staleTip.Stats()
+}
+
+// CFilterStats returns the progress of the compact filter sync, zero when syncing with
+// bloom filters.
+func (ws *WireService) CFilterStats() CFilterStats {
+	if ws.cf == nil {
+		return CFilterStats{}
+	}
+	return ws.cf.Stats()
+}
+
+// checkStaleTip carries out what the stale tip monitor decides.
+func (ws *WireService) checkStaleTip() {
+	peers := make([]tipPeer, 0, len(ws.peerStates))
+	for peer := range ws.peerStates {
+		peers = append(peers, peer)
+	}
+	var syncPeer tipPeer
+	if ws.syncPeer != nil {
+		syncPeer = ws.syncPeer
+	}
+	for _, step := range ws.staleTip.check(time.Now(), peers, syncPeer) {
+		peer := step.peer.(*peerpkg.Peer)
+		e := step.event
+		switch e.Action {
+		case EvictPeer:
+			log.Warnf("Evicting peer %s stuck at height %d below our tip at %d", peer, e.PeerHeight, e.Height)
+			peer.Disconnect()
+		case RotateSyncPeer:
+			log.Warnf("Tip at height %d hasn't moved for %s, syncing from %s at height %d",
+				e.Height, e.TipAge, peer, e.PeerHeight)
+			ws.startSync(peer)
+		case RollbackToFork:
+			log.Warnf("Peer %s at height %d follows a branch forking off at %d, rolling back to the fork",
+				peer, e.PeerHeight, e.ForkHeight)
+			_, err := ws.chain.RollbackToHash(e.ForkHash, chain.RollbackOptions{KeepForks: true})
+			if err != nil {
+				log.Errorf("Failed to roll back to fork %s: %v", e.ForkHash.String(), err)
+				continue
+			}
+			ws.startSync(peer)
+		}
+		if ws.staleTip.cfg.OnEvent != nil {
+			ws.staleTip.cfg.OnEvent(e)
+		}
+	}
+}
+
 func (ws *WireService) handleNewPeerMsg(peer *peerpkg.Peer) {
 	// Initialize the peer state
 	ws.peerStates[peer] = &peerSyncState{
 		syncCandidate:   ws.isSyncCandidate(peer),
 		requestedBlocks: make(map[chainhash.Hash]struct{}),
 	}
+	// The filter has to be loaded before we ask for merkle blocks
+	if ws.filter != nil {
+		peer.QueueMessage(ws.filter.FilterLoad(), nil)
+	}
+	if ws.cf != nil {
+		ws.cf.addPeer(peer, time.Now())
+	}
+	for _, tx := range ws.broadcasts.pending() {
+		ws.announce(peer, tx.TxHash())
+	}
+	// Find out whether a trusted peer has our tip without waiting for the next check
+	if ws.trusted != nil && ws.trusted.ready(peer) {
+		ws.checkTrusted(time.Now())
+	}
 
 	// If we don't have a sync peer and we are not current we should start a sync
 	if ws.syncPeer == nil && !ws.Current() {
 		ws.startSync(nil)
+	} else if ws.cf != nil && ws.Current() {
+		ws.cf.sync(time.Now())
 	}
 }
 
@@ -183,6 +400,14 @@ func (ws *WireService) startSync(syncPeer *peerpkg.Peer) {
 		log.Error(err)
 		return
 	}
+	// With trusted peers we sync from the healthiest
+	if syncPeer == nil && ws.trusted != nil {
+		if conn := ws.trusted.healthiest(); conn != nil {
+			if _, ok := ws.peerStates[conn.(*peerpkg.Peer)]; ok {
+				syncPeer = conn.(*peerpkg.Peer)
+			}
+		}
+	}
 	var bestPeer *peerpkg.Peer
 	if syncPeer == nil {
 		var bestPeerHeight int32
@@ -229,8 +454,10 @@ func (ws *WireService) startSync(syncPeer *peerpkg.Peer) {
 		// blocks we're interested in. However, if we're past the wallet creation date we need to
 		// start downloading merkle blocks so we learn of the wallet's transactions. We'll use a
 		// buffer of one week to make sure we don't miss anything.
+		// With compact filters we only ever download headers, blocks are fetched when their
+		// filter matches.
 		log.Infof("Starting chain download from %s", bestPeer)
-		if bestBlock.Header.Timestamp.Before(time.Now().UTC().Add(-time.Minute * 90)) {
+		if ws.cf != nil || bestBlock.Header.Timestamp.Before(time.Now().UTC().Add(-time.Minute * 90)) {
 			bestPeer.PushGetHeadersMsg(locator, &ws.zeroHash)
 		} else {
 			bestPeer.PushGetBlocksMsg(locator, &ws.zeroHash)
@@ -251,6 +478,11 @@ func (ws *WireService) Current() bool {
 		return false
 	}
 
+	// Enough of our trusted peers have to have our tip
+	if ws.trusted != nil && !ws.trusted.quorumMet(best.Header.BlockHash()) {
+		return false
+	}
+
 	// Check our other peers to see if any are reporting a greater height than we have
 	for peer := range ws.peerStates {
 		if int32(best.Height) < peer.LastBlock() {
@@ -276,6 +508,10 @@ func (ws *WireService) handleDonePeerMsg(peer *peerpkg.Peer) {
 	for blockHash := range state.requestedBlocks {
 		delete(ws.requestedBlocks, blockHash)
 	}
+	if ws.cf != nil {
+		ws.cf.removePeer(peer, time.Now())
+	}
+	ws.retryProofs(peer)
 
 	// Attempt to find a new peer to sync from if the quitting peer is the
 	// sync peer.
@@ -292,6 +528,9 @@ func (ws *WireService) handleDonePeerMsg(peer *peerpkg.Peer) {
 // requested when performing a headers-first sync.
 func (ws *WireService) handleHeadersMsg(hmsg *headersMsg) {
 	peer := hmsg.peer
+	if ws.handleTrustedHeaders(peer, hmsg.headers.Headers) {
+		return
+	}
 	if peer != ws.syncPeer {
 		log.Warn("Received header message from a peer that isn't our sync peer")
 		peer.Disconnect()
@@ -312,24 +551,49 @@ func (ws *WireService) handleHeadersMsg(hmsg *headersMsg) {
 		return
 	}
 
-	// Process each header we received. Make sure when check that each one is 90 min before
-	// now. Prevent bifurcation.
-	badHeaders := 0
+	// Commit the headers we received as one batch. Make sure when check that each one is 90 min
+	// before now. Prevent bifurcation.
 	timePoint := time.Now().UTC().Add(-time.Minute * 90)
+	var toCommit []wire.BlockHeader
+	switchToBlocks := false
 	for _, blockHeader := range msg.Headers {
-		if blockHeader.Timestamp.Before(timePoint) {
-			_, _, height, err := ws.chain.CommitHeader(*blockHeader)
-			if err != nil {
+		if ws.cf == nil && !blockHeader.Timestamp.Before(timePoint) {
+			switchToBlocks = true
+			break
+		}
+		toCommit = append(toCommit, *blockHeader)
+	}
+
+	badHeaders := 0
+	if len(toCommit) > 0 {
+		results, _, err := ws.chain.CommitHeaders(toCommit)
+		if err == chain.NonContiguousBatchError {
+			log.Warnf("Disconnecting from peer %s because he sent us headers that don't link", peer)
+			peer.Disconnect()
+			return
+		} else if err != nil {
+			badHeaders++
+			log.Errorf("Commit headers error: %s", err.Error())
+		}
+		for _, r := range results {
+			if r.Err != nil {
 				badHeaders++
-				log.Errorf("Commit header error: %s", err.Error())
+				log.Errorf("Commit header %s error: %s", r.Hash.String(), r.Err.Error())
+				continue
 			}
-			log.Infof("Received header %s at height %d", blockHeader.BlockHash().String(), height)
-		} else {
-			log.Infof("Switching to downloading merkle blocks at block %s", blockHeader.BlockHash().String())
-			locator := ws.chain.GetBlockLocator()
-			peer.PushGetBlocksMsg(locator, &ws.zeroHash)
-			return
+			log.Debugf("Received header %s at height %d", r.Hash.String(), r.Height)
 		}
+		if len(results) > 0 {
+			last := results[len(results)-1]
+			ws.trustedTip(peer, last.Hash)
+			log.Infof("Received %d headers up to %s at height %d", len(results), last.Hash.String(), last.Height)
+		}
+	}
+	if switchToBlocks {
+		log.Infof("Switching to downloading merkle blocks at block %s", msg.Headers[len(toCommit)].BlockHash().String())
+		locator := ws.chain.GetBlockLocator()
+		peer.PushGetBlocksMsg(locator, &ws.zeroHash)
+		return
 	}
 	// Usually the peer will send the header at the tip of the chain in each batch. This will trigger
 	// one commit error so we'll consider that acceptable, but anything more than that suggests misbehavior
@@ -340,6 +604,11 @@ func (ws *WireService) handleHeadersMsg(hmsg *headersMsg) {
 		return
 	}
 
+	// A short batch means the peer has nothing more, get the filters of the new blocks
+	if ws.cf != nil && numHeaders < wire.MaxBlockHeadersPerMsg {
+		ws.cf.sync(time.Now())
+	}
+
 	// Request the next batch of headers
 	locator := ws.chain.GetBlockLocator()
 	err := peer.PushGetHeadersMsg(locator, &ws.zeroHash)
@@ -353,6 +622,9 @@ func (ws *WireService) handleHeadersMsg(hmsg *headersMsg) {
 // requested in response to inv packets both during initial sync and after.
 func (ws *WireService) handleMerkleBlockMsg(bmsg *merkleBlockMsg) {
 	peer := bmsg.peer
+	if ws.handleProofMerkleBlock(peer, bmsg.merkleBlock) {
+		return
+	}
 
 	// We don't need to process blocks when we're syncing. They wont connect anyway
 	if peer != ws.syncPeer && !ws.Current() {
@@ -416,11 +688,22 @@ func (ws *WireService) handleMerkleBlockMsg(bmsg *merkleBlockMsg) {
 		}
 		log.Warnf("Received unrequested block from peer %s", peer)
 		return
+	} else if rerr, ok := err.(chain.HeaderRuleError); ok {
+		state.blockScore--
+		if state.blockScore < 0 {
+			log.Warnf("Disconnecting from peer %s because he sent us too many invalid blocks", peer)
+			peer.Disconnect()
+			return
+		}
+		log.Warnf("Received invalid block %s from peer %s: %v", blockHash.String(), peer, rerr)
+		return
 	} else if err != nil {
 		log.Error(err)
 		return
 	}
 	state.blockScore++
+	ws.expectTxs(state, merkleBlock, newHeight)
+	ws.trustedTip(peer, blockHash)
 
 	if ws.Current() {
 		peer.UpdateLastBlockHeight(int32(newHeight))
@@ -454,6 +737,89 @@ func (ws *WireService) handleMerkleBlockMsg(bmsg *merkleBlockMsg) {
 	}
 }
 
+// expectTxs remembers the transactions a merkle block matched, the peer sends them next.
+func (ws *WireService) expectTxs(state *peerSyncState, merkleBlock *wire.MsgMerkleBlock, height uint32) {
+	state.pendingTxs = make(map[chainhash.Hash]pendingTx)
+	if ws.filter == nil || len(merkleBlock.Hashes) == 0 {
+		return
+	}
+	matches, err := chain.MerkleBlockMatches(merkleBlock)
+	if err != nil {
+		log.Warnf("Bad merkle block %s: %v", merkleBlock.Header.BlockHash().String(), err)
+		return
+	}
+	if len(matches) == 0 {
+		return
+	}
+	var buf bytes.Buffer
+	if err := merkleBlock.BtcEncode(&buf, wire.ProtocolVersion, wire.LatestEncoding); err != nil {
+		log.Error(err)
+		return
+	}
+	for _, hash := range matches {
+		state.pendingTxs[hash] = pendingTx{
+			blockHash: merkleBlock.Header.BlockHash(),
+			height:    height,
+			proof:     buf.Bytes(),
+		}
+	}
+}
+
+// handleTxMsg handles the transactions peers send after a merkle block which matched them.
+// Those not paying to or spending from what we watch are false positives, once a peer
+// sends too many of them the filter is loaded again with a new tweak.
+func (ws *WireService) handleTxMsg(tmsg *txMsg) {
+	peer := tmsg.peer
+	if ws.handleProofTx(peer, tmsg.tx) {
+		return
+	}
+	state, exists := ws.peerStates[peer]
+	if !exists || ws.filter == nil {
+		return
+	}
+	txHash := tmsg.tx.TxHash()
+	pending, ok := state.pendingTxs[txHash]
+	if !ok {
+		log.Debugf("Received transaction %s from %s without a merkle block", txHash.String(), peer)
+		return
+	}
+	delete(state.pendingTxs, txHash)
+
+	if !ws.filter.match(tmsg.tx) {
+		state.falsePositives++
+		if state.falsePositives >= ws.filter.cfg.MaxFalsePositives {
+			log.Infof("Peer %s sent %d false positives, loading a new filter", peer, state.falsePositives)
+			ws.reloadFilter(ws.filter.Refresh())
+		}
+		return
+	}
+	m := MatchedTx{
+		Tx:        tmsg.tx,
+		BlockHash: pending.blockHash,
+		Height:    pending.height,
+		Proof:     pending.proof,
+	}
+	ws.filter.addMatched(m)
+	log.Infof("Matched transaction %s in block %s at height %d", txHash.String(), pending.blockHash.String(), pending.height)
+	if ws.filter.cfg.OnMatch != nil {
+		ws.filter.cfg.OnMatch(m)
+	}
+}
+
+// reloadFilter loads filter into every peer.
+func (ws *WireService) reloadFilter(filter *wire.MsgFilterLoad) {
+	for peer, state := range ws.peerStates {
+		peer.QueueMessage(filter, nil)
+		state.falsePositives = 0
+	}
+}
+
+// ReloadFilter loads the current filter into every peer, e.g. after an address was added
+// to it. The wire service has to be running.
+func (ws *WireService) ReloadFilter() {
+	ws.msgChan <- reloadFilterMsg{}
+}
+
 // handleInvMsg handles inv messages from all peers.
 // We examine the inventory advertised by the remote peer and act accordingly.
 func (ws *WireService) handleInvMsg(imsg *invMsg) {
@@ -483,6 +849,9 @@ func (ws *WireService) handleInvMsg(imsg *invMsg) {
 	if lastBlock != -1 && (peer != ws.syncPeer || ws.Current()) {
 		peer.UpdateLastAnnouncedBlock(&invVects[lastBlock].Hash)
 	}
+	if lastBlock != -1 {
+		ws.trustedTip(peer, invVects[lastBlock].Hash)
+	}
 
 	// Ignore invs from peers that aren't the sync if we are not current.
 	// Helps prevent fetching a mass of orphans.
@@ -499,6 +868,23 @@ func (ws *WireService) handleInvMsg(imsg *invMsg) {
 		}
 	}
 
+	// With compact filters new blocks only get us the headers from the sync peer, the filter
+	// sync takes it from there
+	if ws.cf != nil {
+		if lastBlock == -1 {
+			return
+		}
+		if haveInv, _ := ws.haveInventory(invVects[lastBlock]); haveInv {
+			return
+		}
+		if ws.syncPeer == nil {
+			ws.startSync(peer)
+		} else {
+			ws.syncPeer.PushGetHeadersMsg(ws.chain.GetBlockLocator(), &ws.zeroHash)
+		}
+		return
+	}
+
 	// Request the advertised inventory if we don't already have it
 	gdmsg := wire.NewMsgGetData()
 	for _, iv := range invVects {
@@ -5,6 +5,12 @@ const (
 	GETCURRENTHEIGHT    = "/api/v1/getcurrentheight"
 	ROLLBACK            = "/api/v1/rollback"
 	BROADCASTTX         = "/api/v1/broadcasttx"
+	GETCHAINTIPS        = "/api/v1/getchaintips"
+	GETCHAINWORK        = "/api/v1/getchainwork"
+	GETDIFFICULTY       = "/api/v1/getdifficultyhistory"
+	GETBLOCKSTATS       = "/api/v1/getblockstats"
+	GETTXSTATUS         = "/api/v1/gettxstatus"
+	BACKUP              = "/api/v1/backup"
 )
 
 const (
@@ -12,6 +18,17 @@ const (
 	ACTION_GETCURRENTHEIGHT    = "getcurrentheight"
 	ACTION_ROLLBACK            = "rollback"
 	ACTION_BROADCASTTX         = "broadcasttx"
+	ACTION_GETCHAINTIPS        = "getchaintips"
+	ACTION_GETCHAINWORK        = "getchainwork"
+	ACTION_GETDIFFICULTY       = "getdifficultyhistory"
+	ACTION_GETBLOCKSTATS       = "getblockstats"
+	ACTION_GETTXSTATUS         = "gettxstatus"
+)
+
+// Databases the backup endpoint takes a snapshot of, picked by the db query parameter
+const (
+	BACKUP_HEADERS = "headers"
+	BACKUP_WAITING = "waiting"
 )
 
 type Response struct {
@@ -33,10 +50,126 @@ type GetCurrentHeightResp struct {
 	Height uint32 `json:"height"`
 }
 
+// RollbackReq takes one target, hash first, then height, then time
 type RollbackReq struct {
-	Time string `json:"time"`
+	Time      string  `json:"time"`
+	Height    *uint32 `json:"height"`
+	Hash      string  `json:"hash"`
+	DryRun    bool    `json:"dry_run"`
+	KeepForks bool    `json:"keep_forks"`
+}
+
+type WaitingTx struct {
+	Txid   string `json:"txid"`
+	Height uint32 `json:"height"`
+}
+
+type RollbackResp struct {
+	OldHeight          uint32      `json:"old_height"`
+	OldHash            string      `json:"old_hash"`
+	NewHeight          uint32      `json:"new_height"`
+	NewHash            string      `json:"new_hash"`
+	RemovedHeaders     uint32      `json:"removed_headers"`
+	RemovedForkHeaders uint32      `json:"removed_fork_headers"`
+	RemovedForks       uint32      `json:"removed_forks"`
+	DryRun             bool        `json:"dry_run"`
+	Waiting            []WaitingTx `json:"waiting"`
 }
 
 type BroadcastReq struct {
 	Tx string `json:"tx"`
 }
+
+// TxStatus describes a transaction broadcast, status is pending, rejected or confirmed.
+// Times are unix seconds, zero if never.
+type TxStatus struct {
+	Txid          string `json:"txid"`
+	Status        string `json:"status"`
+	FirstSent     int64  `json:"first_sent"`
+	LastSent      int64  `json:"last_sent"`
+	Announcements int    `json:"announcements"`
+	Served        int    `json:"served"`
+	RejectPeer    string `json:"reject_peer"`
+	RejectCode    string `json:"reject_code"`
+	RejectReason  string `json:"reject_reason"`
+	BlockHash     string `json:"block_hash"`
+	Height        uint32 `json:"height"`
+	Confirmations uint32 `json:"confirmations"`
+}
+
+// Every transaction broadcast when txid is left out
+type GetTxStatusReq struct {
+	Txid string `json:"txid"`
+}
+
+type GetTxStatusResp struct {
+	Txs []TxStatus `json:"txs"`
+}
+
+type ChainTip struct {
+	Height     uint32 `json:"height"`
+	Hash       string `json:"hash"`
+	BranchLen  uint32 `json:"branchlen"`
+	ForkHeight uint32 `json:"fork_height"`
+	ForkHash   string `json:"fork_hash"`
+	TotalWork  string `json:"total_work"`
+	FirstSeen  int64  `json:"first_seen"`
+	Status     string `json:"status"`
+}
+
+type GetChainTipsResp struct {
+	Tips []ChainTip `json:"tips"`
+}
+
+// The best header when height is left out
+type GetChainWorkReq struct {
+	Height *uint32 `json:"height"`
+}
+
+type GetChainWorkResp struct {
+	Height     uint32  `json:"height"`
+	Hash       string  `json:"hash"`
+	Bits       uint32  `json:"bits"`
+	Difficulty float64 `json:"difficulty"`
+	ChainWork  string  `json:"chain_work"`
+}
+
+// Heights default to the last ten retarget epochs up to the best header
+type GetDifficultyHistoryReq struct {
+	From *uint32 `json:"from"`
+	To   *uint32 `json:"to"`
+}
+
+type DifficultyEpoch struct {
+	Height               uint32  `json:"height"`
+	FirstHeight          uint32  `json:"first_height"`
+	FirstHash            string  `json:"first_hash"`
+	FirstTime            int64   `json:"first_time"`
+	Bits                 uint32  `json:"bits"`
+	Difficulty           float64 `json:"difficulty"`
+	Headers              uint32  `json:"headers"`
+	MinDifficultyHeaders uint32  `json:"min_difficulty_headers"`
+}
+
+type GetDifficultyHistoryResp struct {
+	Epochs []DifficultyEpoch `json:"epochs"`
+}
+
+// The window ends at the best header when height is left out and is a day of blocks by default
+type GetBlockStatsReq struct {
+	Height *uint32 `json:"height"`
+	Window uint32  `json:"window"`
+}
+
+// Intervals are in seconds and the hashrate in hashes per second
+type GetBlockStatsResp struct {
+	From     uint32  `json:"from"`
+	To       uint32  `json:"to"`
+	Mean     float64 `json:"mean"`
+	Median   float64 `json:"median"`
+	P90      float64 `json:"p90"`
+	P99      float64 `json:"p99"`
+	Min      float64 `json:"min"`
+	Max      float64 `json:"max"`
+	Hashrate float64 `json:"hashrate"`
+}
@@ -1,8 +1,17 @@
 package restful
 
+import "net/http"
+
 type Web interface {
 	QueryHeaderByHeight(map[string]interface{}) map[string]interface{}
 	GetCurrentHeight(map[string]interface{}) map[string]interface{}
 	Rollback(params map[string]interface{}) map[string]interface{}
 	BroadcastTx(params map[string]interface{}) map[string]interface{}
+	GetChainTips(params map[string]interface{}) map[string]interface{}
+	GetChainWork(params map[string]interface{}) map[string]interface{}
+	GetDifficultyHistory(params map[string]interface{}) map[string]interface{}
+	GetBlockStats(params map[string]interface{}) map[string]interface{}
+	GetTxStatus(params map[string]interface{}) map[string]interface{}
+	// Backup streams a db snapshot rather than answering with json
+	Backup(w http.ResponseWriter, r *http.Request)
 }
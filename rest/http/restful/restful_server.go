@@ -35,6 +35,8 @@ type restServer struct {
 	server   *http.Server
 	postMap  map[string]Action //post method map
 	getMap   map[string]Action //get method map
+	// get methods which write the response themselves
+	streamMap map[string]http.HandlerFunc
 }
 
 //init restful server
@@ -49,6 +51,7 @@ func InitRestServer(web Web, port uint64) ApiServer {
 	rt.registryRestServerAction(web)
 	rt.initGetHandler()
 	rt.initPostHandler()
+	rt.initStreamHandler()
 	return rt
 }
 
@@ -58,14 +61,24 @@ func (this *restServer) registryRestServerAction(web Web) {
 		common.QUERYHEADERBYHEIGHT: {name: common.ACTION_QUERYHEADERBYHEIGHT, handler: web.QueryHeaderByHeight},
 		common.ROLLBACK:            {name: common.ACTION_ROLLBACK, handler: web.Rollback},
 		common.BROADCASTTX:         {name: common.ACTION_BROADCASTTX, handler: web.BroadcastTx},
+		common.GETCHAINWORK:        {name: common.ACTION_GETCHAINWORK, handler: web.GetChainWork},
+		common.GETDIFFICULTY:       {name: common.ACTION_GETDIFFICULTY, handler: web.GetDifficultyHistory},
+		common.GETBLOCKSTATS:       {name: common.ACTION_GETBLOCKSTATS, handler: web.GetBlockStats},
+		common.GETTXSTATUS:         {name: common.ACTION_GETTXSTATUS, handler: web.GetTxStatus},
 	}
 
 	getMethodMap := map[string]Action{
 		common.GETCURRENTHEIGHT: {name: common.ACTION_GETCURRENTHEIGHT, handler: web.GetCurrentHeight},
+		common.GETCHAINTIPS:     {name: common.ACTION_GETCHAINTIPS, handler: web.GetChainTips},
+	}
+
+	streamMethodMap := map[string]http.HandlerFunc{
+		common.BACKUP: web.Backup,
 	}
 
 	this.postMap = postMethodMap
 	this.getMap = getMethodMap
+	this.streamMap = streamMethodMap
 }
 
 //start server
@@ -162,6 +175,13 @@ func (this *restServer) initPostHandler() {
 	}
 }
 
+//init stream Handler
+func (this *restServer) initStreamHandler() {
+	for k, h := range this.streamMap {
+		this.router.Get(k, h)
+	}
+}
+
 func (this *restServer) write(w http.ResponseWriter, data []byte) {
 	w.Header().Add("Access-Control-Allow-Headers", "Content-Type")
 	w.Header().Set("content-type", "application/json;charset=utf-8")
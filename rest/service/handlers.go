@@ -2,24 +2,44 @@ package service
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"encoding/hex"
 	"fmt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/ontio/spvclient"
+	"github.com/ontio/spvclient/backup"
+	"github.com/ontio/spvclient/chain"
 	"github.com/ontio/spvclient/log"
+	"github.com/ontio/spvclient/netserv"
 	"github.com/ontio/spvclient/rest/http/common"
 	"github.com/ontio/spvclient/rest/http/restful"
 	"github.com/ontio/spvclient/rest/utils"
+	"io"
+	"net/http"
+	"strconv"
 	"time"
 )
 
+// WaitingDB is the part of the voter's waiting db the service reports on
+type WaitingDB interface {
+	GetAboveHeight(height uint32) ([][]byte, []uint32, error)
+	Backup(w io.Writer) (int64, error)
+}
+
 type Service struct {
-	wallet *spvclient.SPVWallet
+	wallet      *spvclient.SPVWallet
+	waiting     WaitingDB
+	backupToken string
 }
 
-func NewService(wallet *spvclient.SPVWallet) *Service {
+// NewService creates the rest service, waiting may be nil when we are not voting.
+// Backups are refused unless backupToken is set.
+func NewService(wallet *spvclient.SPVWallet, waiting WaitingDB, backupToken string) *Service {
 	return &Service{
-		wallet: wallet,
+		wallet:      wallet,
+		waiting:     waiting,
+		backupToken: backupToken,
 	}
 }
 
@@ -92,31 +112,75 @@ func (serv *Service) Rollback(params map[string]interface{}) map[string]interfac
 	req := &common.RollbackReq{}
 	resp := &common.Response{}
 
-	prevh, _ := serv.wallet.ChainTip()
 	err := utils.ParseParams(req, params)
 	if err != nil {
 		resp.Error = restful.INVALID_PARAMS
 		resp.Desc = err.Error()
 		log.Errorf("Rollback: decode params failed, err: %s", err)
 	} else {
-		t, err := time.Parse("2006-01-02 15:04:05", req.Time)
+		opts := chain.RollbackOptions{
+			DryRun:    req.DryRun,
+			KeepForks: req.KeepForks,
+		}
+		var report *chain.RollbackReport
+		switch {
+		case req.Hash != "":
+			var hash *chainhash.Hash
+			hash, err = chainhash.NewHashFromStr(req.Hash)
+			if err == nil {
+				report, err = serv.wallet.RollbackToHash(*hash, opts)
+			}
+		case req.Height != nil:
+			report, err = serv.wallet.RollbackToHeight(*req.Height, opts)
+		default:
+			var t time.Time
+			t, err = time.Parse("2006-01-02 15:04:05", req.Time)
+			if err != nil {
+				err = fmt.Errorf("failed to parse time %s: %v", req.Time, err)
+			} else {
+				report, err = serv.wallet.RollbackToTime(t, opts)
+			}
+		}
 		if err != nil {
 			resp.Error = restful.INTERNAL_ERROR
-			resp.Desc = fmt.Sprintf("failed to parse time %s: %v", req.Time, err)
-			log.Errorf("Rollback: failed to parse time %s: %v", req.Time, err)
+			resp.Desc = err.Error()
+			log.Errorf("Rollback: %v", err)
 		} else {
-			serv.wallet.ReSyncBlockchain(t)
+			res := &common.RollbackResp{
+				OldHeight:          report.OldTip.Height,
+				OldHash:            report.OldTip.Header.BlockHash().String(),
+				NewHeight:          report.NewTip.Height,
+				NewHash:            report.NewTip.Header.BlockHash().String(),
+				RemovedHeaders:     report.RemovedHeaders,
+				RemovedForkHeaders: report.RemovedForkHeaders,
+				RemovedForks:       report.RemovedForks,
+				DryRun:             report.DryRun,
+				Waiting:            make([]common.WaitingTx, 0),
+			}
+			if serv.waiting != nil {
+				keys, heights, err := serv.waiting.GetAboveHeight(report.NewTip.Height)
+				if err != nil {
+					log.Errorf("Rollback: failed to get waiting txs above height %d: %v", report.NewTip.Height, err)
+				}
+				for i, k := range keys {
+					txid, _ := chainhash.NewHash(k)
+					res.Waiting = append(res.Waiting, common.WaitingTx{
+						Txid:   txid.String(),
+						Height: heights[i],
+					})
+				}
+			}
 			resp.Error = restful.SUCCESS
-			resp.Result = nil
+			resp.Result = res
 		}
 	}
 
 	m, err := utils.RefactorResp(resp, resp.Error)
 	if err != nil {
 		log.Errorf("Rollback: failed, err: %s", err)
-	} else {
-		h, _ := serv.wallet.ChainTip()
-		log.Infof("Rollback: resp success, roll back to height %d from height %d", h, prevh)
+	} else if r, ok := resp.Result.(*common.RollbackResp); ok {
+		log.Infof("Rollback: resp success, roll back to height %d from height %d, dry run: %v", r.NewHeight,
+			r.OldHeight, r.DryRun)
 	}
 	return m
 }
@@ -149,6 +213,8 @@ func (serv *Service) BroadcastTx(params map[string]interface{}) map[string]inter
 					resp.Error = restful.INTERNAL_ERROR
 					resp.Desc = err.Error()
 					log.Errorf("BroadcastTx: broadcast msgtx failed: %v", err)
+				} else if st, ok := serv.wallet.BroadcastStatus(mtx.TxHash()); ok {
+					resp.Result = txStatus(st)
 				}
 			}
 		}
@@ -162,3 +228,322 @@ func (serv *Service) BroadcastTx(params map[string]interface{}) map[string]inter
 	}
 	return m
 }
+
+func (serv *Service) GetTxStatus(params map[string]interface{}) map[string]interface{} {
+	req := &common.GetTxStatusReq{}
+	resp := &common.Response{}
+
+	err := utils.ParseParams(req, params)
+	if err != nil {
+		resp.Error = restful.INVALID_PARAMS
+		resp.Desc = err.Error()
+		log.Errorf("GetTxStatus: decode params failed, err: %s", err)
+	} else {
+		res := &common.GetTxStatusResp{
+			Txs: make([]common.TxStatus, 0),
+		}
+		if req.Txid == "" {
+			for _, st := range serv.wallet.BroadcastStatuses() {
+				res.Txs = append(res.Txs, *txStatus(st))
+			}
+		} else {
+			var hash *chainhash.Hash
+			hash, err = chainhash.NewHashFromStr(req.Txid)
+			if err == nil {
+				st, ok := serv.wallet.BroadcastStatus(*hash)
+				if !ok {
+					err = fmt.Errorf("transaction %s was not broadcast", req.Txid)
+				} else {
+					res.Txs = append(res.Txs, *txStatus(st))
+				}
+			}
+		}
+		if err != nil {
+			resp.Error = restful.INTERNAL_ERROR
+			resp.Desc = err.Error()
+			log.Errorf("GetTxStatus: %v", err)
+		} else {
+			resp.Error = restful.SUCCESS
+			resp.Result = res
+		}
+	}
+
+	m, err := utils.RefactorResp(resp, resp.Error)
+	if err != nil {
+		log.Errorf("GetTxStatus: failed, err: %s", err)
+	} else {
+		log.Info("GetTxStatus: resp success")
+	}
+	return m
+}
+
+func txStatus(st netserv.BroadcastStatus) *common.TxStatus {
+	res := &common.TxStatus{
+		Txid:          st.Txid.String(),
+		Status:        st.Status.String(),
+		Announcements: st.Announcements,
+		Served:        st.Served,
+	}
+	if !st.FirstSent.IsZero() {
+		res.FirstSent = st.FirstSent.Unix()
+		res.LastSent = st.LastSent.Unix()
+	}
+	switch st.Status {
+	case netserv.TxRejected:
+		res.RejectPeer = st.RejectPeer
+		res.RejectCode = st.RejectCode.String()
+		res.RejectReason = st.RejectReason
+	case netserv.TxConfirmed:
+		res.BlockHash = st.BlockHash.String()
+		res.Height = st.Height
+		res.Confirmations = st.Confirmations
+	}
+	return res
+}
+
+func (serv *Service) GetChainTips(params map[string]interface{}) map[string]interface{} {
+	resp := &common.Response{}
+	tips, err := serv.wallet.Blockchain.GetChainTips()
+	if err != nil {
+		resp.Error = restful.INTERNAL_ERROR
+		resp.Desc = err.Error()
+		log.Errorf("GetChainTips, failed to get chain tips: %v", err)
+	} else {
+		res := &common.GetChainTipsResp{
+			Tips: make([]common.ChainTip, 0, len(tips)),
+		}
+		for _, tip := range tips {
+			var firstSeen int64
+			if !tip.FirstSeen.IsZero() {
+				firstSeen = tip.FirstSeen.Unix()
+			}
+			res.Tips = append(res.Tips, common.ChainTip{
+				Height:     tip.Height,
+				Hash:       tip.Hash.String(),
+				BranchLen:  tip.BranchLen,
+				ForkHeight: tip.ForkHeight,
+				ForkHash:   tip.ForkHash.String(),
+				TotalWork:  tip.TotalWork.String(),
+				FirstSeen:  firstSeen,
+				Status:     tip.Status,
+			})
+		}
+		resp.Error = restful.SUCCESS
+		resp.Result = res
+	}
+
+	m, err := utils.RefactorResp(resp, resp.Error)
+	if err != nil {
+		log.Errorf("GetChainTips: failed, err: %s", err)
+	} else {
+		log.Info("GetChainTips: resp success")
+	}
+	return m
+}
+
+// Defaults for the stats requests
+const (
+	defaultDifficultyEpochs = 10
+	defaultStatsWindow      = 144
+)
+
+func (serv *Service) GetChainWork(params map[string]interface{}) map[string]interface{} {
+	req := &common.GetChainWorkReq{}
+	resp := &common.Response{}
+
+	err := utils.ParseParams(req, params)
+	if err != nil {
+		resp.Error = restful.INVALID_PARAMS
+		resp.Desc = err.Error()
+		log.Errorf("GetChainWork: decode params failed, err: %s", err)
+	} else {
+		var work *chain.HeaderWork
+		height, err := serv.heightOrBest(req.Height)
+		if err == nil {
+			work, err = serv.wallet.Blockchain.GetChainWork(height)
+		}
+		if err != nil {
+			resp.Error = restful.INTERNAL_ERROR
+			resp.Desc = err.Error()
+			log.Errorf("GetChainWork: %v", err)
+		} else {
+			resp.Error = restful.SUCCESS
+			resp.Result = &common.GetChainWorkResp{
+				Height:     work.Height,
+				Hash:       work.Hash.String(),
+				Bits:       work.Bits,
+				Difficulty: work.Difficulty,
+				ChainWork:  work.ChainWork.String(),
+			}
+		}
+	}
+
+	m, err := utils.RefactorResp(resp, resp.Error)
+	if err != nil {
+		log.Errorf("GetChainWork: failed, err: %s", err)
+	} else {
+		log.Info("GetChainWork: resp success")
+	}
+	return m
+}
+
+func (serv *Service) GetDifficultyHistory(params map[string]interface{}) map[string]interface{} {
+	req := &common.GetDifficultyHistoryReq{}
+	resp := &common.Response{}
+
+	err := utils.ParseParams(req, params)
+	if err != nil {
+		resp.Error = restful.INVALID_PARAMS
+		resp.Desc = err.Error()
+		log.Errorf("GetDifficultyHistory: decode params failed, err: %s", err)
+	} else {
+		var epochs []chain.DifficultyEpoch
+		to, err := serv.heightOrBest(req.To)
+		if err == nil {
+			var from uint32
+			epochLength := uint32(serv.wallet.Blockchain.Rules().RetargetInterval())
+			if req.From != nil {
+				from = *req.From
+			} else if to >= defaultDifficultyEpochs*epochLength {
+				from = to - to%epochLength - (defaultDifficultyEpochs-1)*epochLength
+			}
+			epochs, err = serv.wallet.Blockchain.GetDifficultyHistory(from, to)
+		}
+		if err != nil {
+			resp.Error = restful.INTERNAL_ERROR
+			resp.Desc = err.Error()
+			log.Errorf("GetDifficultyHistory: %v", err)
+		} else {
+			res := &common.GetDifficultyHistoryResp{
+				Epochs: make([]common.DifficultyEpoch, 0, len(epochs)),
+			}
+			for _, e := range epochs {
+				res.Epochs = append(res.Epochs, common.DifficultyEpoch{
+					Height:               e.Height,
+					FirstHeight:          e.FirstHeight,
+					FirstHash:            e.FirstHash.String(),
+					FirstTime:            e.FirstTime.Unix(),
+					Bits:                 e.Bits,
+					Difficulty:           e.Difficulty,
+					Headers:              e.Headers,
+					MinDifficultyHeaders: e.MinDifficultyHeaders,
+				})
+			}
+			resp.Error = restful.SUCCESS
+			resp.Result = res
+		}
+	}
+
+	m, err := utils.RefactorResp(resp, resp.Error)
+	if err != nil {
+		log.Errorf("GetDifficultyHistory: failed, err: %s", err)
+	} else {
+		log.Info("GetDifficultyHistory: resp success")
+	}
+	return m
+}
+
+func (serv *Service) GetBlockStats(params map[string]interface{}) map[string]interface{} {
+	req := &common.GetBlockStatsReq{}
+	resp := &common.Response{}
+
+	err := utils.ParseParams(req, params)
+	if err != nil {
+		resp.Error = restful.INVALID_PARAMS
+		resp.Desc = err.Error()
+		log.Errorf("GetBlockStats: decode params failed, err: %s", err)
+	} else {
+		var stats *chain.BlockStats
+		to, err := serv.heightOrBest(req.Height)
+		if err == nil {
+			window := req.Window
+			if window == 0 {
+				window = defaultStatsWindow
+			}
+			stats, err = serv.wallet.Blockchain.GetBlockStats(to, window)
+		}
+		if err != nil {
+			resp.Error = restful.INTERNAL_ERROR
+			resp.Desc = err.Error()
+			log.Errorf("GetBlockStats: %v", err)
+		} else {
+			resp.Error = restful.SUCCESS
+			resp.Result = &common.GetBlockStatsResp{
+				From:     stats.From,
+				To:       stats.To,
+				Mean:     stats.Mean.Seconds(),
+				Median:   stats.Median.Seconds(),
+				P90:      stats.P90.Seconds(),
+				P99:      stats.P99.Seconds(),
+				Min:      stats.Min.Seconds(),
+				Max:      stats.Max.Seconds(),
+				Hashrate: stats.Hashrate,
+			}
+		}
+	}
+
+	m, err := utils.RefactorResp(resp, resp.Error)
+	if err != nil {
+		log.Errorf("GetBlockStats: failed, err: %s", err)
+	} else {
+		log.Info("GetBlockStats: resp success")
+	}
+	return m
+}
+
+// heightOrBest returns height if it was given and the best height otherwise
+func (serv *Service) heightOrBest(height *uint32) (uint32, error) {
+	if height != nil {
+		return *height, nil
+	}
+	best, err := serv.wallet.Blockchain.BestBlock()
+	if err != nil {
+		return 0, err
+	}
+	return best.Height, nil
+}
+
+// Backup streams a snapshot of the header or waiting db. The request has to carry the
+// backup token as a bearer token. Whether the snapshot is complete is only known once
+// it has been sent, so the size and any error follow in trailers.
+func (serv *Service) Backup(w http.ResponseWriter, r *http.Request) {
+	if serv.backupToken == "" {
+		http.Error(w, "backup is disabled", http.StatusForbidden)
+		return
+	}
+	auth := []byte(r.Header.Get("Authorization"))
+	if subtle.ConstantTimeCompare(auth, []byte("Bearer "+serv.backupToken)) != 1 {
+		log.Warnf("Backup: unauthorized request from %s", r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var snapshot func(w io.Writer) (int64, error)
+	db := r.URL.Query().Get("db")
+	switch db {
+	case "", common.BACKUP_HEADERS:
+		db = common.BACKUP_HEADERS
+		snapshot = serv.wallet.Blockchain.Backup
+	case common.BACKUP_WAITING:
+		if serv.waiting == nil {
+			http.Error(w, "waiting db is not open", http.StatusNotFound)
+			return
+		}
+		snapshot = serv.waiting.Backup
+	default:
+		http.Error(w, fmt.Sprintf("unknown db %s", db), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.bin", db))
+	w.Header().Set("Trailer", backup.TrailerSize+", "+backup.TrailerError)
+	n, err := snapshot(w)
+	w.Header().Set(backup.TrailerSize, strconv.FormatInt(n, 10))
+	if err != nil {
+		w.Header().Set(backup.TrailerError, err.Error())
+		log.Errorf("Backup: failed to send the %s snapshot: %v", db, err)
+		return
+	}
+	log.Infof("Backup: sent a %d byte snapshot of the %s db to %s", n, db, r.RemoteAddr)
+}
@@ -1,6 +1,8 @@
 package spvclient
 
 import (
+	"errors"
+	"fmt"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
@@ -19,16 +21,27 @@ type SPVWallet struct {
 	Blockchain  *chain.Blockchain
 	peerManager *netserv.PeerManager
 	wireService *netserv.WireService
+	filter      *netserv.FilterManager
 	running     bool
 	config      *netserv.PeerManagerConfig
+
+	prunePolicy   chain.PrunePolicy
+	pruneInterval time.Duration
+	quit          chan struct{}
 }
 
 const WALLET_VERSION = "0.1.0"
 
+// How long FetchMerkleProof waits for peers
+const proofTimeout = time.Second * 30
+
 func NewSPVWallet(config *Config) (*SPVWallet, error) {
 	w := &SPVWallet{
-		repoPath: config.RepoPath,
-		params:   config.Params,
+		repoPath:      config.RepoPath,
+		params:        config.Params,
+		prunePolicy:   config.PrunePolicy,
+		pruneInterval: config.PruneInterval,
+		quit:          make(chan struct{}),
 	}
 
 	var err error
@@ -36,18 +49,57 @@ func NewSPVWallet(config *Config) (*SPVWallet, error) {
 		return nil, err
 	}
 
-	w.Blockchain, err = chain.NewBlockchain(w.repoPath, w.params, config.IsVote)
+	if config.Headers != nil {
+		w.Blockchain, err = chain.NewBlockchainWithHeaders(config.Headers, w.params)
+	} else {
+		w.Blockchain, err = chain.NewBlockchain(w.repoPath, w.params)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if len(config.Checkpoints) > 0 {
+		err = w.Blockchain.AddCheckpoints(config.Checkpoints)
+		if err != nil {
+			// Release the header db so it can be opened again
+			w.Blockchain.Close()
+			return nil, err
+		}
+	}
+	// Peers don't answer requests for merkle blocks without a filter, so one is loaded even
+	// if it watches nothing
+	w.filter = netserv.NewFilterManager(config.Filter)
 	minSync := 5
+	cfConfig := config.CFilter
+	trustedConfig := config.TrustedPeers
 	if config.TrustedPeer != nil {
+		trustedConfig.Peers = append([]netserv.TrustedPeer{{Addr: config.TrustedPeer}}, trustedConfig.Peers...)
+	}
+	var trusted *netserv.TrustedPeers
+	if len(trustedConfig.Peers) > 0 {
+		trusted, err = netserv.NewTrustedPeers(trustedConfig)
+		if err != nil {
+			w.Blockchain.Close()
+			return nil, err
+		}
 		minSync = 1
+		// Filter headers take as many trusted peers as the tip
+		if cfConfig.MinPeers == 0 {
+			cfConfig.MinPeers = 1
+			if trustedConfig.Quorum > 1 {
+				cfConfig.MinPeers = trustedConfig.Quorum
+			}
+		}
 	}
 	wireConfig := &netserv.WireServiceConfig{
 		Chain:           w.Blockchain,
 		MinPeersForSync: minSync,
 		Params:          w.params,
+		StaleTip:        config.StaleTip,
+		Filter:          w.filter,
+		SyncMode:        config.SyncMode,
+		CFilter:         cfConfig,
+		Broadcast:       config.Broadcast,
+		Trusted:         trusted,
 	}
 
 	ws := netserv.NewWireService(wireConfig)
@@ -70,14 +122,13 @@ func NewSPVWallet(config *Config) (*SPVWallet, error) {
 		Proxy:            config.Proxy,
 		GetNewestBlock:   getNewestBlock,
 		MsgChan:          ws.MsgChan(),
-	}
-
-	if config.TrustedPeer != nil {
-		w.config.TrustedPeer = config.TrustedPeer
+		SyncMode:         config.SyncMode,
+		Trusted:          trusted,
 	}
 
 	w.peerManager, err = netserv.NewPeerManager(w.config)
 	if err != nil {
+		w.Blockchain.Close()
 		return nil, err
 	}
 
@@ -88,6 +139,24 @@ func (w *SPVWallet) Start() {
 	w.running = true
 	go w.wireService.Start()
 	go w.peerManager.Start()
+	if w.pruneInterval > 0 {
+		go w.pruneHandler()
+	}
+}
+
+func (w *SPVWallet) pruneHandler() {
+	ticker := time.NewTicker(w.pruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Blockchain.Prune(w.prunePolicy); err != nil {
+				log.Errorf("Failed to prune headers: %v", err)
+			}
+		case <-w.quit:
+			return
+		}
+	}
 }
 
 //////////////////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -143,6 +212,7 @@ func (w *SPVWallet) ChainTip() (uint32, chainhash.Hash) {
 func (w *SPVWallet) Close() {
 	if w.running {
 		log.Info("Disconnecting from peers and shutting down")
+		close(w.quit)
 		w.peerManager.Stop()
 		w.Blockchain.Close()
 		w.wireService.Stop()
@@ -156,14 +226,106 @@ func (w *SPVWallet) ReSyncBlockchain(fromDate time.Time) {
 	w.wireService.Resync()
 }
 
+// RollbackToHeight rolls the chain back to height and syncs again from there,
+// unless it's a dry run.
+func (w *SPVWallet) RollbackToHeight(height uint32, opts chain.RollbackOptions) (*chain.RollbackReport, error) {
+	report, err := w.Blockchain.RollbackToHeight(height, opts)
+	if err == nil && !opts.DryRun {
+		w.wireService.Resync()
+	}
+	return report, err
+}
+
+// RollbackToHash rolls the chain back to the header with the given hash and syncs again
+// from there, unless it's a dry run.
+func (w *SPVWallet) RollbackToHash(hash chainhash.Hash, opts chain.RollbackOptions) (*chain.RollbackReport, error) {
+	report, err := w.Blockchain.RollbackToHash(hash, opts)
+	if err == nil && !opts.DryRun {
+		w.wireService.Resync()
+	}
+	return report, err
+}
+
+// RollbackToTime is ReSyncBlockchain with a report and options.
+func (w *SPVWallet) RollbackToTime(t time.Time, opts chain.RollbackOptions) (*chain.RollbackReport, error) {
+	report, err := w.Blockchain.RollbackToTime(t, opts)
+	if err == nil && !opts.DryRun {
+		w.wireService.Resync()
+	}
+	return report, err
+}
+
+// StaleTipStats returns what the stale tip monitor found and did so far.
+func (w *SPVWallet) StaleTipStats() netserv.StaleTipStats {
+	return w.wireService.StaleTipStats()
+}
+
+// AddWatchedAddress adds addr to the bloom filter and loads it into the peers again. With
+// compact filters it's matched against the filters from the next one on.
+func (w *SPVWallet) AddWatchedAddress(addr btc.Address) {
+	w.filter.AddAddress(addr)
+	if w.running {
+		w.wireService.ReloadFilter()
+	}
+}
+
+// CFilterStats returns the progress of the compact filter sync.
+func (w *SPVWallet) CFilterStats() netserv.CFilterStats {
+	return w.wireService.CFilterStats()
+}
+
+// MatchedTxs returns the transactions the bloom filter matched, oldest first.
+func (w *SPVWallet) MatchedTxs() []netserv.MatchedTx {
+	return w.filter.MatchedTxs()
+}
+
+// GetMatchedTx returns a transaction the bloom filter matched by hash.
+func (w *SPVWallet) GetMatchedTx(hash chainhash.Hash) (netserv.MatchedTx, bool) {
+	return w.filter.GetMatchedTx(hash)
+}
+
+// FetchMerkleProof gets the block at height on our best chain from a peer and returns the
+// transaction txid in it with a proof VerifyTxInclusion takes, one we didn't have to take
+// from whoever submitted it.
+func (w *SPVWallet) FetchMerkleProof(txid chainhash.Hash, height uint32) (*wire.MsgTx, []byte, error) {
+	if !w.running {
+		return nil, nil, errors.New("wallet is not running")
+	}
+	sh, err := w.Blockchain.GetHeaderByHeight(height)
+	if err != nil {
+		return nil, nil, fmt.Errorf("no block at height %d: %v", height, err)
+	}
+	return w.wireService.FetchProof(sh.Header.BlockHash(), txid, proofTimeout)
+}
+
 func (w *SPVWallet) ReSync() {
 	w.wireService.ResyncWithNil()
 }
 
+// Broadcast announces tx to the peers and announces it again until it is seen in a block,
+// BroadcastStatus tells how far it got.
 func (s *SPVWallet) Broadcast(tx *wire.MsgTx) error {
-	log.Debugf("Broadcasting tx %s to peers", tx.TxHash().String())
-	for _, p := range s.peerManager.ConnectedPeers() {
-		p.QueueMessageWithEncoding(tx, nil, wire.LatestEncoding)
+	if !s.running {
+		return errors.New("wallet is not running")
 	}
+	log.Debugf("Broadcasting tx %s to peers", tx.TxHash().String())
+	s.wireService.Broadcast(tx)
 	return nil
 }
+
+// TrustedPeerStats returns how the trusted peers are doing and how many have our tip.
+func (w *SPVWallet) TrustedPeerStats() netserv.TrustedPeerStats {
+	return w.wireService.TrustedPeerStats()
+}
+
+// BroadcastStatus returns whether a transaction we broadcast is pending, was rejected by a
+// peer or is confirmed, and how deep.
+func (s *SPVWallet) BroadcastStatus(txid chainhash.Hash) (netserv.BroadcastStatus, bool) {
+	return s.wireService.BroadcastStatus(txid)
+}
+
+// BroadcastStatuses returns the status of every transaction broadcast, those confirmed
+// deep enough are forgotten.
+func (s *SPVWallet) BroadcastStatuses() []netserv.BroadcastStatus {
+	return s.wireService.BroadcastStatuses()
+}